@@ -15,6 +15,19 @@ import (
 
 // ApplicationManager manages an application.
 type ApplicationManager interface {
+	// Register the application on the Handler. An application has to be registered on the Handler before you can
+	// manage its settings and devices.
+	Register() error
+
+	// Get the settings of the application
+	Get() (*Application, error)
+
+	// Set the settings of the application. All settings are replaced, so make sure you Get() the application first.
+	Set(*Application) error
+
+	// Delete the application from the Handler
+	Delete() error
+
 	// Get the payload format used in this application. If the payload format is "custom", you can get the custom JS
 	// payload functions with the GetCustomPayloadFunctions() function.
 	GetPayloadFormat() (string, error)
@@ -58,43 +71,129 @@ type ApplicationManager interface {
 	//   return bytes;
 	// }
 	SetCustomPayloadFunctions(jsDecoder, jsConverter, jsValidator, jsEncoder string) error
+
+	// Test the custom JS uplink payload functions on the Handler, without saving them. The payload and port are passed
+	// to the Decoder, the result of the Decoder is passed to the Converter and the result of the Converter is passed to
+	// the Validator. Empty functions are skipped.
+	TestCustomUplinkPayloadFunctions(jsDecoder, jsConverter, jsValidator string, payload []byte, port uint8) (*DryUplinkResult, error)
+
+	// Test the custom JS downlink payload function on the Handler, without saving it. The fields and port are passed
+	// to the Encoder.
+	TestCustomDownlinkPayloadFunctions(jsEncoder string, fields map[string]interface{}, port uint8) (*DryDownlinkResult, error)
+
+	// Test the payload format (or custom JS payload functions) that is currently used in this application with an
+	// uplink payload.
+	TestUplink(payload []byte, port uint8) (*DryUplinkResult, error)
+
+	// Test the payload format (or custom JS payload functions) that is currently used in this application with
+	// downlink fields.
+	TestDownlink(fields map[string]interface{}, port uint8) (*DryDownlinkResult, error)
+
+	// Deploy custom JS payload functions. The functions are first tested on the Handler with the given test vectors,
+	// and are only saved if all test vectors pass. At least one test vector is required; use
+	// SetCustomPayloadFunctions() to save payload functions without testing them. The returned report contains the
+	// result of each test vector. If the functions are saved, the previous payload format and functions of the
+	// application are kept in memory by the Client, so that they can be restored with
+	// RollbackCustomPayloadFunctions(). To roll back after a restart, save the Previous application of the report
+	// and restore it with Set().
+	DeployCustomPayloadFunctions(functions PayloadFunctions, uplink []UplinkTestVector, downlink []DownlinkTestVector) (*PayloadDeployReport, error)
+
+	// Restore the payload format and functions that the application used before the last call to
+	// DeployCustomPayloadFunctions() on an ApplicationManager of the same Client.
+	RollbackCustomPayloadFunctions() error
+
+	// WithContext returns a view of the ApplicationManager that uses the given context as parent context of its
+	// requests.
+	WithContext(ctx context.Context) ApplicationManager
 }
 
 func (c *client) ManageApplication() (ApplicationManager, error) {
-	if err := c.connectHandler(); err != nil {
+	return c.manageApplication(context.Background())
+}
+
+func (c *client) manageApplication(ctx context.Context) (ApplicationManager, error) {
+	if err := c.connectHandler(ctx); err != nil {
 		return nil, err
 	}
 	return &applicationManager{
+		ctx:            ctx,
 		logger:         c.Logger,
-		client:         handler.NewApplicationManagerClient(c.handler.conn),
+		client:         &handlerClient{c},
 		getContext:     c.getContext,
 		requestTimeout: c.RequestTimeout,
 		appID:          c.appID,
+		payloadHistory: c.payloadHistory,
 	}, nil
 }
 
 type applicationManager struct {
+	ctx            context.Context
 	logger         log.Interface
 	client         handler.ApplicationManagerClient
 	getContext     func(context.Context) context.Context
 	requestTimeout time.Duration
 
 	appID string
+
+	payloadHistory *payloadHistory
+}
+
+func (a *applicationManager) WithContext(ctx context.Context) ApplicationManager {
+	manager := *a
+	manager.ctx = ctx
+	return &manager
+}
+
+func (a *applicationManager) requestContext() (context.Context, context.CancelFunc) {
+	return requestContext(a.ctx, a.getContext, a.requestTimeout)
 }
 
 func (a *applicationManager) getApplication() (*handler.Application, error) {
-	ctx, cancel := context.WithTimeout(a.getContext(context.Background()), a.requestTimeout)
+	ctx, cancel := a.requestContext()
 	defer cancel()
 	return a.client.GetApplication(ctx, &handler.ApplicationIdentifier{AppID: a.appID})
 }
 
 func (a *applicationManager) setApplication(app *handler.Application) error {
-	ctx, cancel := context.WithTimeout(a.getContext(context.Background()), a.requestTimeout)
+	ctx, cancel := a.requestContext()
 	defer cancel()
 	_, err := a.client.SetApplication(ctx, app)
 	return err
 }
 
+func (a *applicationManager) Register() error {
+	ctx, cancel := a.requestContext()
+	defer cancel()
+	_, err := a.client.RegisterApplication(ctx, &handler.ApplicationIdentifier{AppID: a.appID})
+	return err
+}
+
+func (a *applicationManager) Get() (*Application, error) {
+	res, err := a.getApplication()
+	if err != nil {
+		return nil, err
+	}
+	app := &Application{applicationManager: a}
+	app.fromProto(res)
+	return app, nil
+}
+
+func (a *applicationManager) Set(app *Application) error {
+	if app.AppID != a.appID {
+		app.AppID = a.appID
+	}
+	req := new(handler.Application)
+	app.toProto(req)
+	return a.setApplication(req)
+}
+
+func (a *applicationManager) Delete() error {
+	ctx, cancel := a.requestContext()
+	defer cancel()
+	_, err := a.client.DeleteApplication(ctx, &handler.ApplicationIdentifier{AppID: a.appID})
+	return err
+}
+
 func (a *applicationManager) GetPayloadFormat() (string, error) {
 	app, err := a.getApplication()
 	if err != nil {
@@ -136,36 +235,182 @@ func (a *applicationManager) SetCustomPayloadFunctions(jsDecoder, jsConverter, j
 	return a.setApplication(app)
 }
 
-func (a *applicationManager) TestCustomUplinkPayloadFunctions(jsDecoder, jsConverter, jsValidator string, payload []byte, port uint8) (*handler.DryUplinkResult, error) {
-	ctx, cancel := context.WithTimeout(a.getContext(context.Background()), a.requestTimeout)
+// PayloadLog is an entry that was logged with console.log() in a payload function
+type PayloadLog struct {
+	// The payload function that logged the entry
+	Function string `json:"function"`
+
+	// The logged values
+	Fields []interface{} `json:"fields"`
+}
+
+// DryUplinkResult is the result of testing uplink payload functions
+type DryUplinkResult struct {
+	Payload []byte                 `json:"payload"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+	Valid   bool                   `json:"valid"`
+	Logs    []PayloadLog           `json:"logs,omitempty"`
+}
+
+// DryDownlinkResult is the result of testing downlink payload functions
+type DryDownlinkResult struct {
+	Payload []byte       `json:"payload"`
+	Logs    []PayloadLog `json:"logs,omitempty"`
+}
+
+func payloadLogsFromProto(entries []*handler.LogEntry) (logs []PayloadLog) {
+	for _, entry := range entries {
+		payloadLog := PayloadLog{Function: entry.Function}
+		for _, field := range entry.Fields {
+			var value interface{}
+			if err := json.Unmarshal([]byte(field), &value); err != nil {
+				value = field
+			}
+			payloadLog.Fields = append(payloadLog.Fields, value)
+		}
+		logs = append(logs, payloadLog)
+	}
+	return
+}
+
+func (a *applicationManager) dryUplink(app handler.Application, payload []byte, port uint8) (*DryUplinkResult, error) {
+	ctx, cancel := a.requestContext()
 	defer cancel()
-	return a.client.DryUplink(ctx, &handler.DryUplinkMessage{
+	app.AppID = a.appID
+	res, err := a.client.DryUplink(ctx, &handler.DryUplinkMessage{
 		Payload: payload,
-		App: handler.Application{
-			AppID:         a.appID,
-			PayloadFormat: "custom",
-			Decoder:       jsDecoder,
-			Converter:     jsConverter,
-			Validator:     jsValidator,
-		},
-		Port: uint32(port),
+		App:     app,
+		Port:    uint32(port),
 	})
+	if err != nil {
+		return nil, err
+	}
+	result := &DryUplinkResult{
+		Payload: res.Payload,
+		Valid:   res.Valid,
+		Logs:    payloadLogsFromProto(res.Logs),
+	}
+	if res.Fields != "" {
+		if err := json.Unmarshal([]byte(res.Fields), &result.Fields); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
 }
 
-func (a *applicationManager) TestCustomDownlinkPayloadFunctions(jsEncoder string, fields map[string]interface{}, port uint8) (*handler.DryDownlinkResult, error) {
-	ctx, cancel := context.WithTimeout(a.getContext(context.Background()), a.requestTimeout)
-	defer cancel()
+func (a *applicationManager) dryDownlink(app handler.Application, fields map[string]interface{}, port uint8) (*DryDownlinkResult, error) {
 	fieldsJSON, err := json.Marshal(fields)
 	if err != nil {
 		return nil, err
 	}
-	return a.client.DryDownlink(ctx, &handler.DryDownlinkMessage{
+	ctx, cancel := a.requestContext()
+	defer cancel()
+	app.AppID = a.appID
+	res, err := a.client.DryDownlink(ctx, &handler.DryDownlinkMessage{
 		Fields: string(fieldsJSON),
-		App: handler.Application{
-			AppID:         a.appID,
-			PayloadFormat: "custom",
-			Encoder:       jsEncoder,
-		},
-		Port: uint32(port),
+		App:    app,
+		Port:   uint32(port),
 	})
+	if err != nil {
+		return nil, err
+	}
+	return &DryDownlinkResult{
+		Payload: res.Payload,
+		Logs:    payloadLogsFromProto(res.Logs),
+	}, nil
+}
+
+func (a *applicationManager) TestCustomUplinkPayloadFunctions(jsDecoder, jsConverter, jsValidator string, payload []byte, port uint8) (*DryUplinkResult, error) {
+	return a.dryUplink(handler.Application{
+		PayloadFormat: "custom",
+		Decoder:       jsDecoder,
+		Converter:     jsConverter,
+		Validator:     jsValidator,
+	}, payload, port)
+}
+
+func (a *applicationManager) TestCustomDownlinkPayloadFunctions(jsEncoder string, fields map[string]interface{}, port uint8) (*DryDownlinkResult, error) {
+	return a.dryDownlink(handler.Application{
+		PayloadFormat: "custom",
+		Encoder:       jsEncoder,
+	}, fields, port)
+}
+
+func (a *applicationManager) TestUplink(payload []byte, port uint8) (*DryUplinkResult, error) {
+	app, err := a.getApplication()
+	if err != nil {
+		return nil, err
+	}
+	return a.dryUplink(*app, payload, port)
+}
+
+func (a *applicationManager) TestDownlink(fields map[string]interface{}, port uint8) (*DryDownlinkResult, error) {
+	app, err := a.getApplication()
+	if err != nil {
+		return nil, err
+	}
+	return a.dryDownlink(*app, fields, port)
+}
+
+// Application contains the settings of an application on the Handler
+type Application struct {
+	applicationManager ApplicationManager
+
+	AppID                   string `json:"app_id"`
+	PayloadFormat           string `json:"payload_format,omitempty"`
+	Decoder                 string `json:"decoder,omitempty"`
+	Converter               string `json:"converter,omitempty"`
+	Validator               string `json:"validator,omitempty"`
+	Encoder                 string `json:"encoder,omitempty"`
+	RegisterOnJoinAccessKey string `json:"register_on_join_access_key,omitempty"`
+}
+
+// IsNew indicates whether the application is new.
+func (a *Application) IsNew() bool { return a.applicationManager == nil }
+
+// SetManager sets the manager of the application. This function panics if this is not a new application.
+func (a *Application) SetManager(manager ApplicationManager) {
+	if a.applicationManager == manager {
+		return
+	}
+	if !a.IsNew() {
+		panic("ttn-sdk: you can not change the application manager")
+	}
+	a.applicationManager = manager
+}
+
+// Update the application. This function panics if this is a new application.
+func (a *Application) Update() error {
+	if a.IsNew() {
+		panic("ttn-sdk: you can not update new applications")
+	}
+	return a.applicationManager.Set(a)
+}
+
+// Delete the application. This function panics if this is a new application.
+func (a *Application) Delete() error {
+	if a.IsNew() {
+		panic("ttn-sdk: you can not delete new applications")
+	}
+	return a.applicationManager.Delete()
+}
+
+func (a *Application) fromProto(app *handler.Application) {
+	a.AppID = app.AppID
+	a.PayloadFormat = app.PayloadFormat
+	a.Decoder = app.Decoder
+	a.Converter = app.Converter
+	a.Validator = app.Validator
+	a.Encoder = app.Encoder
+	a.RegisterOnJoinAccessKey = app.RegisterOnJoinAccessKey
+}
+
+func (a *Application) toProto(app *handler.Application) {
+	app.AppID = a.AppID
+	app.PayloadFormat = a.PayloadFormat
+	app.Decoder = a.Decoder
+	app.Converter = a.Converter
+	app.Validator = a.Validator
+	app.Encoder = a.Encoder
+	app.RegisterOnJoinAccessKey = a.RegisterOnJoinAccessKey
 }
@@ -87,6 +87,170 @@ func TestApplicationManager(t *testing.T) {
 		a.So(err, ShouldNotBeNil)
 	}
 
-	// TODO: TestCustomUplinkPayloadFunctions(jsDecoder, jsConverter, jsValidator string, payload []byte, port uint8) (*handler.DryUplinkResult, error) {
-	// TODO: TestCustomDownlinkPayloadFunctions(jsEncoder string, fields map[string]interface{}, port uint8) (*handler.DryDownlinkResult, error) {
+	{
+		mock.reset()
+		mock.err = someErr
+		err := manager.Register()
+		a.So(err, ShouldNotBeNil)
+
+		mock.reset()
+		err = manager.Register()
+		a.So(err, ShouldBeNil)
+		a.So(mock.applicationIdentifier.AppID, ShouldEqual, "test")
+
+		mock.reset()
+		mock.err = someErr
+		err = manager.Delete()
+		a.So(err, ShouldNotBeNil)
+
+		mock.reset()
+		err = manager.Delete()
+		a.So(err, ShouldBeNil)
+		a.So(mock.applicationIdentifier.AppID, ShouldEqual, "test")
+	}
+
+	{
+		app := new(Application)
+		a.So(app.IsNew(), ShouldBeTrue)
+		a.So(func() { app.Update() }, ShouldPanic)
+		a.So(func() { app.Delete() }, ShouldPanic)
+		app.SetManager(manager)
+		a.So(app.IsNew(), ShouldBeFalse)
+		a.So(func() { app.SetManager(manager) }, ShouldNotPanic)
+		a.So(func() { app.SetManager(&applicationManager{}) }, ShouldPanic)
+	}
+
+	{
+		mock.reset()
+		mock.err = someErr
+		_, err := manager.Get()
+		a.So(err, ShouldNotBeNil)
+
+		mock.reset()
+		mock.application = &handler.Application{
+			AppID:                   "test",
+			PayloadFormat:           "custom",
+			Decoder:                 "decoder",
+			Converter:               "converter",
+			Validator:               "validator",
+			Encoder:                 "encoder",
+			RegisterOnJoinAccessKey: "key",
+		}
+		app, err := manager.Get()
+		a.So(err, ShouldBeNil)
+		a.So(app.IsNew(), ShouldBeFalse)
+		a.So(app, ShouldResemble, &Application{
+			applicationManager:      manager,
+			AppID:                   "test",
+			PayloadFormat:           "custom",
+			Decoder:                 "decoder",
+			Converter:               "converter",
+			Validator:               "validator",
+			Encoder:                 "encoder",
+			RegisterOnJoinAccessKey: "key",
+		})
+
+		app.PayloadFormat = "cayenne"
+		app.Decoder, app.Converter, app.Validator, app.Encoder = "", "", "", ""
+		err = app.Update()
+		a.So(err, ShouldBeNil)
+		a.So(mock.application.PayloadFormat, ShouldEqual, "cayenne")
+		a.So(mock.application.Decoder, ShouldBeEmpty)
+		a.So(mock.application.RegisterOnJoinAccessKey, ShouldEqual, "key")
+
+		mock.reset()
+		err = manager.Set(&Application{AppID: "other", PayloadFormat: "custom"})
+		a.So(err, ShouldBeNil)
+		a.So(mock.application.AppID, ShouldEqual, "test")
+
+		mock.reset()
+		err = app.Delete()
+		a.So(err, ShouldBeNil)
+		a.So(mock.applicationIdentifier.AppID, ShouldEqual, "test")
+	}
+
+	{
+		type ctxKey struct{}
+		ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), ctxKey{}, "value"), time.Millisecond)
+		defer cancel()
+
+		mock.reset()
+		mock.application = &handler.Application{PayloadFormat: "custom"}
+		_, err := manager.WithContext(ctx).GetPayloadFormat()
+		a.So(err, ShouldBeNil)
+		a.So(mock.ctx.Value(ctxKey{}), ShouldEqual, "value")
+		ctxDeadline, _ := ctx.Deadline()
+		requestDeadline, _ := mock.ctx.Deadline()
+		a.So(requestDeadline, ShouldEqual, ctxDeadline)
+	}
+
+	{
+		mock.reset()
+		mock.err = someErr
+		_, err := manager.TestCustomUplinkPayloadFunctions("decoder", "converter", "validator", []byte{0x01}, 1)
+		a.So(err, ShouldNotBeNil)
+
+		mock.reset()
+		mock.dryUplinkResult = &handler.DryUplinkResult{
+			Payload: []byte{0x01},
+			Fields:  `{"value":1}`,
+			Valid:   true,
+			Logs: []*handler.LogEntry{
+				{Function: "decoder", Fields: []string{`"hello"`, `{"value":1}`, `not json`}},
+			},
+		}
+		res, err := manager.TestCustomUplinkPayloadFunctions("decoder", "converter", "validator", []byte{0x01}, 1)
+		a.So(err, ShouldBeNil)
+		a.So(mock.dryUplinkMessage.Payload, ShouldResemble, []byte{0x01})
+		a.So(mock.dryUplinkMessage.Port, ShouldEqual, 1)
+		a.So(mock.dryUplinkMessage.App.AppID, ShouldEqual, "test")
+		a.So(mock.dryUplinkMessage.App.PayloadFormat, ShouldEqual, "custom")
+		a.So(mock.dryUplinkMessage.App.Decoder, ShouldEqual, "decoder")
+		a.So(mock.dryUplinkMessage.App.Converter, ShouldEqual, "converter")
+		a.So(mock.dryUplinkMessage.App.Validator, ShouldEqual, "validator")
+		a.So(res.Payload, ShouldResemble, []byte{0x01})
+		a.So(res.Fields, ShouldResemble, map[string]interface{}{"value": 1.0})
+		a.So(res.Valid, ShouldBeTrue)
+		a.So(res.Logs, ShouldResemble, []PayloadLog{
+			{Function: "decoder", Fields: []interface{}{"hello", map[string]interface{}{"value": 1.0}, "not json"}},
+		})
+
+		mock.reset()
+		mock.application = &handler.Application{PayloadFormat: "cayenne"}
+		mock.dryUplinkResult = &handler.DryUplinkResult{Payload: []byte{0x01}, Valid: true}
+		res, err = manager.TestUplink([]byte{0x01}, 2)
+		a.So(err, ShouldBeNil)
+		a.So(mock.dryUplinkMessage.App.PayloadFormat, ShouldEqual, "cayenne")
+		a.So(mock.dryUplinkMessage.Port, ShouldEqual, 2)
+		a.So(res.Fields, ShouldBeNil)
+	}
+
+	{
+		mock.reset()
+		mock.err = someErr
+		_, err := manager.TestCustomDownlinkPayloadFunctions("encoder", map[string]interface{}{"value": 1}, 1)
+		a.So(err, ShouldNotBeNil)
+
+		mock.reset()
+		mock.dryDownlinkResult = &handler.DryDownlinkResult{
+			Payload: []byte{0x01},
+			Logs:    []*handler.LogEntry{{Function: "encoder", Fields: []string{`1`}}},
+		}
+		res, err := manager.TestCustomDownlinkPayloadFunctions("encoder", map[string]interface{}{"value": 1}, 1)
+		a.So(err, ShouldBeNil)
+		a.So(mock.dryDownlinkMessage.Fields, ShouldEqual, `{"value":1}`)
+		a.So(mock.dryDownlinkMessage.Port, ShouldEqual, 1)
+		a.So(mock.dryDownlinkMessage.App.AppID, ShouldEqual, "test")
+		a.So(mock.dryDownlinkMessage.App.Encoder, ShouldEqual, "encoder")
+		a.So(res.Payload, ShouldResemble, []byte{0x01})
+		a.So(res.Logs, ShouldResemble, []PayloadLog{{Function: "encoder", Fields: []interface{}{1.0}}})
+
+		mock.reset()
+		mock.application = &handler.Application{PayloadFormat: "custom", Encoder: "saved encoder"}
+		mock.dryDownlinkResult = &handler.DryDownlinkResult{Payload: []byte{0x02}}
+		res, err = manager.TestDownlink(map[string]interface{}{"value": 2}, 3)
+		a.So(err, ShouldBeNil)
+		a.So(mock.dryDownlinkMessage.App.Encoder, ShouldEqual, "saved encoder")
+		a.So(res.Payload, ShouldResemble, []byte{0x02})
+	}
 }
@@ -0,0 +1,281 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// BackupVersion is the version of the backup file format that is written by Backup.Write
+const BackupVersion = 1
+
+const (
+	backupFormat     = "ttn-sdk-backup"
+	backupEncryption = "scrypt-aes256-gcm"
+)
+
+// Backup is a snapshot of an application and its devices
+type Backup struct {
+	AppID       string       `json:"app_id"`
+	Created     time.Time    `json:"created"`
+	Application *Application `json:"application"`
+	Devices     []*Device    `json:"devices"`
+}
+
+// BackupApplication creates a backup of the settings of the application and of all its devices. The details of each
+// device, including session keys and frame counters, are retrieved with DeviceManager.Get.
+func BackupApplication(ctx context.Context, application ApplicationManager, devices DeviceManager) (*Backup, error) {
+	app, err := application.WithContext(ctx).Get()
+	if err != nil {
+		return nil, err
+	}
+	backup := &Backup{
+		AppID:       app.AppID,
+		Created:     time.Now().UTC(),
+		Application: app,
+	}
+	devices = devices.WithContext(ctx)
+	it := NewDeviceIterator(ctx, devices, 0)
+	for it.Next() {
+		dev, err := devices.Get(it.Device().DevID)
+		if status.Code(err) == codes.NotFound {
+			continue // The device was deleted after it was listed
+		}
+		if err != nil {
+			return nil, err
+		}
+		backup.Devices = append(backup.Devices, dev)
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return backup, nil
+}
+
+// backupFile is the format of backup files
+type backupFile struct {
+	Format     string `json:"format"`
+	Version    int    `json:"version"`
+	Encryption string `json:"encryption,omitempty"`
+	Salt       []byte `json:"salt,omitempty"`
+	Nonce      []byte `json:"nonce,omitempty"`
+
+	// The gzip-compressed JSON of the Backup, encrypted if Encryption is set
+	Data []byte `json:"data"`
+}
+
+func backupCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Write the backup to w. If the passphrase is not empty, the backup is encrypted with a key that is derived from the
+// passphrase.
+func (b *Backup) Write(w io.Writer, passphrase string) error {
+	var data bytes.Buffer
+	gz := gzip.NewWriter(&data)
+	if err := json.NewEncoder(gz).Encode(b); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	file := backupFile{
+		Format:  backupFormat,
+		Version: BackupVersion,
+		Data:    data.Bytes(),
+	}
+	if passphrase != "" {
+		file.Encryption = backupEncryption
+		file.Salt = make([]byte, 16)
+		if _, err := rand.Read(file.Salt); err != nil {
+			return err
+		}
+		aead, err := backupCipher(passphrase, file.Salt)
+		if err != nil {
+			return err
+		}
+		file.Nonce = make([]byte, aead.NonceSize())
+		if _, err := rand.Read(file.Nonce); err != nil {
+			return err
+		}
+		file.Data = aead.Seal(nil, file.Nonce, file.Data, nil)
+	}
+	return json.NewEncoder(w).Encode(file)
+}
+
+// ReadBackup reads a backup that was written by Backup.Write. The passphrase is required if the backup is encrypted.
+func ReadBackup(r io.Reader, passphrase string) (*Backup, error) {
+	var file backupFile
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return nil, err
+	}
+	if file.Format != backupFormat {
+		return nil, errors.New("ttn-sdk: not a backup file")
+	}
+	if file.Version < 1 || file.Version > BackupVersion {
+		return nil, fmt.Errorf("ttn-sdk: unsupported backup version %d", file.Version)
+	}
+	switch file.Encryption {
+	case "":
+	case backupEncryption:
+		if passphrase == "" {
+			return nil, errors.New("ttn-sdk: backup is encrypted, but no passphrase was given")
+		}
+		aead, err := backupCipher(passphrase, file.Salt)
+		if err != nil {
+			return nil, err
+		}
+		if len(file.Nonce) != aead.NonceSize() {
+			return nil, errors.New("ttn-sdk: invalid backup nonce")
+		}
+		file.Data, err = aead.Open(nil, file.Nonce, file.Data, nil)
+		if err != nil {
+			return nil, errors.New("ttn-sdk: could not decrypt backup, the passphrase may be wrong")
+		}
+	default:
+		return nil, fmt.Errorf("ttn-sdk: unsupported backup encryption \"%s\"", file.Encryption)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(file.Data))
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, err
+	}
+	backup := new(Backup)
+	if err := json.Unmarshal(data, backup); err != nil {
+		return nil, err
+	}
+	return backup, nil
+}
+
+// RestoreConflictPolicy determines how RestoreApplication handles devices that already exist
+type RestoreConflictPolicy int
+
+const (
+	// RestoreSkipExisting does not change devices that already exist
+	RestoreSkipExisting RestoreConflictPolicy = iota
+
+	// RestoreOverwrite replaces devices that already exist with the device from the backup
+	RestoreOverwrite
+
+	// RestoreFailExisting reports an error for devices that already exist
+	RestoreFailExisting
+)
+
+// RestoreOptions contains the options for RestoreApplication
+type RestoreOptions struct {
+	// Do not restore the payload format and functions of the application
+	SkipApplication bool
+
+	// Set the frame counters of the restored devices to zero
+	ResetFrameCounters bool
+
+	// Remove the DevAddr and session keys of the restored devices, so that OTAA devices have to join again. Devices
+	// that do not have an AppKey keep their session.
+	ResetSessions bool
+
+	Conflict RestoreConflictPolicy
+}
+
+// RestoreReport is the result of RestoreApplication
+type RestoreReport struct {
+	Created []string
+	Updated []string
+	Skipped []string
+	Failed  map[string]error
+}
+
+// RestoreApplication restores a backup to an application, which can be the application of the backup or another
+// application. The application needs to be registered on the Handler. Devices that could not be restored are in the
+// Failed field of the report; the returned error is only set if the restore could not be started or was canceled.
+func RestoreApplication(ctx context.Context, backup *Backup, application ApplicationManager, devices DeviceManager, options RestoreOptions) (*RestoreReport, error) {
+	if !options.SkipApplication && backup.Application != nil {
+		application = application.WithContext(ctx)
+		app, err := application.Get()
+		if err != nil {
+			return nil, err
+		}
+		app.PayloadFormat = backup.Application.PayloadFormat
+		app.Decoder = backup.Application.Decoder
+		app.Converter = backup.Application.Converter
+		app.Validator = backup.Application.Validator
+		app.Encoder = backup.Application.Encoder
+		if app.AppID == backup.AppID {
+			app.RegisterOnJoinAccessKey = backup.Application.RegisterOnJoinAccessKey
+		}
+		if err := application.Set(app); err != nil {
+			return nil, err
+		}
+	}
+
+	existing, err := ListAllDevices(ctx, devices, 0)
+	if err != nil {
+		return nil, err
+	}
+	existingIDs := make(map[string]bool)
+	for _, dev := range existing {
+		existingIDs[dev.DevID] = true
+	}
+
+	report := &RestoreReport{Failed: make(map[string]error)}
+	devices = devices.WithContext(ctx)
+	for _, backupDev := range backup.Devices {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		dev := *backupDev
+		dev.deviceManager = nil
+		if existingIDs[dev.DevID] {
+			switch options.Conflict {
+			case RestoreSkipExisting:
+				report.Skipped = append(report.Skipped, dev.DevID)
+				continue
+			case RestoreFailExisting:
+				report.Failed[dev.DevID] = fmt.Errorf("ttn-sdk: device %s already exists", dev.DevID)
+				continue
+			}
+		}
+		if options.ResetFrameCounters {
+			dev.FCntUp, dev.FCntDown = 0, 0
+		}
+		if options.ResetSessions && dev.AppKey != nil {
+			dev.DevAddr, dev.NwkSKey, dev.AppSKey = nil, nil, nil
+		}
+		if err := devices.Set(&dev); err != nil {
+			report.Failed[dev.DevID] = err
+			continue
+		}
+		if existingIDs[dev.DevID] {
+			report.Updated = append(report.Updated, dev.DevID)
+		} else {
+			report.Created = append(report.Created, dev.DevID)
+		}
+	}
+	return report, nil
+}
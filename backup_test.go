@@ -0,0 +1,130 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/api/handler"
+	ttnlog "github.com/TheThingsNetwork/go-utils/log"
+	testlog "github.com/TheThingsNetwork/go-utils/log/test"
+	"github.com/TheThingsNetwork/ttn/core/types"
+	. "github.com/smartystreets/assertions"
+)
+
+func TestBackup(t *testing.T) {
+	a := New(t)
+
+	log := testlog.NewLogger()
+	ttnlog.Set(log)
+	defer log.Print(t)
+
+	mock := new(mockApplicationManagerClient)
+	application := &applicationManager{
+		logger:         log,
+		client:         mock,
+		getContext:     func(ctx context.Context) context.Context { return ctx },
+		requestTimeout: time.Second,
+		appID:          "test",
+	}
+	mock.application = &handler.Application{AppID: "test", PayloadFormat: "custom", Decoder: "decoder", RegisterOnJoinAccessKey: "key"}
+
+	devAddr, nwkSKey, appSKey, appKey := types.DevAddr{1, 2, 3, 4}, types.NwkSKey{1}, types.AppSKey{2}, types.AppKey{3}
+	devices := newMemoryDeviceManager("test")
+	devices.devices = []*Device{
+		{SparseDevice: SparseDevice{AppID: "test", DevID: "abp", DevAddr: &devAddr, NwkSKey: &nwkSKey, AppSKey: &appSKey}, FCntUp: 10, FCntDown: 5},
+		{SparseDevice: SparseDevice{AppID: "test", DevID: "otaa", AppKey: &appKey, DevAddr: &devAddr, NwkSKey: &nwkSKey, AppSKey: &appSKey}, FCntUp: 20},
+	}
+
+	backup, err := BackupApplication(context.Background(), application, devices)
+	a.So(err, ShouldBeNil)
+	a.So(backup.AppID, ShouldEqual, "test")
+	a.So(backup.Application.Decoder, ShouldEqual, "decoder")
+	a.So(backup.Devices, ShouldHaveLength, 2)
+	a.So(backup.Devices[0].FCntUp, ShouldEqual, 10)
+	a.So(backup.Devices[0].NwkSKey, ShouldResemble, &nwkSKey)
+
+	{
+		var buf bytes.Buffer
+		a.So(backup.Write(&buf, ""), ShouldBeNil)
+		a.So(buf.String(), ShouldContainSubstring, `"format":"ttn-sdk-backup"`)
+		read, err := ReadBackup(bytes.NewReader(buf.Bytes()), "")
+		a.So(err, ShouldBeNil)
+		a.So(read.Devices, ShouldHaveLength, 2)
+		a.So(read.Devices[1].AppKey, ShouldResemble, &appKey)
+		a.So(read.Application.PayloadFormat, ShouldEqual, "custom")
+	}
+
+	{
+		var buf bytes.Buffer
+		a.So(backup.Write(&buf, "secret"), ShouldBeNil)
+		_, err := ReadBackup(bytes.NewReader(buf.Bytes()), "")
+		a.So(err, ShouldNotBeNil)
+		_, err = ReadBackup(bytes.NewReader(buf.Bytes()), "wrong")
+		a.So(err, ShouldNotBeNil)
+		read, err := ReadBackup(bytes.NewReader(buf.Bytes()), "secret")
+		a.So(err, ShouldBeNil)
+		a.So(read.Devices[0].FCntDown, ShouldEqual, 5)
+	}
+
+	{
+		_, err := ReadBackup(bytes.NewReader([]byte(`{"format":"ttn-sdk-backup","version":2}`)), "")
+		a.So(err, ShouldNotBeNil)
+		_, err = ReadBackup(bytes.NewReader([]byte(`{"format":"other","version":1}`)), "")
+		a.So(err, ShouldNotBeNil)
+	}
+
+	{
+		// Restore to another application
+		mock.reset()
+		mock.application = &handler.Application{AppID: "other", RegisterOnJoinAccessKey: "other key"}
+		target := newMemoryDeviceManager("other", "otaa")
+		report, err := RestoreApplication(context.Background(), backup, application, target, RestoreOptions{
+			ResetFrameCounters: true,
+			ResetSessions:      true,
+		})
+		a.So(err, ShouldBeNil)
+		a.So(mock.application.PayloadFormat, ShouldEqual, "custom")
+		a.So(mock.application.Decoder, ShouldEqual, "decoder")
+		a.So(mock.application.RegisterOnJoinAccessKey, ShouldEqual, "other key")
+		a.So(report.Created, ShouldResemble, []string{"abp"})
+		a.So(report.Skipped, ShouldResemble, []string{"otaa"})
+		dev, _ := target.Get("abp")
+		a.So(dev.AppID, ShouldEqual, "other")
+		a.So(dev.FCntUp, ShouldEqual, 0)
+		a.So(dev.DevAddr, ShouldNotBeNil) // ABP devices keep their session
+	}
+
+	{
+		mock.reset()
+		target := newMemoryDeviceManager("test", "otaa")
+		report, err := RestoreApplication(context.Background(), backup, application, target, RestoreOptions{
+			SkipApplication: true,
+			ResetSessions:   true,
+			Conflict:        RestoreOverwrite,
+		})
+		a.So(err, ShouldBeNil)
+		a.So(mock.application, ShouldBeNil)
+		a.So(report.Created, ShouldResemble, []string{"abp"})
+		a.So(report.Updated, ShouldResemble, []string{"otaa"})
+		dev, _ := target.Get("otaa")
+		a.So(dev.FCntUp, ShouldEqual, 20)
+		a.So(dev.DevAddr, ShouldBeNil)
+		a.So(dev.AppKey, ShouldResemble, &appKey)
+	}
+
+	{
+		target := newMemoryDeviceManager("test", "otaa")
+		report, err := RestoreApplication(context.Background(), backup, application, target, RestoreOptions{
+			SkipApplication: true,
+			Conflict:        RestoreFailExisting,
+		})
+		a.So(err, ShouldBeNil)
+		a.So(report.Failed, ShouldContainKey, "otaa")
+		a.So(report.Created, ShouldResemble, []string{"abp"})
+	}
+}
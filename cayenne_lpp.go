@@ -0,0 +1,461 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Cayenne LPP data types
+const (
+	LPPTypeDigitalInput       uint8 = 0
+	LPPTypeDigitalOutput      uint8 = 1
+	LPPTypeAnalogInput        uint8 = 2
+	LPPTypeAnalogOutput       uint8 = 3
+	LPPTypeLuminosity         uint8 = 101
+	LPPTypePresence           uint8 = 102
+	LPPTypeTemperature        uint8 = 103
+	LPPTypeRelativeHumidity   uint8 = 104
+	LPPTypeAccelerometer      uint8 = 113
+	LPPTypeBarometricPressure uint8 = 115
+	LPPTypeGyrometer          uint8 = 134
+	LPPTypeGPS                uint8 = 136
+)
+
+// LPPValue is a value in a Cayenne LPP uplink payload. The implementations of this interface are the LPP types of this
+// package, such as LPPTemperature and LPPGPS.
+type LPPValue interface {
+	// LPPChannel returns the channel of the value
+	LPPChannel() uint8
+
+	// LPPType returns the Cayenne LPP data type of the value
+	LPPType() uint8
+
+	// appendLPP appends the data of the value to the payload
+	appendLPP(payload []byte) ([]byte, error)
+
+	// lppField returns the value as it is decoded by the "cayenne" payload format of the Handler
+	lppField() interface{}
+}
+
+// LPPDigitalInput is a digital input
+type LPPDigitalInput struct {
+	Channel uint8
+	Value   uint8
+}
+
+// LPPDigitalOutput is a digital output
+type LPPDigitalOutput struct {
+	Channel uint8
+	Value   uint8
+}
+
+// LPPAnalogInput is an analog input with a resolution of 0.01
+type LPPAnalogInput struct {
+	Channel uint8
+	Value   float64
+}
+
+// LPPAnalogOutput is an analog output with a resolution of 0.01
+type LPPAnalogOutput struct {
+	Channel uint8
+	Value   float64
+}
+
+// LPPLuminosity is an illuminance in lux
+type LPPLuminosity struct {
+	Channel uint8
+	Lux     uint16
+}
+
+// LPPPresence is a presence sensor value
+type LPPPresence struct {
+	Channel uint8
+	Value   uint8
+}
+
+// LPPTemperature is a temperature in degrees Celsius with a resolution of 0.1
+type LPPTemperature struct {
+	Channel uint8
+	Celsius float64
+}
+
+// LPPRelativeHumidity is a relative humidity in percent with a resolution of 0.5
+type LPPRelativeHumidity struct {
+	Channel uint8
+	Percent float64
+}
+
+// LPPAccelerometer is an acceleration in G with a resolution of 0.001
+type LPPAccelerometer struct {
+	Channel uint8
+	X, Y, Z float64
+}
+
+// LPPBarometricPressure is a pressure in hPa with a resolution of 0.1
+type LPPBarometricPressure struct {
+	Channel uint8
+	HPa     float64
+}
+
+// LPPGyrometer is a rotation speed in degrees per second with a resolution of 0.01
+type LPPGyrometer struct {
+	Channel uint8
+	X, Y, Z float64
+}
+
+// LPPGPS is a location. The latitude and longitude are in degrees with a resolution of 0.0001, the altitude is in
+// meters with a resolution of 0.01.
+type LPPGPS struct {
+	Channel   uint8
+	Latitude  float64
+	Longitude float64
+	Altitude  float64
+}
+
+// lppType contains the size and the name of a Cayenne LPP data type, and decodes values of the type
+type lppType struct {
+	name   string
+	size   int
+	decode func(channel uint8, data []byte) LPPValue
+}
+
+var lppTypes = map[uint8]lppType{
+	LPPTypeDigitalInput: {"digital_in", 1, func(channel uint8, data []byte) LPPValue {
+		return LPPDigitalInput{channel, data[0]}
+	}},
+	LPPTypeDigitalOutput: {"digital_out", 1, func(channel uint8, data []byte) LPPValue {
+		return LPPDigitalOutput{channel, data[0]}
+	}},
+	LPPTypeAnalogInput: {"analog_in", 2, func(channel uint8, data []byte) LPPValue {
+		return LPPAnalogInput{channel, lppGet(data, 0.01)}
+	}},
+	LPPTypeAnalogOutput: {"analog_out", 2, func(channel uint8, data []byte) LPPValue {
+		return LPPAnalogOutput{channel, lppGet(data, 0.01)}
+	}},
+	LPPTypeLuminosity: {"luminosity", 2, func(channel uint8, data []byte) LPPValue {
+		return LPPLuminosity{channel, uint16(data[0])<<8 | uint16(data[1])}
+	}},
+	LPPTypePresence: {"presence", 1, func(channel uint8, data []byte) LPPValue {
+		return LPPPresence{channel, data[0]}
+	}},
+	LPPTypeTemperature: {"temperature", 2, func(channel uint8, data []byte) LPPValue {
+		return LPPTemperature{channel, lppGet(data, 0.1)}
+	}},
+	LPPTypeRelativeHumidity: {"relative_humidity", 1, func(channel uint8, data []byte) LPPValue {
+		return LPPRelativeHumidity{channel, float64(data[0]) / 2}
+	}},
+	LPPTypeAccelerometer: {"accelerometer", 6, func(channel uint8, data []byte) LPPValue {
+		return LPPAccelerometer{channel, lppGet(data[0:2], 0.001), lppGet(data[2:4], 0.001), lppGet(data[4:6], 0.001)}
+	}},
+	LPPTypeBarometricPressure: {"barometric_pressure", 2, func(channel uint8, data []byte) LPPValue {
+		return LPPBarometricPressure{channel, float64(uint16(data[0])<<8|uint16(data[1])) / 10}
+	}},
+	LPPTypeGyrometer: {"gyrometer", 6, func(channel uint8, data []byte) LPPValue {
+		return LPPGyrometer{channel, lppGet(data[0:2], 0.01), lppGet(data[2:4], 0.01), lppGet(data[4:6], 0.01)}
+	}},
+	LPPTypeGPS: {"gps", 9, func(channel uint8, data []byte) LPPValue {
+		return LPPGPS{channel, lppGet(data[0:3], 0.0001), lppGet(data[3:6], 0.0001), lppGet(data[6:9], 0.01)}
+	}},
+}
+
+// lppGet reads a signed big-endian integer from the data and multiplies it with the resolution
+func lppGet(data []byte, resolution float64) float64 {
+	var value int64
+	for _, b := range data {
+		value = value<<8 | int64(b)
+	}
+	if bits := uint(len(data) * 8); value >= 1<<(bits-1) {
+		value -= 1 << bits
+	}
+	return lppRound(float64(value)*resolution, resolution)
+}
+
+// lppAppend divides the value by the resolution and appends it as a big-endian integer of the given size
+func lppAppend(payload []byte, value, resolution float64, size int, signed bool) ([]byte, error) {
+	scaled := math.Round(value / resolution)
+	bits := uint(size * 8)
+	min, max := 0.0, float64(uint64(1)<<bits-1)
+	if signed {
+		min, max = -float64(uint64(1)<<(bits-1)), float64(uint64(1)<<(bits-1)-1)
+	}
+	if scaled < min || scaled > max || math.IsNaN(scaled) {
+		return nil, fmt.Errorf("ttn-sdk: value %v is out of range for Cayenne LPP", value)
+	}
+	raw := uint64(int64(scaled))
+	for i := size - 1; i >= 0; i-- {
+		payload = append(payload, byte(raw>>(uint(i)*8)))
+	}
+	return payload, nil
+}
+
+// lppRound rounds the value to the number of decimals of the resolution
+func lppRound(value, resolution float64) float64 {
+	decimals := math.Pow(10, math.Ceil(-math.Log10(resolution)))
+	return math.Round(value*decimals) / decimals
+}
+
+func lppHeader(payload []byte, v LPPValue) []byte {
+	return append(payload, v.LPPChannel(), v.LPPType())
+}
+
+func (v LPPDigitalInput) LPPChannel() uint8       { return v.Channel }
+func (v LPPDigitalOutput) LPPChannel() uint8      { return v.Channel }
+func (v LPPAnalogInput) LPPChannel() uint8        { return v.Channel }
+func (v LPPAnalogOutput) LPPChannel() uint8       { return v.Channel }
+func (v LPPLuminosity) LPPChannel() uint8         { return v.Channel }
+func (v LPPPresence) LPPChannel() uint8           { return v.Channel }
+func (v LPPTemperature) LPPChannel() uint8        { return v.Channel }
+func (v LPPRelativeHumidity) LPPChannel() uint8   { return v.Channel }
+func (v LPPAccelerometer) LPPChannel() uint8      { return v.Channel }
+func (v LPPBarometricPressure) LPPChannel() uint8 { return v.Channel }
+func (v LPPGyrometer) LPPChannel() uint8          { return v.Channel }
+func (v LPPGPS) LPPChannel() uint8                { return v.Channel }
+
+func (LPPDigitalInput) LPPType() uint8       { return LPPTypeDigitalInput }
+func (LPPDigitalOutput) LPPType() uint8      { return LPPTypeDigitalOutput }
+func (LPPAnalogInput) LPPType() uint8        { return LPPTypeAnalogInput }
+func (LPPAnalogOutput) LPPType() uint8       { return LPPTypeAnalogOutput }
+func (LPPLuminosity) LPPType() uint8         { return LPPTypeLuminosity }
+func (LPPPresence) LPPType() uint8           { return LPPTypePresence }
+func (LPPTemperature) LPPType() uint8        { return LPPTypeTemperature }
+func (LPPRelativeHumidity) LPPType() uint8   { return LPPTypeRelativeHumidity }
+func (LPPAccelerometer) LPPType() uint8      { return LPPTypeAccelerometer }
+func (LPPBarometricPressure) LPPType() uint8 { return LPPTypeBarometricPressure }
+func (LPPGyrometer) LPPType() uint8          { return LPPTypeGyrometer }
+func (LPPGPS) LPPType() uint8                { return LPPTypeGPS }
+
+func (v LPPDigitalInput) appendLPP(payload []byte) ([]byte, error) {
+	return append(lppHeader(payload, v), v.Value), nil
+}
+
+func (v LPPDigitalOutput) appendLPP(payload []byte) ([]byte, error) {
+	return append(lppHeader(payload, v), v.Value), nil
+}
+
+func (v LPPAnalogInput) appendLPP(payload []byte) ([]byte, error) {
+	return lppAppend(lppHeader(payload, v), v.Value, 0.01, 2, true)
+}
+
+func (v LPPAnalogOutput) appendLPP(payload []byte) ([]byte, error) {
+	return lppAppend(lppHeader(payload, v), v.Value, 0.01, 2, true)
+}
+
+func (v LPPLuminosity) appendLPP(payload []byte) ([]byte, error) {
+	return append(lppHeader(payload, v), byte(v.Lux>>8), byte(v.Lux)), nil
+}
+
+func (v LPPPresence) appendLPP(payload []byte) ([]byte, error) {
+	return append(lppHeader(payload, v), v.Value), nil
+}
+
+func (v LPPTemperature) appendLPP(payload []byte) ([]byte, error) {
+	return lppAppend(lppHeader(payload, v), v.Celsius, 0.1, 2, true)
+}
+
+func (v LPPRelativeHumidity) appendLPP(payload []byte) ([]byte, error) {
+	return lppAppend(lppHeader(payload, v), v.Percent, 0.5, 1, false)
+}
+
+func (v LPPAccelerometer) appendLPP(payload []byte) (_ []byte, err error) {
+	payload = lppHeader(payload, v)
+	for _, value := range []float64{v.X, v.Y, v.Z} {
+		if payload, err = lppAppend(payload, value, 0.001, 2, true); err != nil {
+			return nil, err
+		}
+	}
+	return payload, nil
+}
+
+func (v LPPBarometricPressure) appendLPP(payload []byte) ([]byte, error) {
+	return lppAppend(lppHeader(payload, v), v.HPa, 0.1, 2, false)
+}
+
+func (v LPPGyrometer) appendLPP(payload []byte) (_ []byte, err error) {
+	payload = lppHeader(payload, v)
+	for _, value := range []float64{v.X, v.Y, v.Z} {
+		if payload, err = lppAppend(payload, value, 0.01, 2, true); err != nil {
+			return nil, err
+		}
+	}
+	return payload, nil
+}
+
+func (v LPPGPS) appendLPP(payload []byte) (_ []byte, err error) {
+	payload = lppHeader(payload, v)
+	if payload, err = lppAppend(payload, v.Latitude, 0.0001, 3, true); err != nil {
+		return nil, err
+	}
+	if payload, err = lppAppend(payload, v.Longitude, 0.0001, 3, true); err != nil {
+		return nil, err
+	}
+	return lppAppend(payload, v.Altitude, 0.01, 3, true)
+}
+
+func (v LPPDigitalInput) lppField() interface{}       { return float64(v.Value) }
+func (v LPPDigitalOutput) lppField() interface{}      { return float64(v.Value) }
+func (v LPPAnalogInput) lppField() interface{}        { return v.Value }
+func (v LPPAnalogOutput) lppField() interface{}       { return v.Value }
+func (v LPPLuminosity) lppField() interface{}         { return float64(v.Lux) }
+func (v LPPPresence) lppField() interface{}           { return float64(v.Value) }
+func (v LPPTemperature) lppField() interface{}        { return v.Celsius }
+func (v LPPRelativeHumidity) lppField() interface{}   { return v.Percent }
+func (v LPPBarometricPressure) lppField() interface{} { return v.HPa }
+
+func (v LPPAccelerometer) lppField() interface{} {
+	return map[string]interface{}{"x": v.X, "y": v.Y, "z": v.Z}
+}
+
+func (v LPPGyrometer) lppField() interface{} {
+	return map[string]interface{}{"x": v.X, "y": v.Y, "z": v.Z}
+}
+
+func (v LPPGPS) lppField() interface{} {
+	return map[string]interface{}{"latitude": v.Latitude, "longitude": v.Longitude, "altitude": v.Altitude}
+}
+
+// EncodeLPP encodes the values to a Cayenne LPP payload that can be used as PayloadRaw of an uplink message (for
+// example with the Simulator) or of a downlink message.
+func EncodeLPP(values ...LPPValue) (payload []byte, err error) {
+	payload = []byte{}
+	for _, value := range values {
+		if payload, err = value.appendLPP(payload); err != nil {
+			return nil, err
+		}
+	}
+	return payload, nil
+}
+
+// DecodeLPP decodes a Cayenne LPP payload, such as the PayloadRaw of an uplink message
+func DecodeLPP(payload []byte) (values []LPPValue, err error) {
+	for len(payload) > 0 {
+		if len(payload) < 2 {
+			return nil, fmt.Errorf("ttn-sdk: incomplete Cayenne LPP header")
+		}
+		channel, dataType := payload[0], payload[1]
+		t, ok := lppTypes[dataType]
+		if !ok {
+			return nil, fmt.Errorf("ttn-sdk: unknown Cayenne LPP data type %d on channel %d", dataType, channel)
+		}
+		if len(payload) < 2+t.size {
+			return nil, fmt.Errorf("ttn-sdk: incomplete Cayenne LPP %s on channel %d", t.name, channel)
+		}
+		values = append(values, t.decode(channel, payload[2:2+t.size]))
+		payload = payload[2+t.size:]
+	}
+	return values, nil
+}
+
+// LPPFields returns the fields of the values, in the same format as the PayloadFields of an uplink message of an
+// application that uses the "cayenne" payload format. The fields are named after their type and channel, for example
+// "temperature_1".
+func LPPFields(values ...LPPValue) map[string]interface{} {
+	fields := make(map[string]interface{})
+	for _, value := range values {
+		fields[fmt.Sprintf("%s_%d", lppTypes[value.LPPType()].name, value.LPPChannel())] = value.lppField()
+	}
+	return fields
+}
+
+// LPPDownlinkValue is a value in a Cayenne LPP downlink payload. This is the format of downlink payloads of the
+// "cayenne" payload format: the channel followed by the value with a resolution of 0.01.
+type LPPDownlinkValue struct {
+	Channel uint8
+	Value   float64
+}
+
+// EncodeLPPDownlink encodes the values to a Cayenne LPP downlink payload
+func EncodeLPPDownlink(values ...LPPDownlinkValue) (payload []byte, err error) {
+	payload = []byte{}
+	for _, value := range values {
+		if payload, err = lppAppend(append(payload, value.Channel), value.Value, 0.01, 2, true); err != nil {
+			return nil, err
+		}
+	}
+	return payload, nil
+}
+
+// DecodeLPPDownlink decodes a Cayenne LPP downlink payload
+func DecodeLPPDownlink(payload []byte) (values []LPPDownlinkValue, err error) {
+	if len(payload)%3 != 0 {
+		return nil, fmt.Errorf("ttn-sdk: invalid length of Cayenne LPP downlink payload")
+	}
+	for ; len(payload) > 0; payload = payload[3:] {
+		values = append(values, LPPDownlinkValue{Channel: payload[0], Value: lppGet(payload[1:3], 0.01)})
+	}
+	return values, nil
+}
+
+// CayenneLPP is a PayloadCodec for Cayenne LPP. It decodes uplink payloads and encodes downlink fields in the same way
+// as the "cayenne" payload format of the Handler. Downlink fields are named "value_" followed by the channel, for
+// example "value_2", and must have a numeric value.
+type CayenneLPP struct{}
+
+// Decode implements PayloadCodec
+func (CayenneLPP) Decode(payload []byte, port uint8) (map[string]interface{}, error) {
+	values, err := DecodeLPP(payload)
+	if err != nil {
+		return nil, err
+	}
+	return LPPFields(values...), nil
+}
+
+// Encode implements PayloadCodec
+func (CayenneLPP) Encode(fields map[string]interface{}, port uint8) ([]byte, error) {
+	var values []LPPDownlinkValue
+	for name, field := range fields {
+		if !strings.HasPrefix(name, "value_") {
+			return nil, fmt.Errorf("ttn-sdk: invalid Cayenne LPP downlink field %s, expected value_<channel>", name)
+		}
+		channel, err := strconv.ParseUint(strings.TrimPrefix(name, "value_"), 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("ttn-sdk: invalid channel in Cayenne LPP downlink field %s", name)
+		}
+		value, err := lppDownlinkFieldValue(field)
+		if err != nil {
+			return nil, fmt.Errorf("ttn-sdk: invalid value of Cayenne LPP downlink field %s: %s", name, err)
+		}
+		values = append(values, LPPDownlinkValue{Channel: uint8(channel), Value: value})
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Channel < values[j].Channel })
+	return EncodeLPPDownlink(values...)
+}
+
+// lppDownlinkFieldValue returns the numeric value of a downlink field
+func lppDownlinkFieldValue(field interface{}) (float64, error) {
+	switch field := field.(type) {
+	case float64:
+		return field, nil
+	case float32:
+		return float64(field), nil
+	case int:
+		return float64(field), nil
+	case int8:
+		return float64(field), nil
+	case int16:
+		return float64(field), nil
+	case int32:
+		return float64(field), nil
+	case int64:
+		return float64(field), nil
+	case uint:
+		return float64(field), nil
+	case uint8:
+		return float64(field), nil
+	case uint16:
+		return float64(field), nil
+	case uint32:
+		return float64(field), nil
+	case uint64:
+		return float64(field), nil
+	case json.Number:
+		return field.Float64()
+	}
+	return 0, fmt.Errorf("unsupported type %T", field)
+}
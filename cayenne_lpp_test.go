@@ -0,0 +1,153 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/assertions"
+)
+
+var testLPPPayload = []byte{
+	1, LPPTypeDigitalInput, 255,
+	2, LPPTypeDigitalOutput, 100,
+	3, LPPTypeAnalogInput, 21, 74,
+	4, LPPTypeAnalogOutput, 234, 182,
+	5, LPPTypeLuminosity, 1, 244,
+	6, LPPTypePresence, 50,
+	7, LPPTypeTemperature, 255, 100,
+	8, LPPTypeRelativeHumidity, 99,
+	9, LPPTypeAccelerometer, 254, 88, 0, 15, 6, 130,
+	10, LPPTypeBarometricPressure, 41, 239,
+	11, LPPTypeGyrometer, 1, 99, 2, 49, 254, 102,
+	12, LPPTypeGPS, 7, 253, 135, 0, 190, 245, 0, 8, 106,
+}
+
+var testLPPValues = []LPPValue{
+	LPPDigitalInput{1, 255},
+	LPPDigitalOutput{2, 100},
+	LPPAnalogInput{3, 54.5},
+	LPPAnalogOutput{4, -54.5},
+	LPPLuminosity{5, 500},
+	LPPPresence{6, 50},
+	LPPTemperature{7, -15.6},
+	LPPRelativeHumidity{8, 49.5},
+	LPPAccelerometer{9, -0.424, 0.015, 1.666},
+	LPPBarometricPressure{10, 1073.5},
+	LPPGyrometer{11, 3.55, 5.61, -4.1},
+	LPPGPS{12, 52.3655, 4.8885, 21.54},
+}
+
+func TestCayenneLPP(t *testing.T) {
+	a := New(t)
+
+	{
+		values, err := DecodeLPP(testLPPPayload)
+		a.So(err, ShouldBeNil)
+		a.So(values, ShouldResemble, testLPPValues)
+
+		payload, err := EncodeLPP(testLPPValues...)
+		a.So(err, ShouldBeNil)
+		a.So(payload, ShouldResemble, testLPPPayload)
+
+		payload, err = EncodeLPP()
+		a.So(err, ShouldBeNil)
+		a.So(payload, ShouldBeEmpty)
+	}
+
+	for _, value := range []LPPValue{
+		LPPTemperature{1, 3276.8},
+		LPPAnalogInput{1, -327.69},
+		LPPRelativeHumidity{1, -0.5},
+		LPPRelativeHumidity{1, 128},
+		LPPBarometricPressure{1, 6553.6},
+		LPPGPS{1, 839, 0, 0},
+	} {
+		_, err := EncodeLPP(value)
+		a.So(err, ShouldNotBeNil)
+	}
+
+	for _, payload := range [][]byte{
+		{1},
+		{1, 200, 0},
+		{1, LPPTypeTemperature, 0},
+		{1, LPPTypeGPS, 0, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		_, err := DecodeLPP(payload)
+		a.So(err, ShouldNotBeNil)
+	}
+
+	{
+		fields, err := CayenneLPP{}.Decode(testLPPPayload, 1)
+		a.So(err, ShouldBeNil)
+		a.So(fields, ShouldHaveLength, 12)
+		a.So(fields["digital_in_1"], ShouldEqual, 255)
+		a.So(fields["digital_out_2"], ShouldEqual, 100)
+		a.So(fields["analog_in_3"], ShouldEqual, 54.5)
+		a.So(fields["analog_out_4"], ShouldEqual, -54.5)
+		a.So(fields["luminosity_5"], ShouldEqual, 500)
+		a.So(fields["presence_6"], ShouldEqual, 50)
+		a.So(fields["temperature_7"], ShouldEqual, -15.6)
+		a.So(fields["relative_humidity_8"], ShouldEqual, 49.5)
+		a.So(fields["accelerometer_9"], ShouldResemble, map[string]interface{}{"x": -0.424, "y": 0.015, "z": 1.666})
+		a.So(fields["barometric_pressure_10"], ShouldEqual, 1073.5)
+		a.So(fields["gyrometer_11"], ShouldResemble, map[string]interface{}{"x": 3.55, "y": 5.61, "z": -4.1})
+		a.So(fields["gps_12"], ShouldResemble, map[string]interface{}{"latitude": 52.3655, "longitude": 4.8885, "altitude": 21.54})
+	}
+
+	{
+		payload, err := EncodeLPPDownlink(LPPDownlinkValue{2, -50.51}, LPPDownlinkValue{3, 1})
+		a.So(err, ShouldBeNil)
+		a.So(payload, ShouldResemble, []byte{2, 236, 69, 3, 0, 100})
+
+		values, err := DecodeLPPDownlink(payload)
+		a.So(err, ShouldBeNil)
+		a.So(values, ShouldResemble, []LPPDownlinkValue{{2, -50.51}, {3, 1}})
+
+		_, err = DecodeLPPDownlink([]byte{1, 2})
+		a.So(err, ShouldNotBeNil)
+
+		payload, err = CayenneLPP{}.Encode(map[string]interface{}{
+			"value_3": int64(1),
+			"value_2": json.Number("-50.51"),
+		}, 1)
+		a.So(err, ShouldBeNil)
+		a.So(payload, ShouldResemble, []byte{2, 236, 69, 3, 0, 100})
+
+		for name, value := range map[string]interface{}{
+			"custom":       8,
+			"value_x":      1.0,
+			"foo_2":        1.0,
+			"value_256":    1.0,
+			"digital_in_8": "not a value",
+			"value_4":      "not a number",
+			"value_5":      json.Number("NaN?"),
+		} {
+			_, err = CayenneLPP{}.Encode(map[string]interface{}{"value_2": 1, name: value}, 1)
+			a.So(err, ShouldNotBeNil)
+			a.So(err.Error(), ShouldContainSubstring, name)
+		}
+	}
+
+	{
+		mock := new(mockApplicationManagerClient)
+		sim := &simulator{
+			client:         mock,
+			getContext:     func(ctx context.Context) context.Context { return ctx },
+			requestTimeout: time.Second,
+			appID:          "test",
+			devID:          "dev",
+		}
+		err := sim.UplinkLPP(2, LPPTemperature{1, 21.5}, LPPRelativeHumidity{2, 60})
+		a.So(err, ShouldBeNil)
+		a.So(mock.SimulatedUplinkMessage.Port, ShouldEqual, 2)
+		a.So(mock.SimulatedUplinkMessage.Payload, ShouldResemble, []byte{1, LPPTypeTemperature, 0, 215, 2, LPPTypeRelativeHumidity, 120})
+
+		err = sim.UplinkLPP(2, LPPTemperature{1, 5000})
+		a.So(err, ShouldNotBeNil)
+	}
+}
@@ -55,9 +55,46 @@ type ClientConfig struct {
 	// Set this to true if the Discovery Server is insecure (not recommended)
 	DiscoveryServerInsecure bool
 
-	// Address of the Handler (optional)
+	// Interval for asking the Discovery Server if the Handler of the application changed (disabled if zero). The client
+	// also asks the Discovery Server when the Handler is unavailable.
+	RediscoveryInterval time.Duration
+
+	// Function that is called after the client re-connected because the Handler of the application changed (optional)
+	OnHandlerChange func(previous, current *discovery.Announcement)
+
+	// Address of the Handler (optional). If set, the client connects to this Handler directly instead of asking the
+	// Discovery Server for the Handler of the application. Multiple addresses can be given, separated by commas.
 	HandlerAddress string
 
+	// PEM-encoded TLS certificate of the Handler at HandlerAddress (optional). If set, the client only trusts this
+	// certificate when connecting to the Handler. If not set, the TLSConfig is used.
+	HandlerCertificate string
+
+	// Set this to true if the Handler at HandlerAddress is insecure (not recommended)
+	HandlerInsecure bool
+
+	// Set this to true to connect to the addresses of the Handler in random order instead of the announced order
+	RandomizeHandlerAddresses bool
+
+	// Address of the MQTT server (optional). If set, the client connects to this MQTT server directly instead of using
+	// the MQTT address that is announced by the Handler. See the documentation of the MqttAddress field of
+	// discovery.Announcement for the supported formats.
+	MQTTAddress string
+
+	// Registry of Go payload codecs (optional). If set, the payload of uplink messages is decoded into PayloadFields
+	// before the messages are delivered, and the PayloadFields of downlink messages are encoded into PayloadRaw when
+	// the messages are published.
+	PayloadCodecs *PayloadCodecRegistry
+
+	// Default options for subscriptions (in the default config, messages are buffered with a buffer size of
+	// DefaultSubscriptionBufferSize, and dropped when the buffer is full)
+	SubscriptionOptions SubscriptionOptions
+
+	// Registry of device templates (in the default config, this is an empty registry). DeviceManager.CreateFromTemplate
+	// creates devices from these templates. Use FindDrift of the registry to find devices that have drifted from their
+	// template.
+	DeviceTemplates *DeviceTemplateRegistry
+
 	// Timeout for requests (in the default config, this is 10 seconds)
 	RequestTimeout time.Duration
 
@@ -80,6 +117,7 @@ func NewConfig(clientName, accountServerAddress, discoveryServerAddress string)
 		AccountServerAddress:   accountServerAddress,
 		AccountServerClientID:  clientName,
 		DiscoveryServerAddress: discoveryServerAddress,
+		DeviceTemplates:        NewDeviceTemplateRegistry(),
 		RequestTimeout:         10 * time.Second,
 	}
 }
@@ -110,6 +148,7 @@ func newClient(config ClientConfig) Client {
 	client := &client{
 		ClientConfig:         config,
 		transportCredentials: credentials.NewTLS(config.TLSConfig),
+		payloadHistory:       new(payloadHistory),
 	}
 	if config.AccountServerAddress != "" {
 		client.account = account.New(config.AccountServerAddress)
@@ -133,6 +172,15 @@ type Client interface {
 
 	// Simulate uplink messages for a device (for testing)
 	Simulate(devID string) (Simulator, error)
+
+	// Get the status of the addresses of the Handler. If a call fails because the Handler is unavailable, the client
+	// blacklists the address of the Handler and moves to another address.
+	HandlerStatus() []HandlerAddressStatus
+
+	// WithContext returns a view of the client that uses the given context when connecting to the Discovery Server,
+	// the Handler and the MQTT server. The managers and simulators that are returned by this view use the context as
+	// parent context of their requests.
+	WithContext(ctx context.Context) Client
 }
 
 type client struct {
@@ -143,16 +191,27 @@ type client struct {
 		sync.RWMutex
 		conn *grpc.ClientConn
 	}
+	rediscovery struct {
+		sync.Mutex
+		cancel context.CancelFunc
+	}
 	handler struct {
 		sync.RWMutex
 		announcement *discovery.Announcement
 		conn         *grpc.ClientConn
+		address      string
+		status       map[string]*HandlerAddressStatus
 	}
-	mqtt struct {
+	payloadHistory *payloadHistory
+	mqtt           struct {
+		// resubscribe is held while subscriptions are moved to a new MQTT client, and while subscribers are torn down
+		resubscribe sync.Mutex
+
 		sync.RWMutex
-		client mqtt.Client
-		ctx    context.Context
-		cancel context.CancelFunc
+		client      mqtt.Client
+		ctx         context.Context
+		cancel      context.CancelFunc
+		subscribers map[mqttSubscriber]struct{}
 	}
 }
 
@@ -164,7 +223,43 @@ func (c *client) getContext(ctx context.Context) context.Context {
 	return ctx
 }
 
+// requestContext returns the context for a request to the network. The context is derived from the parent context (or
+// from the background context if there is no parent), and is canceled after the request timeout.
+func requestContext(parent context.Context, getContext func(context.Context) context.Context, requestTimeout time.Duration) (context.Context, context.CancelFunc) {
+	if parent == nil {
+		parent = context.Background()
+	}
+	return context.WithTimeout(getContext(parent), requestTimeout)
+}
+
+func (c *client) WithContext(ctx context.Context) Client {
+	return &contextClient{client: c, ctx: ctx}
+}
+
+// contextClient is a view of the client that uses a context
+type contextClient struct {
+	*client
+	ctx context.Context
+}
+
+func (c *contextClient) PubSub() (ApplicationPubSub, error) { return c.client.pubSub(c.ctx) }
+
+func (c *contextClient) ManageApplication() (ApplicationManager, error) {
+	return c.client.manageApplication(c.ctx)
+}
+
+func (c *contextClient) ManageDevices() (DeviceManager, error) { return c.client.manageDevices(c.ctx) }
+
+func (c *contextClient) Simulate(devID string) (Simulator, error) {
+	return c.client.simulate(c.ctx, devID)
+}
+
+func (c *contextClient) WithContext(ctx context.Context) Client {
+	return &contextClient{client: c.client, ctx: ctx}
+}
+
 func (c *client) Close() (closeErr error) {
+	c.stopRediscovery()
 	if err := c.closeHandler(); err != nil {
 		closeErr = err
 	}
@@ -4,16 +4,29 @@
 package ttnsdk
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
 	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/TheThingsNetwork/api/handler"
 	ttnlog "github.com/TheThingsNetwork/go-utils/log"
 	testlog "github.com/TheThingsNetwork/go-utils/log/test"
 	"github.com/TheThingsNetwork/go-utils/random"
 	"github.com/TheThingsNetwork/ttn/core/types"
 	. "github.com/smartystreets/assertions"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 func TestClient(t *testing.T) {
@@ -34,8 +47,8 @@ func TestClient(t *testing.T) {
 	config := NewCommunityConfig("client-test")
 	client := config.NewClient(appID, os.Getenv("APP_ACCESS_KEY")).(*client)
 
-	client.connectHandler()
-	client.connectMQTT()
+	client.connectHandler(context.Background())
+	client.connectMQTT(context.Background())
 
 	time.Sleep(10 * time.Millisecond)
 
@@ -43,8 +56,8 @@ func TestClient(t *testing.T) {
 
 	time.Sleep(time.Second)
 
-	client.connectHandler()
-	client.connectMQTT()
+	client.connectHandler(context.Background())
+	client.connectMQTT(context.Background())
 
 	time.Sleep(10 * time.Millisecond)
 
@@ -116,29 +129,176 @@ func TestCleanMQTTAddress(t *testing.T) {
 	a.So(err, ShouldBeNil)
 	a.So(addr, ShouldEqual, "tcp://localhost:1883")
 
-	// if `host:port` then `mqtt://host:port`
+	// if `host:port` then `tcp://host:port`
 	addr, err = cleanMQTTAddress("localhost:1234")
 	a.So(err, ShouldBeNil)
 	a.So(addr, ShouldEqual, "tcp://localhost:1234")
 
-	// if `host:8883` then `mqtts://host:8883`
+	// if `host:8883` then `ssl://host:8883`
 	addr, err = cleanMQTTAddress("localhost:8883")
 	a.So(err, ShouldBeNil)
 	a.So(addr, ShouldEqual, "ssl://localhost:8883")
 
-	// if `host` then `mqtt://host:1883` and `mqtts://host:8883` (we choose mqtts)
+	// if `host` then `ssl://host:8883`
 	addr, err = cleanMQTTAddress("localhost")
 	a.So(err, ShouldBeNil)
 	a.So(addr, ShouldEqual, "ssl://localhost:8883")
 
-	// if `mqtt://host` then `mqtt://host:1883`
+	// if `mqtt://host` then `tcp://host:1883`
 	addr, err = cleanMQTTAddress("mqtt://localhost")
 	a.So(err, ShouldBeNil)
 	a.So(addr, ShouldEqual, "tcp://localhost:1883")
 
-	// if `mqtts://host` then `mqtt://host:1883` and `mqtts://host:8883` (we choose mqtts)
+	// if `mqtts://host` then `ssl://host:8883`
 	addr, err = cleanMQTTAddress("mqtts://localhost")
 	a.So(err, ShouldBeNil)
 	a.So(addr, ShouldEqual, "ssl://localhost:8883")
 
+	// if `mqtt://host:port` then `tcp://host:port`
+	addr, err = cleanMQTTAddress("mqtt://localhost:1234")
+	a.So(err, ShouldBeNil)
+	a.So(addr, ShouldEqual, "tcp://localhost:1234")
+
+	// if `mqtts://host:port` then `ssl://host:port`
+	addr, err = cleanMQTTAddress("mqtts://localhost:1234")
+	a.So(err, ShouldBeNil)
+	a.So(addr, ShouldEqual, "ssl://localhost:1234")
+}
+
+func generateCertificate(host string) (tls.Certificate, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		IPAddresses:  []net.IP{net.ParseIP(host)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	return cert, string(certPEM), err
+}
+
+func TestStaticEndpoints(t *testing.T) {
+	a := New(t)
+
+	log := testlog.NewLogger()
+	ttnlog.Set(log)
+	defer log.Print(t)
+
+	mock := new(mockApplicationManagerClient)
+	mock.application = &handler.Application{AppID: "test", PayloadFormat: "custom"}
+
+	{
+		addr, stop := serveMockApplicationManager(t, mock)
+		defer stop()
+
+		config := NewConfig("test", "", "")
+		config.Logger = log
+		config.HandlerAddress = addr
+		config.HandlerInsecure = true
+		client := config.NewClient("test", "").(*client)
+		defer client.Close()
+
+		app, err := client.ManageApplication()
+		a.So(err, ShouldBeNil)
+		pf, err := app.GetPayloadFormat()
+		a.So(err, ShouldBeNil)
+		a.So(pf, ShouldEqual, "custom")
+		a.So(client.discovery.conn, ShouldBeNil)
+		a.So(client.handler.announcement.NetAddress, ShouldEqual, addr)
+	}
+
+	{
+		cert, certPEM, err := generateCertificate("127.0.0.1")
+		a.So(err, ShouldBeNil)
+		addr, stop := serveMockApplicationManager(t, mock, grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
+		defer stop()
+
+		config := NewConfig("test", "", "")
+		config.Logger = log
+		config.HandlerAddress = addr
+		config.HandlerCertificate = certPEM
+		client := config.NewClient("test", "").(*client)
+		defer client.Close()
+
+		app, err := client.ManageApplication()
+		a.So(err, ShouldBeNil)
+		pf, err := app.GetPayloadFormat()
+		a.So(err, ShouldBeNil)
+		a.So(pf, ShouldEqual, "custom")
+		a.So(client.discovery.conn, ShouldBeNil)
+	}
+
+	{
+		addr, stop := serveMockApplicationManager(t, mock)
+		defer stop()
+
+		config := NewConfig("test", "", "")
+		config.Logger = log
+		config.HandlerAddress = addr
+		config.HandlerInsecure = true
+		client := config.NewClient("test", "").(*client)
+		defer client.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := client.WithContext(ctx).ManageDevices()
+		a.So(err, ShouldEqual, context.Canceled)
+		a.So(client.handler.conn, ShouldBeNil)
+
+		sim, err := client.WithContext(context.Background()).Simulate("dev-id")
+		a.So(err, ShouldBeNil)
+		err = sim.WithContext(ctx).Uplink(1, []byte{0x01})
+		a.So(err, ShouldNotBeNil)
+		err = sim.Uplink(1, []byte{0x01})
+		a.So(err, ShouldBeNil)
+	}
+
+	{
+		config := NewConfig("test", "", "")
+		config.Logger = log
+		config.HandlerAddress = "127.0.0.1:1904"
+		config.HandlerCertificate = "not a certificate"
+		client := config.NewClient("test", "").(*client)
+		defer client.Close()
+
+		_, err := client.ManageApplication()
+		a.So(err, ShouldNotBeNil)
+	}
+
+	{
+		broker, err := newMockMQTTBroker()
+		a.So(err, ShouldBeNil)
+		defer broker.Close()
+
+		config := NewConfig("test", "", "")
+		config.Logger = log
+		config.MQTTAddress = "mqtt://" + broker.Addr().String()
+		client := config.NewClient("test", "").(*client)
+		defer client.Close()
+
+		_, err = client.PubSub()
+		a.So(err, ShouldBeNil)
+		a.So(client.mqtt.client.IsConnected(), ShouldBeTrue)
+		a.So(client.discovery.conn, ShouldBeNil)
+		a.So(client.handler.announcement, ShouldBeNil)
+	}
 }
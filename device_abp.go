@@ -0,0 +1,212 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/go-utils/random"
+	"github.com/TheThingsNetwork/ttn/core/types"
+)
+
+// logger returns the logger of the device manager
+func (d *Device) logger() log.Interface {
+	if manager, ok := d.deviceManager.(auditLogger); ok {
+		return manager.auditLogger()
+	}
+	return log.Get()
+}
+
+// audit logs an action on the device with the logger of the device manager
+func (d *Device) audit(action string, fields log.Fields, err error) {
+	logger := d.logger().WithFields(log.Fields{"AppID": d.AppID, "DevID": d.DevID, "Action": action}).WithFields(fields)
+	if err != nil {
+		logger.WithError(err).Warn("ttn-sdk: Device action failed")
+		return
+	}
+	logger.Info("ttn-sdk: Device action succeeded")
+}
+
+func (d *Device) mustNotBeNew() {
+	if d.IsNew() {
+		panic("ttn-sdk: you can not update new devices. Use the Get() function to retrieve the device from the server first.")
+	}
+}
+
+// ResetFrameCounters sets the uplink and downlink frame counters of the device to zero. This function panics if this is
+// a new device, so make sure you Get() the device first.
+func (d *Device) ResetFrameCounters() (err error) {
+	d.mustNotBeNew()
+	fields := log.Fields{"FCntUp": d.FCntUp, "FCntDown": d.FCntDown}
+	defer func() { d.audit("reset frame counters", fields, err) }()
+	d.FCntUp, d.FCntDown = 0, 0
+	return d.Update()
+}
+
+// RotateSessionKeys sets the NwkSKey and AppSKey of a personalized device to randomly generated values. See
+// RotateSessionKeysFunc.
+func (d *Device) RotateSessionKeys() error {
+	return d.RotateSessionKeysFunc(func(_ types.DevAddr) (nwkSKey types.NwkSKey, appSKey types.AppSKey) {
+		random.FillBytes(nwkSKey[:])
+		random.FillBytes(appSKey[:])
+		return
+	})
+}
+
+// RotateSessionKeysFunc sets the NwkSKey and AppSKey of a personalized device to the result of the personalizeFunc.
+// Unlike PersonalizeFunc, the device keeps its DevAddr. Because the new keys start a new session, the frame counters
+// are set to zero. This function panics if this is a new device, so make sure you Get() the device first.
+func (d *Device) RotateSessionKeysFunc(personalizeFunc func(types.DevAddr) (types.NwkSKey, types.AppSKey)) (err error) {
+	d.mustNotBeNew()
+	fields := log.Fields{}
+	defer func() { d.audit("rotate session keys", fields, err) }()
+	if d.DevAddr == nil {
+		return fmt.Errorf("ttn-sdk: device %s is not personalized", d.DevID)
+	}
+	fields["DevAddr"] = *d.DevAddr
+	nwkSKey, appSKey := personalizeFunc(*d.DevAddr)
+	d.NwkSKey, d.AppSKey = &nwkSKey, &appSKey
+	d.FCntUp, d.FCntDown = 0, 0
+	return d.Update()
+}
+
+// DefaultFCntCheckRevertAttempts is the number of times that reverting a relaxed frame counter check is attempted if no
+// number is given in the options
+var DefaultFCntCheckRevertAttempts = 5
+
+// DefaultFCntCheckRevertBackoff is the time between the first attempts to revert a relaxed frame counter check if no
+// backoff is given in the options
+var DefaultFCntCheckRevertBackoff = time.Second
+
+// RelaxFCntCheckOptions contains the options for RelaxFCntCheck
+type RelaxFCntCheckOptions struct {
+	// The number of times that reverting the setting is attempted (in the default config, this is
+	// DefaultFCntCheckRevertAttempts)
+	Attempts int
+
+	// The time between the first attempts to revert the setting, which doubles after every attempt (in the default
+	// config, this is DefaultFCntCheckRevertBackoff)
+	Backoff time.Duration
+
+	// OnRevertError is called if the setting could not be reverted. The frame counter check of the device then stays
+	// disabled, so this should alert someone or revert the setting by other means. If OnRevertError is not set, the
+	// failure is logged as an error.
+	OnRevertError func(relaxed *RelaxedFCntCheck, err error)
+}
+
+// RelaxedFCntCheck is a temporary change of the DisableFCntCheck setting of a device, which is returned by
+// RelaxFCntCheck
+type RelaxedFCntCheck struct {
+	device   *Device
+	previous bool
+	options  RelaxFCntCheckOptions
+
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+// RelaxFCntCheck sets DisableFCntCheck on the device for the given duration. After the duration, or when Revert is
+// called, the setting is reverted to its previous value. The revert retrieves the latest version of the device from the
+// device manager, so changes that were made in the meantime are kept, but the *Device itself is not changed. The
+// revert does not use the context of the device manager, and is retried with backoff according to the options. This
+// function panics if this is a new device, so make sure you Get() the device first.
+func (d *Device) RelaxFCntCheck(duration time.Duration, options ...RelaxFCntCheckOptions) (relaxed *RelaxedFCntCheck, err error) {
+	d.mustNotBeNew()
+	defer func() { d.audit("disable frame counter check", log.Fields{"Duration": duration}, err) }()
+	var relaxOptions RelaxFCntCheckOptions
+	if len(options) > 0 {
+		relaxOptions = options[0]
+	}
+	if relaxOptions.Attempts <= 0 {
+		relaxOptions.Attempts = DefaultFCntCheckRevertAttempts
+	}
+	if relaxOptions.Backoff <= 0 {
+		relaxOptions.Backoff = DefaultFCntCheckRevertBackoff
+	}
+	relaxed = &RelaxedFCntCheck{
+		device: &Device{
+			deviceManager: d.deviceManager.WithContext(context.Background()),
+			SparseDevice:  SparseDevice{AppID: d.AppID, DevID: d.DevID},
+		},
+		previous: d.DisableFCntCheck,
+		options:  relaxOptions,
+		done:     make(chan struct{}),
+	}
+	d.DisableFCntCheck = true
+	if err := d.Update(); err != nil {
+		d.DisableFCntCheck = relaxed.previous
+		return nil, err
+	}
+	go func() {
+		timer := time.NewTimer(duration)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			relaxed.Revert()
+		case <-relaxed.done:
+		}
+	}()
+	return relaxed, nil
+}
+
+// Revert the DisableFCntCheck setting of the device to its previous value. Revert can be called multiple times, but
+// the setting is only reverted once; later calls return the result of the first call. If the setting could not be
+// reverted, the OnRevertError func of the options is called.
+func (r *RelaxedFCntCheck) Revert() error {
+	var reverted bool
+	r.once.Do(func() {
+		defer close(r.done)
+		reverted = true
+		backoff := r.options.Backoff
+		for attempt := 1; ; attempt++ {
+			r.err = r.revert(attempt)
+			if r.err == nil || attempt >= r.options.Attempts {
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	})
+	<-r.done
+	if reverted && r.err != nil {
+		if r.options.OnRevertError != nil {
+			r.options.OnRevertError(r, r.err)
+		} else {
+			r.device.logger().WithError(r.err).WithFields(log.Fields{"AppID": r.device.AppID, "DevID": r.device.DevID}).Error("ttn-sdk: Could not revert frame counter check, it is still disabled")
+		}
+	}
+	return r.err
+}
+
+func (r *RelaxedFCntCheck) revert(attempt int) (err error) {
+	defer func() {
+		r.device.audit("revert frame counter check", log.Fields{"DisableFCntCheck": r.previous, "Attempt": attempt}, err)
+	}()
+	dev, err := r.device.deviceManager.Get(r.device.DevID)
+	if err != nil {
+		return err
+	}
+	dev.DisableFCntCheck = r.previous
+	return r.device.deviceManager.Set(dev)
+}
+
+// Done returns a channel that is closed when the setting was reverted
+func (r *RelaxedFCntCheck) Done() <-chan struct{} {
+	return r.done
+}
+
+// Err returns the result of the revert, or nil if the setting was not reverted yet
+func (r *RelaxedFCntCheck) Err() error {
+	select {
+	case <-r.done:
+		return r.err
+	default:
+		return nil
+	}
+}
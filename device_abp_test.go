@@ -0,0 +1,224 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ttnlog "github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/ttn/core/types"
+	. "github.com/smartystreets/assertions"
+)
+
+// recordedEntry is a log entry of a recordingLogger
+type recordedEntry struct {
+	msg    string
+	fields ttnlog.Fields
+}
+
+// recordingLogger is a log.Interface that records the entries that are logged
+type recordingLogger struct {
+	mu      *sync.Mutex
+	entries *[]recordedEntry
+	fields  ttnlog.Fields
+}
+
+func newRecordingLogger() *recordingLogger {
+	return &recordingLogger{mu: new(sync.Mutex), entries: new([]recordedEntry)}
+}
+
+func (l *recordingLogger) log(msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	*l.entries = append(*l.entries, recordedEntry{msg: msg, fields: l.fields})
+}
+
+// find returns the fields of the entries that have the field with the given value
+func (l *recordingLogger) find(key string, value interface{}) (found []ttnlog.Fields) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, entry := range *l.entries {
+		if entry.fields[key] == value {
+			found = append(found, entry.fields)
+		}
+	}
+	return
+}
+
+// contains returns true if any of the entries contains the string in its message or in the value of one of its fields
+func (l *recordingLogger) contains(str string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, entry := range *l.entries {
+		if strings.Contains(entry.msg, str) {
+			return true
+		}
+		for _, value := range entry.fields {
+			if strings.Contains(fmt.Sprint(value), str) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (l *recordingLogger) Debug(msg string)                    { l.log(msg) }
+func (l *recordingLogger) Info(msg string)                     { l.log(msg) }
+func (l *recordingLogger) Warn(msg string)                     { l.log(msg) }
+func (l *recordingLogger) Error(msg string)                    { l.log(msg) }
+func (l *recordingLogger) Fatal(msg string)                    { l.log(msg) }
+func (l *recordingLogger) Debugf(msg string, v ...interface{}) { l.log(fmt.Sprintf(msg, v...)) }
+func (l *recordingLogger) Infof(msg string, v ...interface{})  { l.log(fmt.Sprintf(msg, v...)) }
+func (l *recordingLogger) Warnf(msg string, v ...interface{})  { l.log(fmt.Sprintf(msg, v...)) }
+func (l *recordingLogger) Errorf(msg string, v ...interface{}) { l.log(fmt.Sprintf(msg, v...)) }
+func (l *recordingLogger) Fatalf(msg string, v ...interface{}) { l.log(fmt.Sprintf(msg, v...)) }
+
+func (l *recordingLogger) WithField(key string, value interface{}) ttnlog.Interface {
+	return l.WithFields(ttnlog.Fields{key: value})
+}
+
+func (l *recordingLogger) WithFields(fields ttnlog.Fields) ttnlog.Interface {
+	merged := make(ttnlog.Fields, len(l.fields)+len(fields))
+	for key, value := range l.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return &recordingLogger{mu: l.mu, entries: l.entries, fields: merged}
+}
+
+func (l *recordingLogger) WithError(err error) ttnlog.Interface {
+	return l.WithField("error", err)
+}
+
+func TestABPHelpers(t *testing.T) {
+	a := New(t)
+
+	logs := newRecordingLogger()
+	ttnlog.Set(logs)
+	defer ttnlog.Set(ttnlog.Noop)
+
+	devAddr, nwkSKey, appSKey := types.DevAddr{1, 2, 3, 4}, types.NwkSKey{1}, types.AppSKey{2}
+	manager := newMemoryDeviceManager("test")
+	manager.devices = []*Device{
+		{SparseDevice: SparseDevice{AppID: "test", DevID: "abp", DevAddr: &devAddr, NwkSKey: &nwkSKey, AppSKey: &appSKey}, FCntUp: 10, FCntDown: 5},
+		{SparseDevice: SparseDevice{AppID: "test", DevID: "otaa"}},
+	}
+
+	dev, _ := manager.Get("abp")
+	a.So(dev.ResetFrameCounters(), ShouldBeNil)
+	stored, _ := manager.Get("abp")
+	a.So(stored.FCntUp, ShouldEqual, 0)
+	a.So(stored.FCntDown, ShouldEqual, 0)
+	reset := logs.find("Action", "reset frame counters")
+	a.So(reset, ShouldHaveLength, 1)
+	a.So(reset[0]["FCntUp"], ShouldEqual, 10)
+
+	dev.FCntUp = 3
+	a.So(dev.RotateSessionKeys(), ShouldBeNil)
+	stored, _ = manager.Get("abp")
+	a.So(stored.DevAddr, ShouldResemble, &devAddr)
+	a.So(*stored.NwkSKey, ShouldNotEqual, nwkSKey)
+	a.So(*stored.AppSKey, ShouldNotEqual, appSKey)
+	a.So(stored.FCntUp, ShouldEqual, 0)
+	a.So(logs.find("Action", "rotate session keys"), ShouldHaveLength, 1)
+	a.So(logs.contains(stored.NwkSKey.String()), ShouldBeFalse)
+
+	otaa, _ := manager.Get("otaa")
+	a.So(otaa.RotateSessionKeys(), ShouldNotBeNil)
+	a.So(logs.contains("not personalized"), ShouldBeTrue)
+
+	{
+		relaxed, err := dev.RelaxFCntCheck(10 * time.Millisecond)
+		a.So(err, ShouldBeNil)
+		a.So(relaxed.Err(), ShouldBeNil)
+		stored, _ = manager.Get("abp")
+		a.So(stored.DisableFCntCheck, ShouldBeTrue)
+
+		// Changes in the meantime are kept
+		stored.Description = "changed"
+		a.So(manager.Set(stored), ShouldBeNil)
+
+		select {
+		case <-relaxed.Done():
+		case <-time.After(time.Second):
+			t.Fatal("Frame counter check was not reverted")
+		}
+		a.So(relaxed.Err(), ShouldBeNil)
+		stored, _ = manager.Get("abp")
+		a.So(stored.DisableFCntCheck, ShouldBeFalse)
+		a.So(stored.Description, ShouldEqual, "changed")
+		a.So(logs.find("Action", "revert frame counter check"), ShouldHaveLength, 1)
+	}
+
+	{
+		dev, _ := manager.Get("abp")
+		relaxed, err := dev.RelaxFCntCheck(time.Hour)
+		a.So(err, ShouldBeNil)
+		a.So(relaxed.Revert(), ShouldBeNil)
+		a.So(relaxed.Revert(), ShouldBeNil)
+		stored, _ = manager.Get("abp")
+		a.So(stored.DisableFCntCheck, ShouldBeFalse)
+	}
+
+	{
+		// Failed reverts are retried
+		flaky := &flakyDeviceManager{memoryDeviceManager: manager}
+		dev, _ := manager.Get("abp")
+		dev.deviceManager = flaky
+		relaxed, err := dev.RelaxFCntCheck(time.Hour, RelaxFCntCheckOptions{Attempts: 3, Backoff: time.Millisecond})
+		a.So(err, ShouldBeNil)
+		flaky.failNext(2, errors.New("unavailable"))
+		a.So(relaxed.Revert(), ShouldBeNil)
+		stored, _ = manager.Get("abp")
+		a.So(stored.DisableFCntCheck, ShouldBeFalse)
+		a.So(logs.find("Attempt", 3), ShouldHaveLength, 1)
+	}
+
+	{
+		// Reverts that keep failing are reported
+		flaky := &flakyDeviceManager{memoryDeviceManager: manager}
+		dev, _ := manager.Get("abp")
+		dev.deviceManager = flaky
+		revertErr := errors.New("unavailable")
+		reported := make(chan error, 1)
+		relaxed, err := dev.RelaxFCntCheck(10*time.Millisecond, RelaxFCntCheckOptions{
+			Attempts: 2,
+			Backoff:  time.Millisecond,
+			OnRevertError: func(r *RelaxedFCntCheck, err error) {
+				a.So(r.Err(), ShouldEqual, err)
+				reported <- err
+			},
+		})
+		a.So(err, ShouldBeNil)
+		flaky.failNext(2, revertErr)
+		select {
+		case err := <-reported:
+			a.So(err, ShouldEqual, revertErr)
+		case <-time.After(time.Second):
+			t.Fatal("Failed revert was not reported")
+		}
+		a.So(relaxed.Err(), ShouldEqual, revertErr)
+		stored, _ = manager.Get("abp")
+		a.So(stored.DisableFCntCheck, ShouldBeTrue)
+
+		// Without OnRevertError, the failure is logged as an error
+		dev, _ = manager.Get("abp")
+		dev.deviceManager = flaky
+		relaxed, err = dev.RelaxFCntCheck(time.Hour, RelaxFCntCheckOptions{Attempts: 1})
+		a.So(err, ShouldBeNil)
+		flaky.failNext(1, revertErr)
+		a.So(relaxed.Revert(), ShouldEqual, revertErr)
+		a.So(logs.contains("still disabled"), ShouldBeTrue)
+		a.So(relaxed.Revert(), ShouldEqual, revertErr)
+	}
+
+	a.So(func() { new(Device).ResetFrameCounters() }, ShouldPanic)
+}
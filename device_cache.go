@@ -0,0 +1,310 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/ttn/core/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultDeviceCacheTTL is the time that devices are cached if no TTL is given in the options
+var DefaultDeviceCacheTTL = 5 * time.Minute
+
+// DefaultDeviceCacheSize is the maximum number of cached devices if no size is given in the options
+var DefaultDeviceCacheSize = 1000
+
+// DeviceCacheOptions contains the options for NewCachingDeviceManager
+type DeviceCacheOptions struct {
+	// The time that a device is cached (in the default config, this is DefaultDeviceCacheTTL)
+	TTL time.Duration
+
+	// The maximum number of cached devices (in the default config, this is DefaultDeviceCacheSize). When the cache is
+	// full, the device that was used least recently is removed.
+	Size int
+}
+
+type deviceCacheEntry struct {
+	devID   string
+	device  *Device
+	expires time.Time
+}
+
+// deviceCache is the cache that is shared by a CachingDeviceManager and its views
+type deviceCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+	hits    uint64
+	misses  uint64
+
+	// generation is incremented when devices are invalidated, so that devices that were retrieved before they were
+	// invalidated are not added to the cache
+	generation uint64
+}
+
+func (c *deviceCache) get(devID string) (dev *Device, generation uint64) {
+	c.Lock()
+	defer c.Unlock()
+	element, ok := c.entries[devID]
+	if !ok {
+		c.misses++
+		return nil, c.generation
+	}
+	entry := element.Value.(*deviceCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(element)
+		delete(c.entries, devID)
+		c.misses++
+		return nil, c.generation
+	}
+	c.lru.MoveToFront(element)
+	c.hits++
+	return cloneDevice(entry.device), c.generation
+}
+
+// set adds the device to the cache, unless devices were invalidated since the given generation
+func (c *deviceCache) set(dev *Device, generation uint64) {
+	c.Lock()
+	defer c.Unlock()
+	if generation != c.generation {
+		return
+	}
+	entry := &deviceCacheEntry{
+		devID:   dev.DevID,
+		device:  cloneDevice(dev),
+		expires: time.Now().Add(c.ttl),
+	}
+	entry.device.deviceManager = nil
+	if element, ok := c.entries[dev.DevID]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[dev.DevID] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*deviceCacheEntry).devID)
+	}
+}
+
+func (c *deviceCache) invalidate(devID string) {
+	c.Lock()
+	defer c.Unlock()
+	c.generation++
+	if element, ok := c.entries[devID]; ok {
+		c.lru.Remove(element)
+		delete(c.entries, devID)
+	}
+}
+
+func (c *deviceCache) purge() {
+	c.Lock()
+	defer c.Unlock()
+	c.generation++
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// cloneDevice returns a copy of the device that does not share attributes or keys with the original
+func cloneDevice(dev *Device) *Device {
+	clone := *dev
+	if dev.Attributes != nil {
+		clone.Attributes = make(map[string]string, len(dev.Attributes))
+		for key, value := range dev.Attributes {
+			clone.Attributes[key] = value
+		}
+	}
+	if dev.DevAddr != nil {
+		devAddr := *dev.DevAddr
+		clone.DevAddr = &devAddr
+	}
+	if dev.NwkSKey != nil {
+		nwkSKey := *dev.NwkSKey
+		clone.NwkSKey = &nwkSKey
+	}
+	if dev.AppSKey != nil {
+		appSKey := *dev.AppSKey
+		clone.AppSKey = &appSKey
+	}
+	if dev.AppKey != nil {
+		appKey := *dev.AppKey
+		clone.AppKey = &appKey
+	}
+	return &clone
+}
+
+// CachingDeviceManager is a DeviceManager that caches the devices that are retrieved with Get. Devices that are changed
+// or deleted through the CachingDeviceManager are removed from the cache. Changes that are made in other ways, for
+// example by other clients or by the network when a device joins, are only seen after the TTL has passed, unless the
+// device is invalidated with Invalidate or InvalidateOnActivations. Keep in mind that calling Update() on an outdated
+// device also saves its outdated fields, such as the frame counters.
+type CachingDeviceManager struct {
+	ctx     context.Context // Set for views that are returned by WithContext
+	manager DeviceManager
+	cache   *deviceCache
+}
+
+// NewCachingDeviceManager returns a CachingDeviceManager that wraps the given DeviceManager
+func NewCachingDeviceManager(manager DeviceManager, options DeviceCacheOptions) *CachingDeviceManager {
+	if options.TTL <= 0 {
+		options.TTL = DefaultDeviceCacheTTL
+	}
+	if options.Size <= 0 {
+		options.Size = DefaultDeviceCacheSize
+	}
+	return &CachingDeviceManager{
+		manager: manager,
+		cache: &deviceCache{
+			ttl:     options.TTL,
+			size:    options.Size,
+			entries: make(map[string]*list.Element),
+			lru:     list.New(),
+		},
+	}
+}
+
+// List implements DeviceManager. The result of List is not cached.
+func (c *CachingDeviceManager) List(limit, offset uint64) (DeviceList, error) {
+	return c.manager.List(limit, offset)
+}
+
+// Get implements DeviceManager. If the device is in the cache, it is returned without a request to the server.
+func (c *CachingDeviceManager) Get(devID string) (*Device, error) {
+	dev, generation := c.cache.get(devID)
+	if dev != nil {
+		dev.deviceManager = c
+		return dev, nil
+	}
+	dev, err := c.manager.Get(devID)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.set(dev, generation)
+	dev.deviceManager = c
+	return dev, nil
+}
+
+// Set implements DeviceManager. The device is removed from the cache.
+func (c *CachingDeviceManager) Set(dev *Device) error {
+	defer c.cache.invalidate(dev.DevID)
+	return c.manager.Set(dev)
+}
+
+// Delete implements DeviceManager. The device is removed from the cache.
+func (c *CachingDeviceManager) Delete(devID string) error {
+	defer c.cache.invalidate(devID)
+	return c.manager.Delete(devID)
+}
+
+// CreateFromTemplate implements DeviceManager. The device is removed from the cache.
+func (c *CachingDeviceManager) CreateFromTemplate(template string, overrides Device) (*Device, error) {
+	defer c.cache.invalidate(overrides.DevID)
+	return c.manager.CreateFromTemplate(template, overrides)
+}
+
+func (c *CachingDeviceManager) requestDevAddr(constraints []string) (types.DevAddr, error) {
+	if manager, ok := c.manager.(devAddrRequester); ok {
+		return manager.requestDevAddr(constraints)
+	}
+	return types.DevAddr{}, errors.New("ttn-sdk: you can only personalize devices on The Things Network")
+}
+
+func (c *CachingDeviceManager) auditLogger() log.Interface {
+	if manager, ok := c.manager.(auditLogger); ok {
+		return manager.auditLogger()
+	}
+	return log.Get()
+}
+
+// Query implements DeviceManager. Devices that are retrieved to match the query or with Get of the iterator are cached.
+func (c *CachingDeviceManager) Query(query DeviceQuery, pageSize uint64) *DeviceQueryIterator {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return queryDevices(ctx, c, query, pageSize)
+}
+
+// WithContext implements DeviceManager. The returned view shares the cache with c.
+func (c *CachingDeviceManager) WithContext(ctx context.Context) DeviceManager {
+	return &CachingDeviceManager{
+		ctx:     ctx,
+		manager: c.manager.WithContext(ctx),
+		cache:   c.cache,
+	}
+}
+
+// Warm adds the devices of the application to the cache, so that the next Get of these devices does not need a request
+// to the server. Because List does not return all fields of a device, the devices are listed page by page, and each
+// listed device is then retrieved with Get.
+func (c *CachingDeviceManager) Warm(ctx context.Context, pageSize uint64) error {
+	manager := c.WithContext(ctx)
+	it := NewDeviceIterator(ctx, c.manager, pageSize)
+	for it.Next() {
+		_, err := manager.Get(it.Device().DevID)
+		if status.Code(err) == codes.NotFound {
+			continue // The device was deleted after it was listed
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// Invalidate removes the device from the cache
+func (c *CachingDeviceManager) Invalidate(devID string) {
+	c.cache.invalidate(devID)
+}
+
+// Purge removes all devices from the cache
+func (c *CachingDeviceManager) Purge() {
+	c.cache.purge()
+}
+
+// Stats returns the number of cache hits and misses
+func (c *CachingDeviceManager) Stats() (hits, misses uint64) {
+	c.cache.Lock()
+	defer c.cache.Unlock()
+	return c.cache.hits, c.cache.misses
+}
+
+// InvalidateOnActivations subscribes to the activations of the DeviceSub, and removes devices from the cache when they
+// are activated, so that their new session is retrieved on the next Get. Use the AllDevices() of the ApplicationPubSub
+// to invalidate all devices of the application. The subscription ends when the DeviceSub is closed or unsubscribed.
+//
+// The activations of a DeviceSub are delivered on a single channel, so InvalidateOnActivations returns an error if the
+// activations of the DeviceSub are already subscribed to; the activations of this DeviceSub can then no longer be
+// received in other ways. Activations that do not fit in the buffer of the subscription also invalidate their device
+// (or the entire cache if the dropped activation can not be read back).
+func (c *CachingDeviceManager) InvalidateOnActivations(sub DeviceSub) error {
+	options := subscriptionOptionsWithOnDrop(sub, func(msg DroppedMessage) {
+		if activation, ok := msg.Message.(*types.Activation); ok {
+			c.cache.invalidate(activation.DevID)
+		} else {
+			c.cache.purge()
+		}
+	})
+	activations, err := subscribeActivationsExclusive(sub, []SubscriptionOptions{options})
+	if err != nil {
+		return err
+	}
+	go func() {
+		for activation := range activations {
+			c.cache.invalidate(activation.DevID)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,230 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/api/handler"
+	"github.com/TheThingsNetwork/api/protocol/lorawan"
+	"github.com/TheThingsNetwork/ttn/core/types"
+	. "github.com/smartystreets/assertions"
+)
+
+// activationSub is a DeviceSub that only supports activations
+type activationSub struct {
+	DeviceSub
+	activations chan *types.Activation
+	onDrop      func(DroppedMessage)
+}
+
+func (s *activationSub) SubscribeActivations(options ...SubscriptionOptions) (<-chan *types.Activation, error) {
+	if len(options) > 0 {
+		s.onDrop = options[0].OnDrop
+	}
+	return s.activations, nil
+}
+
+func TestCachingDeviceManager(t *testing.T) {
+	a := New(t)
+
+	devAddr := types.DevAddr{1, 2, 3, 4}
+	manager := newMemoryDeviceManager("test", "dev-1", "dev-2", "dev-3")
+	manager.devices[0].Attributes = map[string]string{"site": "amsterdam"}
+	manager.devices[0].FCntUp = 42
+
+	cache := NewCachingDeviceManager(manager, DeviceCacheOptions{TTL: 50 * time.Millisecond, Size: 2})
+
+	dev, err := cache.Get("dev-1")
+	a.So(err, ShouldBeNil)
+	a.So(dev.FCntUp, ShouldEqual, 42)
+	dev.Attributes["site"] = "changed" // Must not change the cached device
+
+	manager.devices[0].FCntUp = 43
+	dev, err = cache.Get("dev-1")
+	a.So(err, ShouldBeNil)
+	a.So(dev.FCntUp, ShouldEqual, 42)
+	a.So(dev.Attributes["site"], ShouldEqual, "amsterdam")
+	hits, misses := cache.Stats()
+	a.So(hits, ShouldEqual, 1)
+	a.So(misses, ShouldEqual, 1)
+
+	// Update through the cache invalidates the device
+	dev.Description = "updated"
+	a.So(dev.Update(), ShouldBeNil)
+	dev, _ = cache.Get("dev-1")
+	a.So(dev.Description, ShouldEqual, "updated")
+	a.So(dev.FCntUp, ShouldEqual, 42) // The update saved the cached frame counter
+
+	// The TTL expires
+	manager.devices[0].FCntUp = 44
+	time.Sleep(60 * time.Millisecond)
+	dev, _ = cache.Get("dev-1")
+	a.So(dev.FCntUp, ShouldEqual, 44)
+
+	// The size is limited, so dev-1 is removed when dev-3 is added
+	cache.Get("dev-2")
+	cache.Get("dev-3")
+	manager.devices[0].FCntUp = 45
+	dev, _ = cache.Get("dev-1")
+	a.So(dev.FCntUp, ShouldEqual, 45)
+
+	// Delete invalidates the device
+	a.So(cache.Delete("dev-1"), ShouldBeNil)
+	_, err = cache.Get("dev-1")
+	a.So(err, ShouldNotBeNil)
+
+	// Warm adds the full devices, so Get does not need a request
+	cache.Purge()
+	a.So(cache.Warm(context.Background(), 1), ShouldBeNil)
+	hits, misses = cache.Stats()
+	dev, err = cache.Get("dev-3")
+	a.So(err, ShouldBeNil)
+	a.So(dev.DevID, ShouldEqual, "dev-3")
+	newHits, newMisses := cache.Stats()
+	a.So(newHits, ShouldEqual, hits+1)
+	a.So(newMisses, ShouldEqual, misses)
+
+	// Activations invalidate the device
+	sub := &activationSub{activations: make(chan *types.Activation)}
+	a.So(cache.InvalidateOnActivations(sub), ShouldBeNil)
+	dev, _ = cache.Get("dev-2")
+	a.So(dev.DevAddr, ShouldBeNil)
+	manager.devices[0].DevAddr = &devAddr
+	sub.activations <- &types.Activation{AppID: "test", DevID: "dev-2", DevAddr: devAddr}
+	close(sub.activations)
+	time.Sleep(10 * time.Millisecond)
+	dev, _ = cache.WithContext(context.Background()).Get("dev-2")
+	a.So(dev.DevAddr, ShouldResemble, &devAddr)
+
+	// Activations that are dropped also invalidate the device
+	dev, _ = cache.Get("dev-2")
+	manager.devices[0].DevAddr = nil
+	sub.onDrop(DroppedMessage{Subscription: "activations", Message: &types.Activation{AppID: "test", DevID: "dev-2"}})
+	dev, _ = cache.Get("dev-2")
+	a.So(dev.DevAddr, ShouldBeNil)
+}
+
+// blockingGetManager is a DeviceManager of which Get blocks until it is released
+type blockingGetManager struct {
+	DeviceManager
+	started chan struct{}
+	release chan struct{}
+}
+
+func (m *blockingGetManager) Get(devID string) (*Device, error) {
+	dev, err := m.DeviceManager.Get(devID)
+	m.started <- struct{}{}
+	<-m.release
+	return dev, err
+}
+
+func TestCachingDeviceManagerInvalidateDuringGet(t *testing.T) {
+	a := New(t)
+
+	manager := newMemoryDeviceManager("test", "dev-1")
+	manager.devices[0].FCntUp = 1
+	blocking := &blockingGetManager{DeviceManager: manager, started: make(chan struct{}), release: make(chan struct{})}
+	cache := NewCachingDeviceManager(blocking, DeviceCacheOptions{})
+
+	got := make(chan *Device)
+	go func() {
+		dev, _ := cache.Get("dev-1")
+		got <- dev
+	}()
+	<-blocking.started
+
+	// The device changes and is invalidated while the outdated device is being retrieved
+	manager.devices[0].FCntUp = 2
+	cache.Invalidate("dev-1")
+	close(blocking.release)
+	a.So((<-got).FCntUp, ShouldEqual, 1)
+
+	// The outdated device was not added to the cache
+	go func() { <-blocking.started }()
+	dev, err := cache.Get("dev-1")
+	a.So(err, ShouldBeNil)
+	a.So(dev.FCntUp, ShouldEqual, 2)
+}
+
+func TestCachingDeviceManagerPersonalize(t *testing.T) {
+	a := New(t)
+
+	logs := newRecordingLogger()
+	mock := new(mockApplicationManagerClient)
+	devMock := new(mockDevAddrManagerClient)
+	manager := &deviceManager{
+		logger:         logs,
+		client:         mock,
+		devAddrClient:  devMock,
+		getContext:     func(ctx context.Context) context.Context { return ctx },
+		requestTimeout: time.Second,
+		appID:          "test",
+	}
+	cache := NewCachingDeviceManager(manager, DeviceCacheOptions{})
+
+	mock.device = &handler.Device{
+		AppID:  "test",
+		DevID:  "dev-id",
+		Device: &handler.Device_LoRaWANDevice{LoRaWANDevice: &lorawan.Device{}},
+	}
+	dev, err := cache.Get("dev-id")
+	a.So(err, ShouldBeNil)
+
+	devMock.devAddrResponse = &lorawan.DevAddrResponse{DevAddr: types.DevAddr{1, 2, 3, 4}}
+	a.So(dev.PersonalizeRandom(), ShouldBeNil)
+	a.So(mock.device.GetLoRaWANDevice().DevAddr, ShouldResemble, &types.DevAddr{1, 2, 3, 4})
+
+	// Audit logs use the logger of the underlying manager
+	dev, err = cache.Get("dev-id")
+	a.So(err, ShouldBeNil)
+	a.So(dev.ResetFrameCounters(), ShouldBeNil)
+	a.So(logs.find("Action", "reset frame counters"), ShouldHaveLength, 1)
+}
+
+func TestCachingDeviceManagerInvalidateOnActivationsInUse(t *testing.T) {
+	a := New(t)
+
+	broker, err := newMockMQTTBroker()
+	a.So(err, ShouldBeNil)
+	defer broker.Close()
+
+	config := NewConfig("test", "", "")
+	config.MQTTAddress = "mqtt://" + broker.Addr().String()
+	client := config.NewClient("test", "")
+	defer client.Close()
+
+	pubsub, err := client.PubSub()
+	a.So(err, ShouldBeNil)
+	defer pubsub.Close()
+
+	cache := NewCachingDeviceManager(newMemoryDeviceManager("test", "dev-1"), DeviceCacheOptions{})
+
+	sub := pubsub.AllDevices()
+	a.So(cache.InvalidateOnActivations(sub), ShouldBeNil)
+	a.So(cache.InvalidateOnActivations(sub), ShouldNotBeNil)
+
+	other := pubsub.Device("dev-1")
+	_, err = other.SubscribeActivations()
+	a.So(err, ShouldBeNil)
+	a.So(cache.InvalidateOnActivations(other), ShouldNotBeNil)
+}
+
+func TestCachingDeviceManagerQueryContext(t *testing.T) {
+	a := New(t)
+
+	cache := NewCachingDeviceManager(newMemoryDeviceManager("test", "dev-1", "dev-2"), DeviceCacheOptions{})
+
+	it := cache.Query(DeviceQuery{}, 1)
+	a.So(it.Next(), ShouldBeTrue)
+
+	// Views query with their context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	it = cache.WithContext(ctx).Query(DeviceQuery{}, 1)
+	a.So(it.Next(), ShouldBeFalse)
+	a.So(it.Err(), ShouldEqual, context.Canceled)
+}
@@ -0,0 +1,429 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/TheThingsNetwork/api"
+	"github.com/TheThingsNetwork/ttn/core/types"
+)
+
+// DefaultDeviceImportConcurrency is the number of devices that ImportDevices saves concurrently if no concurrency is
+// given in the options
+var DefaultDeviceImportConcurrency = 10
+
+// DeviceImportMode determines how ImportDevices handles devices that already exist
+type DeviceImportMode int
+
+const (
+	// DeviceImportCreateOnly only creates new devices. Rows of devices that already exist fail.
+	DeviceImportCreateOnly DeviceImportMode = iota
+
+	// DeviceImportUpsert creates new devices and updates devices that already exist. When a device is updated, only the
+	// fields that are set in the import are changed.
+	DeviceImportUpsert
+)
+
+// DeviceImportOptions contains the options for ImportDevices
+type DeviceImportOptions struct {
+	Mode DeviceImportMode
+
+	// Validate the devices and check for collisions, but do not save the devices
+	DryRun bool
+
+	// The number of devices that are saved concurrently (in the default config, this is DefaultDeviceImportConcurrency)
+	Concurrency int
+
+	// The page size for listing the existing devices (in the default config, this is DefaultDevicePageSize)
+	PageSize uint64
+}
+
+// DeviceImportRow is a device that was parsed from an import file
+type DeviceImportRow struct {
+	// The number of the row in the file, starting at 1 for the first device. The header of a CSV file is not counted.
+	Row int
+
+	// The parsed device, or nil if the row could not be parsed
+	Device *Device
+
+	// The error that occurred while parsing or validating the row
+	Err error
+}
+
+// deviceImportColumns maps the normalized names of columns to the fields of a device
+var deviceImportColumns = map[string]string{
+	"devid":       "dev_id",
+	"deviceid":    "dev_id",
+	"description": "description",
+	"appeui":      "app_eui",
+	"joineui":     "app_eui",
+	"deveui":      "dev_eui",
+	"appkey":      "app_key",
+	"devaddr":     "dev_addr",
+	"nwkskey":     "nwk_s_key",
+	"appskey":     "app_s_key",
+	"latitude":    "latitude",
+	"lat":         "latitude",
+	"longitude":   "longitude",
+	"lon":         "longitude",
+	"lng":         "longitude",
+	"altitude":    "altitude",
+	"alt":         "altitude",
+}
+
+const deviceImportAttributePrefix = "attributes."
+
+// deviceImportField returns the device field for the name of a column, or an empty string if the column is not used
+func deviceImportField(column string) string {
+	column = strings.TrimSpace(column)
+	for _, prefix := range []string{"attributes.", "attribute.", "attr."} {
+		if strings.HasPrefix(strings.ToLower(column), prefix) {
+			return deviceImportAttributePrefix + column[len(prefix):]
+		}
+	}
+	normalized := strings.NewReplacer("_", "", "-", "", " ", "").Replace(strings.ToLower(column))
+	return deviceImportColumns[normalized]
+}
+
+// ParseDevicesCSV parses devices from a CSV file. The first row of the file must contain the names of the columns.
+// Columns are matched to device fields by name, ignoring case, spaces, dashes and underscores: dev_id, description,
+// app_eui (or join_eui), dev_eui, app_key, dev_addr, nwk_s_key, app_s_key, latitude, longitude and altitude.
+// Attributes are read from columns that are named "attributes." followed by the name of the attribute. The columns
+// argument can be used to map other column names to these names. Other columns are ignored.
+func ParseDevicesCSV(r io.Reader, columns map[string]string) ([]DeviceImportRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	fields := make([]string, len(header))
+	for i, column := range header {
+		if mapped, ok := columns[column]; ok {
+			column = mapped
+		}
+		fields[i] = deviceImportField(column)
+	}
+	var rows []DeviceImportRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return rows, err
+		}
+		values := make(map[string]string)
+		for i, value := range record {
+			if i < len(fields) && fields[i] != "" && value != "" {
+				values[fields[i]] = value
+			}
+		}
+		row := DeviceImportRow{Row: len(rows) + 1}
+		row.Device, row.Err = parseImportedDevice(values)
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// ParseDevicesJSON parses devices from a JSON file that contains an array of objects. The names of the fields are the
+// same as the JSON names of the fields of Device, the attributes are read from an "attributes" object.
+func ParseDevicesJSON(r io.Reader) ([]DeviceImportRow, error) {
+	var objects []map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&objects); err != nil {
+		return nil, err
+	}
+	rows := make([]DeviceImportRow, len(objects))
+	for i, object := range objects {
+		values := make(map[string]string)
+		for name, value := range object {
+			if attributes, ok := value.(map[string]interface{}); ok && name == "attributes" {
+				for key, value := range attributes {
+					values[deviceImportAttributePrefix+key] = jsonImportValue(value)
+				}
+				continue
+			}
+			if field := deviceImportField(name); field != "" && value != nil {
+				values[field] = jsonImportValue(value)
+			}
+		}
+		rows[i].Row = i + 1
+		rows[i].Device, rows[i].Err = parseImportedDevice(values)
+	}
+	return rows, nil
+}
+
+func jsonImportValue(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+var hexSeparators = strings.NewReplacer(":", "", "-", "", " ", "")
+
+// parseImportedDevice converts the values of a row to a device and validates the device
+func parseImportedDevice(values map[string]string) (*Device, error) {
+	dev := new(Device)
+	dev.DevID = strings.TrimSpace(values["dev_id"])
+	if !api.ValidID(dev.DevID) {
+		return nil, fmt.Errorf("ttn-sdk: invalid device ID \"%s\"", dev.DevID)
+	}
+	dev.Description = values["description"]
+	var err error
+	parseHex := func(field string, parse func(string) error) {
+		if value, ok := values[field]; ok && err == nil {
+			if parseErr := parse(hexSeparators.Replace(value)); parseErr != nil {
+				err = fmt.Errorf("ttn-sdk: invalid %s: %s", field, parseErr)
+			}
+		}
+	}
+	parseHex("dev_eui", func(value string) (err error) {
+		dev.DevEUI, err = types.ParseDevEUI(value)
+		return
+	})
+	parseHex("app_eui", func(value string) (err error) {
+		dev.AppEUI, err = types.ParseAppEUI(value)
+		return
+	})
+	parseHex("app_key", func(value string) error {
+		appKey, err := types.ParseAppKey(value)
+		dev.AppKey = &appKey
+		return err
+	})
+	parseHex("dev_addr", func(value string) error {
+		devAddr, err := types.ParseDevAddr(value)
+		dev.DevAddr = &devAddr
+		return err
+	})
+	parseHex("nwk_s_key", func(value string) error {
+		nwkSKey, err := types.ParseNwkSKey(value)
+		dev.NwkSKey = &nwkSKey
+		return err
+	})
+	parseHex("app_s_key", func(value string) error {
+		appSKey, err := types.ParseAppSKey(value)
+		dev.AppSKey = &appSKey
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dev.DevEUI.IsEmpty() {
+		return nil, errors.New("ttn-sdk: missing dev_eui")
+	}
+	if dev.AppEUI.IsEmpty() {
+		return nil, errors.New("ttn-sdk: missing app_eui")
+	}
+	if (dev.DevAddr != nil || dev.NwkSKey != nil || dev.AppSKey != nil) && (dev.DevAddr == nil || dev.NwkSKey == nil || dev.AppSKey == nil) {
+		return nil, errors.New("ttn-sdk: dev_addr, nwk_s_key and app_s_key must be given together")
+	}
+	for field, target := range map[string]*float32{"latitude": &dev.Latitude, "longitude": &dev.Longitude} {
+		if value, ok := values[field]; ok {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 32)
+			if err != nil {
+				return nil, fmt.Errorf("ttn-sdk: invalid %s: %s", field, err)
+			}
+			*target = float32(parsed)
+		}
+	}
+	if dev.Latitude < -90 || dev.Latitude > 90 || dev.Longitude < -180 || dev.Longitude > 180 {
+		return nil, errors.New("ttn-sdk: location out of range")
+	}
+	if value, ok := values["altitude"]; ok {
+		altitude, err := strconv.ParseInt(strings.TrimSpace(value), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("ttn-sdk: invalid altitude: %s", err)
+		}
+		dev.Altitude = int32(altitude)
+	}
+	for field, value := range values {
+		if strings.HasPrefix(field, deviceImportAttributePrefix) {
+			if dev.Attributes == nil {
+				dev.Attributes = make(map[string]string)
+			}
+			dev.Attributes[strings.TrimPrefix(field, deviceImportAttributePrefix)] = value
+		}
+	}
+	return dev, nil
+}
+
+// DeviceImportAction is the action that ImportDevices takes for a row
+type DeviceImportAction string
+
+// Actions of ImportDevices
+const (
+	DeviceImportSkip   DeviceImportAction = "skip"
+	DeviceImportCreate DeviceImportAction = "create"
+	DeviceImportUpdate DeviceImportAction = "update"
+)
+
+// DeviceImportResult is the result of importing a row
+type DeviceImportResult struct {
+	Row    int
+	DevID  string
+	Action DeviceImportAction
+
+	// The error that occurred while parsing, validating or saving the device
+	Err error
+}
+
+// DeviceImportReport is the result of ImportDevices
+type DeviceImportReport struct {
+	DryRun  bool
+	Results []DeviceImportResult
+}
+
+// Failed returns the results of the rows that failed
+func (r *DeviceImportReport) Failed() (failed []DeviceImportResult) {
+	for _, result := range r.Results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return
+}
+
+type deviceEUIs struct {
+	AppEUI types.AppEUI
+	DevEUI types.DevEUI
+}
+
+// mergeImportedDevice sets the fields of the existing device that are set in the imported device
+func mergeImportedDevice(existing, imported *Device) {
+	if imported.Description != "" {
+		existing.Description = imported.Description
+	}
+	existing.AppEUI, existing.DevEUI = imported.AppEUI, imported.DevEUI
+	if imported.AppKey != nil {
+		existing.AppKey = imported.AppKey
+	}
+	if imported.DevAddr != nil {
+		existing.DevAddr, existing.NwkSKey, existing.AppSKey = imported.DevAddr, imported.NwkSKey, imported.AppSKey
+	}
+	if imported.Latitude != 0 || imported.Longitude != 0 {
+		existing.Latitude, existing.Longitude = imported.Latitude, imported.Longitude
+	}
+	if imported.Altitude != 0 {
+		existing.Altitude = imported.Altitude
+	}
+	if len(imported.Attributes) > 0 && existing.Attributes == nil {
+		existing.Attributes = make(map[string]string)
+	}
+	for key, value := range imported.Attributes {
+		existing.Attributes[key] = value
+	}
+}
+
+// ImportDevices saves the devices of the rows with the DeviceManager. Before saving any device, it lists the existing
+// devices to detect collisions: rows fail if they have the same device ID or the same AppEUI and DevEUI as an earlier
+// row, if they have the AppEUI and DevEUI of another existing device, or if the device already exists and the mode is
+// DeviceImportCreateOnly. The returned error is only set if the existing devices could not be listed; errors of
+// individual rows are in the report.
+func ImportDevices(ctx context.Context, manager DeviceManager, rows []DeviceImportRow, options DeviceImportOptions) (*DeviceImportReport, error) {
+	existing, err := ListAllDevices(ctx, manager, options.PageSize)
+	if err != nil {
+		return nil, err
+	}
+	existingIDs := make(map[string]bool)
+	existingEUIs := make(map[deviceEUIs]string)
+	for _, dev := range existing {
+		existingIDs[dev.DevID] = true
+		existingEUIs[deviceEUIs{dev.AppEUI, dev.DevEUI}] = dev.DevID
+	}
+
+	report := &DeviceImportReport{DryRun: options.DryRun, Results: make([]DeviceImportResult, len(rows))}
+	importedIDs := make(map[string]int)
+	importedEUIs := make(map[deviceEUIs]int)
+	var pending []int
+	for i, row := range rows {
+		result := &report.Results[i]
+		result.Row, result.Action, result.Err = row.Row, DeviceImportSkip, row.Err
+		if row.Device == nil {
+			if result.Err == nil {
+				result.Err = errors.New("ttn-sdk: no device")
+			}
+			continue
+		}
+		if result.Err != nil {
+			continue
+		}
+		dev := row.Device
+		eui := deviceEUIs{dev.AppEUI, dev.DevEUI}
+		result.DevID = dev.DevID
+		switch {
+		case importedIDs[dev.DevID] > 0:
+			result.Err = fmt.Errorf("ttn-sdk: device ID %s is also used in row %d", dev.DevID, importedIDs[dev.DevID])
+		case importedEUIs[eui] > 0:
+			result.Err = fmt.Errorf("ttn-sdk: DevEUI %s is also used in row %d", dev.DevEUI, importedEUIs[eui])
+		case existingEUIs[eui] != "" && existingEUIs[eui] != dev.DevID:
+			result.Err = fmt.Errorf("ttn-sdk: DevEUI %s is already used by device %s", dev.DevEUI, existingEUIs[eui])
+		case existingIDs[dev.DevID] && options.Mode == DeviceImportCreateOnly:
+			result.Err = fmt.Errorf("ttn-sdk: device %s already exists", dev.DevID)
+		case existingIDs[dev.DevID]:
+			result.Action = DeviceImportUpdate
+		default:
+			result.Action = DeviceImportCreate
+		}
+		importedIDs[dev.DevID], importedEUIs[eui] = row.Row, row.Row
+		if result.Err == nil {
+			pending = append(pending, i)
+		}
+	}
+	if options.DryRun {
+		return report, nil
+	}
+
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultDeviceImportConcurrency
+	}
+	manager = manager.WithContext(ctx)
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				result := &report.Results[i]
+				if result.Err = ctx.Err(); result.Err != nil {
+					continue
+				}
+				dev := *rows[i].Device
+				if result.Action == DeviceImportUpdate {
+					existing, err := manager.Get(dev.DevID)
+					if err != nil {
+						result.Err = err
+						continue
+					}
+					mergeImportedDevice(existing, &dev)
+					result.Err = existing.Update()
+					continue
+				}
+				result.Err = manager.Set(&dev)
+			}
+		}()
+	}
+	for _, i := range pending {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	return report, nil
+}
@@ -0,0 +1,148 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/TheThingsNetwork/ttn/core/types"
+	. "github.com/smartystreets/assertions"
+)
+
+const testImportCSV = `Device ID,DevEUI,AppEUI,AppKey,Lat,Lon,Altitude,attributes.model,Batch
+dev-1,00-00-00-00-00-00-00-01,70B3D57EF0000001,00112233445566778899AABBCCDDEEFF,52.37,4.89,10,sensor-v1,b1
+dev-2,0000000000000002,70B3D57EF0000001,00112233445566778899AABBCCDDEEFF,,,,,b1
+Dev 3,0000000000000003,70B3D57EF0000001,00112233445566778899AABBCCDDEEFF,,,,,b1
+dev-4,00000000000004,70B3D57EF0000001,00112233445566778899AABBCCDDEEFF,,,,,b1
+dev-5,0000000000000005,,00112233445566778899AABBCCDDEEFF,,,,,b1
+dev-1,0000000000000006,70B3D57EF0000001,00112233445566778899AABBCCDDEEFF,,,,,b1
+dev-7,0000000000000001,70B3D57EF0000001,00112233445566778899AABBCCDDEEFF,,,,,b1
+dev-8,0000000000000008,70B3D57EF0000001,00112233445566778899AABBCCDDEEFF,,,,,b1
+dev-9,0000000000000009,70B3D57EF0000001,00112233445566778899AABBCCDDEEFF,,,,,b1
+`
+
+const testImportJSON = `[
+	{"dev_id": "dev-1", "dev_eui": "0000000000000001", "app_eui": "70B3D57EF0000001", "app_key": "00112233445566778899AABBCCDDEEFF", "latitude": 52.37, "attributes": {"model": "sensor-v1"}},
+	{"dev_id": "dev-2", "dev_eui": "0000000000000002", "app_eui": "70B3D57EF0000001", "dev_addr": "26000001"},
+	{"dev_id": "dev-3", "dev_eui": "0000000000000003", "app_eui": "70B3D57EF0000001", "altitude": 1.5}
+]`
+
+func TestParseDevices(t *testing.T) {
+	a := New(t)
+
+	{
+		rows, err := ParseDevicesCSV(strings.NewReader(testImportCSV), map[string]string{"Batch": "attributes.batch"})
+		a.So(err, ShouldBeNil)
+		a.So(rows, ShouldHaveLength, 9)
+		for _, row := range rows {
+			switch row.Row {
+			case 3, 4, 5:
+				a.So(row.Err, ShouldNotBeNil)
+				a.So(row.Device, ShouldBeNil)
+			default:
+				a.So(row.Err, ShouldBeNil)
+			}
+		}
+		dev := rows[0].Device
+		a.So(dev.DevID, ShouldEqual, "dev-1")
+		a.So(dev.DevEUI, ShouldEqual, types.DevEUI{0, 0, 0, 0, 0, 0, 0, 1})
+		a.So(dev.AppEUI, ShouldEqual, types.AppEUI{0x70, 0xB3, 0xD5, 0x7E, 0xF0, 0, 0, 1})
+		a.So(dev.AppKey, ShouldNotBeNil)
+		a.So(dev.AppKey[15], ShouldEqual, 0xFF)
+		a.So(dev.Latitude, ShouldAlmostEqual, 52.37, 0.0001)
+		a.So(dev.Longitude, ShouldAlmostEqual, 4.89, 0.0001)
+		a.So(dev.Altitude, ShouldEqual, 10)
+		a.So(dev.Attributes, ShouldResemble, map[string]string{"model": "sensor-v1", "batch": "b1"})
+		a.So(rows[1].Device.Attributes, ShouldResemble, map[string]string{"batch": "b1"})
+	}
+
+	{
+		rows, err := ParseDevicesJSON(strings.NewReader(testImportJSON))
+		a.So(err, ShouldBeNil)
+		a.So(rows, ShouldHaveLength, 3)
+		a.So(rows[0].Err, ShouldBeNil)
+		a.So(rows[0].Device.Attributes, ShouldResemble, map[string]string{"model": "sensor-v1"})
+		a.So(rows[0].Device.Latitude, ShouldAlmostEqual, 52.37, 0.0001)
+		a.So(rows[1].Err, ShouldNotBeNil) // dev_addr without session keys
+		a.So(rows[2].Err, ShouldNotBeNil) // invalid altitude
+	}
+
+	{
+		_, err := ParseDevicesJSON(strings.NewReader(`{}`))
+		a.So(err, ShouldNotBeNil)
+		_, err = ParseDevicesCSV(strings.NewReader(``), nil)
+		a.So(err, ShouldNotBeNil)
+	}
+}
+
+func TestImportDevices(t *testing.T) {
+	a := New(t)
+
+	rows, err := ParseDevicesCSV(strings.NewReader(testImportCSV), nil)
+	a.So(err, ShouldBeNil)
+
+	newManager := func() *memoryDeviceManager {
+		manager := newMemoryDeviceManager("test")
+		manager.devices = []*Device{
+			{SparseDevice: SparseDevice{DevID: "dev-8", DevEUI: types.DevEUI{0, 0, 0, 0, 0, 0, 0, 8}, AppEUI: types.AppEUI{0x70, 0xB3, 0xD5, 0x7E, 0xF0, 0, 0, 1}, Description: "existing"}, FCntUp: 42},
+			{SparseDevice: SparseDevice{DevID: "other", DevEUI: types.DevEUI{0, 0, 0, 0, 0, 0, 0, 9}, AppEUI: types.AppEUI{0x70, 0xB3, 0xD5, 0x7E, 0xF0, 0, 0, 1}}},
+		}
+		return manager
+	}
+
+	expectedErrors := map[int]bool{3: true, 4: true, 5: true, 6: true, 7: true, 9: true}
+
+	{
+		manager := newManager()
+		report, err := ImportDevices(context.Background(), manager, rows, DeviceImportOptions{DryRun: true})
+		a.So(err, ShouldBeNil)
+		a.So(report.DryRun, ShouldBeTrue)
+		a.So(report.Results, ShouldHaveLength, 9)
+		for _, result := range report.Results {
+			a.So(result.Err != nil, ShouldEqual, expectedErrors[result.Row] || result.Row == 8)
+		}
+		a.So(report.Results[0].Action, ShouldEqual, DeviceImportCreate)
+		a.So(report.Results[7].Action, ShouldEqual, DeviceImportSkip)
+		a.So(manager.devices, ShouldHaveLength, 2)
+	}
+
+	{
+		manager := newManager()
+		report, err := ImportDevices(context.Background(), manager, rows, DeviceImportOptions{Mode: DeviceImportUpsert, DryRun: true})
+		a.So(err, ShouldBeNil)
+		a.So(report.Results[7].Action, ShouldEqual, DeviceImportUpdate)
+		a.So(report.Results[7].Err, ShouldBeNil)
+		a.So(manager.devices, ShouldHaveLength, 2)
+	}
+
+	{
+		manager := newManager()
+		report, err := ImportDevices(context.Background(), manager, rows, DeviceImportOptions{Mode: DeviceImportUpsert, Concurrency: 2})
+		a.So(err, ShouldBeNil)
+		a.So(report.Failed(), ShouldHaveLength, len(expectedErrors))
+		for _, result := range report.Failed() {
+			a.So(expectedErrors[result.Row], ShouldBeTrue)
+		}
+		a.So(manager.devices, ShouldHaveLength, 4)
+
+		dev, err := manager.Get("dev-1")
+		a.So(err, ShouldBeNil)
+		a.So(dev.Attributes, ShouldResemble, map[string]string{"model": "sensor-v1"})
+
+		dev, err = manager.Get("dev-8")
+		a.So(err, ShouldBeNil)
+		a.So(dev.Description, ShouldEqual, "existing")
+		a.So(dev.FCntUp, ShouldEqual, 42)
+		a.So(dev.AppKey, ShouldNotBeNil)
+	}
+
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := ImportDevices(ctx, newManager(), rows, DeviceImportOptions{})
+		a.So(err, ShouldNotBeNil)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"context"
+)
+
+// DefaultDevicePageSize is the page size that is used by the DeviceIterator if no page size is given
+var DefaultDevicePageSize uint64 = 100
+
+// DeviceIterator iterates over the devices of an application, fetching them in pages with DeviceManager.List.
+//
+// If devices are created or deleted while iterating, the pages can shift. To detect this, the iterator fetches one
+// device of the previous page together with each page. Devices that were already returned are skipped and can be
+// inspected with Duplicates(). If devices before the current page were deleted, devices may have been skipped; this
+// is indicated by PossiblyMissing().
+//
+//   it := ttnsdk.NewDeviceIterator(ctx, manager, 100)
+//   for it.Next() {
+//     dev := it.Device()
+//   }
+//   if err := it.Err(); err != nil {
+//     ...
+//   }
+type DeviceIterator struct {
+	ctx      context.Context
+	manager  DeviceManager
+	pageSize uint64
+
+	offset uint64
+	anchor string
+	page   DeviceList
+	device *SparseDevice
+	end    bool
+	err    error
+
+	seen            map[string]struct{}
+	duplicates      []string
+	possiblyMissing bool
+}
+
+// NewDeviceIterator returns an iterator over the devices of the DeviceManager. The iterator stops when the context is
+// canceled. If the page size is 0, DefaultDevicePageSize is used.
+func NewDeviceIterator(ctx context.Context, manager DeviceManager, pageSize uint64) *DeviceIterator {
+	if pageSize == 0 {
+		pageSize = DefaultDevicePageSize
+	}
+	return &DeviceIterator{
+		ctx:      ctx,
+		manager:  manager.WithContext(ctx),
+		pageSize: pageSize,
+		seen:     make(map[string]struct{}),
+	}
+}
+
+// Next advances the iterator to the next device. It returns false when there are no more devices, or when an error
+// occurred.
+func (it *DeviceIterator) Next() bool {
+	it.device = nil
+	for it.err == nil {
+		if err := it.ctx.Err(); err != nil {
+			it.err = err
+			return false
+		}
+		if len(it.page) == 0 {
+			if it.end {
+				return false
+			}
+			it.fetch()
+			continue
+		}
+		dev := it.page[0]
+		it.page = it.page[1:]
+		if _, ok := it.seen[dev.DevID]; ok {
+			it.duplicates = append(it.duplicates, dev.DevID)
+			continue
+		}
+		it.seen[dev.DevID] = struct{}{}
+		it.device = dev
+		return true
+	}
+	return false
+}
+
+func (it *DeviceIterator) fetch() {
+	limit, offset := it.pageSize, it.offset
+	if it.anchor != "" {
+		limit, offset = limit+1, offset-1
+	}
+	page, err := it.manager.List(limit, offset)
+	if err != nil {
+		it.err = err
+		return
+	}
+	it.end = uint64(len(page)) < limit
+	it.offset = offset + uint64(len(page))
+	if it.anchor != "" {
+		found := false
+		for i, dev := range page {
+			if dev.DevID == it.anchor {
+				// The devices before the anchor were shifted into this page by devices that were created
+				page = append(page[:i], page[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			// Devices before this page were deleted, so devices may have been shifted into the previous page
+			it.possiblyMissing = true
+		}
+	}
+	if len(page) > 0 {
+		it.anchor = page[len(page)-1].DevID
+	}
+	it.page = page
+}
+
+// Device returns the current device
+func (it *DeviceIterator) Device() *SparseDevice {
+	return it.device
+}
+
+// Err returns the error that stopped the iterator, if any
+func (it *DeviceIterator) Err() error {
+	return it.err
+}
+
+// Duplicates returns the IDs of the devices that were returned by the server more than once. The duplicates are not
+// returned by the iterator.
+func (it *DeviceIterator) Duplicates() []string {
+	return it.duplicates
+}
+
+// PossiblyMissing indicates whether devices were deleted while iterating in a way that may have caused other devices
+// to be skipped.
+func (it *DeviceIterator) PossiblyMissing() bool {
+	return it.possiblyMissing
+}
+
+// ListAllDevices returns all devices of the DeviceManager, fetching them in pages of the given size
+func ListAllDevices(ctx context.Context, manager DeviceManager, pageSize uint64) (DeviceList, error) {
+	var devices DeviceList
+	it := NewDeviceIterator(ctx, manager, pageSize)
+	for it.Next() {
+		devices = append(devices, it.Device())
+	}
+	return devices, it.Err()
+}
@@ -0,0 +1,116 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/assertions"
+)
+
+func devIDs(devices DeviceList) (ids []string) {
+	for _, dev := range devices {
+		ids = append(ids, dev.DevID)
+	}
+	return
+}
+
+func TestDeviceIterator(t *testing.T) {
+	a := New(t)
+
+	var ids []string
+	for i := 0; i < 10; i++ {
+		ids = append(ids, fmt.Sprintf("dev-%d", i))
+	}
+
+	{
+		manager := newMemoryDeviceManager("test")
+		devices, err := ListAllDevices(context.Background(), manager, 3)
+		a.So(err, ShouldBeNil)
+		a.So(devices, ShouldBeEmpty)
+	}
+
+	for _, pageSize := range []uint64{0, 1, 3, 5, 10, 20} {
+		manager := newMemoryDeviceManager("test", ids...)
+		var requests int
+		manager.onList = func(limit, offset uint64) { requests++ }
+		it := NewDeviceIterator(context.Background(), manager, pageSize)
+		var devices DeviceList
+		for it.Next() {
+			devices = append(devices, it.Device())
+		}
+		a.So(it.Err(), ShouldBeNil)
+		a.So(devIDs(devices), ShouldResemble, ids)
+		a.So(it.Duplicates(), ShouldBeEmpty)
+		a.So(it.PossiblyMissing(), ShouldBeFalse)
+		a.So(it.Next(), ShouldBeFalse)
+		if pageSize == 3 {
+			a.So(requests, ShouldEqual, 4)
+		}
+	}
+
+	{
+		// Devices are created before the current page
+		manager := newMemoryDeviceManager("test", ids...)
+		var requests int
+		manager.onList = func(limit, offset uint64) {
+			requests++
+			if requests == 2 {
+				manager.Lock()
+				manager.devices = append([]*Device{{SparseDevice: SparseDevice{DevID: "new-1"}}, {SparseDevice: SparseDevice{DevID: "new-2"}}}, manager.devices...)
+				manager.Unlock()
+			}
+		}
+		it := NewDeviceIterator(context.Background(), manager, 3)
+		var devices DeviceList
+		for it.Next() {
+			devices = append(devices, it.Device())
+		}
+		a.So(it.Err(), ShouldBeNil)
+		a.So(devIDs(devices), ShouldResemble, ids)
+		a.So(it.Duplicates(), ShouldResemble, []string{"dev-0", "dev-1"})
+		a.So(it.PossiblyMissing(), ShouldBeFalse)
+	}
+
+	{
+		// Devices are deleted before the current page
+		manager := newMemoryDeviceManager("test", ids...)
+		var requests int
+		manager.onList = func(limit, offset uint64) {
+			requests++
+			if requests == 2 {
+				manager.Delete("dev-0")
+				manager.Delete("dev-1")
+			}
+		}
+		it := NewDeviceIterator(context.Background(), manager, 3)
+		var devices DeviceList
+		for it.Next() {
+			devices = append(devices, it.Device())
+		}
+		a.So(it.Err(), ShouldBeNil)
+		a.So(it.PossiblyMissing(), ShouldBeTrue)
+		a.So(devIDs(devices), ShouldNotContain, "dev-3")
+	}
+
+	{
+		manager := newMemoryDeviceManager("test", ids...)
+		manager.err = errors.New("some error")
+		_, err := ListAllDevices(context.Background(), manager, 3)
+		a.So(err, ShouldEqual, manager.err)
+	}
+
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		manager := newMemoryDeviceManager("test", ids...)
+		it := NewDeviceIterator(ctx, manager, 3)
+		a.So(it.Next(), ShouldBeTrue)
+		cancel()
+		a.So(it.Next(), ShouldBeFalse)
+		a.So(it.Err(), ShouldEqual, context.Canceled)
+	}
+}
@@ -31,6 +31,18 @@ type DeviceManager interface {
 
 	// Delete a device
 	Delete(devID string) error
+
+	// Create a device from the template with the given name in the DeviceTemplates of the ClientConfig. See
+	// DeviceTemplate.NewDevice for the fields that are taken from overrides. The created device is returned.
+	CreateFromTemplate(template string, overrides Device) (*Device, error)
+
+	// Query the devices in the application. The devices are listed page by page (if the page size is 0,
+	// DefaultDevicePageSize is used), and the returned iterator only returns the devices that match the query.
+	Query(query DeviceQuery, pageSize uint64) *DeviceQueryIterator
+
+	// WithContext returns a view of the DeviceManager that uses the given context as parent context of its requests.
+	// Devices that are retrieved from this view also use the context.
+	WithContext(ctx context.Context) DeviceManager
 }
 
 // DeviceList is a slice of *SparseDevice.
@@ -46,31 +58,75 @@ func (d DeviceList) AsDevices() []*Device {
 }
 
 func (c *client) ManageDevices() (DeviceManager, error) {
-	if err := c.connectHandler(); err != nil {
+	return c.manageDevices(context.Background())
+}
+
+func (c *client) manageDevices(ctx context.Context) (DeviceManager, error) {
+	if err := c.connectHandler(ctx); err != nil {
 		return nil, err
 	}
 	return &deviceManager{
+		ctx:            ctx,
 		logger:         c.Logger,
-		client:         handler.NewApplicationManagerClient(c.handler.conn),
-		devAddrClient:  lorawan.NewDevAddrManagerClient(c.handler.conn),
+		client:         &handlerClient{c},
+		devAddrClient:  &handlerClient{c},
 		getContext:     c.getContext,
 		requestTimeout: c.RequestTimeout,
+		templates:      c.DeviceTemplates,
+		codecs:         c.PayloadCodecs,
 		appID:          c.appID,
 	}, nil
 }
 
 type deviceManager struct {
+	ctx            context.Context
 	logger         log.Interface
 	client         handler.ApplicationManagerClient
 	devAddrClient  lorawan.DevAddrManagerClient
 	getContext     func(context.Context) context.Context
 	requestTimeout time.Duration
+	templates      *DeviceTemplateRegistry
+	codecs         *PayloadCodecRegistry // The cached attributes of devices are invalidated when they are set or deleted
 
 	appID string
 }
 
+func (d *deviceManager) WithContext(ctx context.Context) DeviceManager {
+	manager := *d
+	manager.ctx = ctx
+	return &manager
+}
+
+func (d *deviceManager) requestContext() (context.Context, context.CancelFunc) {
+	return requestContext(d.ctx, d.getContext, d.requestTimeout)
+}
+
+// devAddrRequester is implemented by the device managers that can request a DevAddr from the network
+type devAddrRequester interface {
+	requestDevAddr(constraints []string) (types.DevAddr, error)
+}
+
+func (d *deviceManager) requestDevAddr(constraints []string) (types.DevAddr, error) {
+	ctx, cancel := d.requestContext()
+	defer cancel()
+	res, err := d.devAddrClient.GetDevAddr(ctx, &lorawan.DevAddrRequest{Usage: constraints})
+	if err != nil {
+		return types.DevAddr{}, err
+	}
+	return res.DevAddr, nil
+}
+
+// auditLogger is implemented by the device managers that have a logger for the actions on their devices
+type auditLogger interface {
+	auditLogger() log.Interface
+}
+
+func (d *deviceManager) auditLogger() log.Interface {
+	return d.logger
+}
+
 func (d *deviceManager) List(limit, offset uint64) (devices DeviceList, err error) {
-	ctx, cancel := context.WithTimeout(d.getContext(context.Background()), d.requestTimeout)
+	ctx, cancel := d.requestContext()
 	defer cancel()
 	ctx = ttnctx.OutgoingContextWithLimitAndOffset(ctx, limit, offset)
 	res, err := d.client.GetDevicesForApplication(ctx, &handler.ApplicationIdentifier{AppID: d.appID})
@@ -86,7 +142,7 @@ func (d *deviceManager) List(limit, offset uint64) (devices DeviceList, err erro
 }
 
 func (d *deviceManager) Get(devID string) (*Device, error) {
-	ctx, cancel := context.WithTimeout(d.getContext(context.Background()), d.requestTimeout)
+	ctx, cancel := d.requestContext()
 	defer cancel()
 	res, err := d.client.GetDevice(ctx, &handler.DeviceIdentifier{AppID: d.appID, DevID: devID})
 	if err != nil {
@@ -103,19 +159,33 @@ func (d *deviceManager) Set(dev *Device) error {
 	}
 	req := new(handler.Device)
 	dev.toProto(req)
-	ctx, cancel := context.WithTimeout(d.getContext(context.Background()), d.requestTimeout)
+	ctx, cancel := d.requestContext()
 	defer cancel()
+	defer d.codecs.invalidateAttributes(d.appID, dev.DevID)
 	_, err := d.client.SetDevice(ctx, req) // TODO: fill dev from response and set deviceManager when the server actually returns the device
 	return err
 }
 
 func (d *deviceManager) Delete(devID string) error {
-	ctx, cancel := context.WithTimeout(d.getContext(context.Background()), d.requestTimeout)
+	ctx, cancel := d.requestContext()
 	defer cancel()
+	defer d.codecs.invalidateAttributes(d.appID, devID)
 	_, err := d.client.DeleteDevice(ctx, &handler.DeviceIdentifier{AppID: d.appID, DevID: devID})
 	return err
 }
 
+func (d *deviceManager) CreateFromTemplate(template string, overrides Device) (*Device, error) {
+	return createFromTemplate(d, d.templates, template, overrides)
+}
+
+func (d *deviceManager) Query(query DeviceQuery, pageSize uint64) *DeviceQueryIterator {
+	ctx := d.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return queryDevices(ctx, d, query, pageSize)
+}
+
 // SparseDevice contains most, but not all fields of the device. It's returned by List operations to save server resources
 type SparseDevice struct {
 	AppID       string            `json:"app_id"`
@@ -195,11 +265,14 @@ type Device struct {
 }
 
 func (d *Device) addActivationConstraint(c string) {
-	constraints := strings.Split(d.ActivationConstraints, ",")
-	for _, constraint := range constraints {
+	var constraints []string
+	for _, constraint := range strings.Split(d.ActivationConstraints, ",") {
 		if constraint == c {
 			return
 		}
+		if constraint != "" {
+			constraints = append(constraints, constraint)
+		}
 	}
 	constraints = append(constraints, c)
 	d.ActivationConstraints = strings.Join(constraints, ",")
@@ -260,19 +333,17 @@ func (d *Device) PersonalizeFunc(personalizeFunc func(types.DevAddr) (types.NwkS
 	if d.IsNew() {
 		panic("ttn-sdk: you can not update new devices. Use the Get() function to retrieve the device from the server first.")
 	}
-	manager, ok := d.deviceManager.(*deviceManager)
+	manager, ok := d.deviceManager.(devAddrRequester)
 	if !ok {
 		panic("ttn-sdk: you can only personalize devices on The Things Network")
 	}
 	d.addActivationConstraint("abp")
-	ctx, cancel := context.WithTimeout(manager.getContext(context.Background()), manager.requestTimeout)
-	defer cancel()
-	res, err := manager.devAddrClient.GetDevAddr(ctx, &lorawan.DevAddrRequest{Usage: strings.Split(d.ActivationConstraints, ",")})
+	devAddr, err := manager.requestDevAddr(strings.Split(d.ActivationConstraints, ","))
 	if err != nil {
 		return err
 	}
-	d.DevAddr = &res.DevAddr
-	nwkSKey, appSKey := personalizeFunc(res.DevAddr)
+	d.DevAddr = &devAddr
+	nwkSKey, appSKey := personalizeFunc(devAddr)
 	d.NwkSKey, d.AppSKey = &nwkSKey, &appSKey
 	return d.Update()
 }
@@ -33,6 +33,7 @@ func TestDeviceManager(t *testing.T) {
 		devAddrClient:  devMock,
 		getContext:     func(ctx context.Context) context.Context { return ctx },
 		requestTimeout: time.Second,
+		codecs:         NewPayloadCodecRegistry(),
 		appID:          "test",
 	}
 
@@ -97,6 +98,9 @@ func TestDeviceManager(t *testing.T) {
 		err := manager.Set(&Device{})
 		a.So(err, ShouldNotBeNil)
 
+		// Setting the device invalidates its cached attributes
+		manager.codecs.cacheAttributes("test", "dev-id", map[string]string{"type": "a"})
+
 		mock.reset()
 		err = manager.Set(&Device{
 			SparseDevice: SparseDevice{
@@ -113,6 +117,8 @@ func TestDeviceManager(t *testing.T) {
 		a.So(mock.device.GetLoRaWANDevice().AppEUI, ShouldResemble, types.AppEUI{1, 2, 3, 4, 5, 6, 7, 8})
 		a.So(mock.device.GetLoRaWANDevice().DevEUI, ShouldResemble, types.DevEUI{1, 2, 3, 4, 5, 6, 7, 8})
 		a.So(mock.device.GetLoRaWANDevice().FCntDown, ShouldEqual, 42)
+		_, ok := manager.codecs.cachedAttributes("test", "dev-id")
+		a.So(ok, ShouldBeFalse)
 	}
 
 	{
@@ -121,9 +127,12 @@ func TestDeviceManager(t *testing.T) {
 		err := manager.Delete("dev-id")
 		a.So(err, ShouldNotBeNil)
 
+		manager.codecs.cacheAttributes("test", "dev-id", map[string]string{"type": "a"})
 		mock.reset()
 		err = manager.Delete("dev-id")
 		a.So(err, ShouldBeNil)
+		_, ok := manager.codecs.cachedAttributes("test", "dev-id")
+		a.So(ok, ShouldBeFalse)
 		a.So(mock.deviceIdentifier, ShouldNotBeNil)
 		a.So(mock.deviceIdentifier.AppID, ShouldEqual, "test")
 		a.So(mock.deviceIdentifier.DevID, ShouldEqual, "dev-id")
@@ -187,4 +196,28 @@ func TestDeviceManager(t *testing.T) {
 		a.So(mock.deviceIdentifier.DevID, ShouldEqual, "dev-id")
 	}
 
+	{
+		type ctxKey struct{}
+		ctx := context.WithValue(context.Background(), ctxKey{}, "value")
+		ctxManager := manager.WithContext(ctx)
+
+		mock.reset()
+		mock.device = &handler.Device{DevID: "dev-id"}
+		device, err := ctxManager.Get("dev-id")
+		a.So(err, ShouldBeNil)
+		a.So(mock.ctx.Value(ctxKey{}), ShouldEqual, "value")
+		_, hasDeadline := mock.ctx.Deadline()
+		a.So(hasDeadline, ShouldBeTrue)
+
+		mock.reset()
+		err = device.Update()
+		a.So(err, ShouldBeNil)
+		a.So(mock.ctx.Value(ctxKey{}), ShouldEqual, "value")
+
+		// The original manager does not use the context
+		mock.reset()
+		err = manager.Delete("dev-id")
+		a.So(err, ShouldBeNil)
+		a.So(mock.ctx.Value(ctxKey{}), ShouldBeNil)
+	}
 }
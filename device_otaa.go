@@ -0,0 +1,142 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/TheThingsNetwork/go-utils/random"
+	"github.com/TheThingsNetwork/ttn/core/types"
+)
+
+// DevEUIPrefix is a DevEUI with a prefix length
+type DevEUIPrefix struct {
+	DevEUI types.DevEUI
+	Length int
+}
+
+var devEUIPrefixPattern = regexp.MustCompile("^([[:xdigit:]]{16})/([[:digit:]]+)$")
+
+// ParseDevEUIPrefix parses a DevEUI in prefix notation (70B3D57ED0000000/36) to a prefix
+func ParseDevEUIPrefix(prefixString string) (prefix DevEUIPrefix, err error) {
+	matches := devEUIPrefixPattern.FindStringSubmatch(prefixString)
+	if len(matches) != 3 {
+		return prefix, fmt.Errorf("ttn-sdk: invalid DevEUI prefix \"%s\"", prefixString)
+	}
+	devEUI, _ := types.ParseDevEUI(matches[1])  // errors handled in regexp
+	prefix.Length, _ = strconv.Atoi(matches[2]) // errors handled in regexp
+	if prefix.Length > 64 {
+		return prefix, fmt.Errorf("ttn-sdk: invalid DevEUI prefix length %d", prefix.Length)
+	}
+	prefix.DevEUI = prefix.apply(types.DevEUI{}, devEUI)
+	return prefix, nil
+}
+
+// String implements the fmt.Stringer interface
+func (prefix DevEUIPrefix) String() string {
+	return fmt.Sprintf("%s/%d", prefix.DevEUI.String(), prefix.Length)
+}
+
+// apply returns devEUI with the first Length bits replaced by the bits of prefixEUI
+func (prefix DevEUIPrefix) apply(devEUI, prefixEUI types.DevEUI) (prefixed types.DevEUI) {
+	k := uint(prefix.Length)
+	for i := range prefixed {
+		if k >= 8 {
+			prefixed[i] = prefixEUI[i]
+			k -= 8
+			continue
+		}
+		prefixed[i] = (prefixEUI[i] & ^byte(0xff>>k)) | (devEUI[i] & byte(0xff>>k))
+		k = 0
+	}
+	return
+}
+
+// Contains returns true if the DevEUI has the prefix
+func (prefix DevEUIPrefix) Contains(devEUI types.DevEUI) bool {
+	return prefix.apply(devEUI, prefix.DevEUI) == devEUI
+}
+
+// Random returns a random DevEUI with the prefix
+func (prefix DevEUIPrefix) Random() types.DevEUI {
+	var devEUI types.DevEUI
+	random.FillBytes(devEUI[:])
+	return prefix.apply(devEUI, prefix.DevEUI)
+}
+
+// ProvisionOTAARandom prepares the device for over-the-air activation with a randomly generated AppKey. This function
+// panics if this is a new device, so make sure you Get() the device first.
+func (d *Device) ProvisionOTAARandom() error {
+	var appKey types.AppKey
+	random.FillBytes(appKey[:])
+	return d.ProvisionOTAA(appKey)
+}
+
+// ProvisionOTAARandomWithPrefix is like ProvisionOTAARandom, but if the device does not have a DevEUI yet, it also
+// generates a random DevEUI with the given prefix.
+func (d *Device) ProvisionOTAARandomWithPrefix(devEUIPrefix DevEUIPrefix) error {
+	if d.DevEUI.IsEmpty() {
+		d.DevEUI = devEUIPrefix.Random()
+	}
+	return d.ProvisionOTAARandom()
+}
+
+// ProvisionOTAA prepares the device for over-the-air activation by setting the AppKey and adding the "otaa" activation
+// constraint. The device is saved with Update() if it is ready to join, see CheckJoinReady(). This function panics if
+// this is a new device, so make sure you Get() the device first.
+func (d *Device) ProvisionOTAA(appKey types.AppKey) error {
+	d.mustNotBeNew()
+	d.AppKey = &appKey
+	d.addActivationConstraint("otaa")
+	if err := d.CheckJoinReady(); err != nil {
+		return err
+	}
+	return d.Update()
+}
+
+// JoinError is returned by CheckJoinReady if the device can not join
+type JoinError struct {
+	DevID    string
+	Problems []string
+}
+
+func (e *JoinError) Error() string {
+	return fmt.Sprintf("ttn-sdk: device %s can not join: %s", e.DevID, strings.Join(e.Problems, ", "))
+}
+
+var emptyAppKey types.AppKey
+
+// CheckJoinReady checks whether the device is ready for over-the-air activation. It returns a *JoinError with the
+// problems that would prevent the device from joining.
+func (d *Device) CheckJoinReady() error {
+	var problems []string
+	if d.AppEUI.IsEmpty() {
+		problems = append(problems, "no AppEUI")
+	}
+	if d.DevEUI.IsEmpty() {
+		problems = append(problems, "no DevEUI")
+	}
+	if d.AppKey == nil || *d.AppKey == emptyAppKey {
+		problems = append(problems, "no AppKey")
+	}
+	var otaa, abp bool
+	for _, constraint := range strings.Split(d.ActivationConstraints, ",") {
+		switch constraint {
+		case "otaa":
+			otaa = true
+		case "abp":
+			abp = true
+		}
+	}
+	if abp && !otaa {
+		problems = append(problems, "activation constraints only allow ABP")
+	}
+	if len(problems) > 0 {
+		return &JoinError{DevID: d.DevID, Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"testing"
+
+	"github.com/TheThingsNetwork/ttn/core/types"
+	. "github.com/smartystreets/assertions"
+)
+
+func TestDevEUIPrefix(t *testing.T) {
+	a := New(t)
+
+	prefix, err := ParseDevEUIPrefix("70B3D57ED00000FF/36")
+	a.So(err, ShouldBeNil)
+	a.So(prefix.String(), ShouldEqual, "70B3D57ED0000000/36")
+	a.So(prefix.Contains(types.DevEUI{0x70, 0xB3, 0xD5, 0x7E, 0xD0, 1, 2, 3}), ShouldBeTrue)
+	a.So(prefix.Contains(types.DevEUI{0x70, 0xB3, 0xD5, 0x7E, 0xE0, 1, 2, 3}), ShouldBeFalse)
+	for i := 0; i < 10; i++ {
+		a.So(prefix.Contains(prefix.Random()), ShouldBeTrue)
+	}
+
+	for _, invalid := range []string{"", "70B3D57ED0000000", "70B3D57ED0000000/65", "70B3D57ED00000/36"} {
+		_, err := ParseDevEUIPrefix(invalid)
+		a.So(err, ShouldNotBeNil)
+	}
+}
+
+func TestProvisionOTAA(t *testing.T) {
+	a := New(t)
+
+	manager := newMemoryDeviceManager("test")
+	manager.devices = []*Device{
+		{SparseDevice: SparseDevice{DevID: "dev", AppEUI: types.AppEUI{1}}},
+	}
+
+	dev, err := manager.Get("dev")
+	a.So(err, ShouldBeNil)
+	err = dev.CheckJoinReady()
+	a.So(err, ShouldHaveSameTypeAs, &JoinError{})
+	a.So(err.(*JoinError).Problems, ShouldResemble, []string{"no DevEUI", "no AppKey"})
+
+	err = dev.ProvisionOTAARandom()
+	a.So(err, ShouldNotBeNil)
+	a.So(manager.devices[0].AppKey, ShouldBeNil)
+
+	prefix, _ := ParseDevEUIPrefix("70B3D57ED0000000/40")
+	a.So(dev.ProvisionOTAARandomWithPrefix(prefix), ShouldBeNil)
+	a.So(dev.CheckJoinReady(), ShouldBeNil)
+
+	stored, _ := manager.Get("dev")
+	a.So(prefix.Contains(stored.DevEUI), ShouldBeTrue)
+	a.So(stored.AppKey, ShouldNotBeNil)
+	a.So(*stored.AppKey, ShouldNotEqual, types.AppKey{})
+	a.So(stored.ActivationConstraints, ShouldEqual, "otaa")
+
+	stored.ActivationConstraints = "abp"
+	a.So(stored.CheckJoinReady(), ShouldNotBeNil)
+	stored.addActivationConstraint("otaa")
+	a.So(stored.ActivationConstraints, ShouldEqual, "abp,otaa")
+	a.So(stored.CheckJoinReady(), ShouldBeNil)
+
+	a.So(func() { new(Device).ProvisionOTAARandom() }, ShouldPanic)
+}
@@ -0,0 +1,248 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/TheThingsNetwork/ttn/core/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AttributeOperator is the comparison of an AttributeFilter
+type AttributeOperator int
+
+const (
+	// AttributeEquals matches devices that have the attribute with the given value
+	AttributeEquals AttributeOperator = iota
+
+	// AttributeHasPrefix matches devices that have the attribute with a value that starts with the given value
+	AttributeHasPrefix
+
+	// AttributeExists matches devices that have the attribute, regardless of its value
+	AttributeExists
+
+	// AttributeNotExists matches devices that do not have the attribute
+	AttributeNotExists
+)
+
+// AttributeFilter filters devices on the value of an attribute
+type AttributeFilter struct {
+	Key      string
+	Operator AttributeOperator
+	Value    string
+}
+
+func (f AttributeFilter) match(attributes map[string]string) bool {
+	value, ok := attributes[f.Key]
+	switch f.Operator {
+	case AttributeEquals:
+		return ok && value == f.Value
+	case AttributeHasPrefix:
+		return ok && strings.HasPrefix(value, f.Value)
+	case AttributeExists:
+		return ok
+	case AttributeNotExists:
+		return !ok
+	}
+	return false
+}
+
+// DevAddrFilter filters devices on whether they have a DevAddr
+type DevAddrFilter int
+
+const (
+	// DevAddrAny matches all devices
+	DevAddrAny DevAddrFilter = iota
+
+	// DevAddrPresent matches devices that have a DevAddr, meaning that they are personalized or joined
+	DevAddrPresent
+
+	// DevAddrAbsent matches devices that do not have a DevAddr
+	DevAddrAbsent
+)
+
+// BoundingBox is an area on the map. If MinLongitude is larger than MaxLongitude, the box crosses the antimeridian.
+type BoundingBox struct {
+	MinLatitude  float32
+	MinLongitude float32
+	MaxLatitude  float32
+	MaxLongitude float32
+}
+
+// Contains returns true if the location is in the bounding box
+func (b BoundingBox) Contains(latitude, longitude float32) bool {
+	if latitude < b.MinLatitude || latitude > b.MaxLatitude {
+		return false
+	}
+	if b.MinLongitude <= b.MaxLongitude {
+		return longitude >= b.MinLongitude && longitude <= b.MaxLongitude
+	}
+	return longitude >= b.MinLongitude || longitude <= b.MaxLongitude
+}
+
+// DeviceQuery selects devices of an application. A device matches the query if it matches all filters that are set.
+type DeviceQuery struct {
+	Attributes []AttributeFilter
+
+	DevEUI *types.DevEUI
+	AppEUI *types.AppEUI
+
+	DevAddr DevAddrFilter
+
+	// Only devices with a location in the bounding box match. Devices without location (latitude and longitude are
+	// both zero) never match.
+	BoundingBox *BoundingBox
+
+	// Only devices that were last seen in this range match (both are optional). Filtering on LastSeen requires a Get
+	// for each device that matches the other filters.
+	LastSeenAfter  time.Time
+	LastSeenBefore time.Time
+}
+
+func (q *DeviceQuery) needsDevice() bool {
+	return !q.LastSeenAfter.IsZero() || !q.LastSeenBefore.IsZero()
+}
+
+// MatchSparse returns true if the device matches all filters of the query, except for the LastSeen range
+func (q *DeviceQuery) MatchSparse(dev *SparseDevice) bool {
+	for _, filter := range q.Attributes {
+		if !filter.match(dev.Attributes) {
+			return false
+		}
+	}
+	if q.DevEUI != nil && dev.DevEUI != *q.DevEUI {
+		return false
+	}
+	if q.AppEUI != nil && dev.AppEUI != *q.AppEUI {
+		return false
+	}
+	switch q.DevAddr {
+	case DevAddrPresent:
+		if dev.DevAddr == nil || dev.DevAddr.IsEmpty() {
+			return false
+		}
+	case DevAddrAbsent:
+		if dev.DevAddr != nil && !dev.DevAddr.IsEmpty() {
+			return false
+		}
+	}
+	if q.BoundingBox != nil {
+		if dev.Latitude == 0 && dev.Longitude == 0 {
+			return false
+		}
+		if !q.BoundingBox.Contains(dev.Latitude, dev.Longitude) {
+			return false
+		}
+	}
+	return true
+}
+
+// Match returns true if the device matches all filters of the query
+func (q *DeviceQuery) Match(dev *Device) bool {
+	if !q.MatchSparse(&dev.SparseDevice) {
+		return false
+	}
+	if !q.LastSeenAfter.IsZero() && !dev.LastSeen.After(q.LastSeenAfter) {
+		return false
+	}
+	if !q.LastSeenBefore.IsZero() && !dev.LastSeen.Before(q.LastSeenBefore) {
+		return false
+	}
+	return true
+}
+
+// DeviceQueryIterator iterates over the devices that match a DeviceQuery. Devices are fetched page by page, so the
+// application is never loaded into memory at once.
+//
+//   it := manager.Query(ttnsdk.DeviceQuery{
+//     Attributes: []ttnsdk.AttributeFilter{{Key: "site", Value: "amsterdam"}},
+//   }, 0)
+//   for it.Next() {
+//     dev := it.Device()
+//   }
+//   if err := it.Err(); err != nil {
+//     ...
+//   }
+type DeviceQueryIterator struct {
+	query   DeviceQuery
+	manager DeviceManager
+	devices *DeviceIterator
+	sparse  *SparseDevice
+	device  *Device
+	err     error
+}
+
+// queryDevices returns an iterator over the devices of the DeviceManager that match the query. If the page size is 0,
+// DefaultDevicePageSize is used.
+func queryDevices(ctx context.Context, manager DeviceManager, query DeviceQuery, pageSize uint64) *DeviceQueryIterator {
+	return &DeviceQueryIterator{
+		query:   query,
+		manager: manager.WithContext(ctx),
+		devices: NewDeviceIterator(ctx, manager, pageSize),
+	}
+}
+
+// Next advances the iterator to the next matching device. It returns false when there are no more devices, or when an
+// error occurred.
+func (it *DeviceQueryIterator) Next() bool {
+	it.sparse, it.device = nil, nil
+	for it.err == nil && it.devices.Next() {
+		sparse := it.devices.Device()
+		if !it.query.MatchSparse(sparse) {
+			continue
+		}
+		if !it.query.needsDevice() {
+			it.sparse = sparse
+			return true
+		}
+		dev, err := it.manager.Get(sparse.DevID)
+		if status.Code(err) == codes.NotFound {
+			continue // The device was deleted after it was listed
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if it.query.Match(dev) {
+			it.sparse, it.device = &dev.SparseDevice, dev
+			return true
+		}
+	}
+	return false
+}
+
+// Device returns the fields of the current device that are also returned by List
+func (it *DeviceQueryIterator) Device() *SparseDevice {
+	return it.sparse
+}
+
+// Get returns all fields of the current device. If the query filters on LastSeen, this is the device that was already
+// retrieved to match the query; otherwise the device is retrieved with Get of the DeviceManager. The returned device can
+// be updated and deleted.
+func (it *DeviceQueryIterator) Get() (*Device, error) {
+	if it.sparse == nil {
+		return nil, errors.New("ttn-sdk: no current device, call Next() first")
+	}
+	if it.device == nil {
+		dev, err := it.manager.Get(it.sparse.DevID)
+		if err != nil {
+			return nil, err
+		}
+		it.device = dev
+	}
+	return it.device, nil
+}
+
+// Err returns the error that stopped the iterator, if any
+func (it *DeviceQueryIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.devices.Err()
+}
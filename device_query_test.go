@@ -0,0 +1,95 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/ttn/core/types"
+	. "github.com/smartystreets/assertions"
+)
+
+func TestQueryDevices(t *testing.T) {
+	a := New(t)
+
+	devAddr := types.DevAddr{1, 2, 3, 4}
+	now := time.Now()
+	manager := newMemoryDeviceManager("test")
+	manager.devices = []*Device{
+		{SparseDevice: SparseDevice{DevID: "ams-1", DevEUI: types.DevEUI{1}, AppEUI: types.AppEUI{1}, DevAddr: &devAddr, Latitude: 52.37, Longitude: 4.89, Attributes: map[string]string{"site": "amsterdam", "firmware": "1.2.0"}}, LastSeen: now.Add(-time.Minute)},
+		{SparseDevice: SparseDevice{DevID: "ams-2", DevEUI: types.DevEUI{2}, AppEUI: types.AppEUI{1}, Latitude: 52.36, Longitude: 4.90, Attributes: map[string]string{"site": "amsterdam", "firmware": "1.1.0"}}, LastSeen: now.Add(-time.Hour)},
+		{SparseDevice: SparseDevice{DevID: "ber-1", DevEUI: types.DevEUI{3}, AppEUI: types.AppEUI{2}, DevAddr: &devAddr, Latitude: 52.52, Longitude: 13.40, Attributes: map[string]string{"site": "berlin"}}, LastSeen: now.Add(-24 * time.Hour)},
+		{SparseDevice: SparseDevice{DevID: "fiji", Latitude: -17.7, Longitude: 179.5}},
+		{SparseDevice: SparseDevice{DevID: "nowhere"}},
+	}
+
+	query := func(query DeviceQuery) []string {
+		var ids []string
+		it := manager.Query(query, 2)
+		for it.Next() {
+			ids = append(ids, it.Device().DevID)
+		}
+		a.So(it.Err(), ShouldBeNil)
+		return ids
+	}
+
+	devEUI, appEUI := types.DevEUI{2}, types.AppEUI{1}
+
+	a.So(query(DeviceQuery{}), ShouldHaveLength, 5)
+	a.So(query(DeviceQuery{Attributes: []AttributeFilter{{Key: "site", Value: "amsterdam"}}}), ShouldResemble, []string{"ams-1", "ams-2"})
+	a.So(query(DeviceQuery{Attributes: []AttributeFilter{{Key: "firmware", Operator: AttributeHasPrefix, Value: "1.2"}}}), ShouldResemble, []string{"ams-1"})
+	a.So(query(DeviceQuery{Attributes: []AttributeFilter{{Key: "firmware", Operator: AttributeExists}}}), ShouldResemble, []string{"ams-1", "ams-2"})
+	a.So(query(DeviceQuery{Attributes: []AttributeFilter{{Key: "site", Operator: AttributeNotExists}}}), ShouldResemble, []string{"fiji", "nowhere"})
+	a.So(query(DeviceQuery{Attributes: []AttributeFilter{
+		{Key: "site", Value: "amsterdam"},
+		{Key: "firmware", Operator: AttributeHasPrefix, Value: "1.1"},
+	}}), ShouldResemble, []string{"ams-2"})
+	a.So(query(DeviceQuery{DevEUI: &devEUI}), ShouldResemble, []string{"ams-2"})
+	a.So(query(DeviceQuery{AppEUI: &appEUI}), ShouldResemble, []string{"ams-1", "ams-2"})
+	a.So(query(DeviceQuery{DevAddr: DevAddrPresent}), ShouldResemble, []string{"ams-1", "ber-1"})
+	a.So(query(DeviceQuery{DevAddr: DevAddrAbsent}), ShouldResemble, []string{"ams-2", "fiji", "nowhere"})
+	a.So(query(DeviceQuery{BoundingBox: &BoundingBox{MinLatitude: 50, MinLongitude: 3, MaxLatitude: 54, MaxLongitude: 8}}), ShouldResemble, []string{"ams-1", "ams-2"})
+	a.So(query(DeviceQuery{BoundingBox: &BoundingBox{MinLatitude: -20, MinLongitude: 170, MaxLatitude: 0, MaxLongitude: -170}}), ShouldResemble, []string{"fiji"})
+	a.So(query(DeviceQuery{BoundingBox: &BoundingBox{MinLatitude: -1, MinLongitude: -1, MaxLatitude: 1, MaxLongitude: 1}}), ShouldBeEmpty)
+	a.So(query(DeviceQuery{LastSeenAfter: now.Add(-2 * time.Hour)}), ShouldResemble, []string{"ams-1", "ams-2"})
+	a.So(query(DeviceQuery{LastSeenAfter: now.Add(-48 * time.Hour), LastSeenBefore: now.Add(-30 * time.Minute)}), ShouldResemble, []string{"ams-2", "ber-1"})
+
+	{
+		it := manager.Query(DeviceQuery{LastSeenAfter: now.Add(-2 * time.Minute)}, 0)
+		_, err := it.Get()
+		a.So(err, ShouldNotBeNil)
+		a.So(it.Next(), ShouldBeTrue)
+		a.So(it.Device().DevID, ShouldEqual, "ams-1")
+		dev, err := it.Get()
+		a.So(err, ShouldBeNil)
+		a.So(dev.LastSeen, ShouldEqual, now.Add(-time.Minute))
+		a.So(it.Next(), ShouldBeFalse)
+	}
+
+	{
+		// The devices of the query can be updated and deleted
+		it := manager.Query(DeviceQuery{Attributes: []AttributeFilter{{Key: "site", Value: "berlin"}}}, 0)
+		a.So(it.Next(), ShouldBeTrue)
+		dev, err := it.Get()
+		a.So(err, ShouldBeNil)
+		a.So(dev.LastSeen, ShouldEqual, now.Add(-24*time.Hour))
+		dev.Description = "updated"
+		a.So(dev.Update(), ShouldBeNil)
+		stored, _ := manager.Get("ber-1")
+		a.So(stored.Description, ShouldEqual, "updated")
+		a.So(stored.LastSeen, ShouldEqual, now.Add(-24*time.Hour))
+		a.So(dev.Delete(), ShouldBeNil)
+		_, err = manager.Get("ber-1")
+		a.So(err, ShouldNotBeNil)
+	}
+
+	{
+		manager.err = errors.New("some error")
+		it := manager.Query(DeviceQuery{}, 0)
+		a.So(it.Next(), ShouldBeFalse)
+		a.So(it.Err(), ShouldNotBeNil)
+	}
+}
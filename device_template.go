@@ -0,0 +1,283 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/TheThingsNetwork/api"
+	"github.com/TheThingsNetwork/ttn/core/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// DeviceTemplateAttribute is the attribute that NewDevice sets to the name of the template. It is used to find the
+// template of a device when looking for drift.
+const DeviceTemplateAttribute = "template"
+
+// DeviceTemplate contains the settings that are shared by devices of the same model
+type DeviceTemplate struct {
+	Name                  string            `json:"name" yaml:"name"`
+	Description           string            `json:"description,omitempty" yaml:"description,omitempty"`
+	AppEUI                types.AppEUI      `json:"app_eui,omitempty" yaml:"app_eui,omitempty"`
+	ActivationConstraints string            `json:"activation_constraints,omitempty" yaml:"activation_constraints,omitempty"`
+	Uses32BitFCnt         bool              `json:"uses32_bit_f_cnt,omitempty" yaml:"uses32_bit_f_cnt,omitempty"`
+	DisableFCntCheck      bool              `json:"disable_f_cnt_check,omitempty" yaml:"disable_f_cnt_check,omitempty"`
+	Attributes            map[string]string `json:"attributes,omitempty" yaml:"attributes,omitempty"`
+}
+
+func (t *DeviceTemplate) validate() error {
+	if !api.ValidID(t.Name) {
+		return fmt.Errorf("ttn-sdk: invalid device template name \"%s\"", t.Name)
+	}
+	return nil
+}
+
+// NewDevice returns a new device with the settings of the template. The fields that are set in overrides, such as the
+// DevID, DevEUI and location, take precedence over the template, and the attributes of overrides are added to the
+// attributes of the template. Uses32BitFCnt and DisableFCntCheck are enabled if they are enabled in either the template
+// or overrides. The DeviceTemplateAttribute of the device is set to the name of the template.
+func (t *DeviceTemplate) NewDevice(overrides Device) *Device {
+	dev := &Device{
+		SparseDevice:          overrides.SparseDevice,
+		FCntUp:                overrides.FCntUp,
+		FCntDown:              overrides.FCntDown,
+		DisableFCntCheck:      t.DisableFCntCheck || overrides.DisableFCntCheck,
+		Uses32BitFCnt:         t.Uses32BitFCnt || overrides.Uses32BitFCnt,
+		ActivationConstraints: overrides.ActivationConstraints,
+	}
+	if dev.Description == "" {
+		dev.Description = t.Description
+	}
+	if dev.AppEUI.IsEmpty() {
+		dev.AppEUI = t.AppEUI
+	}
+	if dev.ActivationConstraints == "" {
+		dev.ActivationConstraints = t.ActivationConstraints
+	}
+	dev.Attributes = make(map[string]string, len(t.Attributes)+len(overrides.Attributes)+1)
+	for key, value := range t.Attributes {
+		dev.Attributes[key] = value
+	}
+	for key, value := range overrides.Attributes {
+		dev.Attributes[key] = value
+	}
+	dev.Attributes[DeviceTemplateAttribute] = t.Name
+	return dev
+}
+
+// Drift returns the fields of the device that differ from the template. Only the fields that are set in the template
+// are compared; Old is the value of the device and New is the value of the template.
+func (t *DeviceTemplate) Drift(dev *Device) (changes []FieldChange) {
+	change := func(field, old, new string) {
+		if old != new {
+			changes = append(changes, FieldChange{Field: field, Old: old, New: new})
+		}
+	}
+	if !t.AppEUI.IsEmpty() {
+		change("app_eui", keyString(dev.AppEUI, dev.AppEUI.IsEmpty()), t.AppEUI.String())
+	}
+	if t.ActivationConstraints != "" {
+		change("activation_constraints", dev.ActivationConstraints, t.ActivationConstraints)
+	}
+	if t.Uses32BitFCnt {
+		change("uses32_bit_f_cnt", strconv.FormatBool(dev.Uses32BitFCnt), "true")
+	}
+	if t.DisableFCntCheck {
+		change("disable_f_cnt_check", strconv.FormatBool(dev.DisableFCntCheck), "true")
+	}
+	keys := make([]string, 0, len(t.Attributes))
+	for key := range t.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		change("attributes."+key, dev.Attributes[key], t.Attributes[key])
+	}
+	return
+}
+
+// ParseDeviceTemplatesJSON parses device templates from JSON. The JSON can be a single template or an array of
+// templates.
+func ParseDeviceTemplatesJSON(r io.Reader) ([]*DeviceTemplate, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var templates []*DeviceTemplate
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(data, &templates)
+	} else {
+		template := new(DeviceTemplate)
+		err = json.Unmarshal(data, template)
+		templates = append(templates, template)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return templates, validateDeviceTemplates(templates)
+}
+
+// ParseDeviceTemplatesYAML parses device templates from YAML. The YAML can be a single template or a list of
+// templates.
+func ParseDeviceTemplatesYAML(r io.Reader) ([]*DeviceTemplate, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var templates []*DeviceTemplate
+	if err := yaml.UnmarshalStrict(data, &templates); err != nil {
+		template := new(DeviceTemplate)
+		if err := yaml.UnmarshalStrict(data, template); err != nil {
+			return nil, err
+		}
+		templates = []*DeviceTemplate{template}
+	}
+	return templates, validateDeviceTemplates(templates)
+}
+
+func validateDeviceTemplates(templates []*DeviceTemplate) error {
+	for _, template := range templates {
+		if template == nil {
+			return errors.New("ttn-sdk: empty device template")
+		}
+		if err := template.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeviceTemplateRegistry contains device templates by name. The DeviceTemplates of the ClientConfig are used by
+// DeviceManager.CreateFromTemplate.
+type DeviceTemplateRegistry struct {
+	mu        sync.RWMutex
+	templates map[string]*DeviceTemplate
+}
+
+// NewDeviceTemplateRegistry returns a new, empty DeviceTemplateRegistry
+func NewDeviceTemplateRegistry() *DeviceTemplateRegistry {
+	return &DeviceTemplateRegistry{
+		templates: make(map[string]*DeviceTemplate),
+	}
+}
+
+// Register the template, replacing any template with the same name
+func (r *DeviceTemplateRegistry) Register(template *DeviceTemplate) error {
+	if err := template.validate(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.templates[template.Name] = template
+	return nil
+}
+
+// LoadFile registers the templates in the file. Files with the .yml or .yaml extension are parsed as YAML, other files
+// are parsed as JSON.
+func (r *DeviceTemplateRegistry) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var templates []*DeviceTemplate
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		templates, err = ParseDeviceTemplatesYAML(file)
+	default:
+		templates, err = ParseDeviceTemplatesJSON(file)
+	}
+	if err != nil {
+		return fmt.Errorf("ttn-sdk: could not load device templates from %s: %s", path, err)
+	}
+	for _, template := range templates {
+		if err := r.Register(template); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Template returns the template with the given name, or nil if there is no such template
+func (r *DeviceTemplateRegistry) Template(name string) *DeviceTemplate {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.templates[name]
+}
+
+// NewDevice returns a new device with the settings of the template with the given name. See DeviceTemplate.NewDevice.
+func (r *DeviceTemplateRegistry) NewDevice(name string, overrides Device) (*Device, error) {
+	template := r.Template(name)
+	if template == nil {
+		return nil, fmt.Errorf("ttn-sdk: device template \"%s\" not found", name)
+	}
+	return template.NewDevice(overrides), nil
+}
+
+// createFromTemplate creates a device with the manager from the template with the given name in the registry, and
+// returns the created device
+func createFromTemplate(manager DeviceManager, templates *DeviceTemplateRegistry, name string, overrides Device) (*Device, error) {
+	dev, err := templates.NewDevice(name, overrides)
+	if err != nil {
+		return nil, err
+	}
+	if err := manager.Set(dev); err != nil {
+		return nil, err
+	}
+	return manager.Get(dev.DevID)
+}
+
+// DeviceDrift contains the fields of a device that differ from its template
+type DeviceDrift struct {
+	DevID    string
+	Template string
+	Fields   []FieldChange
+}
+
+// FindDrift compares the devices in the application with their templates, and returns the devices that differ. The
+// template of a device is found by the value of its DeviceTemplateAttribute; devices without that attribute, or with a
+// template that is not registered, are not compared.
+func (r *DeviceTemplateRegistry) FindDrift(ctx context.Context, manager DeviceManager) ([]DeviceDrift, error) {
+	manager = manager.WithContext(ctx)
+	var drift []DeviceDrift
+	it := NewDeviceIterator(ctx, manager, 0)
+	for it.Next() {
+		name := it.Device().Attributes[DeviceTemplateAttribute]
+		template := r.Template(name)
+		if template == nil {
+			continue
+		}
+		dev, err := manager.Get(it.Device().DevID)
+		if status.Code(err) == codes.NotFound {
+			continue // The device was deleted after it was listed
+		}
+		if err != nil {
+			return nil, err
+		}
+		if fields := template.Drift(dev); len(fields) > 0 {
+			drift = append(drift, DeviceDrift{DevID: dev.DevID, Template: name, Fields: fields})
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return drift, nil
+}
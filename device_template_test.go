@@ -0,0 +1,145 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/ttn/core/types"
+	. "github.com/smartystreets/assertions"
+)
+
+const testDeviceTemplatesYAML = `
+- name: sensor-v1
+  app_eui: 70B3D57EF0000001
+  activation_constraints: otaa
+  uses32_bit_f_cnt: true
+  attributes:
+    model: sensor
+    firmware: "1.0"
+- name: tracker
+  disable_f_cnt_check: true
+`
+
+const testDeviceTemplateJSON = `{"name": "gateway-probe", "description": "Probe", "attributes": {"model": "probe"}}`
+
+func TestDeviceTemplates(t *testing.T) {
+	a := New(t)
+
+	{
+		templates, err := ParseDeviceTemplatesYAML(strings.NewReader(testDeviceTemplatesYAML))
+		a.So(err, ShouldBeNil)
+		a.So(templates, ShouldHaveLength, 2)
+		a.So(templates[0].AppEUI, ShouldEqual, types.AppEUI{0x70, 0xB3, 0xD5, 0x7E, 0xF0, 0, 0, 1})
+		a.So(templates[0].Attributes, ShouldResemble, map[string]string{"model": "sensor", "firmware": "1.0"})
+		a.So(templates[1].DisableFCntCheck, ShouldBeTrue)
+
+		templates, err = ParseDeviceTemplatesYAML(strings.NewReader("name: single\nuses32_bit_f_cnt: true\n"))
+		a.So(err, ShouldBeNil)
+		a.So(templates, ShouldHaveLength, 1)
+		a.So(templates[0].Name, ShouldEqual, "single")
+
+		// EUIs that only contain digits are not decoded as numbers
+		templates, err = ParseDeviceTemplatesYAML(strings.NewReader("name: digits\napp_eui: 0102030405060708\n"))
+		a.So(err, ShouldBeNil)
+		a.So(templates[0].AppEUI, ShouldEqual, types.AppEUI{1, 2, 3, 4, 5, 6, 7, 8})
+
+		_, err = ParseDeviceTemplatesYAML(strings.NewReader("name: Invalid Name\n"))
+		a.So(err, ShouldNotBeNil)
+		_, err = ParseDeviceTemplatesYAML(strings.NewReader("name: typo\nuses_32bit: true\n"))
+		a.So(err, ShouldNotBeNil)
+	}
+
+	{
+		templates, err := ParseDeviceTemplatesJSON(strings.NewReader(testDeviceTemplateJSON))
+		a.So(err, ShouldBeNil)
+		a.So(templates, ShouldHaveLength, 1)
+		templates, err = ParseDeviceTemplatesJSON(strings.NewReader("[" + testDeviceTemplateJSON + "]"))
+		a.So(err, ShouldBeNil)
+		a.So(templates, ShouldHaveLength, 1)
+		a.So(templates[0].Description, ShouldEqual, "Probe")
+	}
+
+	dir, err := ioutil.TempDir("", "ttn-sdk")
+	a.So(err, ShouldBeNil)
+	defer os.RemoveAll(dir)
+	a.So(ioutil.WriteFile(filepath.Join(dir, "templates.yml"), []byte(testDeviceTemplatesYAML), 0644), ShouldBeNil)
+	a.So(ioutil.WriteFile(filepath.Join(dir, "probe.json"), []byte(testDeviceTemplateJSON), 0644), ShouldBeNil)
+
+	config := NewCommunityConfig("test")
+	registry := config.DeviceTemplates
+	a.So(registry.LoadFile(filepath.Join(dir, "templates.yml")), ShouldBeNil)
+	a.So(registry.LoadFile(filepath.Join(dir, "probe.json")), ShouldBeNil)
+	a.So(registry.LoadFile(filepath.Join(dir, "missing.json")), ShouldNotBeNil)
+	a.So(registry.Template("gateway-probe"), ShouldNotBeNil)
+
+	_, err = registry.NewDevice("unknown", Device{})
+	a.So(err, ShouldNotBeNil)
+
+	dev, err := registry.NewDevice("sensor-v1", Device{SparseDevice: SparseDevice{
+		DevID:      "sensor-1",
+		DevEUI:     types.DevEUI{1},
+		Latitude:   52.37,
+		Attributes: map[string]string{"firmware": "1.1", "site": "amsterdam"},
+	}})
+	a.So(err, ShouldBeNil)
+	a.So(dev.IsNew(), ShouldBeTrue)
+	a.So(dev.DevID, ShouldEqual, "sensor-1")
+	a.So(dev.AppEUI, ShouldEqual, types.AppEUI{0x70, 0xB3, 0xD5, 0x7E, 0xF0, 0, 0, 1})
+	a.So(dev.Latitude, ShouldEqual, 52.37)
+	a.So(dev.Uses32BitFCnt, ShouldBeTrue)
+	a.So(dev.ActivationConstraints, ShouldEqual, "otaa")
+	a.So(dev.Attributes, ShouldResemble, map[string]string{"model": "sensor", "firmware": "1.1", "site": "amsterdam", "template": "sensor-v1"})
+	a.So(registry.Template("sensor-v1").Attributes["firmware"], ShouldEqual, "1.0")
+
+	manager := newMemoryDeviceManager("test")
+	a.So(manager.Set(dev), ShouldBeNil)
+	dev, _ = registry.NewDevice("sensor-v1", Device{SparseDevice: SparseDevice{DevID: "sensor-2", Attributes: map[string]string{"firmware": "1.0"}}})
+	a.So(manager.Set(dev), ShouldBeNil)
+	dev, _ = registry.NewDevice("tracker", Device{SparseDevice: SparseDevice{DevID: "tracker-1"}})
+	a.So(manager.Set(dev), ShouldBeNil)
+	manager.devices = append(manager.devices, &Device{SparseDevice: SparseDevice{DevID: "other", Attributes: map[string]string{"template": "unknown"}}})
+
+	drift, err := registry.FindDrift(context.Background(), manager)
+	a.So(err, ShouldBeNil)
+	a.So(drift, ShouldHaveLength, 1)
+	a.So(drift[0].DevID, ShouldEqual, "sensor-1")
+	a.So(drift[0].Template, ShouldEqual, "sensor-v1")
+	a.So(drift[0].Fields, ShouldResemble, []FieldChange{{Field: "attributes.firmware", Old: "1.1", New: "1.0"}})
+
+	tracker, _ := manager.Get("tracker-1")
+	tracker.DisableFCntCheck = false
+	a.So(tracker.Update(), ShouldBeNil)
+	drift, err = registry.FindDrift(context.Background(), manager)
+	a.So(err, ShouldBeNil)
+	a.So(drift, ShouldHaveLength, 2)
+	a.So(drift[1].Fields, ShouldResemble, []FieldChange{{Field: "disable_f_cnt_check", Old: "false", New: "true"}})
+
+	// The DeviceManager creates devices from the templates of the ClientConfig
+	mock := new(mockApplicationManagerClient)
+	deviceManager := &deviceManager{
+		client:         mock,
+		getContext:     func(ctx context.Context) context.Context { return ctx },
+		requestTimeout: time.Second,
+		templates:      config.DeviceTemplates,
+		appID:          "test",
+	}
+	_, err = deviceManager.CreateFromTemplate("unknown", Device{SparseDevice: SparseDevice{DevID: "sensor-3"}})
+	a.So(err, ShouldNotBeNil)
+	a.So(mock.device, ShouldBeNil)
+
+	created, err := deviceManager.CreateFromTemplate("sensor-v1", Device{SparseDevice: SparseDevice{DevID: "sensor-3"}})
+	a.So(err, ShouldBeNil)
+	a.So(created.IsNew(), ShouldBeFalse)
+	a.So(created.DevID, ShouldEqual, "sensor-3")
+	a.So(created.AppEUI, ShouldEqual, types.AppEUI{0x70, 0xB3, 0xD5, 0x7E, 0xF0, 0, 0, 1})
+	a.So(created.Attributes["template"], ShouldEqual, "sensor-v1")
+	a.So(mock.device.DevID, ShouldEqual, "sensor-3")
+}
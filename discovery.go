@@ -5,37 +5,160 @@ package ttnsdk
 
 import (
 	"context"
+	"time"
 
 	"github.com/TheThingsNetwork/api/discovery"
+	"github.com/TheThingsNetwork/go-utils/log"
 	"google.golang.org/grpc"
 )
 
-func (c *client) discover() (err error) {
+func (c *client) connectDiscovery(ctx context.Context) (conn *grpc.ClientConn, err error) {
+	c.discovery.Lock()
+	defer c.discovery.Unlock()
+	if c.discovery.conn != nil {
+		return c.discovery.conn, nil
+	}
 	logger := c.Logger.WithField("Address", c.DiscoveryServerAddress)
 	logger.Debug("ttn-sdk: Connecting to discovery...")
+	ctx, cancel := context.WithTimeout(ctx, c.RequestTimeout)
+	defer cancel()
 	if c.DiscoveryServerInsecure {
-		c.discovery.conn, err = grpc.Dial(c.DiscoveryServerAddress, append(DialOptions, grpc.WithInsecure())...)
+		c.discovery.conn, err = grpc.DialContext(ctx, c.DiscoveryServerAddress, append(DialOptions, grpc.WithInsecure())...)
 	} else {
-		c.discovery.conn, err = grpc.Dial(c.DiscoveryServerAddress, append(DialOptions, grpc.WithTransportCredentials(c.transportCredentials))...)
+		c.discovery.conn, err = grpc.DialContext(ctx, c.DiscoveryServerAddress, append(DialOptions, grpc.WithTransportCredentials(c.transportCredentials))...)
 	}
 	if err != nil {
 		logger.WithError(err).Debug("ttn-sdk: Could not connect to discovery")
-		return err
+		return nil, err
 	}
 	logger.Debug("ttn-sdk: Connected to discovery")
-	discoveryClient := discovery.NewDiscoveryClient(c.discovery.conn)
-	ctx, cancel := context.WithTimeout(c.getContext(context.Background()), c.RequestTimeout)
+	return c.discovery.conn, nil
+}
+
+func (c *client) lookupHandler(ctx context.Context) (*discovery.Announcement, error) {
+	if c.HandlerAddress != "" {
+		return c.staticAnnouncement(), nil
+	}
+	conn, err := c.connectDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	discoveryClient := discovery.NewDiscoveryClient(conn)
+	ctx, cancel := requestContext(ctx, c.getContext, c.RequestTimeout)
 	defer cancel()
 	c.Logger.Debug("ttn-sdk: Finding handler...")
 	handler, err := discoveryClient.GetByAppID(ctx, &discovery.GetByAppIDRequest{AppID: c.appID})
 	if err != nil {
 		c.Logger.WithError(err).Debug("ttn-sdk: Could not find handler for application")
+		return nil, err
+	}
+	return handler, nil
+}
+
+func (c *client) discover(ctx context.Context) (err error) {
+	handler, err := c.lookupHandler(ctx)
+	if err != nil {
 		return err
 	}
 	c.handler.announcement = handler
+	c.startRediscovery()
 	return nil
 }
 
+// handlerChanged returns true if the client has to re-connect after the announcement of the Handler changed
+func handlerChanged(previous, current *discovery.Announcement) bool {
+	return previous.ID != current.ID ||
+		previous.NetAddress != current.NetAddress ||
+		previous.Certificate != current.Certificate ||
+		previous.MqttAddress != current.MqttAddress
+}
+
+// rediscover asks the Discovery Server for the Handler of the application. If the Handler changed, the client closes
+// its connections, so that the next calls connect to the new Handler, and moves its subscriptions to the new MQTT
+// server.
+func (c *client) rediscover(ctx context.Context) (changed bool, err error) {
+	if c.HandlerAddress != "" {
+		return false, nil
+	}
+	current, err := c.lookupHandler(ctx)
+	if err != nil {
+		return false, err
+	}
+	c.handler.Lock()
+	previous := c.handler.announcement
+	c.handler.announcement = current
+	if previous == nil || !handlerChanged(previous, current) {
+		c.handler.Unlock()
+		return false, nil
+	}
+	c.Logger.WithFields(log.Fields{
+		"PreviousID": previous.ID,
+		"ID":         current.ID,
+		"Address":    current.NetAddress,
+	}).Info("ttn-sdk: Handler changed, reconnecting...")
+	if c.handler.conn != nil {
+		c.handler.conn.Close()
+	}
+	c.handler.conn = nil
+	c.handler.address = ""
+	c.handler.status = nil
+	c.handler.Unlock()
+	if c.MQTTAddress == "" && previous.MqttAddress != current.MqttAddress {
+		err = c.reconnectMQTT(ctx)
+	}
+	if c.OnHandlerChange != nil {
+		c.OnHandlerChange(previous, current)
+	}
+	return true, err
+}
+
+// startRediscovery starts asking the Discovery Server for the Handler of the application every RediscoveryInterval.
+func (c *client) startRediscovery() {
+	if c.HandlerAddress != "" || c.RediscoveryInterval <= 0 {
+		return
+	}
+	c.rediscovery.Lock()
+	defer c.rediscovery.Unlock()
+	if c.rediscovery.cancel != nil {
+		return
+	}
+	var ctx context.Context
+	ctx, c.rediscovery.cancel = context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(c.RediscoveryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := c.rediscover(ctx); err != nil {
+					c.Logger.WithError(err).Warn("ttn-sdk: Could not rediscover handler")
+				}
+			}
+		}
+	}()
+}
+
+func (c *client) stopRediscovery() {
+	c.rediscovery.Lock()
+	defer c.rediscovery.Unlock()
+	if c.rediscovery.cancel != nil {
+		c.rediscovery.cancel()
+	}
+	c.rediscovery.cancel = nil
+}
+
+// staticAnnouncement returns the announcement of the Handler that is configured in the ClientConfig
+func (c *client) staticAnnouncement() *discovery.Announcement {
+	return &discovery.Announcement{
+		ServiceName: "handler",
+		NetAddress:  c.HandlerAddress,
+		Certificate: c.HandlerCertificate,
+		MqttAddress: c.MQTTAddress,
+	}
+}
+
 func (c *client) closeDiscovery() error {
 	c.discovery.Lock()
 	defer c.discovery.Unlock()
@@ -0,0 +1,170 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/api/discovery"
+	"github.com/TheThingsNetwork/api/handler"
+	ttnlog "github.com/TheThingsNetwork/go-utils/log"
+	testlog "github.com/TheThingsNetwork/go-utils/log/test"
+	. "github.com/smartystreets/assertions"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+func TestHandlerChanged(t *testing.T) {
+	a := New(t)
+	announcement := &discovery.Announcement{ID: "handler", NetAddress: "localhost:1904", MqttAddress: "localhost:1883"}
+	a.So(handlerChanged(announcement, &discovery.Announcement{ID: "handler", NetAddress: "localhost:1904", MqttAddress: "localhost:1883", Description: "changed"}), ShouldBeFalse)
+	a.So(handlerChanged(announcement, &discovery.Announcement{ID: "other", NetAddress: "localhost:1904", MqttAddress: "localhost:1883"}), ShouldBeTrue)
+	a.So(handlerChanged(announcement, &discovery.Announcement{ID: "handler", NetAddress: "localhost:1905", MqttAddress: "localhost:1883"}), ShouldBeTrue)
+	a.So(handlerChanged(announcement, &discovery.Announcement{ID: "handler", NetAddress: "localhost:1904", MqttAddress: "localhost:1884"}), ShouldBeTrue)
+	a.So(handlerChanged(announcement, &discovery.Announcement{ID: "handler", NetAddress: "localhost:1904", MqttAddress: "localhost:1883", Certificate: "cert"}), ShouldBeTrue)
+}
+
+func TestRediscovery(t *testing.T) {
+	a := New(t)
+
+	log := testlog.NewLogger()
+	ttnlog.Set(log)
+	defer log.Print(t)
+
+	cert, certPEM, err := generateCertificate("127.0.0.1")
+	a.So(err, ShouldBeNil)
+
+	firstMock := &mockApplicationManagerClient{application: &handler.Application{PayloadFormat: "first"}}
+	firstAddr, stopFirst := serveMockApplicationManager(t, firstMock, grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
+	defer stopFirst()
+	firstBroker, err := newMockMQTTBroker()
+	a.So(err, ShouldBeNil)
+	defer firstBroker.Close()
+
+	secondMock := &mockApplicationManagerClient{application: &handler.Application{PayloadFormat: "second"}}
+	secondAddr, stopSecond := serveMockApplicationManager(t, secondMock, grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
+	defer stopSecond()
+	secondBroker, err := newMockMQTTBroker()
+	a.So(err, ShouldBeNil)
+	defer secondBroker.Close()
+
+	first := &discovery.Announcement{ID: "first", NetAddress: firstAddr, Certificate: certPEM, MqttAddress: "mqtt://" + firstBroker.Addr().String()}
+	second := &discovery.Announcement{ID: "second", NetAddress: secondAddr, Certificate: certPEM, MqttAddress: "mqtt://" + secondBroker.Addr().String()}
+
+	discoveryMock := &mockDiscoveryServer{announcement: first}
+	discoveryAddr, stopDiscovery := serveMockDiscovery(t, discoveryMock)
+	defer stopDiscovery()
+
+	changes := make(chan [2]*discovery.Announcement, 10)
+
+	config := NewConfig("test", "", discoveryAddr)
+	config.Logger = log
+	config.DiscoveryServerInsecure = true
+	config.OnHandlerChange = func(previous, current *discovery.Announcement) {
+		changes <- [2]*discovery.Announcement{previous, current}
+	}
+	client := config.NewClient("test", "").(*client)
+	defer client.Close()
+
+	app, err := client.ManageApplication()
+	a.So(err, ShouldBeNil)
+	pf, err := app.GetPayloadFormat()
+	a.So(err, ShouldBeNil)
+	a.So(pf, ShouldEqual, "first")
+
+	pubsub, err := client.PubSub()
+	a.So(err, ShouldBeNil)
+	defer pubsub.Close()
+	_, err = pubsub.Device("dev").SubscribeUplink()
+	a.So(err, ShouldBeNil)
+	a.So(firstBroker.subscribed("test/devices/dev/up"), ShouldEqual, 1)
+
+	// Nothing changed
+	changed, err := client.rediscover(context.Background())
+	a.So(err, ShouldBeNil)
+	a.So(changed, ShouldBeFalse)
+
+	// The application moves to the second Handler
+	discoveryMock.setAnnouncement(second)
+	changed, err = client.rediscover(context.Background())
+	a.So(err, ShouldBeNil)
+	a.So(changed, ShouldBeTrue)
+
+	select {
+	case change := <-changes:
+		a.So(change[0].ID, ShouldEqual, "first")
+		a.So(change[1].ID, ShouldEqual, "second")
+	default:
+		t.Fatal("OnHandlerChange was not called")
+	}
+
+	pf, err = app.GetPayloadFormat()
+	a.So(err, ShouldBeNil)
+	a.So(pf, ShouldEqual, "second")
+
+	time.Sleep(10 * time.Millisecond)
+	a.So(firstBroker.subscribed("test/devices/dev/up"), ShouldEqual, 0)
+	a.So(secondBroker.subscribed("test/devices/dev/up"), ShouldEqual, 1)
+
+	// The application moves back to the first Handler, and the second Handler goes down
+	discoveryMock.setAnnouncement(first)
+	stopSecond()
+
+	pf, err = app.GetPayloadFormat()
+	a.So(err, ShouldBeNil)
+	a.So(pf, ShouldEqual, "first")
+	a.So(<-changes, ShouldNotBeNil)
+}
+
+func TestPeriodicRediscovery(t *testing.T) {
+	a := New(t)
+
+	log := testlog.NewLogger()
+	ttnlog.Set(log)
+	defer log.Print(t)
+
+	first := &discovery.Announcement{ID: "first", NetAddress: "127.0.0.1:1904"}
+	second := &discovery.Announcement{ID: "second", NetAddress: "127.0.0.1:1904"}
+
+	discoveryMock := &mockDiscoveryServer{announcement: first}
+	discoveryAddr, stopDiscovery := serveMockDiscovery(t, discoveryMock)
+	defer stopDiscovery()
+
+	changes := make(chan *discovery.Announcement, 10)
+
+	config := NewConfig("test", "", discoveryAddr)
+	config.Logger = log
+	config.DiscoveryServerInsecure = true
+	config.RediscoveryInterval = 10 * time.Millisecond
+	config.OnHandlerChange = func(_, current *discovery.Announcement) {
+		changes <- current
+	}
+	client := config.NewClient("test", "").(*client)
+
+	client.handler.Lock()
+	err := client.discover(context.Background())
+	client.handler.Unlock()
+	a.So(err, ShouldBeNil)
+
+	discoveryMock.setAnnouncement(second)
+
+	select {
+	case current := <-changes:
+		a.So(current.ID, ShouldEqual, "second")
+	case <-time.After(time.Second):
+		t.Fatal("Handler change was not detected within a second")
+	}
+
+	client.Close()
+	time.Sleep(20 * time.Millisecond)
+	discoveryMock.Lock()
+	requests := discoveryMock.requests
+	discoveryMock.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	discoveryMock.Lock()
+	a.So(discoveryMock.requests, ShouldEqual, requests)
+	discoveryMock.Unlock()
+}
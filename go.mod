@@ -8,9 +8,14 @@ require (
 	github.com/TheThingsNetwork/go-utils v0.0.0-20190516083235-bdd4967fab4e
 	github.com/TheThingsNetwork/ttn/core/types v0.0.0-20190516112328-fcd38e2b9dc6
 	github.com/TheThingsNetwork/ttn/mqtt v0.0.0-20190516112328-fcd38e2b9dc6
+	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/gogo/protobuf v1.2.1
 	github.com/mwitkow/go-grpc-middleware v1.0.0
+	github.com/robertkrimen/otto v0.0.0-20191219234010-c382bd3c16ff
 	github.com/smartystreets/assertions v0.0.0-20190401211740-f487f9de1cd3
+	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
 	golang.org/x/net v0.0.0-20190514140710-3ec191127204
 	google.golang.org/grpc v1.20.1
+	gopkg.in/sourcemap.v1 v1.0.5 // indirect
+	gopkg.in/yaml.v2 v2.2.2
 )
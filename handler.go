@@ -4,42 +4,291 @@
 package ttnsdk
 
 import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/TheThingsNetwork/go-utils/log"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 )
 
-func (c *client) connectHandler() (err error) {
+var (
+	// HandlerBackoff is the time that a Handler address is blacklisted after a failure. This time is doubled for every
+	// consecutive failure of the address, up to HandlerMaxBackoff.
+	HandlerBackoff = 5 * time.Second
+
+	// HandlerMaxBackoff is the maximum time that a Handler address is blacklisted.
+	HandlerMaxBackoff = 5 * time.Minute
+)
+
+// HandlerAddressStatus contains the status of one of the addresses that are announced by the Handler.
+type HandlerAddressStatus struct {
+	Address string
+
+	// Indicates whether the client is currently connected to this address
+	Active bool
+
+	// The number of consecutive failures of this address
+	Failures int
+
+	// The last error that occurred on this address
+	LastError error
+
+	// The address is not used until this time, unless all other addresses are blacklisted as well
+	BlacklistedUntil time.Time
+}
+
+// Blacklisted indicates whether the address was blacklisted at the given time.
+func (s HandlerAddressStatus) Blacklisted(at time.Time) bool {
+	return at.Before(s.BlacklistedUntil)
+}
+
+func (s *HandlerAddressStatus) fail(err error, at time.Time) {
+	s.Active = false
+	s.LastError = err
+	backoff := HandlerBackoff
+	for i := 0; i < s.Failures && backoff < HandlerMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > HandlerMaxBackoff {
+		backoff = HandlerMaxBackoff
+	}
+	s.Failures++
+	s.BlacklistedUntil = at.Add(backoff)
+}
+
+func (s *HandlerAddressStatus) succeed() {
+	s.Active = true
+	s.Failures = 0
+	s.LastError = nil
+	s.BlacklistedUntil = time.Time{}
+}
+
+func splitHandlerAddresses(netAddress string) (addresses []string) {
+	for _, address := range strings.Split(netAddress, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return
+}
+
+// handlerAddresses returns the addresses of the Handler in the order in which they should be tried. Addresses that are
+// not blacklisted come first, in announced order or shuffled (if RandomizeHandlerAddresses is set), followed by the
+// blacklisted addresses, ordered by the end of their blacklist.
+func (c *client) handlerAddresses() []string {
+	var available, blacklisted []string
+	now := time.Now()
+	for _, address := range splitHandlerAddresses(c.handler.announcement.NetAddress) {
+		if status, ok := c.handler.status[address]; ok && status.Blacklisted(now) {
+			blacklisted = append(blacklisted, address)
+		} else {
+			available = append(available, address)
+		}
+	}
+	if c.RandomizeHandlerAddresses {
+		rand.Shuffle(len(available), func(i, j int) { available[i], available[j] = available[j], available[i] })
+	}
+	sort.SliceStable(blacklisted, func(i, j int) bool {
+		return c.handler.status[blacklisted[i]].BlacklistedUntil.Before(c.handler.status[blacklisted[j]].BlacklistedUntil)
+	})
+	return append(available, blacklisted...)
+}
+
+func (c *client) handlerAddressStatus(address string) *HandlerAddressStatus {
+	if c.handler.status == nil {
+		c.handler.status = make(map[string]*HandlerAddressStatus)
+	}
+	status, ok := c.handler.status[address]
+	if !ok {
+		status = &HandlerAddressStatus{Address: address}
+		c.handler.status[address] = status
+	}
+	return status
+}
+
+func (c *client) connectHandler(ctx context.Context) (err error) {
 	c.handler.Lock()
 	defer c.handler.Unlock()
 	if c.handler.conn != nil {
 		return nil
 	}
 	if c.handler.announcement == nil {
-		if err := c.discover(); err != nil {
+		if err := c.discover(ctx); err != nil {
+			return err
+		}
+	}
+	addresses := c.handlerAddresses()
+	if len(addresses) == 0 {
+		return errors.New("ttn-sdk: Handler does not announce an address")
+	}
+	for _, address := range addresses {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var transportCredentials grpc.DialOption
+		transportCredentials, err = c.handlerTransportCredentials(address)
+		if err != nil {
 			return err
 		}
+		logger := c.Logger.WithFields(log.Fields{
+			"ID":      c.handler.announcement.ID,
+			"Address": address,
+		})
+		logger.Debug("ttn-sdk: Connecting to handler...")
+		dialCtx, cancel := context.WithTimeout(ctx, c.RequestTimeout)
+		c.handler.conn, err = grpc.DialContext(dialCtx, address, append(DialOptions, transportCredentials)...)
+		cancel()
+		if err != nil {
+			logger.WithError(err).Debug("ttn-sdk: Could not connect to handler")
+			if ctx.Err() != nil {
+				return err
+			}
+			c.handlerAddressStatus(address).fail(err, time.Now())
+			continue
+		}
+		logger.Debug("ttn-sdk: Connected to handler")
+		c.handlerAddressStatus(address).succeed()
+		c.handler.address = address
+		return nil
+	}
+	return err
+}
+
+func (c *client) handlerTransportCredentials(address string) (grpc.DialOption, error) {
+	if c.HandlerAddress != "" && c.HandlerInsecure {
+		return grpc.WithInsecure(), nil
 	}
 	tlsConfig, err := c.handler.announcement.GetTLSConfig()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	logger := c.Logger.WithFields(log.Fields{
+	if tlsConfig == nil {
+		if c.HandlerAddress != "" {
+			return grpc.WithTransportCredentials(c.transportCredentials), nil
+		}
+		return grpc.WithTransportCredentials(credentials.NewTLS(nil)), nil
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		tlsConfig.ServerName = host
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)), nil
+}
+
+// getHandlerConn returns the current connection to the Handler, connecting to the Handler if needed.
+func (c *client) getHandlerConn(ctx context.Context) (conn *grpc.ClientConn, address string, err error) {
+	c.handler.RLock()
+	conn, address = c.handler.conn, c.handler.address
+	c.handler.RUnlock()
+	if conn != nil {
+		return conn, address, nil
+	}
+	if err := c.connectHandler(ctx); err != nil {
+		return nil, "", err
+	}
+	c.handler.RLock()
+	defer c.handler.RUnlock()
+	return c.handler.conn, c.handler.address, nil
+}
+
+// failoverHandler blacklists the given Handler address and closes the connection to it if that is still the current
+// connection. The next call to connectHandler connects to another address of the Handler.
+func (c *client) failoverHandler(address string, err error) {
+	c.handler.Lock()
+	defer c.handler.Unlock()
+	if c.handler.conn == nil || c.handler.address != address {
+		return
+	}
+	c.Logger.WithFields(log.Fields{
 		"ID":      c.handler.announcement.ID,
-		"Address": c.handler.announcement.NetAddress,
-	})
-	logger.Debug("ttn-sdk: Connecting to handler...")
-	c.handler.conn, err = grpc.Dial(
-		strings.Split(c.handler.announcement.NetAddress, ",")[0],
-		append(DialOptions, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))...)
+		"Address": address,
+	}).WithError(err).Debug("ttn-sdk: Handler unavailable, connecting to another address...")
+	c.handlerAddressStatus(address).fail(err, time.Now())
+	c.handler.conn.Close()
+	c.handler.conn = nil
+	c.handler.address = ""
+}
+
+// allHandlerAddressesBlacklisted returns true if all announced addresses of the Handler are blacklisted
+func (c *client) allHandlerAddressesBlacklisted() bool {
+	c.handler.RLock()
+	defer c.handler.RUnlock()
+	if c.handler.announcement == nil {
+		return false
+	}
+	now := time.Now()
+	for _, address := range splitHandlerAddresses(c.handler.announcement.NetAddress) {
+		if status, ok := c.handler.status[address]; !ok || !status.Blacklisted(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleUnavailable blacklists the address of the Handler after a call failed because the Handler was unavailable.
+// If all addresses of the Handler are blacklisted, the client checks if the Handler of the application changed.
+func (c *client) handleUnavailable(ctx context.Context, address string, err error) {
+	c.failoverHandler(address, err)
+	if c.allHandlerAddressesBlacklisted() {
+		c.rediscover(ctx)
+	}
+}
+
+// callHandler executes the call on the current connection to the Handler. If the Handler is unavailable, the next
+// call connects to another address of the Handler. The call is not retried, because it may have reached the Handler.
+func (c *client) callHandler(ctx context.Context, call func(*grpc.ClientConn) error) error {
+	conn, address, err := c.getHandlerConn(ctx)
 	if err != nil {
-		logger.WithError(err).Debug("ttn-sdk: Could not connect to handler")
 		return err
 	}
-	logger.Debug("ttn-sdk: Connected to handler")
-	return nil
+	err = call(conn)
+	if status.Code(err) == codes.Unavailable {
+		c.handleUnavailable(ctx, address, err)
+	}
+	return err
+}
+
+// callHandlerWithRetry is like callHandler, but retries the call once on another address of the Handler (or on the
+// new Handler of the application). It must only be used for calls that do not change anything on the Handler.
+func (c *client) callHandlerWithRetry(ctx context.Context, call func(*grpc.ClientConn) error) error {
+	conn, address, err := c.getHandlerConn(ctx)
+	if err != nil {
+		return err
+	}
+	err = call(conn)
+	if status.Code(err) != codes.Unavailable {
+		return err
+	}
+	c.handleUnavailable(ctx, address, err)
+	conn, _, connErr := c.getHandlerConn(ctx)
+	if connErr != nil {
+		return err
+	}
+	return call(conn)
+}
+
+func (c *client) HandlerStatus() []HandlerAddressStatus {
+	c.handler.RLock()
+	defer c.handler.RUnlock()
+	if c.handler.announcement == nil {
+		return nil
+	}
+	var statuses []HandlerAddressStatus
+	for _, address := range splitHandlerAddresses(c.handler.announcement.NetAddress) {
+		if status, ok := c.handler.status[address]; ok {
+			statuses = append(statuses, *status)
+		} else {
+			statuses = append(statuses, HandlerAddressStatus{Address: address})
+		}
+	}
+	return statuses
 }
 
 func (c *client) closeHandler() error {
@@ -49,5 +298,9 @@ func (c *client) closeHandler() error {
 		c.handler.conn.Close()
 	}
 	c.handler.conn = nil
+	if status, ok := c.handler.status[c.handler.address]; ok {
+		status.Active = false
+	}
+	c.handler.address = ""
 	return nil
 }
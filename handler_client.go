@@ -0,0 +1,129 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"context"
+
+	"github.com/TheThingsNetwork/api/handler"
+	"github.com/TheThingsNetwork/api/protocol/lorawan"
+	ptypes "github.com/gogo/protobuf/types"
+	"google.golang.org/grpc"
+)
+
+// handlerClient implements the handler.ApplicationManagerClient and lorawan.DevAddrManagerClient interfaces on top of
+// the current connection to the Handler of the client. Only the calls that do not change anything on the Handler are
+// retried if the Handler is unavailable.
+type handlerClient struct {
+	*client
+}
+
+var (
+	_ handler.ApplicationManagerClient = &handlerClient{}
+	_ lorawan.DevAddrManagerClient     = &handlerClient{}
+)
+
+func (h *handlerClient) RegisterApplication(ctx context.Context, in *handler.ApplicationIdentifier, opts ...grpc.CallOption) (res *ptypes.Empty, err error) {
+	err = h.callHandler(ctx, func(conn *grpc.ClientConn) (err error) {
+		res, err = handler.NewApplicationManagerClient(conn).RegisterApplication(ctx, in, opts...)
+		return
+	})
+	return
+}
+
+func (h *handlerClient) GetApplication(ctx context.Context, in *handler.ApplicationIdentifier, opts ...grpc.CallOption) (res *handler.Application, err error) {
+	err = h.callHandlerWithRetry(ctx, func(conn *grpc.ClientConn) (err error) {
+		res, err = handler.NewApplicationManagerClient(conn).GetApplication(ctx, in, opts...)
+		return
+	})
+	return
+}
+
+func (h *handlerClient) SetApplication(ctx context.Context, in *handler.Application, opts ...grpc.CallOption) (res *ptypes.Empty, err error) {
+	err = h.callHandler(ctx, func(conn *grpc.ClientConn) (err error) {
+		res, err = handler.NewApplicationManagerClient(conn).SetApplication(ctx, in, opts...)
+		return
+	})
+	return
+}
+
+func (h *handlerClient) DeleteApplication(ctx context.Context, in *handler.ApplicationIdentifier, opts ...grpc.CallOption) (res *ptypes.Empty, err error) {
+	err = h.callHandler(ctx, func(conn *grpc.ClientConn) (err error) {
+		res, err = handler.NewApplicationManagerClient(conn).DeleteApplication(ctx, in, opts...)
+		return
+	})
+	return
+}
+
+func (h *handlerClient) GetDevice(ctx context.Context, in *handler.DeviceIdentifier, opts ...grpc.CallOption) (res *handler.Device, err error) {
+	err = h.callHandlerWithRetry(ctx, func(conn *grpc.ClientConn) (err error) {
+		res, err = handler.NewApplicationManagerClient(conn).GetDevice(ctx, in, opts...)
+		return
+	})
+	return
+}
+
+func (h *handlerClient) SetDevice(ctx context.Context, in *handler.Device, opts ...grpc.CallOption) (res *ptypes.Empty, err error) {
+	err = h.callHandler(ctx, func(conn *grpc.ClientConn) (err error) {
+		res, err = handler.NewApplicationManagerClient(conn).SetDevice(ctx, in, opts...)
+		return
+	})
+	return
+}
+
+func (h *handlerClient) DeleteDevice(ctx context.Context, in *handler.DeviceIdentifier, opts ...grpc.CallOption) (res *ptypes.Empty, err error) {
+	err = h.callHandler(ctx, func(conn *grpc.ClientConn) (err error) {
+		res, err = handler.NewApplicationManagerClient(conn).DeleteDevice(ctx, in, opts...)
+		return
+	})
+	return
+}
+
+func (h *handlerClient) GetDevicesForApplication(ctx context.Context, in *handler.ApplicationIdentifier, opts ...grpc.CallOption) (res *handler.DeviceList, err error) {
+	err = h.callHandlerWithRetry(ctx, func(conn *grpc.ClientConn) (err error) {
+		res, err = handler.NewApplicationManagerClient(conn).GetDevicesForApplication(ctx, in, opts...)
+		return
+	})
+	return
+}
+
+func (h *handlerClient) DryDownlink(ctx context.Context, in *handler.DryDownlinkMessage, opts ...grpc.CallOption) (res *handler.DryDownlinkResult, err error) {
+	err = h.callHandlerWithRetry(ctx, func(conn *grpc.ClientConn) (err error) {
+		res, err = handler.NewApplicationManagerClient(conn).DryDownlink(ctx, in, opts...)
+		return
+	})
+	return
+}
+
+func (h *handlerClient) DryUplink(ctx context.Context, in *handler.DryUplinkMessage, opts ...grpc.CallOption) (res *handler.DryUplinkResult, err error) {
+	err = h.callHandlerWithRetry(ctx, func(conn *grpc.ClientConn) (err error) {
+		res, err = handler.NewApplicationManagerClient(conn).DryUplink(ctx, in, opts...)
+		return
+	})
+	return
+}
+
+func (h *handlerClient) SimulateUplink(ctx context.Context, in *handler.SimulatedUplinkMessage, opts ...grpc.CallOption) (res *ptypes.Empty, err error) {
+	err = h.callHandler(ctx, func(conn *grpc.ClientConn) (err error) {
+		res, err = handler.NewApplicationManagerClient(conn).SimulateUplink(ctx, in, opts...)
+		return
+	})
+	return
+}
+
+func (h *handlerClient) GetPrefixes(ctx context.Context, in *lorawan.PrefixesRequest, opts ...grpc.CallOption) (res *lorawan.PrefixesResponse, err error) {
+	err = h.callHandlerWithRetry(ctx, func(conn *grpc.ClientConn) (err error) {
+		res, err = lorawan.NewDevAddrManagerClient(conn).GetPrefixes(ctx, in, opts...)
+		return
+	})
+	return
+}
+
+func (h *handlerClient) GetDevAddr(ctx context.Context, in *lorawan.DevAddrRequest, opts ...grpc.CallOption) (res *lorawan.DevAddrResponse, err error) {
+	err = h.callHandlerWithRetry(ctx, func(conn *grpc.ClientConn) (err error) {
+		res, err = lorawan.NewDevAddrManagerClient(conn).GetDevAddr(ctx, in, opts...)
+		return
+	})
+	return
+}
@@ -0,0 +1,134 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/api/handler"
+	ttnlog "github.com/TheThingsNetwork/go-utils/log"
+	testlog "github.com/TheThingsNetwork/go-utils/log/test"
+	. "github.com/smartystreets/assertions"
+)
+
+func unusedAddress(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+func TestHandlerAddressStatus(t *testing.T) {
+	a := New(t)
+
+	now := time.Now()
+	status := &HandlerAddressStatus{Address: "localhost:1904"}
+	a.So(status.Blacklisted(now), ShouldBeFalse)
+
+	someErr := errors.New("some error")
+	status.fail(someErr, now)
+	a.So(status.Failures, ShouldEqual, 1)
+	a.So(status.LastError, ShouldEqual, someErr)
+	a.So(status.BlacklistedUntil, ShouldEqual, now.Add(HandlerBackoff))
+	a.So(status.Blacklisted(now), ShouldBeTrue)
+	a.So(status.Blacklisted(now.Add(HandlerBackoff)), ShouldBeFalse)
+
+	status.fail(someErr, now)
+	a.So(status.BlacklistedUntil, ShouldEqual, now.Add(2*HandlerBackoff))
+
+	for i := 0; i < 100; i++ {
+		status.fail(someErr, now)
+	}
+	a.So(status.BlacklistedUntil, ShouldEqual, now.Add(HandlerMaxBackoff))
+
+	status.succeed()
+	a.So(status.Active, ShouldBeTrue)
+	a.So(status.Failures, ShouldEqual, 0)
+	a.So(status.Blacklisted(now), ShouldBeFalse)
+}
+
+func TestHandlerFailover(t *testing.T) {
+	a := New(t)
+
+	log := testlog.NewLogger()
+	ttnlog.Set(log)
+	defer log.Print(t)
+
+	mock := new(mockApplicationManagerClient)
+	mock.application = &handler.Application{AppID: "test", PayloadFormat: "cayenne"}
+
+	deadAddr := unusedAddress(t)
+	firstAddr, stopFirst := serveMockApplicationManager(t, mock)
+	defer stopFirst()
+	secondAddr, stopSecond := serveMockApplicationManager(t, mock)
+	defer stopSecond()
+	thirdAddr, stopThird := serveMockApplicationManager(t, mock)
+	defer stopThird()
+
+	config := NewConfig("test", "", "")
+	config.Logger = log
+	config.RequestTimeout = 200 * time.Millisecond
+	config.HandlerAddress = strings.Join([]string{deadAddr, firstAddr, secondAddr, thirdAddr}, ",")
+	config.HandlerInsecure = true
+	client := config.NewClient("test", "").(*client)
+	defer client.Close()
+
+	a.So(client.HandlerStatus(), ShouldBeEmpty)
+
+	app, err := client.ManageApplication()
+	a.So(err, ShouldBeNil)
+
+	status := client.HandlerStatus()
+	a.So(status, ShouldHaveLength, 4)
+	a.So(status[0].Address, ShouldEqual, deadAddr)
+	a.So(status[0].Active, ShouldBeFalse)
+	a.So(status[0].Failures, ShouldEqual, 1)
+	a.So(status[0].Blacklisted(time.Now()), ShouldBeTrue)
+	a.So(status[1].Address, ShouldEqual, firstAddr)
+	a.So(status[1].Active, ShouldBeTrue)
+	a.So(status[2].Active, ShouldBeFalse)
+	a.So(status[2].Failures, ShouldEqual, 0)
+
+	// The first Handler goes down, calls that change something are not retried, but the client moves to the second
+	stopFirst()
+
+	err = app.Register()
+	a.So(err, ShouldNotBeNil)
+
+	status = client.HandlerStatus()
+	a.So(status[1].Active, ShouldBeFalse)
+	a.So(status[1].Failures, ShouldEqual, 1)
+	a.So(status[1].LastError, ShouldNotBeNil)
+
+	pf, err := app.GetPayloadFormat()
+	a.So(err, ShouldBeNil)
+	a.So(pf, ShouldEqual, "cayenne")
+
+	status = client.HandlerStatus()
+	a.So(status[2].Active, ShouldBeTrue)
+
+	// The second Handler goes down, calls that do not change anything are retried on the third
+	stopSecond()
+
+	pf, err = app.GetPayloadFormat()
+	a.So(err, ShouldBeNil)
+	a.So(pf, ShouldEqual, "cayenne")
+
+	status = client.HandlerStatus()
+	a.So(status[2].Active, ShouldBeFalse)
+	a.So(status[2].Failures, ShouldEqual, 1)
+	a.So(status[3].Active, ShouldBeTrue)
+
+	// All Handlers are down
+	stopThird()
+
+	_, err = app.GetPayloadFormat()
+	a.So(err, ShouldNotBeNil)
+}
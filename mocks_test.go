@@ -4,11 +4,24 @@
 package ttnsdk
 
 import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/api/discovery"
 	"github.com/TheThingsNetwork/api/handler"
 	"github.com/TheThingsNetwork/api/protocol/lorawan"
+	paho "github.com/eclipse/paho.mqtt.golang"
 	ptypes "github.com/gogo/protobuf/types"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type mockApplicationManagerClient struct {
@@ -127,3 +140,534 @@ func (m *mockDevAddrManagerClient) GetDevAddr(ctx context.Context, in *lorawan.D
 	m.devAddrRequest = in
 	return m.devAddrResponse, m.err
 }
+
+// mockApplicationManagerServer serves a mockApplicationManagerClient over gRPC
+type mockApplicationManagerServer struct {
+	*mockApplicationManagerClient
+}
+
+func (m *mockApplicationManagerServer) RegisterApplication(ctx context.Context, in *handler.ApplicationIdentifier) (*ptypes.Empty, error) {
+	return serverEmpty(m.mockApplicationManagerClient.RegisterApplication(ctx, in))
+}
+func (m *mockApplicationManagerServer) GetApplication(ctx context.Context, in *handler.ApplicationIdentifier) (*handler.Application, error) {
+	return m.mockApplicationManagerClient.GetApplication(ctx, in)
+}
+func (m *mockApplicationManagerServer) SetApplication(ctx context.Context, in *handler.Application) (*ptypes.Empty, error) {
+	return serverEmpty(m.mockApplicationManagerClient.SetApplication(ctx, in))
+}
+func (m *mockApplicationManagerServer) DeleteApplication(ctx context.Context, in *handler.ApplicationIdentifier) (*ptypes.Empty, error) {
+	return serverEmpty(m.mockApplicationManagerClient.DeleteApplication(ctx, in))
+}
+func (m *mockApplicationManagerServer) GetDevice(ctx context.Context, in *handler.DeviceIdentifier) (*handler.Device, error) {
+	return m.mockApplicationManagerClient.GetDevice(ctx, in)
+}
+func (m *mockApplicationManagerServer) SetDevice(ctx context.Context, in *handler.Device) (*ptypes.Empty, error) {
+	return serverEmpty(m.mockApplicationManagerClient.SetDevice(ctx, in))
+}
+func (m *mockApplicationManagerServer) DeleteDevice(ctx context.Context, in *handler.DeviceIdentifier) (*ptypes.Empty, error) {
+	return serverEmpty(m.mockApplicationManagerClient.DeleteDevice(ctx, in))
+}
+func (m *mockApplicationManagerServer) GetDevicesForApplication(ctx context.Context, in *handler.ApplicationIdentifier) (*handler.DeviceList, error) {
+	return m.mockApplicationManagerClient.GetDevicesForApplication(ctx, in)
+}
+func (m *mockApplicationManagerServer) DryDownlink(ctx context.Context, in *handler.DryDownlinkMessage) (*handler.DryDownlinkResult, error) {
+	return m.mockApplicationManagerClient.DryDownlink(ctx, in)
+}
+func (m *mockApplicationManagerServer) DryUplink(ctx context.Context, in *handler.DryUplinkMessage) (*handler.DryUplinkResult, error) {
+	return m.mockApplicationManagerClient.DryUplink(ctx, in)
+}
+func (m *mockApplicationManagerServer) SimulateUplink(ctx context.Context, in *handler.SimulatedUplinkMessage) (*ptypes.Empty, error) {
+	return serverEmpty(m.mockApplicationManagerClient.SimulateUplink(ctx, in))
+}
+
+// serverEmpty replaces nil responses by empty ones, as gRPC servers can not send nil responses
+func serverEmpty(res *ptypes.Empty, err error) (*ptypes.Empty, error) {
+	if res == nil && err == nil {
+		res = new(ptypes.Empty)
+	}
+	return res, err
+}
+
+func serveMockApplicationManager(t *testing.T, mock *mockApplicationManagerClient, opts ...grpc.ServerOption) (address string, stop func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer(opts...)
+	handler.RegisterApplicationManagerServer(s, &mockApplicationManagerServer{mock})
+	go s.Serve(lis)
+	return lis.Addr().String(), s.Stop
+}
+
+// mockDiscoveryServer only implements GetByAppID
+type mockDiscoveryServer struct {
+	discovery.DiscoveryServer
+
+	sync.Mutex
+	announcement *discovery.Announcement
+	requests     int
+}
+
+func (m *mockDiscoveryServer) setAnnouncement(announcement *discovery.Announcement) {
+	m.Lock()
+	defer m.Unlock()
+	m.announcement = announcement
+}
+
+func (m *mockDiscoveryServer) GetByAppID(ctx context.Context, in *discovery.GetByAppIDRequest) (*discovery.Announcement, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.requests++
+	return m.announcement, nil
+}
+
+func serveMockDiscovery(t *testing.T, mock *mockDiscoveryServer) (address string, stop func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	discovery.RegisterDiscoveryServer(s, mock)
+	go s.Serve(lis)
+	return lis.Addr().String(), s.Stop
+}
+
+// mockMQTTBroker accepts MQTT connections, acknowledges CONNECT, SUBSCRIBE, UNSUBSCRIBE and PINGREQ packets, keeps
+// track of the topics that are subscribed to and routes (QoS 0) PUBLISH packets to the subscribed connections.
+type mockMQTTBroker struct {
+	net.Listener
+
+	sync.Mutex
+	subscriptions map[string]int
+	conns         map[*mockMQTTConn]struct{}
+	published     []mockMQTTMessage
+}
+
+type mockMQTTMessage struct {
+	topic   string
+	payload []byte
+}
+
+type mockMQTTConn struct {
+	net.Conn
+	sync.Mutex
+	topics []string
+}
+
+func (c *mockMQTTConn) write(packet []byte) {
+	c.Lock()
+	defer c.Unlock()
+	c.Write(packet)
+}
+
+func newMockMQTTBroker() (*mockMQTTBroker, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &mockMQTTBroker{
+		Listener:      lis,
+		subscriptions: make(map[string]int),
+		conns:         make(map[*mockMQTTConn]struct{}),
+	}
+	go b.serve(lis)
+	return b, nil
+}
+
+// restart closes the listener and all client connections, waits for the given duration, and listens on the same
+// address again
+func (b *mockMQTTBroker) restart(downtime time.Duration) error {
+	b.Lock()
+	lis := b.Listener
+	b.Unlock()
+	lis.Close()
+	b.disconnectAll()
+	time.Sleep(downtime)
+	lis, err := net.Listen("tcp", lis.Addr().String())
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	b.Listener = lis
+	b.Unlock()
+	go b.serve(lis)
+	return nil
+}
+
+// subscribed returns the number of active subscriptions on the topic
+func (b *mockMQTTBroker) subscribed(topic string) int {
+	b.Lock()
+	defer b.Unlock()
+	return b.subscriptions[topic]
+}
+
+// messages returns the messages that were published by clients on the topic
+func (b *mockMQTTBroker) messages(topic string) (payloads [][]byte) {
+	b.Lock()
+	defer b.Unlock()
+	for _, msg := range b.published {
+		if msg.topic == topic {
+			payloads = append(payloads, msg.payload)
+		}
+	}
+	return
+}
+
+// publish sends the message to the connections that are subscribed to the topic
+func (b *mockMQTTBroker) publish(topic string, payload []byte) {
+	remaining := 2 + len(topic) + len(payload)
+	packet := []byte{0x30}
+	for {
+		digit := byte(remaining % 128)
+		remaining /= 128
+		if remaining > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if remaining == 0 {
+			break
+		}
+	}
+	packet = append(packet, byte(len(topic)>>8), byte(len(topic)))
+	packet = append(packet, topic...)
+	packet = append(packet, payload...)
+	b.Lock()
+	var conns []*mockMQTTConn
+	for conn := range b.conns {
+		conn.Lock()
+		for _, filter := range conn.topics {
+			if mockMQTTTopicMatch(filter, topic) {
+				conns = append(conns, conn)
+				break
+			}
+		}
+		conn.Unlock()
+	}
+	b.Unlock()
+	for _, conn := range conns {
+		conn.write(packet)
+	}
+}
+
+// disconnectAll closes all client connections
+func (b *mockMQTTBroker) disconnectAll() {
+	b.Lock()
+	defer b.Unlock()
+	for conn := range b.conns {
+		conn.Close()
+	}
+}
+
+func mockMQTTTopicMatch(filter, topic string) bool {
+	filterParts, topicParts := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, part := range filterParts {
+		if part == "#" {
+			return true
+		}
+		if i >= len(topicParts) || (part != "+" && part != topicParts[i]) {
+			return false
+		}
+	}
+	return len(filterParts) == len(topicParts)
+}
+
+func (b *mockMQTTBroker) serve(lis net.Listener) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(&mockMQTTConn{Conn: conn})
+	}
+}
+
+func (b *mockMQTTBroker) handle(conn *mockMQTTConn) {
+	b.Lock()
+	b.conns[conn] = struct{}{}
+	b.Unlock()
+	defer func() {
+		b.Lock()
+		delete(b.conns, conn)
+		conn.Lock()
+		for _, topic := range conn.topics {
+			b.subscriptions[topic]--
+		}
+		conn.Unlock()
+		b.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		header, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		var length, multiplier int = 0, 1
+		for {
+			digit, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			length += int(digit&0x7f) * multiplier
+			multiplier *= 128
+			if digit&0x80 == 0 {
+				break
+			}
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(r, packet); err != nil {
+			return
+		}
+		switch header >> 4 {
+		case 1: // CONNECT
+			conn.write([]byte{0x20, 0x02, 0x00, 0x00})
+		case 3: // PUBLISH
+			topicLength := int(binary.BigEndian.Uint16(packet))
+			topic := string(packet[2 : 2+topicLength])
+			payload := packet[2+topicLength:]
+			if qos := (header >> 1) & 0x03; qos > 0 {
+				conn.write([]byte{0x40, 0x02, payload[0], payload[1]})
+				payload = payload[2:]
+			}
+			b.Lock()
+			b.published = append(b.published, mockMQTTMessage{topic: topic, payload: payload})
+			b.Unlock()
+			b.publish(topic, payload)
+		case 8: // SUBSCRIBE
+			for payload := packet[2:]; len(payload) >= 2; {
+				topicLength := int(binary.BigEndian.Uint16(payload))
+				topic := string(payload[2 : 2+topicLength])
+				payload = payload[2+topicLength+1:]
+				b.Lock()
+				b.subscriptions[topic]++
+				b.Unlock()
+				conn.Lock()
+				conn.topics = append(conn.topics, topic)
+				conn.Unlock()
+			}
+			conn.write([]byte{0x90, 0x03, packet[0], packet[1], 0x00})
+		case 10: // UNSUBSCRIBE
+			for payload := packet[2:]; len(payload) >= 2; {
+				topicLength := int(binary.BigEndian.Uint16(payload))
+				topic := string(payload[2 : 2+topicLength])
+				payload = payload[2+topicLength:]
+				b.Lock()
+				conn.Lock()
+				for i, subscribed := range conn.topics {
+					if subscribed == topic {
+						conn.topics = append(conn.topics[:i], conn.topics[i+1:]...)
+						b.subscriptions[topic]--
+						break
+					}
+				}
+				conn.Unlock()
+				b.Unlock()
+			}
+			conn.write([]byte{0xb0, 0x02, packet[0], packet[1]})
+		case 12: // PINGREQ
+			conn.write([]byte{0xd0, 0x00})
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+// mockPahoClient is a paho.Client that records the operations on it instead of connecting to a broker
+type mockPahoClient struct {
+	sync.Mutex
+	err          error
+	subscribed   []string
+	handlers     map[string]paho.MessageHandler
+	unsubscribed []string
+	published    []mockMQTTMessage
+}
+
+func (c *mockPahoClient) IsConnected() bool      { return true }
+func (c *mockPahoClient) IsConnectionOpen() bool { return true }
+func (c *mockPahoClient) Connect() paho.Token    { return errorToken{c.err} }
+func (c *mockPahoClient) Disconnect(uint)        {}
+
+func (c *mockPahoClient) Publish(topic string, _ byte, _ bool, payload interface{}) paho.Token {
+	c.Lock()
+	defer c.Unlock()
+	c.published = append(c.published, mockMQTTMessage{topic: topic, payload: payload.([]byte)})
+	return errorToken{c.err}
+}
+
+func (c *mockPahoClient) Subscribe(topic string, _ byte, handler paho.MessageHandler) paho.Token {
+	c.Lock()
+	defer c.Unlock()
+	if c.handlers == nil {
+		c.handlers = make(map[string]paho.MessageHandler)
+	}
+	c.subscribed = append(c.subscribed, topic)
+	c.handlers[topic] = handler
+	return errorToken{c.err}
+}
+
+func (c *mockPahoClient) SubscribeMultiple(map[string]byte, paho.MessageHandler) paho.Token {
+	return errorToken{c.err}
+}
+
+func (c *mockPahoClient) Unsubscribe(topics ...string) paho.Token {
+	c.Lock()
+	defer c.Unlock()
+	c.unsubscribed = append(c.unsubscribed, topics...)
+	return errorToken{c.err}
+}
+
+func (c *mockPahoClient) AddRoute(string, paho.MessageHandler) {}
+
+func (c *mockPahoClient) OptionsReader() paho.ClientOptionsReader { return paho.ClientOptionsReader{} }
+
+// deliver passes a message on the topic to the handler of the subscription
+func (c *mockPahoClient) deliver(subscription, topic string, payload []byte) {
+	c.Lock()
+	handler := c.handlers[subscription]
+	c.Unlock()
+	handler(c, &mockPahoMessage{topic: topic, payload: payload})
+}
+
+type mockPahoMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *mockPahoMessage) Duplicate() bool   { return false }
+func (m *mockPahoMessage) Qos() byte         { return 0 }
+func (m *mockPahoMessage) Retained() bool    { return false }
+func (m *mockPahoMessage) Topic() string     { return m.topic }
+func (m *mockPahoMessage) MessageID() uint16 { return 0 }
+func (m *mockPahoMessage) Payload() []byte   { return m.payload }
+func (m *mockPahoMessage) Ack()              {}
+
+// memoryDeviceManager is a DeviceManager that keeps the devices of an application in memory, in the order in which
+// they were created.
+type memoryDeviceManager struct {
+	sync.Mutex
+	appID     string
+	devices   []*Device
+	err       error
+	templates *DeviceTemplateRegistry
+
+	// Called before every List request, without holding the lock
+	onList func(limit, offset uint64)
+}
+
+func newMemoryDeviceManager(appID string, devIDs ...string) *memoryDeviceManager {
+	m := &memoryDeviceManager{appID: appID}
+	for _, devID := range devIDs {
+		m.devices = append(m.devices, &Device{SparseDevice: SparseDevice{AppID: appID, DevID: devID}})
+	}
+	return m
+}
+
+func (m *memoryDeviceManager) List(limit, offset uint64) (DeviceList, error) {
+	if m.onList != nil {
+		m.onList(limit, offset)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	var devices DeviceList
+	for i := offset; i < uint64(len(m.devices)) && (limit == 0 || i < offset+limit); i++ {
+		dev := m.devices[i].SparseDevice
+		devices = append(devices, &dev)
+	}
+	return devices, nil
+}
+
+func (m *memoryDeviceManager) index(devID string) int {
+	for i, dev := range m.devices {
+		if dev.DevID == devID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *memoryDeviceManager) Get(devID string) (*Device, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	i := m.index(devID)
+	if i < 0 {
+		return nil, status.Error(codes.NotFound, "device not found")
+	}
+	dev := *m.devices[i]
+	dev.deviceManager = m
+	return &dev, nil
+}
+
+func (m *memoryDeviceManager) Set(dev *Device) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	stored := *dev
+	stored.deviceManager = nil
+	stored.AppID = m.appID
+	if i := m.index(dev.DevID); i >= 0 {
+		m.devices[i] = &stored
+	} else {
+		m.devices = append(m.devices, &stored)
+	}
+	return nil
+}
+
+func (m *memoryDeviceManager) Delete(devID string) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	i := m.index(devID)
+	if i < 0 {
+		return status.Error(codes.NotFound, "device not found")
+	}
+	m.devices = append(m.devices[:i], m.devices[i+1:]...)
+	return nil
+}
+
+func (m *memoryDeviceManager) CreateFromTemplate(template string, overrides Device) (*Device, error) {
+	return createFromTemplate(m, m.templates, template, overrides)
+}
+
+func (m *memoryDeviceManager) Query(query DeviceQuery, pageSize uint64) *DeviceQueryIterator {
+	return queryDevices(context.Background(), m, query, pageSize)
+}
+
+func (m *memoryDeviceManager) WithContext(ctx context.Context) DeviceManager { return m }
+
+// flakyDeviceManager is a DeviceManager of which the next Set requests fail
+type flakyDeviceManager struct {
+	*memoryDeviceManager
+	failMu   sync.Mutex
+	failures int
+	err      error
+}
+
+// failNext makes the next count Set requests fail with the error
+func (m *flakyDeviceManager) failNext(count int, err error) {
+	m.failMu.Lock()
+	defer m.failMu.Unlock()
+	m.failures, m.err = count, err
+}
+
+func (m *flakyDeviceManager) Set(dev *Device) error {
+	m.failMu.Lock()
+	if m.failures > 0 {
+		m.failures--
+		m.failMu.Unlock()
+		return m.err
+	}
+	m.failMu.Unlock()
+	return m.memoryDeviceManager.Set(dev)
+}
+
+func (m *flakyDeviceManager) WithContext(ctx context.Context) DeviceManager { return m }
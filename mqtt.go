@@ -7,49 +7,133 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"strings"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/TheThingsNetwork/go-utils/log"
 	"github.com/TheThingsNetwork/ttn/core/types"
 	"github.com/TheThingsNetwork/ttn/mqtt"
 )
 
-func (c *client) connectMQTT() (err error) {
+func (c *client) connectMQTT(ctx context.Context) (err error) {
 	c.mqtt.Lock()
 	defer c.mqtt.Unlock()
 	if c.mqtt.client != nil {
 		return nil
 	}
-	c.handler.RLock()
-	defer c.handler.RUnlock()
-	if c.handler.announcement == nil {
-		if err := c.discover(); err != nil {
-			return err
-		}
+	c.mqtt.client, err = c.dialMQTT(ctx)
+	if err != nil {
+		return err
 	}
-	if c.handler.announcement.MqttAddress == "" {
-		c.Logger.WithField("HandlerID", c.handler.announcement.ID).Debug("ttn-sdk: Handler does not announce MQTT address")
-		return errors.New("ttn-sdk: Handler does not announce MQTT address")
+	c.mqtt.ctx, c.mqtt.cancel = context.WithCancel(context.Background())
+	return nil
+}
+
+func (c *client) dialMQTT(ctx context.Context) (client mqtt.Client, err error) {
+	mqttAddress, err := c.getMQTTAddress(ctx)
+	if err != nil {
+		return nil, err
 	}
-	mqttAddress, err := cleanMQTTAddress(c.handler.announcement.MqttAddress)
+	mqttAddress, err = cleanMQTTAddress(mqttAddress)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if strings.HasPrefix(mqttAddress, "ssl://") {
-		c.mqtt.client = mqtt.NewTLSClient(c.Logger, c.ClientName, c.appID, c.appAccessKey, c.TLSConfig, mqttAddress)
-	} else {
-		c.mqtt.client = mqtt.NewClient(c.Logger, c.ClientName, c.appID, c.appAccessKey, mqttAddress)
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	c.mqtt.ctx, c.mqtt.cancel = context.WithCancel(context.Background())
+	mqttClient := newMQTTClient(c.Logger, c.ClientName, c.appID, c.appAccessKey, c.TLSConfig, mqttAddress)
+	mqttClient.onConnect = c.handleMQTTConnected
+	mqttClient.onLost = c.handleMQTTLost
+	client = mqttClient
 	logger := c.Logger.WithField("Address", mqttAddress)
 	logger.Debug("ttn-sdk: Connecting to MQTT...")
-	if err := c.mqtt.client.Connect(); err != nil {
+	if err := client.Connect(); err != nil {
 		logger.WithError(err).Debug("ttn-sdk: Could not connect to MQTT")
-		return err
+		return nil, err
 	}
 	logger.Debug("ttn-sdk: Connected to MQTT")
-	return nil
+	return client, nil
+}
+
+// reconnectMQTT replaces the MQTT client with a new one, and moves all subscriptions to the new client. If the client
+// is not connected to MQTT, it connects to the new address when PubSub() is called. It returns the first error of
+// moving the subscriptions.
+func (c *client) reconnectMQTT(ctx context.Context) error {
+	c.mqtt.resubscribe.Lock()
+	defer c.mqtt.resubscribe.Unlock()
+	c.mqtt.Lock()
+	if c.mqtt.client == nil {
+		c.mqtt.Unlock()
+		return nil
+	}
+	client, err := c.dialMQTT(ctx)
+	if err != nil {
+		c.mqtt.Unlock()
+		return err
+	}
+	previous := c.mqtt.client
+	c.mqtt.client = client
+	subscribers := make([]mqttSubscriber, 0, len(c.mqtt.subscribers))
+	for subscriber := range c.mqtt.subscribers {
+		subscribers = append(subscribers, subscriber)
+	}
+	c.mqtt.Unlock()
+	for _, subscriber := range subscribers {
+		if resubscribeErr := subscriber.resubscribe(client); resubscribeErr != nil && err == nil {
+			err = resubscribeErr
+		}
+	}
+	previous.Disconnect()
+	c.broadcastConnectionEvent(&ConnectionEvent{State: ConnectionResubscribed, Time: time.Now(), Err: err})
+	return err
+}
+
+// mqttSubscriber is implemented by the types that use the MQTT client
+type mqttSubscriber interface {
+	// resubscribe replaces the MQTT client and restores all subscriptions on the new client
+	resubscribe(mqtt.Client) error
+}
+
+// registerMQTTSubscriber registers the subscriber and sets its MQTT client
+func (c *client) registerMQTTSubscriber(subscriber mqttSubscriber) {
+	c.mqtt.Lock()
+	defer c.mqtt.Unlock()
+	if c.mqtt.subscribers == nil {
+		c.mqtt.subscribers = make(map[mqttSubscriber]struct{})
+	}
+	c.mqtt.subscribers[subscriber] = struct{}{}
+	subscriber.resubscribe(c.mqtt.client)
+}
+
+// unregisterMQTTSubscriber unregisters the subscriber and then calls teardown to remove its subscriptions. This waits
+// until subscriptions are no longer being moved to a new MQTT client.
+func (c *client) unregisterMQTTSubscriber(subscriber mqttSubscriber, teardown func()) {
+	c.mqtt.resubscribe.Lock()
+	defer c.mqtt.resubscribe.Unlock()
+	c.mqtt.Lock()
+	delete(c.mqtt.subscribers, subscriber)
+	c.mqtt.Unlock()
+	teardown()
+}
+
+func (c *client) getMQTTAddress(ctx context.Context) (string, error) {
+	if c.MQTTAddress != "" {
+		return c.MQTTAddress, nil
+	}
+	c.handler.Lock()
+	defer c.handler.Unlock()
+	if c.handler.announcement == nil {
+		if err := c.discover(ctx); err != nil {
+			return "", err
+		}
+	}
+	if c.handler.announcement.MqttAddress == "" {
+		c.Logger.WithField("HandlerID", c.handler.announcement.ID).Debug("ttn-sdk: Handler does not announce MQTT address")
+		return "", errors.New("ttn-sdk: Handler does not announce MQTT address")
+	}
+	return c.handler.announcement.MqttAddress, nil
 }
 
 func (c *client) closeMQTT() error {
@@ -65,21 +149,29 @@ func (c *client) closeMQTT() error {
 	return nil
 }
 
-var mqttBufferSize = 10
-
 // DevicePub interface for publishing downlink messages to the device
 type DevicePub interface {
 	Publish(*types.DownlinkMessage) error
+
+	// PublishTracked publishes the downlink message and returns a handle that resolves when the downlink message was
+	// delivered to the device, or when it failed
+	PublishTracked(*types.DownlinkMessage, ...DownlinkTrackingOptions) (*DownlinkHandle, error)
 }
 
-// DeviceSub interface for subscribing to uplink messages and events from the device
+// DeviceSub interface for subscribing to uplink messages and events from the device. The Subscribe functions accept
+// SubscriptionOptions for the subscription; if no options are given, the SubscriptionOptions of the ClientConfig are
+// used.
 type DeviceSub interface {
-	SubscribeUplink() (<-chan *types.UplinkMessage, error)
+	SubscribeUplink(options ...SubscriptionOptions) (<-chan *types.UplinkMessage, error)
 	UnsubscribeUplink() error
-	SubscribeEvents() (<-chan *types.DeviceEvent, error)
+	SubscribeEvents(options ...SubscriptionOptions) (<-chan *types.DeviceEvent, error)
 	UnsubscribeEvents() error
-	SubscribeActivations() (<-chan *types.Activation, error)
+	SubscribeActivations(options ...SubscriptionOptions) (<-chan *types.Activation, error)
 	UnsubscribeActivations() error
+
+	// Dropped returns the number of messages that were dropped by the subscriptions
+	Dropped() uint64
+
 	Close()
 }
 
@@ -90,59 +182,146 @@ type DevicePubSub interface {
 }
 
 type devicePubSub struct {
-	logger log.Interface
-	client mqtt.Client
-	ctx    context.Context
-	cancel context.CancelFunc
+	dropped            uint64
+	appDropped         *uint64
+	scheduledDownlinks uint64
+
+	// publishTracked is held while a tracked downlink message is added and published
+	publishTracked sync.Mutex
+
+	logger  log.Interface
+	ctx     context.Context
+	cancel  context.CancelFunc
+	codecs  *PayloadCodecRegistry
+	options SubscriptionOptions
+
+	// getAttributes returns the attributes that are stored for a device on the Handler
+	getAttributes func(devID string) (map[string]string, error)
 
 	appID string
 	devID string
 
+	// app is the ApplicationPubSub that dispatches the events and activations of the device, and whose MQTT client
+	// is used to publish downlink messages
+	app *applicationPubSub
+
+	// registered registers the device on its first subscription, so that its subscriptions are moved to a new MQTT
+	// client, and removed when the device is closed
+	registered sync.Once
+
 	sync.RWMutex
-	uplink      chan *types.UplinkMessage
-	events      chan *types.DeviceEvent
-	activations chan *types.Activation
+	client           mqtt.Client // Set when the device is registered
+	uplink           *subscriptionQueue
+	events           *subscriptionQueue
+	eventsSubscribed bool
+	downlinks        []*DownlinkHandle
+	activations      *subscriptionQueue
 }
 
 func (d *devicePubSub) Publish(downlink *types.DownlinkMessage) error {
+	msg, err := d.prepareDownlink(downlink)
+	if err != nil {
+		return err
+	}
+	return d.publish(msg)
+}
+
+// prepareDownlink returns a copy of the downlink message for the device, with its payload fields encoded
+func (d *devicePubSub) prepareDownlink(downlink *types.DownlinkMessage) (types.DownlinkMessage, error) {
 	msg := *downlink
 	msg.AppID = d.appID
 	msg.DevID = d.devID
-	token := d.client.PublishDownlink(msg)
+	if err := d.codecs.encodeDownlink(&msg, d.getAttributes); err != nil {
+		return msg, err
+	}
+	return msg, nil
+}
+
+// errMQTTNotConnected is returned when a message is published or subscribed to after the MQTT client was closed
+var errMQTTNotConnected = errors.New("ttn-sdk: Not connected to MQTT")
+
+func (d *devicePubSub) publish(msg types.DownlinkMessage) error {
+	if err := d.ctx.Err(); err != nil {
+		return err
+	}
+	d.app.RLock()
+	client := d.app.client
+	d.app.RUnlock()
+	if client == nil {
+		return errMQTTNotConnected
+	}
+	token := client.PublishDownlink(msg)
 	token.Wait()
 	return token.Error()
 }
 
-func (d *devicePubSub) SubscribeUplink() (<-chan *types.UplinkMessage, error) {
+// dropper returns the function that is called when the subscription drops a message
+func (d *devicePubSub) dropper(options SubscriptionOptions, subscription string) func(interface{}, error) {
+	return func(msg interface{}, err error) {
+		atomic.AddUint64(&d.dropped, 1)
+		if d.appDropped != nil {
+			atomic.AddUint64(d.appDropped, 1)
+		}
+		logger := d.logger.WithFields(log.Fields{"AppID": d.appID, "DevID": d.devID, "Subscription": subscription})
+		if err != nil {
+			logger = logger.WithError(err)
+		}
+		logger.Debug("ttn-sdk: Dropped message")
+		if options.OnDrop != nil {
+			options.OnDrop(DroppedMessage{AppID: d.appID, DevID: d.devID, Subscription: subscription, Message: msg, Err: err})
+		}
+	}
+}
+
+func (d *devicePubSub) Dropped() uint64 {
+	return atomic.LoadUint64(&d.dropped)
+}
+
+func (d *devicePubSub) SubscribeUplink(options ...SubscriptionOptions) (<-chan *types.UplinkMessage, error) {
+	return d.subscribeUplink(false, options)
+}
+
+func (d *devicePubSub) subscribeUplink(exclusive bool, options []SubscriptionOptions) (<-chan *types.UplinkMessage, error) {
 	if err := d.ctx.Err(); err != nil {
 		return nil, err
 	}
+	d.register()
 	d.Lock()
 	defer d.Unlock()
 	if d.uplink != nil {
-		return d.uplink, nil
-	}
-	d.uplink = make(chan *types.UplinkMessage, mqttBufferSize)
-	token := d.client.SubscribeDeviceUplink(d.appID, d.devID, func(_ mqtt.Client, appID string, devID string, msg types.UplinkMessage) {
-		msg.AppID = appID
-		msg.DevID = devID
-		d.RLock()
-		defer d.RUnlock()
-		if d.uplink == nil {
-			return
-		}
-		select {
-		case d.uplink <- &msg:
-		default:
+		if exclusive {
+			return nil, subscriptionInUseError("uplink")
 		}
-	})
+		return d.uplink.channel().(chan *types.UplinkMessage), nil
+	}
+	if d.client == nil {
+		return nil, errMQTTNotConnected
+	}
+	subscriptionOptions := subscriptionOptions(d.options, options)
+	uplink := make(chan *types.UplinkMessage, subscriptionOptions.bufferSize())
+	d.uplink = newSubscriptionQueue(uplink, subscriptionOptions, decodeUplink, d.dropper(subscriptionOptions, "uplink"))
+	token := d.client.SubscribeDeviceUplink(d.appID, d.devID, d.handleUplink)
 	token.Wait()
-	err := token.Error()
-	if err != nil {
-		close(d.uplink)
+	if err := token.Error(); err != nil {
+		d.uplink.close()
 		d.uplink = nil
+		return nil, err
+	}
+	return uplink, nil
+}
+
+func (d *devicePubSub) handleUplink(_ mqtt.Client, appID string, devID string, msg types.UplinkMessage) {
+	msg.AppID = appID
+	msg.DevID = devID
+	if err := d.codecs.decodeUplink(&msg); err != nil {
+		d.logger.WithError(err).WithFields(log.Fields{"AppID": appID, "DevID": devID}).Warn("ttn-sdk: Could not decode uplink payload")
+	}
+	d.RLock()
+	uplink := d.uplink
+	d.RUnlock()
+	if uplink != nil {
+		uplink.push(&msg)
 	}
-	return d.uplink, err
 }
 
 func (d *devicePubSub) UnsubscribeUplink() error {
@@ -151,52 +330,83 @@ func (d *devicePubSub) UnsubscribeUplink() error {
 	if d.uplink == nil {
 		return nil
 	}
+	d.uplink.close()
+	d.uplink = nil
 	token := d.client.UnsubscribeDeviceUplink(d.appID, d.devID)
 	token.Wait()
-	close(d.uplink)
-	d.uplink = nil
 	return token.Error()
 }
 
-func (d *devicePubSub) SubscribeEvents() (<-chan *types.DeviceEvent, error) {
+func (d *devicePubSub) SubscribeEvents(options ...SubscriptionOptions) (<-chan *types.DeviceEvent, error) {
+	return d.subscribeEvents(false, options)
+}
+
+func (d *devicePubSub) subscribeEvents(exclusive bool, options []SubscriptionOptions) (<-chan *types.DeviceEvent, error) {
 	if err := d.ctx.Err(); err != nil {
 		return nil, err
 	}
+	d.register()
 	d.Lock()
 	defer d.Unlock()
 	if d.events != nil {
-		return d.events, nil
-	}
-	d.events = make(chan *types.DeviceEvent, mqttBufferSize)
-	token := d.client.SubscribeDeviceEvents(d.appID, d.devID, "#", func(_ mqtt.Client, appID string, devID string, eventType types.EventType, payload []byte) {
-		msg := types.DeviceEvent{
-			AppID: appID,
-			DevID: devID,
-			Event: eventType,
+		if exclusive {
+			return nil, subscriptionInUseError("events")
 		}
-		eventData := eventType.Data()
-		if eventData != nil {
-			if err := json.Unmarshal(payload, eventData); err == nil {
-				msg.Data = eventData
-			}
-		}
-		d.RLock()
-		defer d.RUnlock()
-		if d.events == nil {
-			return
-		}
-		select {
-		case d.events <- &msg:
-		default:
-		}
-	})
-	token.Wait()
-	err := token.Error()
-	if err != nil {
-		close(d.events)
+		return d.events.channel().(chan *types.DeviceEvent), nil
+	}
+	subscriptionOptions := subscriptionOptions(d.options, options)
+	events := make(chan *types.DeviceEvent, subscriptionOptions.bufferSize())
+	d.events = newSubscriptionQueue(events, subscriptionOptions, decodeDeviceEvent, d.dropper(subscriptionOptions, "events"))
+	if err := d.subscribeEventsLocked(); err != nil {
+		d.events.close()
 		d.events = nil
+		return nil, err
+	}
+	return events, nil
+}
+
+// subscribeEventsLocked subscribes to the events of the device, which is used by both the events subscription
+// and the tracking of downlink messages. It must be called with the lock held.
+func (d *devicePubSub) subscribeEventsLocked() error {
+	if d.eventsSubscribed {
+		return nil
+	}
+	if err := d.app.addDeviceEventListener(d, d.devID, "", d.handleEvent); err != nil {
+		return err
+	}
+	d.eventsSubscribed = true
+	return nil
+}
+
+// unsubscribeEventsLocked unsubscribes from the events of the device if it is no longer used. It must be called
+// with the lock held.
+func (d *devicePubSub) unsubscribeEventsLocked() error {
+	if !d.eventsSubscribed || d.events != nil || len(d.downlinks) > 0 {
+		return nil
 	}
-	return d.events, err
+	d.eventsSubscribed = false
+	return d.app.removeDeviceEventListener(d)
+}
+
+func (d *devicePubSub) handleEvent(_ mqtt.Client, appID string, devID string, eventType types.EventType, payload []byte) {
+	msg := types.DeviceEvent{
+		AppID: appID,
+		DevID: devID,
+		Event: eventType,
+	}
+	eventData := eventType.Data()
+	if eventData != nil {
+		if err := json.Unmarshal(payload, eventData); err == nil {
+			msg.Data = eventData
+		}
+	}
+	d.RLock()
+	events := d.events
+	d.RUnlock()
+	if events != nil {
+		events.push(&msg)
+	}
+	d.trackDownlink(&msg)
 }
 
 func (d *devicePubSub) UnsubscribeEvents() error {
@@ -205,43 +415,126 @@ func (d *devicePubSub) UnsubscribeEvents() error {
 	if d.events == nil {
 		return nil
 	}
-	token := d.client.UnsubscribeDeviceEvents(d.appID, d.devID, "#")
-	token.Wait()
-	close(d.events)
+	d.events.close()
 	d.events = nil
-	return token.Error()
+	return d.unsubscribeEventsLocked()
+}
+
+func (d *devicePubSub) SubscribeActivations(options ...SubscriptionOptions) (<-chan *types.Activation, error) {
+	return d.subscribeActivations(false, options)
 }
 
-func (d *devicePubSub) SubscribeActivations() (<-chan *types.Activation, error) {
+func (d *devicePubSub) subscribeActivations(exclusive bool, options []SubscriptionOptions) (<-chan *types.Activation, error) {
 	if err := d.ctx.Err(); err != nil {
 		return nil, err
 	}
+	d.register()
 	d.Lock()
 	defer d.Unlock()
 	if d.activations != nil {
-		return d.activations, nil
-	}
-	d.activations = make(chan *types.Activation, mqttBufferSize)
-	token := d.client.SubscribeDeviceActivations(d.appID, d.devID, func(_ mqtt.Client, appID string, devID string, mqg types.Activation) {
-		mqg.AppID = appID
-		mqg.DevID = devID
-		d.RLock()
-		defer d.RUnlock()
-		if d.activations == nil {
-			return
+		if exclusive {
+			return nil, subscriptionInUseError("activations")
 		}
-		select {
-		case d.activations <- &mqg:
-		default:
-		}
-	})
-	token.Wait()
-	err := token.Error()
-	if err != nil {
-		close(d.activations)
+		return d.activations.channel().(chan *types.Activation), nil
+	}
+	subscriptionOptions := subscriptionOptions(d.options, options)
+	activations := make(chan *types.Activation, subscriptionOptions.bufferSize())
+	d.activations = newSubscriptionQueue(activations, subscriptionOptions, decodeActivation, d.dropper(subscriptionOptions, "activations"))
+	if err := d.app.addDeviceEventListener(activationsListener{d}, d.devID, types.ActivationEvent, d.handleActivationEvent); err != nil {
+		d.activations.close()
 		d.activations = nil
+		return nil, err
+	}
+	return activations, nil
+}
+
+// subscriptionInUseError returns the error for an exclusive subscription that is already in use
+func subscriptionInUseError(subscription string) error {
+	return fmt.Errorf("ttn-sdk: the %s subscription is already in use", subscription)
+}
+
+// exclusiveSubscriber is implemented by DeviceSubs that can refuse to share their subscriptions. If exclusive is set,
+// the subscribe funcs return an error if the subscription is already in use, instead of returning its channel.
+type exclusiveSubscriber interface {
+	subscribeUplink(exclusive bool, options []SubscriptionOptions) (<-chan *types.UplinkMessage, error)
+	subscribeEvents(exclusive bool, options []SubscriptionOptions) (<-chan *types.DeviceEvent, error)
+	subscribeActivations(exclusive bool, options []SubscriptionOptions) (<-chan *types.Activation, error)
+	defaultSubscriptionOptions() SubscriptionOptions
+}
+
+func (d *devicePubSub) defaultSubscriptionOptions() SubscriptionOptions {
+	return d.options
+}
+
+// subscribeUplinkExclusive subscribes to the uplink messages of the DeviceSub, and returns an error if the DeviceSub
+// supports it and its uplink messages are already subscribed to
+func subscribeUplinkExclusive(sub DeviceSub, options []SubscriptionOptions) (<-chan *types.UplinkMessage, error) {
+	if sub, ok := sub.(exclusiveSubscriber); ok {
+		return sub.subscribeUplink(true, options)
+	}
+	return sub.SubscribeUplink(options...)
+}
+
+// subscribeEventsExclusive subscribes to the events of the DeviceSub, and returns an error if the DeviceSub supports
+// it and its events are already subscribed to
+func subscribeEventsExclusive(sub DeviceSub, options []SubscriptionOptions) (<-chan *types.DeviceEvent, error) {
+	if sub, ok := sub.(exclusiveSubscriber); ok {
+		return sub.subscribeEvents(true, options)
+	}
+	return sub.SubscribeEvents(options...)
+}
+
+// subscribeActivationsExclusive subscribes to the activations of the DeviceSub, and returns an error if the DeviceSub
+// supports it and its activations are already subscribed to
+func subscribeActivationsExclusive(sub DeviceSub, options []SubscriptionOptions) (<-chan *types.Activation, error) {
+	if sub, ok := sub.(exclusiveSubscriber); ok {
+		return sub.subscribeActivations(true, options)
+	}
+	return sub.SubscribeActivations(options...)
+}
+
+// subscriptionOptionsWithOnDrop returns the default options of the DeviceSub, with onDrop called in addition to the
+// OnDrop of the defaults
+func subscriptionOptionsWithOnDrop(sub DeviceSub, onDrop func(DroppedMessage)) SubscriptionOptions {
+	exclusive, ok := sub.(exclusiveSubscriber)
+	if !ok {
+		return SubscriptionOptions{OnDrop: onDrop}
+	}
+	options := exclusive.defaultSubscriptionOptions()
+	if defaultOnDrop := options.OnDrop; defaultOnDrop != nil {
+		options.OnDrop = func(msg DroppedMessage) {
+			defaultOnDrop(msg)
+			onDrop(msg)
+		}
+	} else {
+		options.OnDrop = onDrop
+	}
+	return options
+}
+
+// activationsListener is the key of the activations listener of the device
+type activationsListener struct {
+	*devicePubSub
+}
+
+func (d *devicePubSub) handleActivationEvent(client mqtt.Client, appID string, devID string, _ types.EventType, payload []byte) {
+	var msg types.Activation
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		d.logger.WithError(err).WithFields(log.Fields{"AppID": appID, "DevID": devID}).Warn("ttn-sdk: Could not unmarshal activation")
+		return
+	}
+	d.handleActivation(client, appID, devID, msg)
+}
+
+func (d *devicePubSub) handleActivation(_ mqtt.Client, appID string, devID string, msg types.Activation) {
+	msg.AppID = appID
+	msg.DevID = devID
+	d.RLock()
+	activations := d.activations
+	d.RUnlock()
+	if activations != nil {
+		activations.push(&msg)
 	}
-	return d.activations, err
 }
 
 func (d *devicePubSub) UnsubscribeActivations() error {
@@ -250,48 +543,126 @@ func (d *devicePubSub) UnsubscribeActivations() error {
 	if d.activations == nil {
 		return nil
 	}
-	token := d.client.UnsubscribeDeviceActivations(d.appID, d.devID)
-	token.Wait()
-	close(d.activations)
+	d.activations.close()
 	d.activations = nil
-	return token.Error()
+	return d.app.removeDeviceEventListener(activationsListener{d})
 }
 
 func (d *devicePubSub) Close() {
 	d.cancel()
 }
 
+// register registers the device with the client and removes its subscriptions when it is closed. It must be called
+// without holding the lock.
+func (d *devicePubSub) register() {
+	d.registered.Do(func() {
+		d.app.register(d)
+		go func() {
+			<-d.ctx.Done()
+			d.app.unregister(d, func() {
+				d.UnsubscribeUplink()
+				d.UnsubscribeEvents()
+				d.UnsubscribeActivations()
+			})
+		}()
+	})
+}
+
+func (d *devicePubSub) resubscribe(client mqtt.Client) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.client == client {
+		return nil
+	}
+	d.client = client
+	return d.restoreLocked()
+}
+
+func (d *devicePubSub) restoreLocked() error {
+	var tokens []mqtt.Token
+	if d.uplink != nil {
+		tokens = append(tokens, d.client.SubscribeDeviceUplink(d.appID, d.devID, d.handleUplink))
+	}
+	return waitForRestore(d.logger, tokens)
+}
+
+// waitForRestore waits for the tokens of restored subscriptions, and returns the first error
+func waitForRestore(logger log.Interface, tokens []mqtt.Token) (err error) {
+	for _, token := range tokens {
+		token.Wait()
+		if tokenErr := token.Error(); tokenErr != nil {
+			logger.WithError(tokenErr).Warn("ttn-sdk: Could not restore subscription")
+			if err == nil {
+				err = tokenErr
+			}
+		}
+	}
+	return err
+}
+
 // ApplicationPubSub interface for publishing and subscribing to devices in an application
 type ApplicationPubSub interface {
 	Publish(devID string, downlink *types.DownlinkMessage) error
 	Device(devID string) DevicePubSub
 	AllDevices() DeviceSub
+
+	// SubscribeApplicationEvents subscribes to the events of the application itself, such as application errors
+	SubscribeApplicationEvents(options ...SubscriptionOptions) (<-chan *ApplicationEvent, error)
+	UnsubscribeApplicationEvents() error
+
+	// SubscribeAllEvents subscribes to the events of the application and the events of all its devices
+	SubscribeAllEvents(options ...SubscriptionOptions) (<-chan *Event, error)
+	UnsubscribeAllEvents() error
+
+	// SubscribeConnectionEvents subscribes to the lifecycle events of the MQTT connection. When the connection is
+	// lost, the client reconnects by itself and restores all subscriptions of the ApplicationPubSub and its devices.
+	SubscribeConnectionEvents(options ...SubscriptionOptions) (<-chan *ConnectionEvent, error)
+	UnsubscribeConnectionEvents() error
+
+	// Dropped returns the number of messages that were dropped by the subscriptions of the ApplicationPubSub and the
+	// subscriptions of its devices
+	Dropped() uint64
+
 	Close()
 }
 
 type applicationPubSub struct {
-	logger log.Interface
-	client mqtt.Client
-	ctx    context.Context
-	cancel context.CancelFunc
+	dropped uint64
+
+	logger     log.Interface
+	ctx        context.Context
+	cancel     context.CancelFunc
+	register   func(mqttSubscriber)
+	unregister func(mqttSubscriber, func())
+	codecs     *PayloadCodecRegistry
+	options    SubscriptionOptions
+
+	// getAttributes returns the attributes that are stored for a device on the Handler
+	getAttributes func(devID string) (map[string]string, error)
 
 	appID string
+
+	sync.RWMutex
+	client               mqtt.Client
+	appEvents            *subscriptionQueue
+	allEvents            *subscriptionQueue
+	connectionEvents     *subscriptionQueue
+	deviceEventListeners map[interface{}]deviceEventSubscription
+	deviceEventTopics    map[string]struct{}
 }
 
 func (a *applicationPubSub) Device(devID string) DevicePubSub {
 	d := &devicePubSub{
-		logger: a.logger,
-		client: a.client,
-		appID:  a.appID,
-		devID:  devID,
+		appDropped:    &a.dropped,
+		logger:        a.logger,
+		codecs:        a.codecs,
+		options:       a.options,
+		getAttributes: a.getAttributes,
+		appID:         a.appID,
+		devID:         devID,
+		app:           a,
 	}
 	d.ctx, d.cancel = context.WithCancel(a.ctx)
-	go func() {
-		<-d.ctx.Done()
-		d.UnsubscribeUplink()
-		d.UnsubscribeEvents()
-		d.UnsubscribeActivations()
-	}()
 	return d
 }
 
@@ -301,30 +672,80 @@ func (a *applicationPubSub) AllDevices() DeviceSub {
 
 func (a *applicationPubSub) Publish(devID string, downlink *types.DownlinkMessage) error {
 	d := &devicePubSub{
-		logger: a.logger,
-		client: a.client,
-		appID:  a.appID,
-		devID:  devID,
+		logger:        a.logger,
+		ctx:           a.ctx,
+		codecs:        a.codecs,
+		getAttributes: a.getAttributes,
+		appID:         a.appID,
+		devID:         devID,
+		app:           a,
 	}
 	return d.Publish(downlink)
 }
 
+func (a *applicationPubSub) resubscribe(client mqtt.Client) error {
+	a.Lock()
+	defer a.Unlock()
+	if a.client == client {
+		return nil
+	}
+	previous := a.client
+	a.client = client
+	if previous == nil {
+		return nil
+	}
+	return a.restoreLocked()
+}
+
+func (a *applicationPubSub) restoreLocked() error {
+	var tokens []mqtt.Token
+	if a.appEvents != nil || a.allEvents != nil {
+		tokens = append(tokens, a.subscribeAppEvents())
+	}
+	for devID := range a.deviceEventTopics {
+		tokens = append(tokens, a.subscribeDeviceEvents(devID))
+	}
+	return waitForRestore(a.logger, tokens)
+}
+
 func (a *applicationPubSub) Close() {
 	a.cancel()
 }
 
 func (c *client) PubSub() (ApplicationPubSub, error) {
-	if err := c.connectMQTT(); err != nil {
+	return c.pubSub(context.Background())
+}
+
+func (c *client) pubSub(ctx context.Context) (ApplicationPubSub, error) {
+	if err := c.connectMQTT(ctx); err != nil {
 		return nil, err
 	}
-	if err := c.mqtt.ctx.Err(); err != nil {
+	c.mqtt.RLock()
+	mqttCtx := c.mqtt.ctx
+	c.mqtt.RUnlock()
+	if err := mqttCtx.Err(); err != nil {
 		return nil, err
 	}
 	a := &applicationPubSub{
-		logger: c.Logger,
-		client: c.mqtt.client,
-		appID:  c.appID,
+		logger:     c.Logger,
+		register:   c.registerMQTTSubscriber,
+		unregister: c.unregisterMQTTSubscriber,
+		codecs:     c.PayloadCodecs,
+		options:    c.SubscriptionOptions,
+		appID:      c.appID,
 	}
-	a.ctx, a.cancel = context.WithCancel(c.mqtt.ctx)
+	a.ctx, a.cancel = context.WithCancel(mqttCtx)
+	a.getAttributes = func(devID string) (map[string]string, error) {
+		return c.deviceAttributes(a.ctx, devID)
+	}
+	c.registerMQTTSubscriber(a)
+	go func() {
+		<-a.ctx.Done()
+		c.unregisterMQTTSubscriber(a, func() {
+			a.UnsubscribeApplicationEvents()
+			a.UnsubscribeAllEvents()
+			a.UnsubscribeConnectionEvents()
+		})
+	}()
 	return a, nil
 }
@@ -0,0 +1,395 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/TheThingsNetwork/ttn/core/types"
+)
+
+// DefaultSubscriptionBufferSize is the number of messages that are buffered for a subscription if no buffer size is
+// given in the options
+var DefaultSubscriptionBufferSize = 10
+
+// OverflowPolicy determines what happens to messages that arrive while the buffer of a subscription is full
+type OverflowPolicy int
+
+const (
+	// OverflowDropNewest drops the messages that arrive while the buffer is full
+	OverflowDropNewest OverflowPolicy = iota
+
+	// OverflowDropOldest drops the oldest message in the buffer to make room for the message that arrives
+	OverflowDropOldest
+
+	// OverflowBlock waits until there is room in the buffer. Keep in mind that this also holds up the delivery of
+	// messages to the other subscriptions of the MQTT client.
+	OverflowBlock
+
+	// OverflowSpillToDisk writes the messages that do not fit in the buffer to a temporary file, and delivers them in
+	// order when there is room in the buffer again. Spilled messages that are not yet delivered when the subscription
+	// ends are dropped.
+	OverflowSpillToDisk
+)
+
+// DroppedMessage is a message that was dropped by a subscription
+type DroppedMessage struct {
+	AppID string
+
+	// The DevID of the subscription. This is empty for application subscriptions and "+" for the subscriptions of
+	// AllDevices().
+	DevID string
+
+	// The subscription that dropped the message: "uplink", "events", "activations", "application-events",
+	// "all-events" or "connection-events"
+	Subscription string
+
+	// The message that was dropped. This is nil if a spilled message could not be read back.
+	Message interface{}
+
+	// The error that caused the message to be dropped (if any), for example if it could not be spilled to disk
+	Err error
+}
+
+// SubscriptionOptions contains the options for subscriptions
+type SubscriptionOptions struct {
+	// The number of messages that are buffered (in the default config, this is DefaultSubscriptionBufferSize)
+	BufferSize int
+
+	// What happens to messages that arrive while the buffer is full (in the default config, they are dropped)
+	Overflow OverflowPolicy
+
+	// Directory for the files of OverflowSpillToDisk (in the default config, this is the default directory for
+	// temporary files)
+	SpillDir string
+
+	// Function that is called for every message that is dropped (optional). It must not block.
+	OnDrop func(DroppedMessage)
+}
+
+func (o SubscriptionOptions) bufferSize() int {
+	if o.BufferSize <= 0 {
+		return DefaultSubscriptionBufferSize
+	}
+	return o.BufferSize
+}
+
+// subscriptionOptions returns the options given to a Subscribe function, or the defaults if none are given
+func subscriptionOptions(defaults SubscriptionOptions, options []SubscriptionOptions) SubscriptionOptions {
+	if len(options) > 0 {
+		return options[0]
+	}
+	return defaults
+}
+
+// subscriptionQueue delivers the messages of a subscription to its channel, applying the overflow policy when the
+// channel is full. Messages that are pushed after the queue is closed are ignored.
+type subscriptionQueue struct {
+	out     reflect.Value
+	options SubscriptionOptions
+	decode  func([]byte) (interface{}, error)
+	drop    func(msg interface{}, err error)
+
+	mu       sync.Mutex
+	closed   bool
+	done     chan struct{}
+	inflight sync.WaitGroup
+
+	send  sync.Mutex
+	spill *spillFile
+}
+
+// newSubscriptionQueue returns a queue for the channel. The decode func reads back messages that were spilled to disk
+// as JSON, the drop func is called for every message that is dropped.
+func newSubscriptionQueue(channel interface{}, options SubscriptionOptions, decode func([]byte) (interface{}, error), drop func(msg interface{}, err error)) *subscriptionQueue {
+	q := &subscriptionQueue{
+		out:     reflect.ValueOf(channel),
+		options: options,
+		decode:  decode,
+		drop:    drop,
+		done:    make(chan struct{}),
+	}
+	if options.Overflow == OverflowSpillToDisk {
+		q.spill = &spillFile{
+			dir:     options.SpillDir,
+			notify:  make(chan struct{}, 1),
+			stopped: make(chan struct{}),
+		}
+		go q.deliverSpilled()
+	}
+	return q
+}
+
+// channel returns the channel of the queue
+func (q *subscriptionQueue) channel() interface{} {
+	return q.out.Interface()
+}
+
+func (q *subscriptionQueue) push(msg interface{}) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.inflight.Add(1)
+	q.mu.Unlock()
+	defer q.inflight.Done()
+
+	q.send.Lock()
+	defer q.send.Unlock()
+	value := reflect.ValueOf(msg)
+	switch q.options.Overflow {
+	case OverflowDropOldest:
+		for !q.out.TrySend(value) {
+			if oldest, ok := q.out.TryRecv(); ok {
+				q.drop(oldest.Interface(), nil)
+			}
+		}
+	case OverflowBlock:
+		if !q.sendOrDone(value) {
+			q.drop(msg, nil)
+		}
+	case OverflowSpillToDisk:
+		q.pushSpill(msg, value)
+	default:
+		if !q.out.TrySend(value) {
+			q.drop(msg, nil)
+		}
+	}
+}
+
+// sendOrDone blocks until the value is sent or the queue is closed. It returns false if the queue was closed.
+func (q *subscriptionQueue) sendOrDone(value reflect.Value) bool {
+	chosen, _, _ := reflect.Select([]reflect.SelectCase{
+		{Dir: reflect.SelectSend, Chan: q.out, Send: value},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(q.done)},
+	})
+	return chosen == 0
+}
+
+func (q *subscriptionQueue) pushSpill(msg interface{}, value reflect.Value) {
+	s := q.spill
+	s.Lock()
+	defer s.Unlock()
+	if s.pending == 0 && q.out.TrySend(value) {
+		return
+	}
+	data, err := json.Marshal(msg)
+	if err == nil {
+		err = s.write(data)
+	}
+	if err != nil {
+		q.drop(msg, err)
+		return
+	}
+	s.pending++
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// deliverSpilled delivers the spilled messages in order until the queue is closed
+func (q *subscriptionQueue) deliverSpilled() {
+	s := q.spill
+	defer close(s.stopped)
+	for {
+		select {
+		case <-s.notify:
+		case <-q.done:
+			return
+		}
+		for {
+			s.Lock()
+			if s.pending == 0 {
+				s.Unlock()
+				break
+			}
+			data, err := s.read()
+			s.Unlock()
+			var msg interface{}
+			if err == nil {
+				msg, err = q.decode(data)
+			}
+			if err != nil {
+				q.drop(nil, err)
+			} else if !q.sendOrDone(reflect.ValueOf(msg)) {
+				q.drop(msg, nil)
+				s.Lock()
+				s.pending--
+				s.Unlock()
+				return
+			}
+			s.Lock()
+			s.pending--
+			if s.pending == 0 {
+				s.reset()
+			}
+			s.Unlock()
+		}
+	}
+}
+
+// close stops the delivery of messages and closes the channel
+func (q *subscriptionQueue) close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	close(q.done)
+	q.mu.Unlock()
+	q.inflight.Wait()
+	if s := q.spill; s != nil {
+		<-s.stopped
+		s.Lock()
+		for ; s.pending > 0; s.pending-- {
+			var msg interface{}
+			data, err := s.read()
+			if err == nil {
+				msg, err = q.decode(data)
+			}
+			q.drop(msg, err)
+		}
+		s.remove()
+		s.Unlock()
+	}
+	q.out.Close()
+}
+
+// spillFile is a temporary file with length-prefixed records. It is created when the first record is written.
+type spillFile struct {
+	dir     string
+	notify  chan struct{}
+	stopped chan struct{}
+
+	sync.Mutex
+	file        *os.File
+	readOffset  int64
+	writeOffset int64
+	pending     int
+}
+
+func (s *spillFile) write(data []byte) error {
+	if s.file == nil {
+		file, err := ioutil.TempFile(s.dir, "ttn-sdk-spill-")
+		if err != nil {
+			return err
+		}
+		s.file = file
+	}
+	record := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[4:], data)
+	if _, err := s.file.WriteAt(record, s.writeOffset); err != nil {
+		return err
+	}
+	s.writeOffset += int64(len(record))
+	return nil
+}
+
+func (s *spillFile) read() ([]byte, error) {
+	var header [4]byte
+	if _, err := s.file.ReadAt(header[:], s.readOffset); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := s.file.ReadAt(data, s.readOffset+4); err != nil {
+		return nil, err
+	}
+	s.readOffset += int64(4 + len(data))
+	return data, nil
+}
+
+// reset truncates the file when all records are delivered
+func (s *spillFile) reset() {
+	if s.file != nil {
+		s.file.Truncate(0)
+	}
+	s.readOffset, s.writeOffset = 0, 0
+}
+
+func (s *spillFile) remove() {
+	if s.file == nil {
+		return
+	}
+	s.file.Close()
+	os.Remove(s.file.Name())
+	s.file = nil
+}
+
+func decodeUplink(data []byte) (interface{}, error) {
+	msg := new(types.UplinkMessage)
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func decodeActivation(data []byte) (interface{}, error) {
+	msg := new(types.Activation)
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// spilledEvent is used to read back spilled events, of which the type of the Data depends on the Event
+type spilledEvent struct {
+	AppID string
+	DevID string
+	Event types.EventType
+	Data  json.RawMessage
+}
+
+func (e spilledEvent) deviceEventData() interface{} {
+	eventData := e.Event.Data()
+	if eventData == nil || len(e.Data) == 0 || string(e.Data) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(e.Data, eventData); err != nil {
+		return nil
+	}
+	return eventData
+}
+
+func decodeDeviceEvent(data []byte) (interface{}, error) {
+	var event spilledEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+	return &types.DeviceEvent{AppID: event.AppID, DevID: event.DevID, Event: event.Event, Data: event.deviceEventData()}, nil
+}
+
+func decodeApplicationEvent(data []byte) (interface{}, error) {
+	var event spilledEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+	msg := &ApplicationEvent{AppID: event.AppID, Event: event.Event}
+	if string(event.Data) != "null" {
+		msg.Data = applicationEventData(event.Event, event.Data)
+	}
+	return msg, nil
+}
+
+func decodeEvent(data []byte) (interface{}, error) {
+	var event spilledEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+	msg := &Event{AppID: event.AppID, DevID: event.DevID, Event: event.Event}
+	if event.DevID != "" {
+		msg.Data = event.deviceEventData()
+	} else if string(event.Data) != "null" {
+		msg.Data = applicationEventData(event.Event, event.Data)
+	}
+	return msg, nil
+}
@@ -0,0 +1,204 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	ttnlog "github.com/TheThingsNetwork/go-utils/log"
+	testlog "github.com/TheThingsNetwork/go-utils/log/test"
+	"github.com/TheThingsNetwork/ttn/core/types"
+	. "github.com/smartystreets/assertions"
+)
+
+// droppedUplinks collects the FCnt of dropped uplink messages
+type droppedUplinks struct {
+	sync.Mutex
+	fCnts []uint32
+	errs  []error
+}
+
+func (d *droppedUplinks) drop(msg interface{}, err error) {
+	d.Lock()
+	defer d.Unlock()
+	if uplink, ok := msg.(*types.UplinkMessage); ok {
+		d.fCnts = append(d.fCnts, uplink.FCnt)
+	}
+	if err != nil {
+		d.errs = append(d.errs, err)
+	}
+}
+
+func (d *droppedUplinks) get() []uint32 {
+	d.Lock()
+	defer d.Unlock()
+	return append([]uint32{}, d.fCnts...)
+}
+
+func receiveUplinks(t *testing.T, uplink <-chan *types.UplinkMessage, n int) (fCnts []uint32) {
+	for i := 0; i < n; i++ {
+		select {
+		case msg := <-uplink:
+			fCnts = append(fCnts, msg.FCnt)
+		case <-time.After(time.Second):
+			t.Fatalf("Did not receive uplink %d within a second", i)
+		}
+	}
+	return fCnts
+}
+
+func TestSubscriptionQueue(t *testing.T) {
+	a := New(t)
+
+	dir, err := ioutil.TempDir("", "ttn-sdk-test-")
+	a.So(err, ShouldBeNil)
+	defer os.RemoveAll(dir)
+
+	newQueue := func(policy OverflowPolicy) (chan *types.UplinkMessage, *subscriptionQueue, *droppedUplinks) {
+		dropped := new(droppedUplinks)
+		uplink := make(chan *types.UplinkMessage, 2)
+		options := SubscriptionOptions{Overflow: policy, SpillDir: dir}
+		return uplink, newSubscriptionQueue(uplink, options, decodeUplink, dropped.drop), dropped
+	}
+
+	{
+		uplink, q, dropped := newQueue(OverflowDropNewest)
+		for fCnt := uint32(1); fCnt <= 3; fCnt++ {
+			q.push(&types.UplinkMessage{FCnt: fCnt})
+		}
+		a.So(dropped.get(), ShouldResemble, []uint32{3})
+		a.So(receiveUplinks(t, uplink, 2), ShouldResemble, []uint32{1, 2})
+		q.close()
+		_, ok := <-uplink
+		a.So(ok, ShouldBeFalse)
+		q.push(&types.UplinkMessage{FCnt: 4}) // Ignored after close
+		a.So(dropped.get(), ShouldHaveLength, 1)
+	}
+
+	{
+		uplink, q, dropped := newQueue(OverflowDropOldest)
+		for fCnt := uint32(1); fCnt <= 3; fCnt++ {
+			q.push(&types.UplinkMessage{FCnt: fCnt})
+		}
+		a.So(dropped.get(), ShouldResemble, []uint32{1})
+		a.So(receiveUplinks(t, uplink, 2), ShouldResemble, []uint32{2, 3})
+		q.close()
+	}
+
+	{
+		uplink, q, dropped := newQueue(OverflowBlock)
+		pushed := make(chan struct{})
+		go func() {
+			for fCnt := uint32(1); fCnt <= 3; fCnt++ {
+				q.push(&types.UplinkMessage{FCnt: fCnt})
+			}
+			close(pushed)
+		}()
+		time.Sleep(10 * time.Millisecond)
+		a.So(receiveUplinks(t, uplink, 3), ShouldResemble, []uint32{1, 2, 3})
+		<-pushed
+		a.So(dropped.get(), ShouldBeEmpty)
+
+		// Closing the queue releases a blocked push
+		q.push(&types.UplinkMessage{FCnt: 4})
+		q.push(&types.UplinkMessage{FCnt: 5})
+		go q.push(&types.UplinkMessage{FCnt: 6})
+		time.Sleep(10 * time.Millisecond)
+		q.close()
+		a.So(dropped.get(), ShouldResemble, []uint32{6})
+	}
+
+	{
+		uplink, q, dropped := newQueue(OverflowSpillToDisk)
+		for fCnt := uint32(1); fCnt <= 5; fCnt++ {
+			q.push(&types.UplinkMessage{FCnt: fCnt, PayloadFields: map[string]interface{}{"fcnt": fmt.Sprint(fCnt)}})
+		}
+		a.So(dropped.get(), ShouldBeEmpty)
+		a.So(receiveUplinks(t, uplink, 3), ShouldResemble, []uint32{1, 2, 3})
+		q.push(&types.UplinkMessage{FCnt: 6}) // Must be delivered after the spilled messages
+		select {
+		case msg := <-uplink:
+			a.So(msg.FCnt, ShouldEqual, 4)
+			a.So(msg.PayloadFields, ShouldResemble, map[string]interface{}{"fcnt": "4"})
+		case <-time.After(time.Second):
+			t.Fatal("Did not receive spilled uplink within a second")
+		}
+		a.So(receiveUplinks(t, uplink, 2), ShouldResemble, []uint32{5, 6})
+
+		// Spilled messages that are not delivered are dropped when the queue is closed
+		for fCnt := uint32(7); fCnt <= 10; fCnt++ {
+			q.push(&types.UplinkMessage{FCnt: fCnt})
+		}
+		spillFile := q.spill.file.Name()
+		q.close()
+		a.So(dropped.get(), ShouldResemble, []uint32{9, 10})
+		_, err := os.Stat(spillFile)
+		a.So(os.IsNotExist(err), ShouldBeTrue)
+	}
+}
+
+func TestSubscriptionOverflow(t *testing.T) {
+	a := New(t)
+
+	log := testlog.NewLogger()
+	ttnlog.Set(log)
+	defer log.Print(t)
+
+	broker, err := newMockMQTTBroker()
+	a.So(err, ShouldBeNil)
+	defer broker.Close()
+
+	var droppedMu sync.Mutex
+	var dropped []DroppedMessage
+
+	config := NewConfig("test", "", "")
+	config.Logger = log
+	config.MQTTAddress = "mqtt://" + broker.Addr().String()
+	config.SubscriptionOptions = SubscriptionOptions{
+		BufferSize: 1,
+		OnDrop: func(msg DroppedMessage) {
+			droppedMu.Lock()
+			defer droppedMu.Unlock()
+			dropped = append(dropped, msg)
+		},
+	}
+	client := config.NewClient("test", "")
+	defer client.Close()
+
+	pubsub, err := client.PubSub()
+	a.So(err, ShouldBeNil)
+	defer pubsub.Close()
+
+	device := pubsub.Device("dev")
+	uplink, err := device.SubscribeUplink()
+	a.So(err, ShouldBeNil)
+	activations, err := device.SubscribeActivations(SubscriptionOptions{BufferSize: 3})
+	a.So(err, ShouldBeNil)
+
+	for i := 0; i < 3; i++ {
+		broker.publish("test/devices/dev/up", []byte(fmt.Sprintf(`{"counter":%d}`, i)))
+		broker.publish("test/devices/dev/events/activations", []byte(`{"dev_addr":"26000001"}`))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	a.So(receiveUplinks(t, uplink, 1), ShouldResemble, []uint32{0})
+	a.So(activations, ShouldHaveLength, 3)
+	a.So(device.Dropped(), ShouldEqual, 2)
+	a.So(pubsub.Dropped(), ShouldEqual, 2)
+
+	droppedMu.Lock()
+	defer droppedMu.Unlock()
+	a.So(dropped, ShouldHaveLength, 2)
+	for _, msg := range dropped {
+		a.So(msg.AppID, ShouldEqual, "test")
+		a.So(msg.DevID, ShouldEqual, "dev")
+		a.So(msg.Subscription, ShouldEqual, "uplink")
+		a.So(msg.Message, ShouldHaveSameTypeAs, &types.UplinkMessage{})
+	}
+}
@@ -0,0 +1,377 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/go-utils/random"
+	"github.com/TheThingsNetwork/ttn/core/types"
+	"github.com/TheThingsNetwork/ttn/mqtt"
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttClient implements the mqtt.Client of the ttn/mqtt package on top of the paho client. Unlike the client of the
+// ttn/mqtt package, it reports changes in its connection through the OnConnect and OnConnectionLost handlers of paho,
+// and it reports the errors of restoring its subscriptions after it reconnected.
+type mqttClient struct {
+	logger log.Interface
+	paho   paho.Client
+
+	// onConnect is called when the client (re)connected. If the client reconnected, it first restores its
+	// subscriptions, and err is the first error of restoring them.
+	onConnect func(client mqtt.Client, reconnected bool, err error)
+
+	// onLost is called when the connection was lost
+	onLost func(client mqtt.Client, err error)
+
+	mu            sync.Mutex
+	connects      int
+	subscriptions map[string]paho.MessageHandler
+	topics        []string // The topics of the subscriptions, in the order in which they were made
+}
+
+// newMQTTClient returns a client for the broker. Addresses that start with ssl:// use the TLS config, or the RootCAs of
+// the ttn/mqtt package if no TLS config is given.
+func newMQTTClient(logger log.Interface, id, username, password string, tlsConfig *tls.Config, broker string) *mqttClient {
+	c := &mqttClient{
+		logger:        logger,
+		onConnect:     func(mqtt.Client, bool, error) {},
+		onLost:        func(mqtt.Client, error) {},
+		subscriptions: make(map[string]paho.MessageHandler),
+	}
+	options := paho.NewClientOptions()
+	options.AddBroker(broker)
+	options.SetClientID(fmt.Sprintf("%s-%s", id, random.String(16)))
+	options.SetUsername(username)
+	options.SetPassword(password)
+	options.SetKeepAlive(30 * time.Second)
+	options.SetPingTimeout(10 * time.Second)
+	options.SetCleanSession(true)
+	if strings.HasPrefix(broker, "ssl://") {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{RootCAs: mqtt.RootCAs}
+		}
+		options.SetTLSConfig(tlsConfig)
+	}
+	options.SetDefaultPublishHandler(func(_ paho.Client, msg paho.Message) {
+		logger.Warnf("ttn-sdk: Received unhandled MQTT message on %s", msg.Topic())
+	})
+	options.SetOnConnectHandler(c.handleConnect)
+	options.SetConnectionLostHandler(func(_ paho.Client, err error) {
+		c.onLost(c, err)
+	})
+	c.paho = paho.NewClient(options)
+	return c
+}
+
+// handleConnect restores the subscriptions in the order in which they were made if the client reconnected, and then
+// calls onConnect. The paho client calls it in a new goroutine.
+func (c *mqttClient) handleConnect(_ paho.Client) {
+	c.mu.Lock()
+	c.connects++
+	reconnected := c.connects > 1
+	var tokens []mqtt.Token
+	if reconnected {
+		for _, topic := range c.topics {
+			tokens = append(tokens, c.paho.Subscribe(topic, mqtt.SubscribeQoS, c.subscriptions[topic]))
+		}
+	}
+	c.mu.Unlock()
+	c.onConnect(c, reconnected, waitForRestore(c.logger, tokens))
+}
+
+// Connect connects to the MQTT broker. Like the client of the ttn/mqtt package, it retries mqtt.ConnectRetries times.
+func (c *mqttClient) Connect() error {
+	if c.paho.IsConnected() {
+		return nil
+	}
+	var err error
+	for retries := 0; retries < mqtt.ConnectRetries; retries++ {
+		token := c.paho.Connect()
+		token.Wait()
+		if err = token.Error(); err == nil {
+			return nil
+		}
+		c.logger.WithError(err).Debug("ttn-sdk: Could not connect to MQTT, retrying...")
+		time.Sleep(mqtt.ConnectRetryDelay)
+	}
+	return fmt.Errorf("ttn-sdk: could not connect to MQTT: %s", err)
+}
+
+func (c *mqttClient) Disconnect() {
+	if !c.paho.IsConnected() {
+		return
+	}
+	c.paho.Disconnect(25)
+}
+
+func (c *mqttClient) IsConnected() bool {
+	return c.paho.IsConnected()
+}
+
+// errorToken is a token for an operation that failed before it was started
+type errorToken struct {
+	err error
+}
+
+func (t errorToken) Wait() bool                     { return true }
+func (t errorToken) WaitTimeout(time.Duration) bool { return true }
+func (t errorToken) Error() error                   { return t.err }
+
+// multiToken is the token of multiple operations
+type multiToken []mqtt.Token
+
+func (t multiToken) Wait() bool {
+	for _, token := range t {
+		token.Wait()
+	}
+	return true
+}
+
+func (t multiToken) WaitTimeout(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for _, token := range t {
+		if !token.WaitTimeout(time.Until(deadline)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t multiToken) Error() error {
+	for _, token := range t {
+		if err := token.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *mqttClient) publish(topic string, payload interface{}) mqtt.Token {
+	msg, err := json.Marshal(payload)
+	if err != nil {
+		return errorToken{fmt.Errorf("ttn-sdk: could not marshal MQTT message: %s", err)}
+	}
+	return c.paho.Publish(topic, mqtt.PublishQoS, false, msg)
+}
+
+// subscribe subscribes to the topic and remembers the subscription, so that it is restored when the client reconnects
+func (c *mqttClient) subscribe(topic string, handler paho.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.subscriptions[topic]; !ok {
+		c.topics = append(c.topics, topic)
+	}
+	c.subscriptions[topic] = handler
+	return c.paho.Subscribe(topic, mqtt.SubscribeQoS, handler)
+}
+
+func (c *mqttClient) unsubscribe(topic string) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.subscriptions[topic]; ok {
+		delete(c.subscriptions, topic)
+		for i, subscribed := range c.topics {
+			if subscribed == topic {
+				c.topics = append(c.topics[:i], c.topics[i+1:]...)
+				break
+			}
+		}
+	}
+	return c.paho.Unsubscribe(topic)
+}
+
+// subscribeDevice subscribes to a device topic and passes the messages to the handler with the topic that they were
+// published on
+func (c *mqttClient) subscribeDevice(topic mqtt.DeviceTopic, handler func(*mqtt.DeviceTopic, []byte)) mqtt.Token {
+	return c.subscribe(topic.String(), func(_ paho.Client, msg paho.Message) {
+		topic, err := mqtt.ParseDeviceTopic(msg.Topic())
+		if err != nil {
+			c.logger.Warnf("ttn-sdk: Received MQTT message on invalid topic %s", msg.Topic())
+			return
+		}
+		handler(topic, msg.Payload())
+	})
+}
+
+// unmarshal unmarshals the payload of a message, and logs if that fails
+func (c *mqttClient) unmarshal(payload []byte, msg interface{}, kind string) bool {
+	if err := json.Unmarshal(payload, msg); err != nil {
+		c.logger.WithError(err).Warnf("ttn-sdk: Could not unmarshal %s", kind)
+		return false
+	}
+	return true
+}
+
+func (c *mqttClient) PublishUplink(msg types.UplinkMessage) mqtt.Token {
+	return c.publish(mqtt.DeviceTopic{AppID: msg.AppID, DevID: msg.DevID, Type: mqtt.DeviceUplink}.String(), msg)
+}
+
+// PublishUplinkFields publishes each (nested) field to its own topic
+func (c *mqttClient) PublishUplinkFields(appID string, devID string, fields map[string]interface{}) mqtt.Token {
+	flattened := make(map[string]interface{})
+	flattenFields("", fields, flattened)
+	tokens := make(multiToken, 0, len(flattened))
+	for field, value := range flattened {
+		tokens = append(tokens, c.publish(mqtt.DeviceTopic{AppID: appID, DevID: devID, Type: mqtt.DeviceUplink, Field: field}.String(), value))
+	}
+	return tokens
+}
+
+// flattenFields adds the fields to out, with the keys of nested fields joined by slashes
+func flattenFields(prefix string, fields, out map[string]interface{}) {
+	for key, value := range fields {
+		if prefix != "" {
+			key = prefix + "/" + key
+		}
+		out[key] = value
+		if nested, ok := value.(map[string]interface{}); ok {
+			flattenFields(key, nested, out)
+		}
+	}
+}
+
+func (c *mqttClient) SubscribeDeviceUplink(appID string, devID string, handler mqtt.UplinkHandler) mqtt.Token {
+	return c.subscribeDevice(mqtt.DeviceTopic{AppID: appID, DevID: devID, Type: mqtt.DeviceUplink}, func(topic *mqtt.DeviceTopic, payload []byte) {
+		var msg types.UplinkMessage
+		if !c.unmarshal(payload, &msg, "uplink") {
+			return
+		}
+		msg.AppID, msg.DevID = topic.AppID, topic.DevID
+		handler(c, topic.AppID, topic.DevID, msg)
+	})
+}
+
+func (c *mqttClient) SubscribeAppUplink(appID string, handler mqtt.UplinkHandler) mqtt.Token {
+	return c.SubscribeDeviceUplink(appID, "", handler)
+}
+
+func (c *mqttClient) SubscribeUplink(handler mqtt.UplinkHandler) mqtt.Token {
+	return c.SubscribeDeviceUplink("", "", handler)
+}
+
+func (c *mqttClient) UnsubscribeDeviceUplink(appID string, devID string) mqtt.Token {
+	return c.unsubscribe(mqtt.DeviceTopic{AppID: appID, DevID: devID, Type: mqtt.DeviceUplink}.String())
+}
+
+func (c *mqttClient) UnsubscribeAppUplink(appID string) mqtt.Token {
+	return c.UnsubscribeDeviceUplink(appID, "")
+}
+
+func (c *mqttClient) UnsubscribeUplink() mqtt.Token {
+	return c.UnsubscribeDeviceUplink("", "")
+}
+
+func (c *mqttClient) PublishDownlink(msg types.DownlinkMessage) mqtt.Token {
+	topic := mqtt.DeviceTopic{AppID: msg.AppID, DevID: msg.DevID, Type: mqtt.DeviceDownlink}
+	msg.AppID, msg.DevID = "", ""
+	return c.publish(topic.String(), msg)
+}
+
+func (c *mqttClient) SubscribeDeviceDownlink(appID string, devID string, handler mqtt.DownlinkHandler) mqtt.Token {
+	return c.subscribeDevice(mqtt.DeviceTopic{AppID: appID, DevID: devID, Type: mqtt.DeviceDownlink}, func(topic *mqtt.DeviceTopic, payload []byte) {
+		var msg types.DownlinkMessage
+		if !c.unmarshal(payload, &msg, "downlink") {
+			return
+		}
+		msg.AppID, msg.DevID = topic.AppID, topic.DevID
+		handler(c, topic.AppID, topic.DevID, msg)
+	})
+}
+
+func (c *mqttClient) SubscribeAppDownlink(appID string, handler mqtt.DownlinkHandler) mqtt.Token {
+	return c.SubscribeDeviceDownlink(appID, "", handler)
+}
+
+func (c *mqttClient) SubscribeDownlink(handler mqtt.DownlinkHandler) mqtt.Token {
+	return c.SubscribeDeviceDownlink("", "", handler)
+}
+
+func (c *mqttClient) UnsubscribeDeviceDownlink(appID string, devID string) mqtt.Token {
+	return c.unsubscribe(mqtt.DeviceTopic{AppID: appID, DevID: devID, Type: mqtt.DeviceDownlink}.String())
+}
+
+func (c *mqttClient) UnsubscribeAppDownlink(appID string) mqtt.Token {
+	return c.UnsubscribeDeviceDownlink(appID, "")
+}
+
+func (c *mqttClient) UnsubscribeDownlink() mqtt.Token {
+	return c.UnsubscribeDeviceDownlink("", "")
+}
+
+func (c *mqttClient) PublishAppEvent(appID string, eventType types.EventType, payload interface{}) mqtt.Token {
+	return c.publish(mqtt.ApplicationTopic{AppID: appID, Type: mqtt.AppEvents, Field: string(eventType)}.String(), payload)
+}
+
+func (c *mqttClient) PublishDeviceEvent(appID string, devID string, eventType types.EventType, payload interface{}) mqtt.Token {
+	return c.publish(mqtt.DeviceTopic{AppID: appID, DevID: devID, Type: mqtt.DeviceEvents, Field: string(eventType)}.String(), payload)
+}
+
+func (c *mqttClient) SubscribeAppEvents(appID string, eventType types.EventType, handler mqtt.AppEventHandler) mqtt.Token {
+	topic := mqtt.ApplicationTopic{AppID: appID, Type: mqtt.AppEvents, Field: string(eventType)}
+	return c.subscribe(topic.String(), func(_ paho.Client, msg paho.Message) {
+		topic, err := mqtt.ParseApplicationTopic(msg.Topic())
+		if err != nil {
+			c.logger.Warnf("ttn-sdk: Received MQTT message on invalid topic %s", msg.Topic())
+			return
+		}
+		handler(c, topic.AppID, types.EventType(topic.Field), msg.Payload())
+	})
+}
+
+func (c *mqttClient) SubscribeDeviceEvents(appID string, devID string, eventType types.EventType, handler mqtt.DeviceEventHandler) mqtt.Token {
+	return c.subscribeDevice(mqtt.DeviceTopic{AppID: appID, DevID: devID, Type: mqtt.DeviceEvents, Field: string(eventType)}, func(topic *mqtt.DeviceTopic, payload []byte) {
+		handler(c, topic.AppID, topic.DevID, types.EventType(topic.Field), payload)
+	})
+}
+
+func (c *mqttClient) UnsubscribeAppEvents(appID string, eventType types.EventType) mqtt.Token {
+	return c.unsubscribe(mqtt.ApplicationTopic{AppID: appID, Type: mqtt.AppEvents, Field: string(eventType)}.String())
+}
+
+func (c *mqttClient) UnsubscribeDeviceEvents(appID string, devID string, eventType types.EventType) mqtt.Token {
+	return c.unsubscribe(mqtt.DeviceTopic{AppID: appID, DevID: devID, Type: mqtt.DeviceEvents, Field: string(eventType)}.String())
+}
+
+func (c *mqttClient) PublishActivation(activation types.Activation) mqtt.Token {
+	return c.PublishDeviceEvent(activation.AppID, activation.DevID, types.ActivationEvent, activation)
+}
+
+func (c *mqttClient) SubscribeDeviceActivations(appID string, devID string, handler mqtt.ActivationHandler) mqtt.Token {
+	return c.SubscribeDeviceEvents(appID, devID, types.ActivationEvent, func(_ mqtt.Client, appID string, devID string, _ types.EventType, payload []byte) {
+		var activation types.Activation
+		if !c.unmarshal(payload, &activation, "activation") {
+			return
+		}
+		activation.AppID, activation.DevID = appID, devID
+		handler(c, appID, devID, activation)
+	})
+}
+
+func (c *mqttClient) SubscribeAppActivations(appID string, handler mqtt.ActivationHandler) mqtt.Token {
+	return c.SubscribeDeviceActivations(appID, "", handler)
+}
+
+func (c *mqttClient) SubscribeActivations(handler mqtt.ActivationHandler) mqtt.Token {
+	return c.SubscribeDeviceActivations("", "", handler)
+}
+
+func (c *mqttClient) UnsubscribeDeviceActivations(appID string, devID string) mqtt.Token {
+	return c.UnsubscribeDeviceEvents(appID, devID, types.ActivationEvent)
+}
+
+func (c *mqttClient) UnsubscribeAppActivations(appID string) mqtt.Token {
+	return c.UnsubscribeDeviceActivations(appID, "")
+}
+
+func (c *mqttClient) UnsubscribeActivations() mqtt.Token {
+	return c.UnsubscribeDeviceActivations("", "")
+}
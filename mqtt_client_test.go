@@ -0,0 +1,151 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/ttn/core/types"
+	"github.com/TheThingsNetwork/ttn/mqtt"
+	. "github.com/smartystreets/assertions"
+)
+
+// newMockedMQTTClient returns an mqttClient that uses a mockPahoClient instead of connecting to a broker
+func newMockedMQTTClient(logger *recordingLogger) (*mqttClient, *mockPahoClient) {
+	c := newMQTTClient(logger, "test", "test", "", nil, "tcp://localhost:1883")
+	mock := &mockPahoClient{}
+	c.paho = mock
+	return c, mock
+}
+
+// pendingToken is a token of an operation that does not complete. It records the timeouts that it is waited for.
+type pendingToken struct {
+	timeouts *[]time.Duration
+}
+
+func (t pendingToken) Wait() bool { select {} }
+func (t pendingToken) WaitTimeout(timeout time.Duration) bool {
+	*t.timeouts = append(*t.timeouts, timeout)
+	time.Sleep(timeout)
+	return false
+}
+func (t pendingToken) Error() error { return nil }
+
+func TestMultiToken(t *testing.T) {
+	a := New(t)
+
+	a.So(errorToken{}.Wait(), ShouldBeTrue)
+	a.So(errorToken{}.Error(), ShouldBeNil)
+
+	err := errors.New("failed")
+	tokens := multiToken{errorToken{}, errorToken{err}, errorToken{errors.New("also failed")}}
+	a.So(tokens.Wait(), ShouldBeTrue)
+	a.So(tokens.WaitTimeout(time.Second), ShouldBeTrue)
+	a.So(tokens.Error(), ShouldEqual, err)
+
+	a.So(multiToken{}.Error(), ShouldBeNil)
+	a.So(multiToken{errorToken{}, errorToken{}}.Error(), ShouldBeNil)
+
+	// The timeout applies to all tokens together, and waiting stops at the first token that does not complete
+	var timeouts []time.Duration
+	pending := pendingToken{&timeouts}
+	a.So(multiToken{pending, pending}.WaitTimeout(20*time.Millisecond), ShouldBeFalse)
+	a.So(timeouts, ShouldHaveLength, 1)
+	a.So(multiToken{errorToken{}, pending}.WaitTimeout(20*time.Millisecond), ShouldBeFalse)
+	a.So(timeouts, ShouldHaveLength, 2)
+	a.So(timeouts[1], ShouldBeLessThanOrEqualTo, 20*time.Millisecond)
+}
+
+func TestMQTTClientPublishUplinkFields(t *testing.T) {
+	a := New(t)
+
+	c, mock := newMockedMQTTClient(newRecordingLogger())
+
+	token := c.PublishUplinkFields("test", "dev", map[string]interface{}{
+		"temperature": 21.5,
+		"location": map[string]interface{}{
+			"lat": 52.37,
+			"gps": map[string]interface{}{"fix": true},
+		},
+	})
+	a.So(token.Wait(), ShouldBeTrue)
+	a.So(token.Error(), ShouldBeNil)
+
+	published := make(map[string]string)
+	for _, msg := range mock.published {
+		published[msg.topic] = string(msg.payload)
+	}
+	a.So(published, ShouldHaveLength, 5)
+	a.So(published["test/devices/dev/up/temperature"], ShouldEqual, "21.5")
+	a.So(published["test/devices/dev/up/location/lat"], ShouldEqual, "52.37")
+	a.So(published["test/devices/dev/up/location/gps/fix"], ShouldEqual, "true")
+	a.So(published["test/devices/dev/up/location/gps"], ShouldEqual, `{"fix":true}`)
+	var location map[string]interface{}
+	a.So(json.Unmarshal([]byte(published["test/devices/dev/up/location"]), &location), ShouldBeNil)
+	a.So(location["lat"], ShouldEqual, 52.37)
+
+	mock.err = errors.New("not connected")
+	token = c.PublishUplinkFields("test", "dev", map[string]interface{}{"temperature": 21.5})
+	a.So(token.Error(), ShouldEqual, mock.err)
+
+	token = c.PublishUplinkFields("test", "dev", map[string]interface{}{"invalid": func() {}})
+	a.So(token.Error(), ShouldNotBeNil)
+}
+
+func TestMQTTClientResubscribe(t *testing.T) {
+	a := New(t)
+
+	c, mock := newMockedMQTTClient(newRecordingLogger())
+	type connect struct {
+		reconnected bool
+		err         error
+	}
+	connects := make(chan connect, 1)
+	c.onConnect = func(_ mqtt.Client, reconnected bool, err error) {
+		connects <- connect{reconnected, err}
+	}
+
+	// The subscriptions are only restored when the client reconnects
+	c.handleConnect(mock)
+	a.So(<-connects, ShouldResemble, connect{false, nil})
+
+	var uplinks []types.UplinkMessage
+	c.SubscribeDeviceUplink("test", "dev", func(mqtt.Client, string, string, types.UplinkMessage) {
+		t.Error("Received uplink on replaced handler")
+	})
+	c.SubscribeDeviceEvents("test", "", "#", func(mqtt.Client, string, string, types.EventType, []byte) {})
+	c.SubscribeAppEvents("test", "", func(mqtt.Client, string, types.EventType, []byte) {})
+	c.SubscribeDeviceActivations("test", "dev", func(mqtt.Client, string, string, types.Activation) {})
+	c.UnsubscribeDeviceEvents("test", "", "#")
+	c.SubscribeDeviceEvents("test", "other", "#", func(mqtt.Client, string, string, types.EventType, []byte) {})
+	c.SubscribeDeviceUplink("test", "dev", func(_ mqtt.Client, _, _ string, msg types.UplinkMessage) {
+		uplinks = append(uplinks, msg)
+	})
+	a.So(mock.unsubscribed, ShouldResemble, []string{"test/devices/+/events/#"})
+
+	mock.subscribed = nil
+	c.handleConnect(mock)
+	a.So(<-connects, ShouldResemble, connect{true, nil})
+	a.So(mock.subscribed, ShouldResemble, []string{
+		"test/devices/dev/up",
+		"test/events/#",
+		"test/devices/dev/events/activations",
+		"test/devices/other/events/#",
+	})
+
+	// The restored subscriptions use the handler of the last subscription to the topic
+	mock.deliver("test/devices/dev/up", "test/devices/dev/up", []byte(`{"counter":1}`))
+	a.So(uplinks, ShouldHaveLength, 1)
+	a.So(uplinks[0].AppID, ShouldEqual, "test")
+	a.So(uplinks[0].DevID, ShouldEqual, "dev")
+	a.So(uplinks[0].FCnt, ShouldEqual, 1)
+
+	// The first error of restoring the subscriptions is reported
+	mock.err = errors.New("not authorized")
+	c.handleConnect(mock)
+	a.So(<-connects, ShouldResemble, connect{true, mock.err})
+}
@@ -0,0 +1,159 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/TheThingsNetwork/ttn/mqtt"
+)
+
+// ConnectionState is the state of the MQTT connection
+type ConnectionState string
+
+// Connection states
+const (
+	// ConnectionConnected is reported when the client (re)connected to MQTT
+	ConnectionConnected ConnectionState = "connected"
+
+	// ConnectionLost is reported when the connection to MQTT was lost. The Err of the ConnectionEvent contains the
+	// reason.
+	ConnectionLost ConnectionState = "lost"
+
+	// ConnectionReconnecting is reported when the client starts to reconnect after the connection was lost
+	ConnectionReconnecting ConnectionState = "reconnecting"
+
+	// ConnectionResubscribed is reported when the subscriptions were restored after the client reconnected. If some
+	// subscriptions could not be restored, the Err of the ConnectionEvent contains the first error.
+	ConnectionResubscribed ConnectionState = "resubscribed"
+)
+
+// ConnectionEvent is an event in the lifecycle of the MQTT connection
+type ConnectionEvent struct {
+	State ConnectionState
+	Time  time.Time
+	Err   error
+}
+
+type connectionEventJSON struct {
+	State ConnectionState `json:"state"`
+	Time  time.Time       `json:"time"`
+	Err   string          `json:"error,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler
+func (e ConnectionEvent) MarshalJSON() ([]byte, error) {
+	event := connectionEventJSON{State: e.State, Time: e.Time}
+	if e.Err != nil {
+		event.Err = e.Err.Error()
+	}
+	return json.Marshal(event)
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (e *ConnectionEvent) UnmarshalJSON(data []byte) error {
+	var event connectionEventJSON
+	if err := json.Unmarshal(data, &event); err != nil {
+		return err
+	}
+	*e = ConnectionEvent{State: event.State, Time: event.Time}
+	if event.Err != "" {
+		e.Err = errors.New(event.Err)
+	}
+	return nil
+}
+
+func decodeConnectionEvent(data []byte) (interface{}, error) {
+	event := new(ConnectionEvent)
+	if err := json.Unmarshal(data, event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// mqttConnectionListener is implemented by the MQTT subscribers that report connection events
+type mqttConnectionListener interface {
+	connectionEvent(*ConnectionEvent)
+}
+
+func (c *client) handleMQTTConnected(client mqtt.Client, reconnected bool, err error) {
+	if !c.isCurrentMQTTClient(client) {
+		return
+	}
+	c.broadcastConnectionEvent(&ConnectionEvent{State: ConnectionConnected, Time: time.Now()})
+	if reconnected {
+		c.broadcastConnectionEvent(&ConnectionEvent{State: ConnectionResubscribed, Time: time.Now(), Err: err})
+	}
+}
+
+func (c *client) handleMQTTLost(client mqtt.Client, err error) {
+	if !c.isCurrentMQTTClient(client) {
+		return
+	}
+	c.broadcastConnectionEvent(&ConnectionEvent{State: ConnectionLost, Time: time.Now(), Err: err})
+	c.broadcastConnectionEvent(&ConnectionEvent{State: ConnectionReconnecting, Time: time.Now()})
+}
+
+// isCurrentMQTTClient returns true if the client is the current MQTT client. While a client is dialed, this waits
+// until it is set as the current client.
+func (c *client) isCurrentMQTTClient(client mqtt.Client) bool {
+	c.mqtt.RLock()
+	defer c.mqtt.RUnlock()
+	return c.mqtt.client == client
+}
+
+// broadcastConnectionEvent sends the event to the subscribers that listen for connection events
+func (c *client) broadcastConnectionEvent(event *ConnectionEvent) {
+	for _, listener := range c.mqttConnectionListeners() {
+		listener.connectionEvent(event)
+	}
+}
+
+func (c *client) mqttConnectionListeners() (listeners []mqttConnectionListener) {
+	c.mqtt.RLock()
+	defer c.mqtt.RUnlock()
+	for subscriber := range c.mqtt.subscribers {
+		if listener, ok := subscriber.(mqttConnectionListener); ok {
+			listeners = append(listeners, listener)
+		}
+	}
+	return listeners
+}
+
+func (a *applicationPubSub) SubscribeConnectionEvents(options ...SubscriptionOptions) (<-chan *ConnectionEvent, error) {
+	if err := a.ctx.Err(); err != nil {
+		return nil, err
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.connectionEvents != nil {
+		return a.connectionEvents.channel().(chan *ConnectionEvent), nil
+	}
+	subscriptionOptions := subscriptionOptions(a.options, options)
+	connectionEvents := make(chan *ConnectionEvent, subscriptionOptions.bufferSize())
+	a.connectionEvents = newSubscriptionQueue(connectionEvents, subscriptionOptions, decodeConnectionEvent, a.dropper(subscriptionOptions, "connection-events"))
+	return connectionEvents, nil
+}
+
+func (a *applicationPubSub) connectionEvent(event *ConnectionEvent) {
+	a.RLock()
+	connectionEvents := a.connectionEvents
+	a.RUnlock()
+	if connectionEvents != nil {
+		event := *event
+		connectionEvents.push(&event)
+	}
+}
+
+func (a *applicationPubSub) UnsubscribeConnectionEvents() error {
+	a.Lock()
+	defer a.Unlock()
+	if a.connectionEvents != nil {
+		a.connectionEvents.close()
+		a.connectionEvents = nil
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"testing"
+	"time"
+
+	ttnlog "github.com/TheThingsNetwork/go-utils/log"
+	testlog "github.com/TheThingsNetwork/go-utils/log/test"
+	"github.com/TheThingsNetwork/ttn/core/types"
+	. "github.com/smartystreets/assertions"
+)
+
+func TestMQTTReconnect(t *testing.T) {
+	a := New(t)
+
+	log := testlog.NewLogger()
+	ttnlog.Set(log)
+	defer log.Print(t)
+
+	broker, err := newMockMQTTBroker()
+	a.So(err, ShouldBeNil)
+	defer broker.Close()
+
+	config := NewConfig("test", "", "")
+	config.Logger = log
+	config.MQTTAddress = "mqtt://" + broker.Addr().String()
+	client := config.NewClient("test", "")
+	defer client.Close()
+
+	pubsub, err := client.PubSub()
+	a.So(err, ShouldBeNil)
+	defer pubsub.Close()
+
+	connectionEvents, err := pubsub.SubscribeConnectionEvents()
+	a.So(err, ShouldBeNil)
+	uplink, err := pubsub.Device("dev").SubscribeUplink()
+	a.So(err, ShouldBeNil)
+	activations, err := pubsub.AllDevices().SubscribeActivations()
+	a.So(err, ShouldBeNil)
+	deviceEvents, err := pubsub.AllDevices().SubscribeEvents()
+	a.So(err, ShouldBeNil)
+	appEvents, err := pubsub.SubscribeApplicationEvents()
+	a.So(err, ShouldBeNil)
+
+	a.So(broker.restart(100*time.Millisecond), ShouldBeNil)
+
+	states := make(map[ConnectionState]int)
+waitForResubscribe:
+	for {
+		select {
+		case event := <-connectionEvents:
+			states[event.State]++
+			switch event.State {
+			case ConnectionLost:
+				a.So(event.Err, ShouldNotBeNil)
+			case ConnectionResubscribed:
+				a.So(event.Err, ShouldBeNil)
+				break waitForResubscribe
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Subscriptions were not restored within five seconds (events: %v)", states)
+		}
+	}
+	a.So(states[ConnectionLost], ShouldEqual, 1)
+	a.So(states[ConnectionReconnecting], ShouldEqual, 1)
+	a.So(states[ConnectionConnected], ShouldBeGreaterThanOrEqualTo, 1) // Can include the event of the first connect
+	a.So(states[ConnectionResubscribed], ShouldEqual, 1)
+
+	broker.publish("test/devices/dev/up", []byte(`{"counter":1}`))
+	broker.publish("test/devices/dev/events/activations", []byte(`{"dev_addr":"26000001"}`))
+	broker.publish("test/events/errors", []byte(`{"error":"something went wrong"}`))
+
+	select {
+	case msg := <-uplink:
+		a.So(msg.FCnt, ShouldEqual, 1)
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive uplink after reconnect within a second")
+	}
+	select {
+	case msg := <-activations:
+		a.So(msg.DevAddr, ShouldEqual, types.DevAddr{0x26, 0, 0, 1})
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive activation after reconnect within a second")
+	}
+	select {
+	case msg := <-deviceEvents:
+		a.So(msg.Event, ShouldEqual, types.ActivationEvent)
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive device event after reconnect within a second")
+	}
+	select {
+	case msg := <-appEvents:
+		a.So(msg.Event, ShouldEqual, ApplicationErrorEvent)
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive application event after reconnect within a second")
+	}
+
+	a.So(pubsub.UnsubscribeConnectionEvents(), ShouldBeNil)
+	_, ok := <-connectionEvents
+	a.So(ok, ShouldBeFalse)
+}
+
+func TestMQTTClosed(t *testing.T) {
+	a := New(t)
+
+	broker, err := newMockMQTTBroker()
+	a.So(err, ShouldBeNil)
+	defer broker.Close()
+
+	config := NewConfig("test", "", "")
+	config.Logger = newRecordingLogger()
+	config.MQTTAddress = "mqtt://" + broker.Addr().String()
+	c := config.NewClient("test", "").(*client)
+	defer c.Close()
+
+	pubsub, err := c.PubSub()
+	a.So(err, ShouldBeNil)
+	defer pubsub.Close()
+
+	subscribers := func() int {
+		c.mqtt.RLock()
+		defer c.mqtt.RUnlock()
+		return len(c.mqtt.subscribers)
+	}
+	a.So(subscribers(), ShouldEqual, 1)
+
+	// Devices are only registered when they subscribe
+	for i := 0; i < 3; i++ {
+		a.So(pubsub.Device("dev").Publish(&types.DownlinkMessage{FPort: 1}), ShouldBeNil)
+	}
+	a.So(pubsub.Publish("dev", &types.DownlinkMessage{FPort: 1}), ShouldBeNil)
+	a.So(subscribers(), ShouldEqual, 1)
+	device := pubsub.Device("dev")
+	_, err = device.SubscribeUplink()
+	a.So(err, ShouldBeNil)
+	_, err = device.SubscribeEvents()
+	a.So(err, ShouldBeNil)
+	a.So(subscribers(), ShouldEqual, 2)
+	device.Close()
+	waitForCondition(t, "device unregistration", func() bool {
+		return subscribers() == 1 && broker.subscribed("test/devices/dev/up") == 0
+	})
+
+	// Devices that are created after the client is closed return errors
+	a.So(c.Close(), ShouldBeNil)
+	closed := pubsub.Device("dev")
+	a.So(closed.Publish(&types.DownlinkMessage{FPort: 1}), ShouldNotBeNil)
+	_, err = closed.PublishTracked(&types.DownlinkMessage{FPort: 1})
+	a.So(err, ShouldNotBeNil)
+	_, err = closed.SubscribeUplink()
+	a.So(err, ShouldNotBeNil)
+	a.So(pubsub.Publish("dev", &types.DownlinkMessage{FPort: 1}), ShouldNotBeNil)
+}
@@ -0,0 +1,323 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TheThingsNetwork/ttn/core/types"
+)
+
+// DefaultDownlinkTrackingTimeout is the time that a tracked downlink message may take to resolve if no timeout is given
+// in the options. Keep in mind that the downlink messages of Class A devices are only sent after an uplink message of
+// the device.
+var DefaultDownlinkTrackingTimeout = 5 * time.Minute
+
+// ErrDownlinkTimeout is the error of a DownlinkResult if the downlink message did not resolve before the timeout
+var ErrDownlinkTimeout = errors.New("ttn-sdk: Downlink was not delivered before the timeout")
+
+// DownlinkStatus is the delivery status of a tracked downlink message
+type DownlinkStatus string
+
+// Downlink statuses, in the order in which they are reached
+const (
+	DownlinkPublished    DownlinkStatus = "published"
+	DownlinkScheduled    DownlinkStatus = "scheduled"
+	DownlinkSent         DownlinkStatus = "sent"
+	DownlinkAcknowledged DownlinkStatus = "acknowledged"
+	DownlinkFailed       DownlinkStatus = "failed"
+)
+
+func (s DownlinkStatus) rank() int {
+	switch s {
+	case DownlinkScheduled:
+		return 1
+	case DownlinkSent:
+		return 2
+	case DownlinkAcknowledged:
+		return 3
+	}
+	return 0
+}
+
+// DownlinkTrackingOptions contains the options for PublishTracked
+type DownlinkTrackingOptions struct {
+	// The status at which the handle resolves: DownlinkScheduled, DownlinkSent or DownlinkAcknowledged (in the
+	// default config, this is DownlinkAcknowledged for confirmed downlink messages and DownlinkSent otherwise)
+	Until DownlinkStatus
+
+	// The time after which the handle resolves with ErrDownlinkTimeout (in the default config, this is
+	// DefaultDownlinkTrackingTimeout)
+	Timeout time.Duration
+}
+
+// DownlinkResult is the result of a tracked downlink message
+type DownlinkResult struct {
+	// The last status that the downlink message reached, or DownlinkFailed if the Network reported an error
+	Status DownlinkStatus
+
+	// The error if the downlink message did not reach the status of the options. This is ErrDownlinkTimeout if it
+	// timed out.
+	Err error
+
+	// The downlink events of the downlink message
+	Events []*types.DeviceEvent
+}
+
+// DownlinkHandle tracks the delivery of a downlink message. The downlink events of a device do not identify the
+// downlink message that they are about. Scheduled events are matched with the tracked downlink message that has the
+// same port and payload (or with the oldest tracked downlink message if none has), and the other events are matched
+// with the tracked downlink messages in the order in which these were scheduled. The tracked downlink messages of a
+// device are published one at a time, in the order in which they are tracked. Avoid tracking multiple downlink messages
+// of the same device if some of them are not tracked until they are sent, or if downlink messages are also published
+// without tracking.
+type DownlinkHandle struct {
+	msg       types.DownlinkMessage
+	until     DownlinkStatus
+	resolved  chan struct{}
+	closeOnce sync.Once
+
+	mu        sync.Mutex
+	result    DownlinkResult
+	scheduled uint64 // The order in which the downlink message was scheduled, or 0 if it was not scheduled
+}
+
+// Status returns the current status of the downlink message
+func (h *DownlinkHandle) Status() DownlinkStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.result.Status
+}
+
+// Done returns a channel that is closed when the handle resolves
+func (h *DownlinkHandle) Done() <-chan struct{} {
+	return h.resolved
+}
+
+func (h *DownlinkHandle) isResolved() bool {
+	select {
+	case <-h.resolved:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait waits until the handle resolves and returns the result
+func (h *DownlinkHandle) Wait() DownlinkResult {
+	<-h.resolved
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.result
+}
+
+// scheduledOrder returns the order in which the downlink message was scheduled, or 0 if it was not scheduled
+func (h *DownlinkHandle) scheduledOrder() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.scheduled
+}
+
+// update updates the handle with the event, and resolves the handle if the downlink message reached its status. The
+// scheduled order is set for scheduled events.
+func (h *DownlinkHandle) update(event *types.DeviceEvent, scheduled uint64) {
+	h.mu.Lock()
+	h.result.Events = append(h.result.Events, event)
+	if event.Event == types.DownlinkScheduledEvent {
+		h.scheduled = scheduled
+	}
+	if event.Event == types.DownlinkErrorEvent {
+		h.result.Status = DownlinkFailed
+		h.result.Err = errors.New("ttn-sdk: Downlink failed")
+		if data, ok := event.Data.(*types.DownlinkEventData); ok && data.Error != "" {
+			h.result.Err = errors.New(data.Error)
+		}
+	} else {
+		h.result.Status = downlinkEventStatus(event.Event)
+	}
+	resolved := h.result.Err != nil || h.result.Status.rank() >= h.until.rank()
+	h.mu.Unlock()
+	if resolved {
+		h.resolve(nil)
+	}
+}
+
+// resolve resolves the handle, with the error if it did not already resolve
+func (h *DownlinkHandle) resolve(err error) {
+	h.closeOnce.Do(func() {
+		if err != nil {
+			h.mu.Lock()
+			h.result.Err = err
+			h.mu.Unlock()
+		}
+		close(h.resolved)
+	})
+}
+
+func downlinkEventStatus(eventType types.EventType) DownlinkStatus {
+	switch eventType {
+	case types.DownlinkScheduledEvent:
+		return DownlinkScheduled
+	case types.DownlinkSentEvent:
+		return DownlinkSent
+	case types.DownlinkAckEvent:
+		return DownlinkAcknowledged
+	}
+	return ""
+}
+
+// matches returns true if the downlink message in the event is the tracked downlink message
+func (h *DownlinkHandle) matches(event *types.DeviceEvent) bool {
+	data, ok := event.Data.(*types.DownlinkEventData)
+	if !ok || data.Message == nil {
+		return false
+	}
+	return data.Message.FPort == h.msg.FPort && bytes.Equal(data.Message.PayloadRaw, h.msg.PayloadRaw)
+}
+
+func (d *devicePubSub) PublishTracked(downlink *types.DownlinkMessage, options ...DownlinkTrackingOptions) (*DownlinkHandle, error) {
+	if err := d.ctx.Err(); err != nil {
+		return nil, err
+	}
+	var trackingOptions DownlinkTrackingOptions
+	if len(options) > 0 {
+		trackingOptions = options[0]
+	}
+	if trackingOptions.Until == "" {
+		trackingOptions.Until = DownlinkSent
+		if downlink.Confirmed {
+			trackingOptions.Until = DownlinkAcknowledged
+		}
+	}
+	if trackingOptions.Until.rank() == 0 {
+		return nil, errors.New("ttn-sdk: Downlinks can only be tracked until scheduled, sent or acknowledged")
+	}
+	if trackingOptions.Until == DownlinkAcknowledged && !downlink.Confirmed {
+		return nil, errors.New("ttn-sdk: Unconfirmed downlinks are not acknowledged")
+	}
+	if trackingOptions.Timeout <= 0 {
+		trackingOptions.Timeout = DefaultDownlinkTrackingTimeout
+	}
+
+	msg, err := d.prepareDownlink(downlink)
+	if err != nil {
+		return nil, err
+	}
+	h := &DownlinkHandle{
+		msg:      msg,
+		until:    trackingOptions.Until,
+		resolved: make(chan struct{}),
+		result:   DownlinkResult{Status: DownlinkPublished},
+	}
+
+	// Subscribe to the events before publishing, so that no events are missed. The tracked downlink messages are
+	// published in the order in which they are tracked, which is the order in which unscheduled events are matched.
+	d.publishTracked.Lock()
+	d.Lock()
+	d.downlinks = append(d.downlinks, h)
+	err = d.subscribeEventsLocked()
+	d.Unlock()
+	if err == nil {
+		err = d.publish(msg)
+	}
+	d.publishTracked.Unlock()
+	if err != nil {
+		d.untrackDownlink(h)
+		return nil, err
+	}
+
+	go func() {
+		timeout := time.NewTimer(trackingOptions.Timeout)
+		defer timeout.Stop()
+		select {
+		case <-h.resolved:
+		case <-timeout.C:
+			h.resolve(ErrDownlinkTimeout)
+		case <-d.ctx.Done():
+			h.resolve(d.ctx.Err())
+		}
+		d.untrackDownlink(h)
+	}()
+
+	return h, nil
+}
+
+// trackDownlink updates the tracked downlink message that the event applies to
+func (d *devicePubSub) trackDownlink(event *types.DeviceEvent) {
+	var match *DownlinkHandle
+	var scheduled uint64
+	d.RLock()
+	switch event.Event {
+	case types.DownlinkScheduledEvent:
+		match = d.matchScheduledDownlink(event)
+		scheduled = atomic.AddUint64(&d.scheduledDownlinks, 1)
+	case types.DownlinkSentEvent, types.DownlinkErrorEvent:
+		// Errors are reported before the downlink message is sent
+		match = d.oldestDownlink(DownlinkScheduled, false)
+		if match == nil {
+			match = d.oldestDownlink(DownlinkPublished, false)
+		}
+	case types.DownlinkAckEvent:
+		match = d.oldestDownlink(DownlinkSent, true)
+	}
+	d.RUnlock()
+	if match != nil {
+		match.update(event, scheduled) // The goroutine of PublishTracked stops tracking the downlink message when it resolves
+	}
+}
+
+// matchScheduledDownlink returns the published downlink message with the port and payload of the scheduled event, or
+// the oldest published downlink message if none matches. It must be called with the lock held.
+func (d *devicePubSub) matchScheduledDownlink(event *types.DeviceEvent) *DownlinkHandle {
+	var oldest *DownlinkHandle
+	for _, h := range d.downlinks {
+		if h.isResolved() || h.Status() != DownlinkPublished {
+			continue
+		}
+		if h.matches(event) {
+			return h
+		}
+		if oldest == nil {
+			oldest = h
+		}
+	}
+	return oldest
+}
+
+// oldestDownlink returns the unresolved downlink message with the status that was scheduled first, or that was
+// published first if the status is DownlinkPublished. It must be called with the lock held.
+func (d *devicePubSub) oldestDownlink(status DownlinkStatus, confirmed bool) *DownlinkHandle {
+	var oldest *DownlinkHandle
+	var oldestScheduled uint64
+	for _, h := range d.downlinks {
+		if h.isResolved() || h.Status() != status || (confirmed && !h.msg.Confirmed) {
+			continue
+		}
+		scheduled := h.scheduledOrder()
+		if oldest == nil || scheduled < oldestScheduled {
+			oldest, oldestScheduled = h, scheduled
+		}
+	}
+	return oldest
+}
+
+// untrackDownlink stops tracking the downlink message, and unsubscribes from the events of the device if they are no
+// longer used
+func (d *devicePubSub) untrackDownlink(h *DownlinkHandle) {
+	d.Lock()
+	defer d.Unlock()
+	for i, tracked := range d.downlinks {
+		if tracked == h {
+			d.downlinks = append(d.downlinks[:i], d.downlinks[i+1:]...)
+			break
+		}
+	}
+	if err := d.unsubscribeEventsLocked(); err != nil {
+		d.logger.WithError(err).Warn("ttn-sdk: Could not unsubscribe from device events")
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/ttn/core/types"
+	. "github.com/smartystreets/assertions"
+)
+
+func waitForDownlink(t *testing.T, h *DownlinkHandle) DownlinkResult {
+	select {
+	case <-h.Done():
+		return h.Wait()
+	case <-time.After(time.Second):
+		t.Fatalf("Downlink did not resolve within a second (status %s)", h.Status())
+	}
+	return DownlinkResult{}
+}
+
+// waitForCondition waits until the condition is true, and fails the test if it is not true within a second
+func waitForCondition(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitForStatus waits until the downlink message reached the status
+func waitForStatus(t *testing.T, h *DownlinkHandle, status DownlinkStatus) {
+	waitForCondition(t, fmt.Sprintf("downlink status %s (status %s)", status, h.Status()), func() bool {
+		return h.Status() == status
+	})
+}
+
+func TestPublishTracked(t *testing.T) {
+	a := New(t)
+
+	broker, err := newMockMQTTBroker()
+	a.So(err, ShouldBeNil)
+	defer broker.Close()
+
+	config := NewConfig("test", "", "")
+	config.Logger = newRecordingLogger()
+	config.MQTTAddress = "mqtt://" + broker.Addr().String()
+	client := config.NewClient("test", "")
+	defer client.Close()
+
+	pubsub, err := client.PubSub()
+	a.So(err, ShouldBeNil)
+	defer pubsub.Close()
+
+	device := pubsub.Device("dev")
+	subscribed := func(count int) func() bool {
+		return func() bool { return broker.subscribed("test/devices/dev/events/#") == count }
+	}
+
+	_, err = device.PublishTracked(&types.DownlinkMessage{FPort: 1}, DownlinkTrackingOptions{Until: DownlinkAcknowledged})
+	a.So(err, ShouldNotBeNil)
+
+	// Confirmed downlinks resolve when they are acknowledged
+	confirmed, err := device.PublishTracked(&types.DownlinkMessage{FPort: 1, Confirmed: true, PayloadRaw: []byte{0x01}})
+	a.So(err, ShouldBeNil)
+	unconfirmed, err := device.PublishTracked(&types.DownlinkMessage{FPort: 2, PayloadRaw: []byte{0x02}})
+	a.So(err, ShouldBeNil)
+	a.So(confirmed.Status(), ShouldEqual, DownlinkPublished)
+	waitForCondition(t, "published downlinks", func() bool { return len(broker.messages("test/devices/dev/down")) == 2 })
+	waitForCondition(t, "events subscription", subscribed(1))
+
+	// The scheduled events are matched by payload, the sent events in the order in which the downlinks were scheduled
+	broker.publish("test/devices/dev/events/down/scheduled", []byte(`{"message":{"port":2,"payload_raw":"Ag=="}}`))
+	waitForStatus(t, unconfirmed, DownlinkScheduled)
+	broker.publish("test/devices/dev/events/down/scheduled", []byte(`{"message":{"port":1,"payload_raw":"AQ=="}}`))
+	waitForStatus(t, confirmed, DownlinkScheduled)
+
+	// Unconfirmed downlinks resolve when they are sent
+	broker.publish("test/devices/dev/events/down/sent", []byte(`{}`))
+	result := waitForDownlink(t, unconfirmed)
+	a.So(result.Err, ShouldBeNil)
+	a.So(result.Status, ShouldEqual, DownlinkSent)
+	a.So(confirmed.Status(), ShouldEqual, DownlinkScheduled)
+
+	broker.publish("test/devices/dev/events/down/sent", []byte(`{"gateway_id":"gtw"}`))
+	waitForStatus(t, confirmed, DownlinkSent)
+	broker.publish("test/devices/dev/events/down/acks", []byte(`{}`))
+	result = waitForDownlink(t, confirmed)
+	a.So(result.Err, ShouldBeNil)
+	a.So(result.Status, ShouldEqual, DownlinkAcknowledged)
+	a.So(result.Events, ShouldHaveLength, 3)
+	a.So(result.Events[1].Data.(*types.DownlinkEventData).GatewayID, ShouldEqual, "gtw")
+
+	waitForCondition(t, "events unsubscription", subscribed(0))
+
+	// Errors
+	failed, err := device.PublishTracked(&types.DownlinkMessage{FPort: 3, Confirmed: true})
+	a.So(err, ShouldBeNil)
+	waitForCondition(t, "events subscription", subscribed(1))
+	broker.publish("test/devices/dev/events/down/errors", []byte(`{"error":"not enough airtime"}`))
+	result = waitForDownlink(t, failed)
+	a.So(result.Status, ShouldEqual, DownlinkFailed)
+	a.So(result.Err.Error(), ShouldEqual, "not enough airtime")
+	waitForCondition(t, "events unsubscription", subscribed(0))
+
+	// Timeout, while the events are also subscribed
+	events, err := device.SubscribeEvents()
+	a.So(err, ShouldBeNil)
+	timedOut, err := device.PublishTracked(&types.DownlinkMessage{FPort: 4}, DownlinkTrackingOptions{
+		Until:   DownlinkScheduled,
+		Timeout: 50 * time.Millisecond,
+	})
+	a.So(err, ShouldBeNil)
+	result = waitForDownlink(t, timedOut)
+	a.So(result.Status, ShouldEqual, DownlinkPublished)
+	a.So(result.Err, ShouldEqual, ErrDownlinkTimeout)
+
+	a.So(broker.subscribed("test/devices/dev/events/#"), ShouldEqual, 1)
+	broker.publish("test/devices/dev/events/down/sent", []byte(`{}`))
+	select {
+	case event := <-events:
+		a.So(event.Event, ShouldEqual, types.DownlinkSentEvent)
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive event within a second")
+	}
+
+	// Closing the device resolves the tracked downlinks
+	closed, err := device.PublishTracked(&types.DownlinkMessage{FPort: 5})
+	a.So(err, ShouldBeNil)
+	device.Close()
+	result = waitForDownlink(t, closed)
+	a.So(result.Err, ShouldNotBeNil)
+}
+
+func TestPublishTrackedConcurrently(t *testing.T) {
+	a := New(t)
+
+	broker, err := newMockMQTTBroker()
+	a.So(err, ShouldBeNil)
+	defer broker.Close()
+
+	config := NewConfig("test", "", "")
+	config.Logger = newRecordingLogger()
+	config.MQTTAddress = "mqtt://" + broker.Addr().String()
+	client := config.NewClient("test", "")
+	defer client.Close()
+
+	pubsub, err := client.PubSub()
+	a.So(err, ShouldBeNil)
+	defer pubsub.Close()
+
+	device := pubsub.Device("dev")
+
+	const count = 10
+	handles := make([]*DownlinkHandle, count)
+	var wg sync.WaitGroup
+	for i := range handles {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			h, err := device.PublishTracked(&types.DownlinkMessage{FPort: uint8(i + 1), PayloadRaw: []byte{byte(i)}})
+			a.So(err, ShouldBeNil)
+			handles[i] = h
+		}(i)
+	}
+	wg.Wait()
+
+	// The Network schedules the downlinks in the order in which they were published, and sends them in that order
+	waitForCondition(t, "published downlinks", func() bool { return len(broker.messages("test/devices/dev/down")) == count })
+	published := broker.messages("test/devices/dev/down")
+	var order []int
+	for _, payload := range published {
+		var msg types.DownlinkMessage
+		a.So(json.Unmarshal(payload, &msg), ShouldBeNil)
+		order = append(order, int(msg.FPort)-1)
+		broker.publish("test/devices/dev/events/down/scheduled", []byte(fmt.Sprintf(`{"message":{"port":%d,"payload_raw":"%s"}}`,
+			msg.FPort, base64.StdEncoding.EncodeToString(msg.PayloadRaw))))
+	}
+	for _, i := range order {
+		waitForStatus(t, handles[i], DownlinkScheduled)
+	}
+	for _, i := range order {
+		broker.publish("test/devices/dev/events/down/sent", []byte(`{}`))
+		result := waitForDownlink(t, handles[i])
+		a.So(result.Err, ShouldBeNil)
+		a.So(result.Status, ShouldEqual, DownlinkSent)
+	}
+}
+
+func TestPublishTrackedWithAllEvents(t *testing.T) {
+	a := New(t)
+
+	broker, err := newMockMQTTBroker()
+	a.So(err, ShouldBeNil)
+	defer broker.Close()
+
+	config := NewConfig("test", "", "")
+	config.Logger = newRecordingLogger()
+	config.MQTTAddress = "mqtt://" + broker.Addr().String()
+	client := config.NewClient("test", "")
+	defer client.Close()
+
+	pubsub, err := client.PubSub()
+	a.So(err, ShouldBeNil)
+	defer pubsub.Close()
+
+	allEvents, err := pubsub.SubscribeAllEvents()
+	a.So(err, ShouldBeNil)
+
+	// The downlink is tracked with the events of the combined stream, instead of a subscription of the device
+	h, err := pubsub.Device("dev").PublishTracked(&types.DownlinkMessage{FPort: 1})
+	a.So(err, ShouldBeNil)
+	a.So(broker.subscribed("test/devices/dev/events/#"), ShouldEqual, 0)
+
+	broker.publish("test/devices/other/events/down/acks", []byte(`{}`))
+	select {
+	case event := <-allEvents:
+		a.So(event.DevID, ShouldEqual, "other")
+		a.So(event.Event, ShouldEqual, types.DownlinkAckEvent)
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive event of other device within a second")
+	}
+
+	broker.publish("test/devices/dev/events/down/sent", []byte(`{}`))
+	result := waitForDownlink(t, h)
+	a.So(result.Err, ShouldBeNil)
+	a.So(result.Status, ShouldEqual, DownlinkSent)
+	select {
+	case event := <-allEvents:
+		a.So(event.DevID, ShouldEqual, "dev")
+		a.So(event.Event, ShouldEqual, types.DownlinkSentEvent)
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive event of device within a second")
+	}
+
+	// The events of other devices keep arriving after the downlink resolved
+	broker.publish("test/devices/other/events/down/sent", []byte(`{}`))
+	select {
+	case event := <-allEvents:
+		a.So(event.DevID, ShouldEqual, "other")
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive event of other device within a second")
+	}
+	a.So(broker.subscribed("test/devices/+/events/#"), ShouldEqual, 1)
+}
@@ -0,0 +1,319 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"encoding/json"
+	"sync/atomic"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+
+	"github.com/TheThingsNetwork/ttn/core/types"
+	"github.com/TheThingsNetwork/ttn/mqtt"
+)
+
+// ApplicationErrorEvent is the type of application events that report an error in the application
+const ApplicationErrorEvent types.EventType = "errors"
+
+// ApplicationEvent is an event of an application. The Data is an *types.ErrorEventData for error events, the data type
+// of the event type (see types.EventType.Data) for known event types, and a map[string]interface{} for other events
+// with a JSON payload.
+type ApplicationEvent struct {
+	AppID string
+	Event types.EventType
+	Data  interface{}
+}
+
+// Event is an application event or a device event. The DevID is empty for application events.
+type Event struct {
+	AppID string
+	DevID string
+	Event types.EventType
+	Data  interface{}
+}
+
+func applicationEventData(eventType types.EventType, payload []byte) interface{} {
+	eventData := eventType.Data()
+	if eventType == ApplicationErrorEvent {
+		eventData = new(types.ErrorEventData)
+	}
+	if eventData == nil {
+		if len(payload) == 0 {
+			return nil
+		}
+		eventData = new(map[string]interface{})
+	}
+	if err := json.Unmarshal(payload, eventData); err != nil {
+		return nil
+	}
+	if fields, ok := eventData.(*map[string]interface{}); ok {
+		return *fields
+	}
+	return eventData
+}
+
+// deviceEventListener receives the device events that are dispatched to it
+type deviceEventListener func(client mqtt.Client, appID string, devID string, eventType types.EventType, payload []byte)
+
+// deviceEventSubscription is a listener for the events of a device, or of all devices if the DevID is "+". If the
+// event type is set, only events of that type are dispatched to the listener.
+type deviceEventSubscription struct {
+	devID     string
+	eventType types.EventType
+	listener  deviceEventListener
+}
+
+func (s deviceEventSubscription) matches(devID string, eventType types.EventType) bool {
+	return (s.devID == "+" || s.devID == devID) && (s.eventType == "" || s.eventType == eventType)
+}
+
+// subscribeAppEvents subscribes to the application events topic. It must be called with the lock held.
+func (a *applicationPubSub) subscribeAppEvents() mqtt.Token {
+	return a.client.SubscribeAppEvents(a.appID, "", a.handleAppEvent)
+}
+
+// subscribeDeviceEvents subscribes to the events topic of the device, or of all devices if the DevID is "+". It must
+// be called with the lock held.
+func (a *applicationPubSub) subscribeDeviceEvents(devID string) mqtt.Token {
+	return a.client.SubscribeDeviceEvents(a.appID, devID, "#", a.dispatchDeviceEvent)
+}
+
+// addDeviceEventListener adds a listener for the events of a device, or of all devices if the DevID is "+". The MQTT
+// client replaces the handler of a subscription if a subscription with an overlapping topic is made, and removes the
+// wrong subscription if an overlapping one is unsubscribed, so all device events and activations of the application
+// are dispatched from the subscriptions of the ApplicationPubSub.
+func (a *applicationPubSub) addDeviceEventListener(key interface{}, devID string, eventType types.EventType, listener deviceEventListener) error {
+	a.Lock()
+	defer a.Unlock()
+	return a.addDeviceEventListenerLocked(key, devID, eventType, listener)
+}
+
+func (a *applicationPubSub) addDeviceEventListenerLocked(key interface{}, devID string, eventType types.EventType, listener deviceEventListener) error {
+	if a.deviceEventListeners == nil {
+		a.deviceEventListeners = make(map[interface{}]deviceEventSubscription)
+	}
+	if devID == "" {
+		devID = "+"
+	}
+	a.deviceEventListeners[key] = deviceEventSubscription{devID: devID, eventType: eventType, listener: listener}
+	if err := a.updateDeviceEventTopicsLocked(); err != nil {
+		delete(a.deviceEventListeners, key)
+		a.updateDeviceEventTopicsLocked()
+		return err
+	}
+	return nil
+}
+
+// removeDeviceEventListener removes the listener, and unsubscribes from the topics that are no longer used
+func (a *applicationPubSub) removeDeviceEventListener(key interface{}) error {
+	a.Lock()
+	defer a.Unlock()
+	return a.removeDeviceEventListenerLocked(key)
+}
+
+func (a *applicationPubSub) removeDeviceEventListenerLocked(key interface{}) error {
+	if _, ok := a.deviceEventListeners[key]; !ok {
+		return nil
+	}
+	delete(a.deviceEventListeners, key)
+	return a.updateDeviceEventTopicsLocked()
+}
+
+// updateDeviceEventTopicsLocked subscribes to the events topic of all devices if a listener needs the events of all
+// devices, and to the events topics of the devices of the listeners otherwise. Once the events of all devices are
+// subscribed to, that subscription is kept until the last listener is removed, as moving back to the topics of the
+// devices would lose the events in between. It must be called with the lock held.
+func (a *applicationPubSub) updateDeviceEventTopicsLocked() error {
+	topics := make(map[string]struct{})
+	if _, ok := a.deviceEventTopics["+"]; ok && len(a.deviceEventListeners) > 0 {
+		topics["+"] = struct{}{}
+	} else {
+		for _, subscription := range a.deviceEventListeners {
+			if subscription.devID == "+" {
+				topics = map[string]struct{}{"+": {}}
+				break
+			}
+			topics[subscription.devID] = struct{}{}
+		}
+	}
+	if a.deviceEventTopics == nil {
+		a.deviceEventTopics = make(map[string]struct{})
+	}
+	// Subscribe first, so that no events are lost when moving to the topic of all devices
+	for devID := range topics {
+		if _, ok := a.deviceEventTopics[devID]; ok {
+			continue
+		}
+		token := a.subscribeDeviceEvents(devID)
+		token.Wait()
+		if err := token.Error(); err != nil {
+			return err
+		}
+		a.deviceEventTopics[devID] = struct{}{}
+	}
+	var err error
+	for devID := range a.deviceEventTopics {
+		if _, ok := topics[devID]; ok {
+			continue
+		}
+		delete(a.deviceEventTopics, devID)
+		token := a.client.UnsubscribeDeviceEvents(a.appID, devID, "#")
+		token.Wait()
+		if tokenErr := token.Error(); tokenErr != nil && err == nil {
+			err = tokenErr
+		}
+	}
+	return err
+}
+
+func (a *applicationPubSub) dispatchDeviceEvent(client mqtt.Client, appID string, devID string, eventType types.EventType, payload []byte) {
+	a.RLock()
+	listeners := make([]deviceEventListener, 0, len(a.deviceEventListeners))
+	for _, subscription := range a.deviceEventListeners {
+		if subscription.matches(devID, eventType) {
+			listeners = append(listeners, subscription.listener)
+		}
+	}
+	a.RUnlock()
+	for _, listener := range listeners {
+		listener(client, appID, devID, eventType, payload)
+	}
+}
+
+// dropper returns the function that is called when the subscription drops a message
+func (a *applicationPubSub) dropper(options SubscriptionOptions, subscription string) func(interface{}, error) {
+	return func(msg interface{}, err error) {
+		atomic.AddUint64(&a.dropped, 1)
+		logger := a.logger.WithFields(log.Fields{"AppID": a.appID, "Subscription": subscription})
+		if err != nil {
+			logger = logger.WithError(err)
+		}
+		logger.Debug("ttn-sdk: Dropped message")
+		if options.OnDrop != nil {
+			options.OnDrop(DroppedMessage{AppID: a.appID, Subscription: subscription, Message: msg, Err: err})
+		}
+	}
+}
+
+func (a *applicationPubSub) Dropped() uint64 {
+	return atomic.LoadUint64(&a.dropped)
+}
+
+func (a *applicationPubSub) SubscribeApplicationEvents(options ...SubscriptionOptions) (<-chan *ApplicationEvent, error) {
+	if err := a.ctx.Err(); err != nil {
+		return nil, err
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.appEvents != nil {
+		return a.appEvents.channel().(chan *ApplicationEvent), nil
+	}
+	if a.allEvents == nil { // Otherwise the topic is already subscribed for the combined stream
+		token := a.subscribeAppEvents()
+		token.Wait()
+		if err := token.Error(); err != nil {
+			return nil, err
+		}
+	}
+	subscriptionOptions := subscriptionOptions(a.options, options)
+	appEvents := make(chan *ApplicationEvent, subscriptionOptions.bufferSize())
+	a.appEvents = newSubscriptionQueue(appEvents, subscriptionOptions, decodeApplicationEvent, a.dropper(subscriptionOptions, "application-events"))
+	return appEvents, nil
+}
+
+func (a *applicationPubSub) handleAppEvent(_ mqtt.Client, appID string, eventType types.EventType, payload []byte) {
+	data := applicationEventData(eventType, payload)
+	a.RLock()
+	appEvents, allEvents := a.appEvents, a.allEvents
+	a.RUnlock()
+	if appEvents != nil {
+		appEvents.push(&ApplicationEvent{AppID: appID, Event: eventType, Data: data})
+	}
+	if allEvents != nil {
+		allEvents.push(&Event{AppID: appID, Event: eventType, Data: data})
+	}
+}
+
+func (a *applicationPubSub) UnsubscribeApplicationEvents() error {
+	a.Lock()
+	defer a.Unlock()
+	if a.appEvents == nil {
+		return nil
+	}
+	a.appEvents.close()
+	a.appEvents = nil
+	if a.allEvents != nil {
+		return nil // The topic is still needed for the combined stream
+	}
+	token := a.client.UnsubscribeAppEvents(a.appID, "")
+	token.Wait()
+	return token.Error()
+}
+
+func (a *applicationPubSub) SubscribeAllEvents(options ...SubscriptionOptions) (<-chan *Event, error) {
+	if err := a.ctx.Err(); err != nil {
+		return nil, err
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.allEvents != nil {
+		return a.allEvents.channel().(chan *Event), nil
+	}
+	if a.appEvents == nil {
+		token := a.subscribeAppEvents()
+		token.Wait()
+		if err := token.Error(); err != nil {
+			return nil, err
+		}
+	}
+	if err := a.addDeviceEventListenerLocked(a, "+", "", a.handleDeviceEvent); err != nil {
+		if a.appEvents == nil {
+			a.client.UnsubscribeAppEvents(a.appID, "").Wait()
+		}
+		return nil, err
+	}
+	subscriptionOptions := subscriptionOptions(a.options, options)
+	allEvents := make(chan *Event, subscriptionOptions.bufferSize())
+	a.allEvents = newSubscriptionQueue(allEvents, subscriptionOptions, decodeEvent, a.dropper(subscriptionOptions, "all-events"))
+	return allEvents, nil
+}
+
+func (a *applicationPubSub) handleDeviceEvent(_ mqtt.Client, appID string, devID string, eventType types.EventType, payload []byte) {
+	msg := &Event{
+		AppID: appID,
+		DevID: devID,
+		Event: eventType,
+	}
+	eventData := eventType.Data()
+	if eventData != nil {
+		if err := json.Unmarshal(payload, eventData); err == nil {
+			msg.Data = eventData
+		}
+	}
+	a.RLock()
+	allEvents := a.allEvents
+	a.RUnlock()
+	if allEvents != nil {
+		allEvents.push(msg)
+	}
+}
+
+func (a *applicationPubSub) UnsubscribeAllEvents() error {
+	a.Lock()
+	defer a.Unlock()
+	if a.allEvents == nil {
+		return nil
+	}
+	a.allEvents.close()
+	a.allEvents = nil
+	err := a.removeDeviceEventListenerLocked(a)
+	if a.appEvents == nil {
+		token := a.client.UnsubscribeAppEvents(a.appID, "")
+		token.Wait()
+		if tokenErr := token.Error(); tokenErr != nil && err == nil {
+			err = tokenErr
+		}
+	}
+	return err
+}
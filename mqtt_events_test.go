@@ -0,0 +1,211 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	ttnlog "github.com/TheThingsNetwork/go-utils/log"
+	testlog "github.com/TheThingsNetwork/go-utils/log/test"
+	"github.com/TheThingsNetwork/ttn/core/types"
+	. "github.com/smartystreets/assertions"
+)
+
+func TestApplicationEvents(t *testing.T) {
+	a := New(t)
+
+	log := testlog.NewLogger()
+	ttnlog.Set(log)
+	defer log.Print(t)
+
+	broker, err := newMockMQTTBroker()
+	a.So(err, ShouldBeNil)
+	defer broker.Close()
+
+	config := NewConfig("test", "", "")
+	config.Logger = log
+	config.MQTTAddress = "mqtt://" + broker.Addr().String()
+	client := config.NewClient("test", "")
+	defer client.Close()
+
+	pubsub, err := client.PubSub()
+	a.So(err, ShouldBeNil)
+	defer pubsub.Close()
+
+	appEvents, err := pubsub.SubscribeApplicationEvents()
+	a.So(err, ShouldBeNil)
+	allEvents, err := pubsub.SubscribeAllEvents()
+	a.So(err, ShouldBeNil)
+	deviceEvents, err := pubsub.AllDevices().SubscribeEvents()
+	a.So(err, ShouldBeNil)
+
+	broker.publish("test/events/errors", []byte(`{"error":"something went wrong"}`))
+	select {
+	case event := <-appEvents:
+		a.So(event.AppID, ShouldEqual, "test")
+		a.So(event.Event, ShouldEqual, ApplicationErrorEvent)
+		a.So(event.Data, ShouldResemble, &types.ErrorEventData{Error: "something went wrong"})
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive application event within a second")
+	}
+	select {
+	case event := <-allEvents:
+		a.So(event.DevID, ShouldBeEmpty)
+		a.So(event.Event, ShouldEqual, ApplicationErrorEvent)
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive application event on combined stream within a second")
+	}
+
+	broker.publish("test/events/custom", []byte(`{"key":"value"}`))
+	select {
+	case event := <-appEvents:
+		a.So(event.Data, ShouldResemble, map[string]interface{}{"key": "value"})
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive application event within a second")
+	}
+	<-allEvents
+
+	broker.publish("test/devices/dev/events/down/acks", []byte(`{}`))
+	select {
+	case event := <-allEvents:
+		a.So(event.DevID, ShouldEqual, "dev")
+		a.So(event.Event, ShouldEqual, types.DownlinkAckEvent)
+		a.So(event.Data, ShouldHaveSameTypeAs, &types.DownlinkEventData{})
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive device event on combined stream within a second")
+	}
+	select {
+	case event := <-deviceEvents:
+		a.So(event.Event, ShouldEqual, types.DownlinkAckEvent)
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive device event within a second")
+	}
+
+	// The application events topic stays subscribed for the combined stream
+	a.So(pubsub.UnsubscribeApplicationEvents(), ShouldBeNil)
+	_, ok := <-appEvents
+	a.So(ok, ShouldBeFalse)
+	a.So(broker.subscribed("test/events/#"), ShouldEqual, 1)
+
+	a.So(pubsub.UnsubscribeAllEvents(), ShouldBeNil)
+	_, ok = <-allEvents
+	a.So(ok, ShouldBeFalse)
+	time.Sleep(10 * time.Millisecond)
+	a.So(broker.subscribed("test/events/#"), ShouldEqual, 0)
+	a.So(broker.subscribed("test/devices/+/events/#"), ShouldEqual, 1) // Still used by AllDevices()
+
+	allEvents, err = pubsub.SubscribeAllEvents()
+	a.So(err, ShouldBeNil)
+	pubsub.Close()
+	select {
+	case _, ok := <-allEvents:
+		a.So(ok, ShouldBeFalse)
+	case <-time.After(time.Second):
+		t.Fatal("Combined stream was not closed within a second")
+	}
+}
+
+func TestOverlappingDeviceEvents(t *testing.T) {
+	for _, activationsFirst := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ActivationsFirst=%v", activationsFirst), func(t *testing.T) {
+			a := New(t)
+
+			broker, err := newMockMQTTBroker()
+			a.So(err, ShouldBeNil)
+			defer broker.Close()
+
+			config := NewConfig("test", "", "")
+			config.Logger = newRecordingLogger()
+			config.MQTTAddress = "mqtt://" + broker.Addr().String()
+			client := config.NewClient("test", "")
+			defer client.Close()
+
+			pubsub, err := client.PubSub()
+			a.So(err, ShouldBeNil)
+			defer pubsub.Close()
+
+			allDevices := pubsub.AllDevices()
+			device := pubsub.Device("dev")
+
+			var (
+				activations  <-chan *types.Activation
+				deviceEvents <-chan *types.DeviceEvent
+				allEvents    <-chan *Event
+			)
+			subscribeActivations := func() {
+				activations, err = allDevices.SubscribeActivations()
+				a.So(err, ShouldBeNil)
+			}
+			if activationsFirst {
+				subscribeActivations()
+			}
+			deviceEvents, err = allDevices.SubscribeEvents()
+			a.So(err, ShouldBeNil)
+			allEvents, err = pubsub.SubscribeAllEvents()
+			a.So(err, ShouldBeNil)
+			if !activationsFirst {
+				subscribeActivations()
+			}
+			devEvents, err := device.SubscribeEvents()
+			a.So(err, ShouldBeNil)
+
+			// All subscriptions share the events topic of all devices
+			a.So(broker.subscribed("test/devices/+/events/#"), ShouldEqual, 1)
+			a.So(broker.subscribed("test/devices/+/events/activations"), ShouldEqual, 0)
+			a.So(broker.subscribed("test/devices/dev/events/#"), ShouldEqual, 0)
+
+			broker.publish("test/devices/dev/events/activations", []byte(`{"dev_addr":"26000001"}`))
+			select {
+			case msg := <-activations:
+				a.So(msg.DevID, ShouldEqual, "dev")
+				a.So(msg.DevAddr, ShouldEqual, types.DevAddr{0x26, 0, 0, 1})
+			case <-time.After(time.Second):
+				t.Fatal("Did not receive activation within a second")
+			}
+			for _, events := range []<-chan *types.DeviceEvent{deviceEvents, devEvents} {
+				select {
+				case event := <-events:
+					a.So(event.Event, ShouldEqual, types.ActivationEvent)
+				case <-time.After(time.Second):
+					t.Fatal("Did not receive activation event within a second")
+				}
+			}
+			select {
+			case event := <-allEvents:
+				a.So(event.Event, ShouldEqual, types.ActivationEvent)
+			case <-time.After(time.Second):
+				t.Fatal("Did not receive activation event on combined stream within a second")
+			}
+
+			// Unsubscribing a device does not affect the subscriptions of all devices
+			a.So(device.UnsubscribeEvents(), ShouldBeNil)
+			a.So(allDevices.UnsubscribeActivations(), ShouldBeNil)
+
+			broker.publish("test/devices/other/events/down/acks", []byte(`{}`))
+			select {
+			case event := <-deviceEvents:
+				a.So(event.DevID, ShouldEqual, "other")
+				a.So(event.Event, ShouldEqual, types.DownlinkAckEvent)
+			case <-time.After(time.Second):
+				t.Fatal("Did not receive device event within a second")
+			}
+			select {
+			case event := <-allEvents:
+				a.So(event.DevID, ShouldEqual, "other")
+			case <-time.After(time.Second):
+				t.Fatal("Did not receive device event on combined stream within a second")
+			}
+			select {
+			case msg, ok := <-activations:
+				a.So(ok, ShouldBeFalse)
+				a.So(msg, ShouldBeNil)
+			case <-time.After(time.Second):
+				t.Fatal("Activations were not closed within a second")
+			}
+			a.So(broker.subscribed("test/devices/+/events/#"), ShouldEqual, 1)
+		})
+	}
+}
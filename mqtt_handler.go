@@ -0,0 +1,301 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"runtime/debug"
+	"sync"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/ttn/core/types"
+)
+
+// UplinkHandler handles uplink messages
+type UplinkHandler interface {
+	HandleUplink(*types.UplinkMessage) error
+}
+
+// UplinkHandlerFunc is a func that implements UplinkHandler
+type UplinkHandlerFunc func(*types.UplinkMessage) error
+
+// HandleUplink implements UplinkHandler
+func (f UplinkHandlerFunc) HandleUplink(msg *types.UplinkMessage) error { return f(msg) }
+
+// EventHandler handles device events
+type EventHandler interface {
+	HandleEvent(*types.DeviceEvent) error
+}
+
+// EventHandlerFunc is a func that implements EventHandler
+type EventHandlerFunc func(*types.DeviceEvent) error
+
+// HandleEvent implements EventHandler
+func (f EventHandlerFunc) HandleEvent(msg *types.DeviceEvent) error { return f(msg) }
+
+// ActivationHandler handles activations
+type ActivationHandler interface {
+	HandleActivation(*types.Activation) error
+}
+
+// ActivationHandlerFunc is a func that implements ActivationHandler
+type ActivationHandlerFunc func(*types.Activation) error
+
+// HandleActivation implements ActivationHandler
+func (f ActivationHandlerFunc) HandleActivation(msg *types.Activation) error { return f(msg) }
+
+// HandlerPanicError is the error of a DeadLetter if the handler panicked
+type HandlerPanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (err *HandlerPanicError) Error() string {
+	return fmt.Sprintf("ttn-sdk: Handler panicked: %v", err.Value)
+}
+
+// DeadLetter is a message that could not be handled
+type DeadLetter struct {
+	AppID string
+	DevID string
+
+	// The subscription of the message: "uplink", "events" or "activations"
+	Subscription string
+
+	Message interface{}
+
+	// The error that was returned by the handler, or a *HandlerPanicError if the handler panicked
+	Err error
+}
+
+// ErrHandlerQueueFull is the error of a DeadLetter if the message did not fit in the queue of its worker
+var ErrHandlerQueueFull = errors.New("ttn-sdk: Handler queue is full")
+
+// HandlerOptions contains the options for HandleUplink, HandleEvents and HandleActivations
+type HandlerOptions struct {
+	// Options for the subscription (optional). If not set, the SubscriptionOptions of the ClientConfig are used.
+	Subscription *SubscriptionOptions
+
+	// The number of workers that handle messages concurrently (in the default config, this is 1). Messages of the
+	// same device are always handled by the same worker, in the order in which they were received.
+	Workers int
+
+	// Options for the queue of each worker (optional). While a worker is busy, the messages for that worker are
+	// queued, so that a slow device does not hold up the messages of devices that are handled by other workers.
+	// Messages that arrive while the queue is full are handled according to the Overflow of the queue; messages that
+	// are dropped are passed to DeadLetter, with ErrHandlerQueueFull if there was no other error. The OnDrop func of
+	// the queue options is not used. If not set, DefaultSubscriptionBufferSize messages are queued for each worker,
+	// and messages that do not fit are dropped. Keep in mind that with OverflowBlock, a full queue holds up all
+	// workers and the subscription.
+	Queue *SubscriptionOptions
+
+	// Function that is called for messages that could not be handled (optional). If not set, the errors are logged.
+	DeadLetter func(DeadLetter)
+
+	// Logger for errors of handlers (in the default config, this is the global logger)
+	Logger log.Interface
+}
+
+// HandlerPool runs the handlers of a subscription. The HandlerPool stops when the subscription ends, for example when
+// the DeviceSub is unsubscribed or closed.
+type HandlerPool struct {
+	subscription string
+	options      HandlerOptions
+	handle       func(interface{}) error
+	queues       []*subscriptionQueue
+	wg           sync.WaitGroup
+	done         chan struct{}
+}
+
+func newHandlerPool(subscription string, options []HandlerOptions, decode func([]byte) (interface{}, error), handle func(interface{}) error) *HandlerPool {
+	p := &HandlerPool{
+		subscription: subscription,
+		handle:       handle,
+		done:         make(chan struct{}),
+	}
+	if len(options) > 0 {
+		p.options = options[0]
+	}
+	if p.options.Workers <= 0 {
+		p.options.Workers = 1
+	}
+	if p.options.Logger == nil {
+		p.options.Logger = log.Get()
+	}
+	var queueOptions SubscriptionOptions
+	if p.options.Queue != nil {
+		queueOptions = *p.options.Queue
+	}
+	p.queues = make([]*subscriptionQueue, p.options.Workers)
+	for i := range p.queues {
+		messages := make(chan interface{}, queueOptions.bufferSize())
+		p.queues[i] = newSubscriptionQueue(messages, queueOptions, decode, p.dropped)
+		p.wg.Add(1)
+		go p.work(messages)
+	}
+	go func() {
+		p.wg.Wait()
+		close(p.done)
+	}()
+	return p
+}
+
+// subscriptionOptions returns the options for the Subscribe function of the DeviceSub
+func (p *HandlerPool) subscriptionOptions() []SubscriptionOptions {
+	if p.options.Subscription == nil {
+		return nil
+	}
+	return []SubscriptionOptions{*p.options.Subscription}
+}
+
+// dispatch queues the message for the worker of the device
+func (p *HandlerPool) dispatch(devID string, msg interface{}) {
+	hash := fnv.New32a()
+	hash.Write([]byte(devID))
+	p.queues[hash.Sum32()%uint32(len(p.queues))].push(msg)
+}
+
+// dropped is called for the messages that are dropped by the queue of a worker
+func (p *HandlerPool) dropped(msg interface{}, err error) {
+	if err == nil {
+		err = ErrHandlerQueueFull
+	}
+	appID, devID := messageDevice(msg)
+	p.deadLetter(DeadLetter{
+		AppID:        appID,
+		DevID:        devID,
+		Subscription: p.subscription,
+		Message:      msg,
+		Err:          err,
+	})
+}
+
+// stop stops the workers after they handled the queued messages
+func (p *HandlerPool) stop() {
+	for _, queue := range p.queues {
+		queue.close()
+	}
+}
+
+func (p *HandlerPool) work(messages <-chan interface{}) {
+	defer p.wg.Done()
+	for msg := range messages {
+		if err := p.safeHandle(msg); err != nil {
+			appID, devID := messageDevice(msg)
+			p.deadLetter(DeadLetter{
+				AppID:        appID,
+				DevID:        devID,
+				Subscription: p.subscription,
+				Message:      msg,
+				Err:          err,
+			})
+		}
+	}
+}
+
+// messageDevice returns the AppID and DevID of an uplink message, device event or activation
+func messageDevice(msg interface{}) (appID, devID string) {
+	switch msg := msg.(type) {
+	case *types.UplinkMessage:
+		return msg.AppID, msg.DevID
+	case *types.DeviceEvent:
+		return msg.AppID, msg.DevID
+	case *types.Activation:
+		return msg.AppID, msg.DevID
+	}
+	return "", ""
+}
+
+func (p *HandlerPool) safeHandle(msg interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &HandlerPanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return p.handle(msg)
+}
+
+func (p *HandlerPool) deadLetter(letter DeadLetter) {
+	if p.options.DeadLetter != nil {
+		p.options.DeadLetter(letter)
+		return
+	}
+	p.options.Logger.WithError(letter.Err).WithFields(log.Fields{
+		"AppID":        letter.AppID,
+		"DevID":        letter.DevID,
+		"Subscription": letter.Subscription,
+	}).Warn("ttn-sdk: Could not handle message")
+}
+
+// Wait waits until the subscription has ended and all received messages are handled
+func (p *HandlerPool) Wait() {
+	<-p.done
+}
+
+// Done returns a channel that is closed when the subscription has ended and all received messages are handled
+func (p *HandlerPool) Done() <-chan struct{} {
+	return p.done
+}
+
+// HandleUplink subscribes to the uplink messages of the DeviceSub and passes them to the handler. It returns an error if
+// the uplink messages of the DeviceSub are already subscribed to.
+func HandleUplink(sub DeviceSub, handler UplinkHandler, options ...HandlerOptions) (*HandlerPool, error) {
+	p := newHandlerPool("uplink", options, decodeUplink, func(msg interface{}) error {
+		return handler.HandleUplink(msg.(*types.UplinkMessage))
+	})
+	uplink, err := subscribeUplinkExclusive(sub, p.subscriptionOptions())
+	if err != nil {
+		p.stop()
+		return nil, err
+	}
+	go func() {
+		defer p.stop()
+		for msg := range uplink {
+			p.dispatch(msg.DevID, msg)
+		}
+	}()
+	return p, nil
+}
+
+// HandleEvents subscribes to the events of the DeviceSub and passes them to the handler. It returns an error if the
+// events of the DeviceSub are already subscribed to.
+func HandleEvents(sub DeviceSub, handler EventHandler, options ...HandlerOptions) (*HandlerPool, error) {
+	p := newHandlerPool("events", options, decodeDeviceEvent, func(msg interface{}) error {
+		return handler.HandleEvent(msg.(*types.DeviceEvent))
+	})
+	events, err := subscribeEventsExclusive(sub, p.subscriptionOptions())
+	if err != nil {
+		p.stop()
+		return nil, err
+	}
+	go func() {
+		defer p.stop()
+		for msg := range events {
+			p.dispatch(msg.DevID, msg)
+		}
+	}()
+	return p, nil
+}
+
+// HandleActivations subscribes to the activations of the DeviceSub and passes them to the handler. It returns an error
+// if the activations of the DeviceSub are already subscribed to.
+func HandleActivations(sub DeviceSub, handler ActivationHandler, options ...HandlerOptions) (*HandlerPool, error) {
+	p := newHandlerPool("activations", options, decodeActivation, func(msg interface{}) error {
+		return handler.HandleActivation(msg.(*types.Activation))
+	})
+	activations, err := subscribeActivationsExclusive(sub, p.subscriptionOptions())
+	if err != nil {
+		p.stop()
+		return nil, err
+	}
+	go func() {
+		defer p.stop()
+		for msg := range activations {
+			p.dispatch(msg.DevID, msg)
+		}
+	}()
+	return p, nil
+}
@@ -0,0 +1,199 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/ttn/core/types"
+	. "github.com/smartystreets/assertions"
+)
+
+// uplinkSub is a DeviceSub that only supports uplink messages
+type uplinkSub struct {
+	DeviceSub
+	uplink chan *types.UplinkMessage
+}
+
+func (s *uplinkSub) SubscribeUplink(_ ...SubscriptionOptions) (<-chan *types.UplinkMessage, error) {
+	return s.uplink, nil
+}
+
+func TestHandleUplink(t *testing.T) {
+	a := New(t)
+
+	sub := &uplinkSub{uplink: make(chan *types.UplinkMessage)}
+
+	var mu sync.Mutex
+	handled := make(map[string][]uint32)
+	var deadLetters []DeadLetter
+
+	pool, err := HandleUplink(sub, UplinkHandlerFunc(func(msg *types.UplinkMessage) error {
+		time.Sleep(time.Millisecond)
+		switch msg.FCnt {
+		case 13:
+			return errors.New("unlucky")
+		case 42:
+			panic("the answer")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		handled[msg.DevID] = append(handled[msg.DevID], msg.FCnt)
+		return nil
+	}), HandlerOptions{
+		Workers: 4,
+		Queue:   &SubscriptionOptions{Overflow: OverflowBlock},
+		DeadLetter: func(letter DeadLetter) {
+			mu.Lock()
+			defer mu.Unlock()
+			deadLetters = append(deadLetters, letter)
+		},
+	})
+	a.So(err, ShouldBeNil)
+
+	for fCnt := uint32(0); fCnt < 50; fCnt++ {
+		for dev := 0; dev < 5; dev++ {
+			sub.uplink <- &types.UplinkMessage{AppID: "test", DevID: fmt.Sprintf("dev-%d", dev), FCnt: fCnt}
+		}
+	}
+	close(sub.uplink)
+
+	select {
+	case <-pool.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handlers did not finish within five seconds")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	a.So(handled, ShouldHaveLength, 5)
+	for devID, fCnts := range handled {
+		a.So(fCnts, ShouldHaveLength, 48)
+		for i := 1; i < len(fCnts); i++ {
+			if fCnts[i] <= fCnts[i-1] {
+				t.Fatalf("Uplink messages of %s were handled out of order: %v", devID, fCnts)
+			}
+		}
+	}
+
+	a.So(deadLetters, ShouldHaveLength, 10)
+	for _, letter := range deadLetters {
+		a.So(letter.AppID, ShouldEqual, "test")
+		a.So(letter.Subscription, ShouldEqual, "uplink")
+		switch letter.Message.(*types.UplinkMessage).FCnt {
+		case 13:
+			a.So(letter.Err.Error(), ShouldEqual, "unlucky")
+		case 42:
+			a.So(letter.Err, ShouldHaveSameTypeAs, &HandlerPanicError{})
+			a.So(letter.Err.(*HandlerPanicError).Value, ShouldEqual, "the answer")
+		default:
+			t.Errorf("Unexpected dead letter %v", letter)
+		}
+	}
+}
+
+func TestHandlerPoolQueue(t *testing.T) {
+	a := New(t)
+
+	sub := &uplinkSub{uplink: make(chan *types.UplinkMessage)}
+
+	// Find two devices that are handled by different workers
+	slow, fast := "dev-0", ""
+	worker := func(devID string) uint32 {
+		hash := fnv.New32a()
+		hash.Write([]byte(devID))
+		return hash.Sum32() % 2
+	}
+	for i := 1; fast == ""; i++ {
+		if devID := fmt.Sprintf("dev-%d", i); worker(devID) != worker(slow) {
+			fast = devID
+		}
+	}
+
+	started, release := make(chan struct{}), make(chan struct{})
+	handled := make(chan *types.UplinkMessage, 10)
+	deadLetters := make(chan DeadLetter, 10)
+	pool, err := HandleUplink(sub, UplinkHandlerFunc(func(msg *types.UplinkMessage) error {
+		if msg.DevID == slow {
+			started <- struct{}{}
+			<-release
+		}
+		handled <- msg
+		return nil
+	}), HandlerOptions{
+		Workers:    2,
+		Queue:      &SubscriptionOptions{BufferSize: 1},
+		DeadLetter: func(letter DeadLetter) { deadLetters <- letter },
+	})
+	a.So(err, ShouldBeNil)
+
+	// The first message of the slow device is handled, the second is queued and the third is dropped
+	sub.uplink <- &types.UplinkMessage{AppID: "test", DevID: slow, FCnt: 1}
+	<-started
+	sub.uplink <- &types.UplinkMessage{AppID: "test", DevID: slow, FCnt: 2}
+	sub.uplink <- &types.UplinkMessage{AppID: "test", DevID: slow, FCnt: 3}
+	select {
+	case letter := <-deadLetters:
+		a.So(letter.DevID, ShouldEqual, slow)
+		a.So(letter.Err, ShouldEqual, ErrHandlerQueueFull)
+		a.So(letter.Message.(*types.UplinkMessage).FCnt, ShouldEqual, 3)
+	case <-time.After(time.Second):
+		t.Fatal("Message was not dropped within a second")
+	}
+
+	// The messages of the other worker are handled while the slow device is busy
+	sub.uplink <- &types.UplinkMessage{AppID: "test", DevID: fast, FCnt: 1}
+	select {
+	case msg := <-handled:
+		a.So(msg.DevID, ShouldEqual, fast)
+	case <-time.After(time.Second):
+		t.Fatal("Message of the other worker was not handled within a second")
+	}
+
+	close(release)
+	<-started
+	close(sub.uplink)
+	pool.Wait()
+	a.So(handled, ShouldHaveLength, 2)
+}
+
+func TestHandlerPoolSubscriptionInUse(t *testing.T) {
+	a := New(t)
+
+	broker, err := newMockMQTTBroker()
+	a.So(err, ShouldBeNil)
+	defer broker.Close()
+
+	config := NewConfig("test", "", "")
+	config.MQTTAddress = "mqtt://" + broker.Addr().String()
+	client := config.NewClient("test", "")
+	defer client.Close()
+
+	pubsub, err := client.PubSub()
+	a.So(err, ShouldBeNil)
+	defer pubsub.Close()
+
+	device := pubsub.Device("dev")
+	_, err = device.SubscribeUplink()
+	a.So(err, ShouldBeNil)
+	_, err = HandleUplink(device, UplinkHandlerFunc(func(*types.UplinkMessage) error { return nil }))
+	a.So(err, ShouldNotBeNil)
+
+	_, err = HandleEvents(device, EventHandlerFunc(func(*types.DeviceEvent) error { return nil }))
+	a.So(err, ShouldBeNil)
+	_, err = HandleEvents(device, EventHandlerFunc(func(*types.DeviceEvent) error { return nil }))
+	a.So(err, ShouldNotBeNil)
+	_, err = device.SubscribeEvents()
+	a.So(err, ShouldBeNil) // The non-exclusive Subscribe funcs still return the existing channel
+
+	_, err = HandleActivations(device, ActivationHandlerFunc(func(*types.Activation) error { return nil }))
+	a.So(err, ShouldBeNil)
+	_, err = HandleActivations(device, ActivationHandlerFunc(func(*types.Activation) error { return nil }))
+	a.So(err, ShouldNotBeNil)
+}
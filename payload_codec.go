@@ -0,0 +1,314 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"container/list"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TheThingsNetwork/api/handler"
+	"github.com/TheThingsNetwork/ttn/core/types"
+)
+
+// PayloadCodec decodes uplink payloads and encodes downlink payloads in Go. It can be used instead of the payload
+// functions on the Handler, by setting the payload format of the application to "" and registering the codec in a
+// PayloadCodecRegistry.
+type PayloadCodec interface {
+	// Decode the payload of an uplink message into fields
+	Decode(payload []byte, port uint8) (fields map[string]interface{}, err error)
+
+	// Encode the fields of a downlink message into a payload
+	Encode(fields map[string]interface{}, port uint8) (payload []byte, err error)
+}
+
+// DefaultPayloadCodecCacheTTL is the time that the attributes of a device are cached if no TTL is given in the options
+var DefaultPayloadCodecCacheTTL = 5 * time.Minute
+
+// DefaultPayloadCodecCacheSize is the maximum number of devices of which the attributes are cached if no size is given
+// in the options
+var DefaultPayloadCodecCacheSize = 1000
+
+// PayloadCodecCacheOptions contains the options for the attribute cache of a PayloadCodecRegistry
+type PayloadCodecCacheOptions struct {
+	// The time that the attributes of a device are cached (in the default config, this is DefaultPayloadCodecCacheTTL)
+	TTL time.Duration
+
+	// The maximum number of devices of which the attributes are cached (in the default config, this is
+	// DefaultPayloadCodecCacheSize). When the cache is full, the device that was used least recently is removed.
+	Size int
+}
+
+// PayloadCodecRegistry selects the PayloadCodec for uplink and downlink messages. Set the PayloadCodecs field of the
+// ClientConfig to decode the payload of uplink messages into PayloadFields before they are delivered on the uplink
+// channel, and to encode the PayloadFields of downlink messages into PayloadRaw when they are published.
+//
+// A codec can be registered for an application, for an FPort of an application, and for the devices of an application
+// with a given value of an attribute. Attribute codecs take precedence over FPort codecs, which take precedence over
+// application codecs. Downlink messages do not carry attributes, so if attribute codecs are registered for the
+// application, the registry uses the attributes that are stored for the device on the Handler. These are cached for
+// the TTL of the PayloadCodecCacheOptions, updated with the attributes of their uplink messages, and removed from the
+// cache when the device is updated or deleted with a DeviceManager of the client.
+type PayloadCodecRegistry struct {
+	mu           sync.RWMutex
+	applications map[string]PayloadCodec
+	ports        map[string]map[uint8]PayloadCodec
+	attributes   map[string]map[string]map[string]PayloadCodec
+
+	cacheMu   sync.Mutex
+	cacheTTL  time.Duration
+	cacheSize int
+	cache     map[string]*list.Element
+	cacheLRU  *list.List
+}
+
+type attributeCacheEntry struct {
+	key        string
+	attributes map[string]string
+	expires    time.Time
+}
+
+// NewPayloadCodecRegistry returns a new, empty PayloadCodecRegistry. The options of the attribute cache are optional.
+func NewPayloadCodecRegistry(options ...PayloadCodecCacheOptions) *PayloadCodecRegistry {
+	var cacheOptions PayloadCodecCacheOptions
+	if len(options) > 0 {
+		cacheOptions = options[0]
+	}
+	if cacheOptions.TTL <= 0 {
+		cacheOptions.TTL = DefaultPayloadCodecCacheTTL
+	}
+	if cacheOptions.Size <= 0 {
+		cacheOptions.Size = DefaultPayloadCodecCacheSize
+	}
+	return &PayloadCodecRegistry{
+		applications: make(map[string]PayloadCodec),
+		ports:        make(map[string]map[uint8]PayloadCodec),
+		attributes:   make(map[string]map[string]map[string]PayloadCodec),
+		cacheTTL:     cacheOptions.TTL,
+		cacheSize:    cacheOptions.Size,
+		cache:        make(map[string]*list.Element),
+		cacheLRU:     list.New(),
+	}
+}
+
+// RegisterApplication registers the codec for all messages of the application. Pass a nil codec to remove it.
+func (r *PayloadCodecRegistry) RegisterApplication(appID string, codec PayloadCodec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if codec == nil {
+		delete(r.applications, appID)
+		return
+	}
+	r.applications[appID] = codec
+}
+
+// RegisterPort registers the codec for the messages of the application on the given FPort. Pass a nil codec to remove
+// it.
+func (r *PayloadCodecRegistry) RegisterPort(appID string, port uint8, codec PayloadCodec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if codec == nil {
+		delete(r.ports[appID], port)
+		return
+	}
+	if r.ports[appID] == nil {
+		r.ports[appID] = make(map[uint8]PayloadCodec)
+	}
+	r.ports[appID][port] = codec
+}
+
+// RegisterAttribute registers the codec for the messages of devices of the application that have the given value for
+// the attribute. Pass a nil codec to remove it. If a device matches codecs for multiple attributes, the codec of the
+// attribute that comes first in alphabetical order is used.
+//
+// For uplink messages, only the attributes that the Handler is configured to include in uplink messages can be used to
+// select codecs.
+func (r *PayloadCodecRegistry) RegisterAttribute(appID, key, value string, codec PayloadCodec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if codec == nil {
+		delete(r.attributes[appID][key], value)
+		return
+	}
+	if r.attributes[appID] == nil {
+		r.attributes[appID] = make(map[string]map[string]PayloadCodec)
+	}
+	if r.attributes[appID][key] == nil {
+		r.attributes[appID][key] = make(map[string]PayloadCodec)
+	}
+	r.attributes[appID][key][value] = codec
+}
+
+// Codec returns the codec for a message of the device, or nil if there is no codec
+func (r *PayloadCodecRegistry) Codec(appID string, port uint8, attributes map[string]string) PayloadCodec {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if codec, ok := r.attributes[appID][key][attributes[key]]; ok {
+			return codec
+		}
+	}
+	if codec, ok := r.ports[appID][port]; ok {
+		return codec
+	}
+	return r.applications[appID]
+}
+
+// hasAttributeCodecs returns true if attribute codecs are registered for the application
+func (r *PayloadCodecRegistry) hasAttributeCodecs(appID string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, values := range r.attributes[appID] {
+		if len(values) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedAttributes returns the cached attributes of the device, unless they expired
+func (r *PayloadCodecRegistry) cachedAttributes(appID, devID string) (attributes map[string]string, ok bool) {
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+	element, ok := r.cache[appID+"/"+devID]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*attributeCacheEntry)
+	if time.Now().After(entry.expires) {
+		r.cacheLRU.Remove(element)
+		delete(r.cache, entry.key)
+		return nil, false
+	}
+	r.cacheLRU.MoveToFront(element)
+	return entry.attributes, true
+}
+
+// cacheAttributes caches the attributes of the device, removing the device that was used least recently if the cache
+// is full
+func (r *PayloadCodecRegistry) cacheAttributes(appID, devID string, attributes map[string]string) {
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+	key := appID + "/" + devID
+	if element, ok := r.cache[key]; ok {
+		r.cacheLRU.Remove(element)
+		delete(r.cache, key)
+	}
+	for r.cacheLRU.Len() >= r.cacheSize {
+		oldest := r.cacheLRU.Back()
+		r.cacheLRU.Remove(oldest)
+		delete(r.cache, oldest.Value.(*attributeCacheEntry).key)
+	}
+	r.cache[key] = r.cacheLRU.PushFront(&attributeCacheEntry{
+		key:        key,
+		attributes: attributes,
+		expires:    time.Now().Add(r.cacheTTL),
+	})
+}
+
+// updateCachedAttributes updates the cached attributes of the device with the given attributes. This does not extend
+// the time that the attributes are cached, as the other attributes of the device may have changed.
+func (r *PayloadCodecRegistry) updateCachedAttributes(appID, devID string, attributes map[string]string) {
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+	element, ok := r.cache[appID+"/"+devID]
+	if !ok {
+		return
+	}
+	entry := element.Value.(*attributeCacheEntry)
+	merged := make(map[string]string, len(entry.attributes)+len(attributes))
+	for k, v := range entry.attributes {
+		merged[k] = v
+	}
+	for k, v := range attributes {
+		merged[k] = v
+	}
+	entry.attributes = merged
+}
+
+// invalidateAttributes removes the cached attributes of the device
+func (r *PayloadCodecRegistry) invalidateAttributes(appID, devID string) {
+	if r == nil {
+		return
+	}
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+	key := appID + "/" + devID
+	if element, ok := r.cache[key]; ok {
+		r.cacheLRU.Remove(element)
+		delete(r.cache, key)
+	}
+}
+
+// decodeUplink decodes the payload of the uplink message if there is a codec for it
+func (r *PayloadCodecRegistry) decodeUplink(msg *types.UplinkMessage) error {
+	if r == nil {
+		return nil
+	}
+	// Uplink messages may only contain some of the attributes of the device, so they only update devices that are
+	// already cached
+	if len(msg.Attributes) > 0 {
+		r.updateCachedAttributes(msg.AppID, msg.DevID, msg.Attributes)
+	}
+	codec := r.Codec(msg.AppID, msg.FPort, msg.Attributes)
+	if codec == nil || msg.PayloadRaw == nil {
+		return nil
+	}
+	fields, err := codec.Decode(msg.PayloadRaw, msg.FPort)
+	if err != nil {
+		return err
+	}
+	msg.PayloadFields = fields
+	return nil
+}
+
+// encodeDownlink encodes the fields of the downlink message if there is a codec for it and the message has no payload.
+// The getAttributes func returns the attributes that are stored for the device on the Handler.
+func (r *PayloadCodecRegistry) encodeDownlink(msg *types.DownlinkMessage, getAttributes func(devID string) (map[string]string, error)) error {
+	if r == nil || msg.PayloadRaw != nil || msg.PayloadFields == nil {
+		return nil
+	}
+	var attributes map[string]string
+	if getAttributes != nil && r.hasAttributeCodecs(msg.AppID) {
+		var ok bool
+		if attributes, ok = r.cachedAttributes(msg.AppID, msg.DevID); !ok {
+			var err error
+			if attributes, err = getAttributes(msg.DevID); err != nil {
+				return err
+			}
+			r.cacheAttributes(msg.AppID, msg.DevID, attributes)
+		}
+	}
+	codec := r.Codec(msg.AppID, msg.FPort, attributes)
+	if codec == nil {
+		return nil
+	}
+	payload, err := codec.Encode(msg.PayloadFields, msg.FPort)
+	if err != nil {
+		return err
+	}
+	msg.PayloadRaw, msg.PayloadFields = payload, nil
+	return nil
+}
+
+// deviceAttributes returns the attributes that are stored for the device on the Handler
+func (c *client) deviceAttributes(ctx context.Context, devID string) (map[string]string, error) {
+	ctx, cancel := requestContext(ctx, c.getContext, c.RequestTimeout)
+	defer cancel()
+	dev, err := (&handlerClient{c}).GetDevice(ctx, &handler.DeviceIdentifier{AppID: c.appID, DevID: devID})
+	if err != nil {
+		return nil, err
+	}
+	return dev.Attributes, nil
+}
@@ -0,0 +1,226 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	ttnlog "github.com/TheThingsNetwork/go-utils/log"
+	testlog "github.com/TheThingsNetwork/go-utils/log/test"
+	"github.com/TheThingsNetwork/ttn/core/types"
+	. "github.com/smartystreets/assertions"
+)
+
+type testPayloadCodec string
+
+func (c testPayloadCodec) Decode(payload []byte, port uint8) (map[string]interface{}, error) {
+	if len(payload) == 0 {
+		return nil, errors.New("empty payload")
+	}
+	return map[string]interface{}{"codec": string(c), "value": payload[0]}, nil
+}
+
+func (c testPayloadCodec) Encode(fields map[string]interface{}, port uint8) ([]byte, error) {
+	value, ok := fields["value"].(int)
+	if !ok {
+		return nil, errors.New("no value")
+	}
+	return []byte{byte(value), c[0]}, nil
+}
+
+func TestPayloadCodecRegistry(t *testing.T) {
+	a := New(t)
+
+	var nilRegistry *PayloadCodecRegistry
+	a.So(nilRegistry.Codec("test", 1, nil), ShouldBeNil)
+
+	r := NewPayloadCodecRegistry()
+	a.So(r.Codec("test", 1, nil), ShouldBeNil)
+
+	r.RegisterApplication("test", testPayloadCodec("application"))
+	r.RegisterPort("test", 2, testPayloadCodec("port"))
+	r.RegisterAttribute("test", "model", "a", testPayloadCodec("model"))
+	r.RegisterAttribute("test", "type", "b", testPayloadCodec("type"))
+
+	a.So(r.Codec("test", 1, nil), ShouldEqual, testPayloadCodec("application"))
+	a.So(r.Codec("other", 1, nil), ShouldBeNil)
+	a.So(r.Codec("test", 2, nil), ShouldEqual, testPayloadCodec("port"))
+	a.So(r.Codec("other", 2, nil), ShouldBeNil)
+	a.So(r.Codec("test", 2, map[string]string{"model": "a"}), ShouldEqual, testPayloadCodec("model"))
+	a.So(r.Codec("test", 2, map[string]string{"model": "b"}), ShouldEqual, testPayloadCodec("port"))
+	a.So(r.Codec("test", 1, map[string]string{"type": "b", "model": "a"}), ShouldEqual, testPayloadCodec("model"))
+	a.So(r.Codec("other", 1, map[string]string{"type": "b", "model": "a"}), ShouldBeNil)
+
+	r.RegisterAttribute("test", "model", "a", nil)
+	a.So(r.Codec("test", 2, map[string]string{"model": "a"}), ShouldEqual, testPayloadCodec("port"))
+	r.RegisterPort("test", 2, nil)
+	a.So(r.Codec("test", 2, nil), ShouldEqual, testPayloadCodec("application"))
+	r.RegisterApplication("test", nil)
+	a.So(r.Codec("test", 2, nil), ShouldBeNil)
+
+	r.RegisterApplication("test", testPayloadCodec("application"))
+
+	{
+		msg := &types.UplinkMessage{AppID: "test", DevID: "dev", FPort: 1, PayloadRaw: []byte{0x01}}
+		a.So(r.decodeUplink(msg), ShouldBeNil)
+		a.So(msg.PayloadFields, ShouldResemble, map[string]interface{}{"codec": "application", "value": byte(0x01)})
+
+		msg = &types.UplinkMessage{AppID: "test", DevID: "dev", FPort: 1, PayloadRaw: []byte{}}
+		a.So(r.decodeUplink(msg), ShouldNotBeNil)
+		a.So(msg.PayloadFields, ShouldBeNil)
+	}
+
+	{
+		msg := &types.DownlinkMessage{AppID: "test", DevID: "dev", FPort: 1, PayloadFields: map[string]interface{}{"value": 2}}
+		a.So(r.encodeDownlink(msg, nil), ShouldBeNil)
+		a.So(msg.PayloadRaw, ShouldResemble, []byte{0x02, 'a'})
+		a.So(msg.PayloadFields, ShouldBeNil)
+
+		msg = &types.DownlinkMessage{AppID: "test", DevID: "dev", FPort: 1, PayloadRaw: []byte{0x01}, PayloadFields: map[string]interface{}{"value": 2}}
+		a.So(r.encodeDownlink(msg, nil), ShouldBeNil)
+		a.So(msg.PayloadRaw, ShouldResemble, []byte{0x01})
+
+		msg = &types.DownlinkMessage{AppID: "test", DevID: "dev", FPort: 1, PayloadFields: map[string]interface{}{}}
+		a.So(r.encodeDownlink(msg, nil), ShouldNotBeNil)
+	}
+
+	{
+		// The attributes that are stored for the device are used for downlink messages, and updated by uplink messages
+		r.RegisterAttribute("test", "type", "b", testPayloadCodec("type"))
+		stored := map[string]map[string]string{"typed": {"type": "b"}}
+		var lookups int
+		getAttributes := func(devID string) (map[string]string, error) {
+			lookups++
+			if attributes, ok := stored[devID]; ok {
+				return attributes, nil
+			}
+			return nil, errors.New("not found")
+		}
+
+		msg := &types.DownlinkMessage{AppID: "test", DevID: "typed", FPort: 1, PayloadFields: map[string]interface{}{"value": 3}}
+		a.So(r.encodeDownlink(msg, getAttributes), ShouldBeNil)
+		a.So(msg.PayloadRaw, ShouldResemble, []byte{0x03, 't'})
+
+		a.So(r.decodeUplink(&types.UplinkMessage{AppID: "test", DevID: "typed", Attributes: map[string]string{"type": "c"}}), ShouldBeNil)
+		msg = &types.DownlinkMessage{AppID: "test", DevID: "typed", FPort: 1, PayloadFields: map[string]interface{}{"value": 3}}
+		a.So(r.encodeDownlink(msg, getAttributes), ShouldBeNil)
+		a.So(msg.PayloadRaw, ShouldResemble, []byte{0x03, 'a'})
+		a.So(lookups, ShouldEqual, 1)
+
+		msg = &types.DownlinkMessage{AppID: "test", DevID: "unknown", FPort: 1, PayloadFields: map[string]interface{}{"value": 3}}
+		a.So(r.encodeDownlink(msg, getAttributes), ShouldNotBeNil)
+
+		// Downlink messages to applications without attribute codecs do not look up the attributes
+		r.RegisterApplication("other", testPayloadCodec("other"))
+		msg = &types.DownlinkMessage{AppID: "other", DevID: "unknown", FPort: 1, PayloadFields: map[string]interface{}{"value": 3}}
+		a.So(r.encodeDownlink(msg, getAttributes), ShouldBeNil)
+		a.So(lookups, ShouldEqual, 2)
+	}
+
+	{
+		// The cache of attributes is bounded
+		r := NewPayloadCodecRegistry(PayloadCodecCacheOptions{Size: 2})
+		for _, devID := range []string{"a", "b", "c"} {
+			r.cacheAttributes("bounded", devID, map[string]string{"type": devID})
+		}
+		_, ok := r.cachedAttributes("bounded", "a")
+		a.So(ok, ShouldBeFalse)
+		attributes, ok := r.cachedAttributes("bounded", "c")
+		a.So(ok, ShouldBeTrue)
+		a.So(attributes, ShouldResemble, map[string]string{"type": "c"})
+
+		// The device that was used least recently is removed
+		r.cachedAttributes("bounded", "b")
+		r.cacheAttributes("bounded", "d", map[string]string{"type": "d"})
+		_, ok = r.cachedAttributes("bounded", "b")
+		a.So(ok, ShouldBeTrue)
+		_, ok = r.cachedAttributes("bounded", "c")
+		a.So(ok, ShouldBeFalse)
+	}
+
+	{
+		// Cached attributes expire, also when they are updated by uplink messages
+		r := NewPayloadCodecRegistry(PayloadCodecCacheOptions{TTL: 20 * time.Millisecond})
+		r.cacheAttributes("expiring", "dev", map[string]string{"type": "a"})
+		r.decodeUplink(&types.UplinkMessage{AppID: "expiring", DevID: "dev", Attributes: map[string]string{"type": "b"}})
+		attributes, ok := r.cachedAttributes("expiring", "dev")
+		a.So(ok, ShouldBeTrue)
+		a.So(attributes, ShouldResemble, map[string]string{"type": "b"})
+		time.Sleep(30 * time.Millisecond)
+		_, ok = r.cachedAttributes("expiring", "dev")
+		a.So(ok, ShouldBeFalse)
+
+		// Uplink messages do not add devices to the cache
+		r.decodeUplink(&types.UplinkMessage{AppID: "expiring", DevID: "dev", Attributes: map[string]string{"type": "b"}})
+		_, ok = r.cachedAttributes("expiring", "dev")
+		a.So(ok, ShouldBeFalse)
+	}
+
+	{
+		// Cached attributes are invalidated
+		r := NewPayloadCodecRegistry()
+		r.cacheAttributes("invalidated", "dev", map[string]string{"type": "a"})
+		r.invalidateAttributes("invalidated", "dev")
+		_, ok := r.cachedAttributes("invalidated", "dev")
+		a.So(ok, ShouldBeFalse)
+
+		var nilRegistry *PayloadCodecRegistry
+		nilRegistry.invalidateAttributes("invalidated", "dev")
+	}
+}
+
+func TestPayloadCodecPubSub(t *testing.T) {
+	a := New(t)
+
+	log := testlog.NewLogger()
+	ttnlog.Set(log)
+	defer log.Print(t)
+
+	broker, err := newMockMQTTBroker()
+	a.So(err, ShouldBeNil)
+	defer broker.Close()
+
+	codecs := NewPayloadCodecRegistry()
+	codecs.RegisterApplication("test", testPayloadCodec("application"))
+
+	config := NewConfig("test", "", "")
+	config.Logger = log
+	config.MQTTAddress = "mqtt://" + broker.Addr().String()
+	config.PayloadCodecs = codecs
+	client := config.NewClient("test", "")
+	defer client.Close()
+
+	pubsub, err := client.PubSub()
+	a.So(err, ShouldBeNil)
+	defer pubsub.Close()
+
+	device := pubsub.Device("dev")
+	uplink, err := device.SubscribeUplink()
+	a.So(err, ShouldBeNil)
+
+	broker.publish("test/devices/dev/up", []byte(`{"port":1,"payload_raw":"AQ=="}`))
+	select {
+	case msg := <-uplink:
+		a.So(msg.PayloadRaw, ShouldResemble, []byte{0x01})
+		a.So(msg.PayloadFields, ShouldResemble, map[string]interface{}{"codec": "application", "value": byte(0x01)})
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive uplink within a second")
+	}
+
+	err = device.Publish(&types.DownlinkMessage{FPort: 1, PayloadFields: map[string]interface{}{"value": 2}})
+	a.So(err, ShouldBeNil)
+	err = pubsub.Publish("dev", &types.DownlinkMessage{FPort: 1, PayloadFields: map[string]interface{}{}})
+	a.So(err, ShouldNotBeNil)
+
+	time.Sleep(100 * time.Millisecond)
+	messages := broker.messages("test/devices/dev/down")
+	a.So(messages, ShouldHaveLength, 1)
+	var downlink types.DownlinkMessage
+	a.So(json.Unmarshal(messages[0], &downlink), ShouldBeNil)
+	a.So(downlink.PayloadRaw, ShouldResemble, []byte{0x02, 'a'})
+	a.So(downlink.PayloadFields, ShouldBeNil)
+}
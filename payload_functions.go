@@ -0,0 +1,206 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/TheThingsNetwork/api/handler"
+)
+
+// PayloadFunctions contains custom JS payload functions. See the documentation of
+// ApplicationManager.SetCustomPayloadFunctions for examples.
+type PayloadFunctions struct {
+	Decoder   string `json:"decoder,omitempty"`
+	Converter string `json:"converter,omitempty"`
+	Validator string `json:"validator,omitempty"`
+	Encoder   string `json:"encoder,omitempty"`
+}
+
+// UplinkTestVector is a test case for the uplink payload functions
+type UplinkTestVector struct {
+	Name    string `json:"name"`
+	Payload []byte `json:"payload"`
+	Port    uint8  `json:"port"`
+
+	// The expected result of the Decoder and Converter
+	Fields map[string]interface{} `json:"fields"`
+
+	// Set this to true if the Validator is expected to reject the message
+	Invalid bool `json:"invalid,omitempty"`
+}
+
+// DownlinkTestVector is a test case for the downlink payload function
+type DownlinkTestVector struct {
+	Name   string                 `json:"name"`
+	Fields map[string]interface{} `json:"fields"`
+	Port   uint8                  `json:"port"`
+
+	// The expected result of the Encoder
+	Payload []byte `json:"payload"`
+}
+
+// PayloadTestResult is the result of a test vector
+type PayloadTestResult struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Failure string `json:"failure,omitempty"`
+
+	// The result of the uplink payload functions (for uplink test vectors)
+	Uplink *DryUplinkResult `json:"uplink,omitempty"`
+
+	// The result of the downlink payload function (for downlink test vectors)
+	Downlink *DryDownlinkResult `json:"downlink,omitempty"`
+}
+
+// PayloadDeployReport is the result of deploying custom payload functions
+type PayloadDeployReport struct {
+	Uplink   []PayloadTestResult `json:"uplink,omitempty"`
+	Downlink []PayloadTestResult `json:"downlink,omitempty"`
+
+	// Indicates whether the payload functions were saved
+	Deployed bool `json:"deployed"`
+
+	// The settings of the application before the payload functions were saved
+	Previous *Application `json:"previous,omitempty"`
+}
+
+// Passed returns true if all test vectors passed
+func (r *PayloadDeployReport) Passed() bool {
+	return len(r.Failed()) == 0
+}
+
+// Failed returns the results of the test vectors that failed
+func (r *PayloadDeployReport) Failed() (failed []PayloadTestResult) {
+	for _, results := range [][]PayloadTestResult{r.Uplink, r.Downlink} {
+		for _, result := range results {
+			if !result.Passed {
+				failed = append(failed, result)
+			}
+		}
+	}
+	return
+}
+
+// payloadHistory keeps the settings of the application before the last deployment of payload functions. It is shared
+// by the application managers of a client.
+type payloadHistory struct {
+	sync.Mutex
+	previous *handler.Application
+}
+
+// jsonEqual returns true if the JSON representations of expected and actual are equal
+func jsonEqual(expected, actual interface{}) bool {
+	expectedJSON, err := json.Marshal(expected)
+	if err != nil {
+		return false
+	}
+	actualJSON, err := json.Marshal(actual)
+	if err != nil {
+		return false
+	}
+	var expectedValue, actualValue interface{}
+	json.Unmarshal(expectedJSON, &expectedValue)
+	json.Unmarshal(actualJSON, &actualValue)
+	return reflect.DeepEqual(expectedValue, actualValue)
+}
+
+func (a *applicationManager) testUplinkVector(functions PayloadFunctions, vector UplinkTestVector) (result PayloadTestResult, err error) {
+	result.Name = vector.Name
+	result.Uplink, err = a.TestCustomUplinkPayloadFunctions(functions.Decoder, functions.Converter, functions.Validator, vector.Payload, vector.Port)
+	if err != nil {
+		return result, err
+	}
+	switch {
+	case result.Uplink.Valid == vector.Invalid && vector.Invalid:
+		result.Failure = "expected the validator to reject the message"
+	case result.Uplink.Valid == vector.Invalid:
+		result.Failure = "expected the validator to accept the message"
+	case !vector.Invalid && !jsonEqual(vector.Fields, result.Uplink.Fields):
+		result.Failure = fmt.Sprintf("expected fields %v, got %v", vector.Fields, result.Uplink.Fields)
+	default:
+		result.Passed = true
+	}
+	return result, nil
+}
+
+func (a *applicationManager) testDownlinkVector(functions PayloadFunctions, vector DownlinkTestVector) (result PayloadTestResult, err error) {
+	result.Name = vector.Name
+	result.Downlink, err = a.TestCustomDownlinkPayloadFunctions(functions.Encoder, vector.Fields, vector.Port)
+	if err != nil {
+		return result, err
+	}
+	if !bytes.Equal(vector.Payload, result.Downlink.Payload) {
+		result.Failure = fmt.Sprintf("expected payload %X, got %X", vector.Payload, result.Downlink.Payload)
+	} else {
+		result.Passed = true
+	}
+	return result, nil
+}
+
+func (a *applicationManager) DeployCustomPayloadFunctions(functions PayloadFunctions, uplink []UplinkTestVector, downlink []DownlinkTestVector) (*PayloadDeployReport, error) {
+	report := new(PayloadDeployReport)
+	if len(uplink) == 0 && len(downlink) == 0 {
+		return report, errors.New("ttn-sdk: no test vectors given, use SetCustomPayloadFunctions to save payload functions without testing them")
+	}
+	for _, vector := range uplink {
+		result, err := a.testUplinkVector(functions, vector)
+		if err != nil {
+			return report, err
+		}
+		report.Uplink = append(report.Uplink, result)
+	}
+	for _, vector := range downlink {
+		result, err := a.testDownlinkVector(functions, vector)
+		if err != nil {
+			return report, err
+		}
+		report.Downlink = append(report.Downlink, result)
+	}
+	if failed := report.Failed(); len(failed) > 0 {
+		return report, fmt.Errorf("ttn-sdk: %d payload function tests failed, not deploying", len(failed))
+	}
+	app, err := a.getApplication()
+	if err != nil {
+		return report, err
+	}
+	previous := *app
+	app.PayloadFormat = "custom"
+	app.Decoder, app.Converter, app.Validator, app.Encoder = functions.Decoder, functions.Converter, functions.Validator, functions.Encoder
+	if err := a.setApplication(app); err != nil {
+		return report, err
+	}
+	a.payloadHistory.Lock()
+	a.payloadHistory.previous = &previous
+	a.payloadHistory.Unlock()
+	report.Deployed = true
+	report.Previous = &Application{applicationManager: a}
+	report.Previous.fromProto(&previous)
+	return report, nil
+}
+
+func (a *applicationManager) RollbackCustomPayloadFunctions() error {
+	a.payloadHistory.Lock()
+	defer a.payloadHistory.Unlock()
+	previous := a.payloadHistory.previous
+	if previous == nil {
+		return errors.New("ttn-sdk: no payload functions were deployed")
+	}
+	app, err := a.getApplication()
+	if err != nil {
+		return err
+	}
+	app.PayloadFormat = previous.PayloadFormat
+	app.Decoder, app.Converter, app.Validator, app.Encoder = previous.Decoder, previous.Converter, previous.Validator, previous.Encoder
+	if err := a.setApplication(app); err != nil {
+		return err
+	}
+	a.payloadHistory.previous = nil
+	return nil
+}
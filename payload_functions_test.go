@@ -0,0 +1,143 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/api/handler"
+	ttnlog "github.com/TheThingsNetwork/go-utils/log"
+	testlog "github.com/TheThingsNetwork/go-utils/log/test"
+	. "github.com/smartystreets/assertions"
+)
+
+func TestDeployCustomPayloadFunctions(t *testing.T) {
+	a := New(t)
+
+	log := testlog.NewLogger()
+	ttnlog.Set(log)
+	defer log.Print(t)
+
+	mock := new(mockApplicationManagerClient)
+
+	manager := &applicationManager{
+		logger:         log,
+		client:         mock,
+		getContext:     func(ctx context.Context) context.Context { return ctx },
+		requestTimeout: time.Second,
+		appID:          "test",
+		payloadHistory: new(payloadHistory),
+	}
+
+	functions := PayloadFunctions{Decoder: "new decoder", Encoder: "new encoder"}
+	uplink := []UplinkTestVector{
+		{Name: "temperature", Payload: []byte{0x01}, Port: 1, Fields: map[string]interface{}{"temperature": 1}},
+	}
+	downlink := []DownlinkTestVector{
+		{Name: "led", Fields: map[string]interface{}{"led": true}, Port: 2, Payload: []byte{0x01}},
+	}
+	previous := &handler.Application{AppID: "test", PayloadFormat: "cayenne", RegisterOnJoinAccessKey: "key"}
+
+	{
+		err := manager.RollbackCustomPayloadFunctions()
+		a.So(err, ShouldNotBeNil)
+	}
+
+	{
+		mock.reset()
+		mock.application = previous
+		report, err := manager.DeployCustomPayloadFunctions(functions, nil, nil)
+		a.So(err, ShouldNotBeNil)
+		a.So(report.Deployed, ShouldBeFalse)
+		a.So(mock.application, ShouldEqual, previous)
+	}
+
+	{
+		mock.reset()
+		mock.err = errors.New("some error")
+		report, err := manager.DeployCustomPayloadFunctions(functions, uplink, downlink)
+		a.So(err, ShouldNotBeNil)
+		a.So(report.Deployed, ShouldBeFalse)
+	}
+
+	{
+		mock.reset()
+		mock.application = previous
+		mock.dryUplinkResult = &handler.DryUplinkResult{Fields: `{"temperature":2}`, Valid: true}
+		mock.dryDownlinkResult = &handler.DryDownlinkResult{Payload: []byte{0x01}}
+		report, err := manager.DeployCustomPayloadFunctions(functions, uplink, downlink)
+		a.So(err, ShouldNotBeNil)
+		a.So(report.Deployed, ShouldBeFalse)
+		a.So(report.Passed(), ShouldBeFalse)
+		a.So(report.Uplink, ShouldHaveLength, 1)
+		a.So(report.Uplink[0].Name, ShouldEqual, "temperature")
+		a.So(report.Uplink[0].Passed, ShouldBeFalse)
+		a.So(report.Uplink[0].Failure, ShouldNotBeEmpty)
+		a.So(report.Uplink[0].Uplink.Fields, ShouldResemble, map[string]interface{}{"temperature": 2.0})
+		a.So(report.Downlink, ShouldHaveLength, 1)
+		a.So(report.Downlink[0].Passed, ShouldBeTrue)
+		a.So(report.Failed(), ShouldHaveLength, 1)
+		a.So(mock.application, ShouldEqual, previous)
+	}
+
+	{
+		mock.reset()
+		mock.application = previous
+		mock.dryUplinkResult = &handler.DryUplinkResult{Fields: `{"temperature":1}`, Valid: true}
+		mock.dryDownlinkResult = &handler.DryDownlinkResult{Payload: []byte{0x02}}
+		report, err := manager.DeployCustomPayloadFunctions(functions, uplink, downlink)
+		a.So(err, ShouldNotBeNil)
+		a.So(report.Uplink[0].Passed, ShouldBeTrue)
+		a.So(report.Downlink[0].Passed, ShouldBeFalse)
+		a.So(report.Downlink[0].Failure, ShouldContainSubstring, "02")
+		a.So(mock.application, ShouldEqual, previous)
+	}
+
+	{
+		mock.reset()
+		mock.application = previous
+		mock.dryUplinkResult = &handler.DryUplinkResult{Valid: true}
+		report, err := manager.DeployCustomPayloadFunctions(functions, []UplinkTestVector{{Name: "rejected", Payload: []byte{0xFF}, Invalid: true}}, nil)
+		a.So(err, ShouldNotBeNil)
+		a.So(report.Uplink[0].Passed, ShouldBeFalse)
+
+		mock.dryUplinkResult = &handler.DryUplinkResult{Valid: false}
+		report, err = manager.DeployCustomPayloadFunctions(functions, []UplinkTestVector{{Name: "rejected", Payload: []byte{0xFF}, Invalid: true}}, nil)
+		a.So(err, ShouldBeNil)
+		a.So(report.Deployed, ShouldBeTrue)
+	}
+
+	{
+		mock.reset()
+		mock.application = &handler.Application{AppID: "test", PayloadFormat: "cayenne", RegisterOnJoinAccessKey: "key"}
+		mock.dryUplinkResult = &handler.DryUplinkResult{Fields: `{"temperature":1}`, Valid: true}
+		mock.dryDownlinkResult = &handler.DryDownlinkResult{Payload: []byte{0x01}}
+		report, err := manager.DeployCustomPayloadFunctions(functions, uplink, downlink)
+		a.So(err, ShouldBeNil)
+		a.So(report.Passed(), ShouldBeTrue)
+		a.So(report.Deployed, ShouldBeTrue)
+		a.So(report.Previous.PayloadFormat, ShouldEqual, "cayenne")
+		a.So(mock.application.PayloadFormat, ShouldEqual, "custom")
+		a.So(mock.application.Decoder, ShouldEqual, "new decoder")
+		a.So(mock.application.Encoder, ShouldEqual, "new encoder")
+		a.So(mock.application.RegisterOnJoinAccessKey, ShouldEqual, "key")
+
+		mock.application.RegisterOnJoinAccessKey = "other key"
+
+		// The history is shared by the application managers of the client
+		other := *manager
+		err = other.WithContext(context.Background()).RollbackCustomPayloadFunctions()
+		a.So(err, ShouldBeNil)
+		a.So(mock.application.PayloadFormat, ShouldEqual, "cayenne")
+		a.So(mock.application.Decoder, ShouldBeEmpty)
+		a.So(mock.application.Encoder, ShouldBeEmpty)
+		a.So(mock.application.RegisterOnJoinAccessKey, ShouldEqual, "other key")
+
+		err = manager.RollbackCustomPayloadFunctions()
+		a.So(err, ShouldNotBeNil)
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/TheThingsNetwork/api/handler"
+	"github.com/robertkrimen/otto"
+)
+
+// PayloadFunctionTimeout is the maximum time that a payload function is allowed to run. This is the same limit that
+// the Handler uses.
+var PayloadFunctionTimeout = 100 * time.Millisecond
+
+// payloadFunctionStackDepth is the maximum depth of the call stack of a payload function. This is the same limit that
+// the Handler uses.
+const payloadFunctionStackDepth = 32
+
+var errPayloadFunctionTimeout = errors.New("ttn-sdk: payload function timed out")
+
+// LocalPayloadFunctions runs custom JS payload functions locally, with the same semantics and limits as the Handler.
+// This can be used to test payload functions without connecting to the network.
+type LocalPayloadFunctions struct {
+	PayloadFunctions
+}
+
+// NewLocalPayloadFunctions returns a runner for the given custom JS payload functions. See the documentation of
+// ApplicationManager.SetCustomPayloadFunctions for examples.
+func NewLocalPayloadFunctions(jsDecoder, jsConverter, jsValidator, jsEncoder string) *LocalPayloadFunctions {
+	return &LocalPayloadFunctions{PayloadFunctions{
+		Decoder:   jsDecoder,
+		Converter: jsConverter,
+		Validator: jsValidator,
+		Encoder:   jsEncoder,
+	}}
+}
+
+// payloadLogger collects the entries that are logged with console.log() in payload functions
+type payloadLogger struct {
+	function string
+	entries  []*handler.LogEntry
+}
+
+func (l *payloadLogger) log(call otto.FunctionCall) otto.Value {
+	entry := &handler.LogEntry{Function: l.function}
+	for _, argument := range call.ArgumentList {
+		entry.Fields = append(entry.Fields, stringify(argument))
+	}
+	l.entries = append(l.entries, entry)
+	return otto.UndefinedValue()
+}
+
+// stringify returns the JSON representation of a JS value
+func stringify(value otto.Value) string {
+	vm := otto.New()
+	vm.Set("value", value)
+	res, _ := vm.Run(`JSON.stringify(value)`)
+	return res.String()
+}
+
+// runPayloadFunction runs the code of a payload function in a new JS VM with the given environment
+func runPayloadFunction(name, code string, env map[string]interface{}, logger *payloadLogger) (value interface{}, err error) {
+	vm := otto.New()
+	vm.SetStackDepthLimit(payloadFunctionStackDepth)
+	for key, val := range env {
+		vm.Set(key, val)
+	}
+	logger.function = name
+	vm.Set("__log", logger.log)
+	vm.Run("console.log = __log")
+
+	start := time.Now()
+	defer func() {
+		if caught := recover(); caught != nil {
+			value = nil
+			if caught == errPayloadFunctionTimeout {
+				err = fmt.Errorf("ttn-sdk: interrupted %s after %v", name, time.Since(start))
+			} else {
+				err = fmt.Errorf("ttn-sdk: fatal error in %s: %v", name, caught)
+			}
+		}
+	}()
+
+	vm.Interrupt = make(chan func(), 1)
+	timer := time.AfterFunc(PayloadFunctionTimeout, func() {
+		vm.Interrupt <- func() { panic(errPayloadFunctionTimeout) }
+	})
+	defer timer.Stop()
+
+	res, err := vm.Run(code)
+	if err != nil {
+		return nil, fmt.Errorf("ttn-sdk: %s threw error: %s", name, err)
+	}
+
+	switch {
+	case res.IsBoolean():
+		return res.ToBoolean()
+	case res.IsNull(), res.IsUndefined():
+		return nil, nil
+	case res.IsNumber():
+		f, _ := res.ToFloat()
+		if float64(int64(f)) == f {
+			return res.ToInteger()
+		}
+		return f, nil
+	case res.IsObject():
+		return res.Export()
+	case res.IsString():
+		return res.ToString()
+	}
+	return nil, fmt.Errorf("ttn-sdk: %s returned an invalid value", name)
+}
+
+// Uplink runs the Decoder, Converter and Validator on the payload. Empty functions are skipped. The result has the
+// same shape as the result of ApplicationManager.TestCustomUplinkPayloadFunctions.
+func (f *LocalPayloadFunctions) Uplink(payload []byte, port uint8) (*DryUplinkResult, error) {
+	logger := new(payloadLogger)
+	var fields map[string]interface{}
+	if f.Decoder != "" {
+		value, err := runPayloadFunction("Decoder", fmt.Sprintf("%s;\nDecoder(payload.slice(0), port);", f.Decoder), map[string]interface{}{
+			"payload": payload,
+			"port":    port,
+		}, logger)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if fields, ok = value.(map[string]interface{}); !ok {
+			return nil, errors.New("ttn-sdk: Decoder does not return an object")
+		}
+	}
+	if f.Converter != "" {
+		value, err := runPayloadFunction("Converter", fmt.Sprintf("%s;\nConverter(fields, port);", f.Converter), map[string]interface{}{
+			"fields": fields,
+			"port":   port,
+		}, logger)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if fields, ok = value.(map[string]interface{}); !ok {
+			return nil, errors.New("ttn-sdk: Converter does not return an object")
+		}
+	}
+	valid := true
+	if f.Validator != "" {
+		value, err := runPayloadFunction("Validator", fmt.Sprintf("%s;\nValidator(fields, port);", f.Validator), map[string]interface{}{
+			"fields": fields,
+			"port":   port,
+		}, logger)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if valid, ok = value.(bool); !ok {
+			return nil, errors.New("ttn-sdk: Validator does not return a boolean")
+		}
+	}
+
+	// The Handler sends the fields as JSON, so we do the same to get the same types
+	fieldsJSON, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	result := &DryUplinkResult{
+		Payload: payload,
+		Valid:   valid,
+		Logs:    payloadLogsFromProto(logger.entries),
+	}
+	if err := json.Unmarshal(fieldsJSON, &result.Fields); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Downlink runs the Encoder on the fields. The result has the same shape as the result of
+// ApplicationManager.TestCustomDownlinkPayloadFunctions.
+func (f *LocalPayloadFunctions) Downlink(fields map[string]interface{}, port uint8) (*DryDownlinkResult, error) {
+	if f.Encoder == "" {
+		return nil, errors.New("ttn-sdk: fields supplied, but no Encoder function set")
+	}
+
+	// The Handler receives the fields as JSON, so we do the same to get the same types
+	fieldsJSON, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	var env map[string]interface{}
+	if err := json.Unmarshal(fieldsJSON, &env); err != nil {
+		return nil, err
+	}
+
+	logger := new(payloadLogger)
+	value, err := runPayloadFunction("Encoder", fmt.Sprintf("%s;\nEncoder(payload, port);", f.Encoder), map[string]interface{}{
+		"payload": env,
+		"port":    port,
+	}, logger)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := encodedPayload(value)
+	if err != nil {
+		return nil, err
+	}
+	return &DryDownlinkResult{
+		Payload: payload,
+		Logs:    payloadLogsFromProto(logger.entries),
+	}, nil
+}
+
+// encodedPayload converts the value that was returned by the Encoder to bytes
+func encodedPayload(value interface{}) ([]byte, error) {
+	if value == nil || reflect.TypeOf(value).Kind() != reflect.Slice {
+		return nil, errors.New("ttn-sdk: Encoder does not return an Array")
+	}
+	s := reflect.ValueOf(value)
+	payload := make([]byte, s.Len())
+	for i := range payload {
+		var n int64
+		switch el := reflect.ValueOf(s.Index(i).Interface()); el.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n = el.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if el.Uint() > 255 {
+				n = 256
+			} else {
+				n = int64(el.Uint())
+			}
+		case reflect.Float32, reflect.Float64:
+			n = int64(el.Float())
+			if float64(n) != el.Float() {
+				return nil, errors.New("ttn-sdk: Encoder should return an Array of integer numbers")
+			}
+		default:
+			return nil, errors.New("ttn-sdk: Encoder should return an Array of integer numbers")
+		}
+		if n < 0 || n > 255 {
+			return nil, errors.New("ttn-sdk: numbers in the Array returned by the Encoder should be between 0 and 255")
+		}
+		payload[i] = byte(n)
+	}
+	return payload, nil
+}
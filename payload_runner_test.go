@@ -0,0 +1,96 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/assertions"
+)
+
+func TestLocalPayloadFunctions(t *testing.T) {
+	a := New(t)
+
+	functions := NewLocalPayloadFunctions(`
+		function Decoder(bytes, port) {
+			console.log("decoding", bytes.length, "bytes on port", port);
+			return { temperature: (bytes[0] << 8 | bytes[1]) / 100, port: port };
+		}
+	`, `
+		function Converter(decoded, port) {
+			decoded.fahrenheit = decoded.temperature * 9 / 5 + 32;
+			return decoded;
+		}
+	`, `
+		function Validator(converted, port) {
+			return converted.temperature < 50;
+		}
+	`, `
+		function Encoder(object, port) {
+			console.log(object);
+			return [object.led ? 1 : 0, port];
+		}
+	`)
+
+	{
+		res, err := functions.Uplink([]byte{0x09, 0xC4}, 1)
+		a.So(err, ShouldBeNil)
+		a.So(res.Payload, ShouldResemble, []byte{0x09, 0xC4})
+		a.So(res.Fields, ShouldResemble, map[string]interface{}{"temperature": 25.0, "fahrenheit": 77.0, "port": 1.0})
+		a.So(res.Valid, ShouldBeTrue)
+		a.So(res.Logs, ShouldResemble, []PayloadLog{
+			{Function: "Decoder", Fields: []interface{}{"decoding", 2.0, "bytes on port", 1.0}},
+		})
+
+		res, err = functions.Uplink([]byte{0x27, 0x10}, 1)
+		a.So(err, ShouldBeNil)
+		a.So(res.Valid, ShouldBeFalse)
+	}
+
+	{
+		res, err := functions.Downlink(map[string]interface{}{"led": true}, 2)
+		a.So(err, ShouldBeNil)
+		a.So(res.Payload, ShouldResemble, []byte{0x01, 0x02})
+		a.So(res.Logs, ShouldResemble, []PayloadLog{
+			{Function: "Encoder", Fields: []interface{}{map[string]interface{}{"led": true}}},
+		})
+	}
+
+	{
+		res, err := NewLocalPayloadFunctions("", "", "", "").Uplink([]byte{0x01}, 1)
+		a.So(err, ShouldBeNil)
+		a.So(res.Fields, ShouldBeNil)
+		a.So(res.Valid, ShouldBeTrue)
+
+		_, err = NewLocalPayloadFunctions("", "", "", "").Downlink(map[string]interface{}{"led": true}, 1)
+		a.So(err, ShouldNotBeNil)
+	}
+
+	for _, decoder := range []string{
+		`function Decoder(bytes, port) { return 1; }`,
+		`function Decoder(bytes, port) { throw new Error("oops"); }`,
+		`function Decoder(bytes, port) { while (true) {} }`,
+		`function Decoder(bytes, port) { return Decoder(bytes, port); }`,
+		`function Decoder(bytes, port) {`,
+	} {
+		_, err := NewLocalPayloadFunctions(decoder, "", "", "").Uplink([]byte{0x01}, 1)
+		a.So(err, ShouldNotBeNil)
+	}
+
+	{
+		_, err := NewLocalPayloadFunctions("", "", `function Validator(fields, port) { return "yes"; }`, "").Uplink([]byte{0x01}, 1)
+		a.So(err, ShouldNotBeNil)
+	}
+
+	for _, encoder := range []string{
+		`function Encoder(object, port) { return 1; }`,
+		`function Encoder(object, port) { return [256]; }`,
+		`function Encoder(object, port) { return [-1]; }`,
+		`function Encoder(object, port) { return [1.5]; }`,
+		`function Encoder(object, port) { return ["1"]; }`,
+	} {
+		_, err := NewLocalPayloadFunctions("", "", "", encoder).Downlink(map[string]interface{}{}, 1)
+		a.So(err, ShouldNotBeNil)
+	}
+}
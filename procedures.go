@@ -3,24 +3,289 @@
 
 package ttnsdk
 
-// MoveDevice moves a device to another application
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MoveDevice moves a device to another application. The device is first created in the destination application and
+// verified, and only then deleted from the source application. The session of the device is kept, see
+// MoveSessionKeep.
 func MoveDevice(devID string, from, to DeviceManager) (err error) {
+	return MoveDevices(context.Background(), []string{devID}, from, to, MoveOptions{})[devID]
+}
+
+// MoveSessionPolicy determines what happens with the session of a device that is moved
+type MoveSessionPolicy int
+
+const (
+	// MoveSessionKeep copies the DevAddr and session keys to the destination application. Between creating the device
+	// in the destination and deleting it from the source, the device exists in both applications with the same
+	// session, so uplink messages in that period may end up in either application.
+	MoveSessionKeep MoveSessionPolicy = iota
+
+	// MoveSessionReset creates the device in the destination application without DevAddr and session keys, so that
+	// the device has to join again. Devices that do not have an AppKey can not join, so they are not moved.
+	MoveSessionReset
+)
+
+// MoveState is the state of a device in a move
+type MoveState string
+
+// States of a device in a move
+const (
+	MoveStarted  MoveState = "started"
+	MoveCreated  MoveState = "created"
+	MoveVerified MoveState = "verified"
+	MoveDone     MoveState = "done"
+)
+
+// MoveJournal keeps track of the progress of moving devices, so that an interrupted move can be resumed by calling
+// MoveDevices again with the same journal.
+type MoveJournal interface {
+	// State returns the state of the device, or an empty state if the device is not in the journal
+	State(devID string) (MoveState, error)
+
+	// SetState saves the state of the device
+	SetState(devID string, state MoveState) error
+}
+
+// MoveOptions contains the options for MoveDevices
+type MoveOptions struct {
+	Session MoveSessionPolicy
+
+	// The number of devices that are moved concurrently (in the default config, this is 1)
+	Concurrency int
+
+	// The journal to use (optional)
+	Journal MoveJournal
+}
+
+// MoveDevices moves devices to another application. For each device, the procedure is:
+//
+//   1. Get the device from the source application
+//   2. Create the device in the destination application (this fails if a device with the same ID already exists
+//      there, unless the journal shows that it was created by an earlier run of this procedure)
+//   3. Get the device from the destination application and verify its EUIs and keys
+//   4. Delete the device from the source application
+//
+// If the verification fails, the device is deleted from the destination again, and the source is not changed. The
+// returned map contains the errors of the devices that could not be moved.
+func MoveDevices(ctx context.Context, devIDs []string, from, to DeviceManager, options MoveOptions) map[string]error {
+	from, to = from.WithContext(ctx), to.WithContext(ctx)
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	errs := make(map[string]error)
+	var mu sync.Mutex
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for devID := range queue {
+				err := ctx.Err()
+				if err == nil {
+					err = moveDevice(devID, from, to, options)
+				}
+				if err != nil {
+					mu.Lock()
+					errs[devID] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, devID := range devIDs {
+		queue <- devID
+	}
+	close(queue)
+	wg.Wait()
+	return errs
+}
+
+func moveDevice(devID string, from, to DeviceManager, options MoveOptions) (err error) {
+	journal := options.Journal
+	if journal == nil {
+		journal = new(memoryMoveJournal)
+	}
+	state, err := journal.State(devID)
+	if err != nil {
+		return err
+	}
+	if state == MoveDone {
+		return nil
+	}
+
 	dev, err := from.Get(devID)
+	if status.Code(err) == codes.NotFound && (state == MoveCreated || state == MoveVerified) {
+		// The device was deleted from the source after it was verified, but before the journal was updated
+		if _, err := to.Get(devID); err != nil {
+			return err
+		}
+		return journal.SetState(devID, MoveDone)
+	}
 	if err != nil {
 		return err
 	}
-	err = from.Delete(devID)
+	if options.Session == MoveSessionReset && dev.AppKey == nil {
+		return fmt.Errorf("ttn-sdk: device %s does not have an AppKey, so it can not join after its session is reset", devID)
+	}
+
+	moved := *dev
+	moved.deviceManager = nil
+	moved.AppID = ""
+	if options.Session == MoveSessionReset {
+		moved.DevAddr, moved.NwkSKey, moved.AppSKey = nil, nil, nil
+		moved.FCntUp, moved.FCntDown = 0, 0
+	}
+
+	if state == "" {
+		if _, err := to.Get(devID); err == nil {
+			return fmt.Errorf("ttn-sdk: device %s already exists in the destination application", devID)
+		} else if status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err := journal.SetState(devID, MoveStarted); err != nil {
+			return err
+		}
+	}
+
+	if state == "" || state == MoveStarted {
+		if err := to.Set(&moved); err != nil {
+			return err
+		}
+		if err := journal.SetState(devID, MoveCreated); err != nil {
+			return err
+		}
+	}
+
+	created, err := to.Get(devID)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err != nil {
-			from.Set(dev)
+	if err := verifyMovedDevice(&moved, created); err != nil {
+		if deleteErr := to.Delete(devID); deleteErr != nil {
+			return fmt.Errorf("%s, and the device could not be deleted from the destination application: %s", err, deleteErr)
 		}
-	}()
-	err = to.Set(dev)
+		if journalErr := journal.SetState(devID, ""); journalErr != nil {
+			return journalErr
+		}
+		return err
+	}
+	if err := journal.SetState(devID, MoveVerified); err != nil {
+		return err
+	}
+
+	if err := from.Delete(devID); err != nil && status.Code(err) != codes.NotFound {
+		return err
+	}
+	return journal.SetState(devID, MoveDone)
+}
+
+// verifyMovedDevice checks that the EUIs and keys of the device in the destination application are the same as those
+// of the device that was created
+func verifyMovedDevice(expected, actual *Device) error {
+	equal := expected.DevEUI == actual.DevEUI && expected.AppEUI == actual.AppEUI &&
+		(expected.AppKey == nil) == (actual.AppKey == nil) && (expected.AppKey == nil || *expected.AppKey == *actual.AppKey) &&
+		(expected.DevAddr == nil) == (actual.DevAddr == nil) && (expected.DevAddr == nil || *expected.DevAddr == *actual.DevAddr) &&
+		(expected.NwkSKey == nil) == (actual.NwkSKey == nil) && (expected.NwkSKey == nil || *expected.NwkSKey == *actual.NwkSKey) &&
+		(expected.AppSKey == nil) == (actual.AppSKey == nil) && (expected.AppSKey == nil || *expected.AppSKey == *actual.AppSKey)
+	if !equal {
+		return fmt.Errorf("ttn-sdk: device %s in the destination application does not match the device in the source application", expected.DevID)
+	}
+	return nil
+}
+
+// memoryMoveJournal is a MoveJournal that is not persisted
+type memoryMoveJournal struct {
+	sync.Mutex
+	states map[string]MoveState
+}
+
+func (j *memoryMoveJournal) State(devID string) (MoveState, error) {
+	j.Lock()
+	defer j.Unlock()
+	return j.states[devID], nil
+}
+
+func (j *memoryMoveJournal) SetState(devID string, state MoveState) error {
+	j.Lock()
+	defer j.Unlock()
+	if j.states == nil {
+		j.states = make(map[string]MoveState)
+	}
+	j.states[devID] = state
+	return nil
+}
+
+// FileMoveJournal is a MoveJournal that appends the states of devices to a file. Each state change is synced to disk
+// before the move continues.
+type FileMoveJournal struct {
+	memoryMoveJournal
+	file *os.File
+}
+
+type moveJournalEntry struct {
+	DevID string    `json:"dev_id"`
+	State MoveState `json:"state"`
+	Time  time.Time `json:"time"`
+}
+
+// OpenMoveJournal opens the journal file at the given path, creating it if it does not exist
+func OpenMoveJournal(path string) (*FileMoveJournal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j := &FileMoveJournal{file: file}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry moveJournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // The last entry may be incomplete if the process crashed while writing it
+		}
+		j.memoryMoveJournal.SetState(entry.DevID, entry.State)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// SetState implements MoveJournal
+func (j *FileMoveJournal) SetState(devID string, state MoveState) error {
+	entry, err := json.Marshal(moveJournalEntry{DevID: devID, State: state, Time: time.Now().UTC()})
 	if err != nil {
 		return err
 	}
+	j.Lock()
+	defer j.Unlock()
+	if _, err := j.file.Write(append(entry, '\n')); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	if j.states == nil {
+		j.states = make(map[string]MoveState)
+	}
+	j.states[devID] = state
 	return nil
 }
+
+// Close the journal file
+func (j *FileMoveJournal) Close() error {
+	return j.file.Close()
+}
@@ -0,0 +1,121 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/TheThingsNetwork/ttn/core/types"
+	. "github.com/smartystreets/assertions"
+)
+
+// corruptingDeviceManager stores devices with a different AppKey
+type corruptingDeviceManager struct {
+	*memoryDeviceManager
+}
+
+func (m corruptingDeviceManager) Set(dev *Device) error {
+	corrupted := *dev
+	corrupted.AppKey = &types.AppKey{0xFF}
+	return m.memoryDeviceManager.Set(&corrupted)
+}
+
+func (m corruptingDeviceManager) WithContext(ctx context.Context) DeviceManager { return m }
+
+func TestMoveDevices(t *testing.T) {
+	a := New(t)
+
+	devAddr, nwkSKey, appSKey, appKey := types.DevAddr{1, 2, 3, 4}, types.NwkSKey{1}, types.AppSKey{2}, types.AppKey{3}
+	newSource := func() *memoryDeviceManager {
+		source := newMemoryDeviceManager("source")
+		source.devices = []*Device{
+			{SparseDevice: SparseDevice{AppID: "source", DevID: "abp", DevEUI: types.DevEUI{1}, DevAddr: &devAddr, NwkSKey: &nwkSKey, AppSKey: &appSKey}, FCntUp: 10},
+			{SparseDevice: SparseDevice{AppID: "source", DevID: "otaa", DevEUI: types.DevEUI{2}, AppKey: &appKey, DevAddr: &devAddr, NwkSKey: &nwkSKey, AppSKey: &appSKey}, FCntUp: 20},
+			{SparseDevice: SparseDevice{AppID: "source", DevID: "conflict", DevEUI: types.DevEUI{3}}},
+		}
+		return source
+	}
+
+	{
+		source, destination := newSource(), newMemoryDeviceManager("destination", "conflict")
+		errs := MoveDevices(context.Background(), []string{"abp", "otaa", "conflict", "unknown"}, source, destination, MoveOptions{Concurrency: 2})
+		a.So(errs, ShouldHaveLength, 2)
+		a.So(errs, ShouldContainKey, "conflict")
+		a.So(errs, ShouldContainKey, "unknown")
+		a.So(devIDs(listDevices(source)), ShouldResemble, []string{"conflict"})
+
+		dev, err := destination.Get("abp")
+		a.So(err, ShouldBeNil)
+		a.So(dev.AppID, ShouldEqual, "destination")
+		a.So(dev.DevAddr, ShouldResemble, &devAddr)
+		a.So(dev.FCntUp, ShouldEqual, 10)
+	}
+
+	{
+		source, destination := newSource(), newMemoryDeviceManager("destination")
+		errs := MoveDevices(context.Background(), []string{"abp", "otaa"}, source, destination, MoveOptions{Session: MoveSessionReset})
+		a.So(errs, ShouldHaveLength, 1)
+		a.So(errs, ShouldContainKey, "abp") // ABP devices can not join
+		dev, err := destination.Get("otaa")
+		a.So(err, ShouldBeNil)
+		a.So(dev.DevAddr, ShouldBeNil)
+		a.So(dev.FCntUp, ShouldEqual, 0)
+		a.So(dev.AppKey, ShouldResemble, &appKey)
+	}
+
+	{
+		// The device in the destination does not match, so the source must not be changed
+		source, destination := newSource(), newMemoryDeviceManager("destination")
+		err := MoveDevice("otaa", source, corruptingDeviceManager{destination})
+		a.So(err, ShouldNotBeNil)
+		a.So(source.devices, ShouldHaveLength, 3)
+		a.So(destination.devices, ShouldBeEmpty)
+	}
+
+	{
+		dir, err := ioutil.TempDir("", "ttn-sdk")
+		a.So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "journal")
+
+		// Simulate a crash after the device was created in the destination and deleted from the source
+		source, destination := newSource(), newMemoryDeviceManager("destination")
+		journal, err := OpenMoveJournal(path)
+		a.So(err, ShouldBeNil)
+		a.So(journal.SetState("abp", MoveStarted), ShouldBeNil)
+		dev, _ := source.Get("abp")
+		a.So(destination.Set(dev), ShouldBeNil)
+		a.So(journal.SetState("abp", MoveCreated), ShouldBeNil)
+		a.So(source.Delete("abp"), ShouldBeNil)
+		// And a crash after the device was created, but before that was written to the journal
+		a.So(journal.SetState("otaa", MoveStarted), ShouldBeNil)
+		dev, _ = source.Get("otaa")
+		a.So(destination.Set(dev), ShouldBeNil)
+		a.So(journal.Close(), ShouldBeNil)
+
+		journal, err = OpenMoveJournal(path)
+		a.So(err, ShouldBeNil)
+		state, _ := journal.State("abp")
+		a.So(state, ShouldEqual, MoveCreated)
+
+		errs := MoveDevices(context.Background(), []string{"abp", "otaa"}, source, destination, MoveOptions{Journal: journal})
+		a.So(errs, ShouldBeEmpty)
+		a.So(devIDs(listDevices(source)), ShouldResemble, []string{"conflict"})
+		a.So(devIDs(listDevices(destination)), ShouldResemble, []string{"abp", "otaa"})
+		for _, devID := range []string{"abp", "otaa"} {
+			state, _ := journal.State(devID)
+			a.So(state, ShouldEqual, MoveDone)
+		}
+		a.So(journal.Close(), ShouldBeNil)
+	}
+}
+
+func listDevices(manager DeviceManager) DeviceList {
+	devices, _ := manager.List(0, 0)
+	return devices
+}
@@ -0,0 +1,339 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/TheThingsNetwork/api"
+)
+
+// DefaultReconcileRate is the number of requests per second that PlanReconcile and ApplyReconcile make if no rate is
+// given in the options
+var DefaultReconcileRate = 10.0
+
+// ReconcileOptions contains the options for PlanReconcile and ApplyReconcile
+type ReconcileOptions struct {
+	// Do not delete devices that exist in the application, but not in the desired devices
+	SkipDelete bool
+
+	// The maximum number of requests per second (in the default config, this is DefaultReconcileRate)
+	Rate float64
+
+	// The page size for listing the existing devices (in the default config, this is DefaultDevicePageSize)
+	PageSize uint64
+}
+
+// ReconcileAction is the action that is taken for a device
+type ReconcileAction string
+
+// Actions in a ReconcilePlan
+const (
+	ReconcileCreate ReconcileAction = "create"
+	ReconcileUpdate ReconcileAction = "update"
+	ReconcileDelete ReconcileAction = "delete"
+)
+
+// FieldChange is a change of a single field of a device
+type FieldChange struct {
+	Field string
+	Old   string
+	New   string
+
+	// Sensitive fields are not printed by ReconcilePlan.String
+	Sensitive bool
+}
+
+// ReconcileChange contains the changes for a single device
+type ReconcileChange struct {
+	Action ReconcileAction
+	DevID  string
+	Fields []FieldChange
+
+	// The device that is saved when the plan is applied
+	device *Device
+}
+
+// ReconcilePlan contains the changes that are needed to reconcile an application with the desired devices
+type ReconcilePlan struct {
+	Changes []ReconcileChange
+}
+
+// Empty returns true if the application already matches the desired devices
+func (p *ReconcilePlan) Empty() bool {
+	return len(p.Changes) == 0
+}
+
+// Count returns the number of changes with the given action
+func (p *ReconcilePlan) Count(action ReconcileAction) (count int) {
+	for _, change := range p.Changes {
+		if change.Action == action {
+			count++
+		}
+	}
+	return
+}
+
+var reconcileSymbols = map[ReconcileAction]string{
+	ReconcileCreate: "+",
+	ReconcileUpdate: "~",
+	ReconcileDelete: "-",
+}
+
+// String returns a human-readable representation of the plan
+func (p *ReconcilePlan) String() string {
+	var buf bytes.Buffer
+	for _, change := range p.Changes {
+		fmt.Fprintf(&buf, "  %s %s\n", reconcileSymbols[change.Action], change.DevID)
+		for _, field := range change.Fields {
+			old, new := strconv.Quote(field.Old), strconv.Quote(field.New)
+			if field.Sensitive {
+				old, new = "(sensitive)", "(sensitive)"
+				if field.Old == "" {
+					old = `""`
+				}
+				if field.New == "" {
+					new = `""`
+				}
+			}
+			switch change.Action {
+			case ReconcileCreate:
+				fmt.Fprintf(&buf, "      %s: %s\n", field.Field, new)
+			default:
+				fmt.Fprintf(&buf, "      %s: %s => %s\n", field.Field, old, new)
+			}
+		}
+	}
+	fmt.Fprintf(&buf, "Plan: %d to create, %d to update, %d to delete\n",
+		p.Count(ReconcileCreate), p.Count(ReconcileUpdate), p.Count(ReconcileDelete))
+	return buf.String()
+}
+
+// rateLimiter allows one request per interval
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		rate = DefaultReconcileRate
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+func (r *rateLimiter) wait(ctx context.Context) error {
+	now := time.Now()
+	if r.next.After(now) {
+		timer := time.NewTimer(r.next.Sub(now))
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+		now = r.next
+	}
+	r.next = now.Add(r.interval)
+	return ctx.Err()
+}
+
+func keyString(key fmt.Stringer, isNil bool) string {
+	if isNil {
+		return ""
+	}
+	return key.String()
+}
+
+// reconcileDevice applies the fields of the desired device to the existing device and returns the changed fields.
+// Keys that are not set in the desired device are not managed, because the session of OTAA devices is set by the
+// network. Frame counters and LastSeen are never changed.
+func reconcileDevice(existing, desired *Device) (changes []FieldChange) {
+	change := func(field, old, new string, sensitive bool) bool {
+		if old == new {
+			return false
+		}
+		changes = append(changes, FieldChange{Field: field, Old: old, New: new, Sensitive: sensitive})
+		return true
+	}
+	if change("description", existing.Description, desired.Description, false) {
+		existing.Description = desired.Description
+	}
+	if change("app_eui", keyString(existing.AppEUI, existing.AppEUI.IsEmpty()), keyString(desired.AppEUI, desired.AppEUI.IsEmpty()), false) {
+		existing.AppEUI = desired.AppEUI
+	}
+	if change("dev_eui", keyString(existing.DevEUI, existing.DevEUI.IsEmpty()), keyString(desired.DevEUI, desired.DevEUI.IsEmpty()), false) {
+		existing.DevEUI = desired.DevEUI
+	}
+	if desired.AppKey != nil && change("app_key", keyString(existing.AppKey, existing.AppKey == nil), desired.AppKey.String(), true) {
+		existing.AppKey = desired.AppKey
+	}
+	if desired.DevAddr != nil && change("dev_addr", keyString(existing.DevAddr, existing.DevAddr == nil), desired.DevAddr.String(), false) {
+		existing.DevAddr = desired.DevAddr
+	}
+	if desired.NwkSKey != nil && change("nwk_s_key", keyString(existing.NwkSKey, existing.NwkSKey == nil), desired.NwkSKey.String(), true) {
+		existing.NwkSKey = desired.NwkSKey
+	}
+	if desired.AppSKey != nil && change("app_s_key", keyString(existing.AppSKey, existing.AppSKey == nil), desired.AppSKey.String(), true) {
+		existing.AppSKey = desired.AppSKey
+	}
+	formatFloat := func(f float32) string {
+		if f == 0 {
+			return ""
+		}
+		return strconv.FormatFloat(float64(f), 'f', -1, 32)
+	}
+	if change("latitude", formatFloat(existing.Latitude), formatFloat(desired.Latitude), false) {
+		existing.Latitude = desired.Latitude
+	}
+	if change("longitude", formatFloat(existing.Longitude), formatFloat(desired.Longitude), false) {
+		existing.Longitude = desired.Longitude
+	}
+	formatInt := func(i int32) string {
+		if i == 0 {
+			return ""
+		}
+		return strconv.Itoa(int(i))
+	}
+	if change("altitude", formatInt(existing.Altitude), formatInt(desired.Altitude), false) {
+		existing.Altitude = desired.Altitude
+	}
+	formatBool := func(b bool) string {
+		if !b {
+			return ""
+		}
+		return "true"
+	}
+	if change("uses32_bit_f_cnt", formatBool(existing.Uses32BitFCnt), formatBool(desired.Uses32BitFCnt), false) {
+		existing.Uses32BitFCnt = desired.Uses32BitFCnt
+	}
+	if change("disable_f_cnt_check", formatBool(existing.DisableFCntCheck), formatBool(desired.DisableFCntCheck), false) {
+		existing.DisableFCntCheck = desired.DisableFCntCheck
+	}
+	if change("activation_constraints", existing.ActivationConstraints, desired.ActivationConstraints, false) {
+		existing.ActivationConstraints = desired.ActivationConstraints
+	}
+
+	keys := make(map[string]bool)
+	for key := range existing.Attributes {
+		keys[key] = true
+	}
+	for key := range desired.Attributes {
+		keys[key] = true
+	}
+	sortedKeys := make([]string, 0, len(keys))
+	for key := range keys {
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Strings(sortedKeys)
+	attributes := make(map[string]string, len(desired.Attributes))
+	for key, value := range desired.Attributes {
+		attributes[key] = value
+	}
+	attributesChanged := false
+	for _, key := range sortedKeys {
+		if change("attributes."+key, existing.Attributes[key], desired.Attributes[key], false) {
+			attributesChanged = true
+		}
+	}
+	if attributesChanged {
+		existing.Attributes = attributes
+	}
+	return
+}
+
+// PlanReconcile compares the devices in the application with the desired devices and returns the changes that are
+// needed to make the application match the desired devices. The AppID of the desired devices is ignored. The existing
+// devices are listed, and devices that are in both are retrieved with Get to compare all fields.
+func PlanReconcile(ctx context.Context, manager DeviceManager, desired []*Device, options ReconcileOptions) (*ReconcilePlan, error) {
+	desiredIDs := make(map[string]bool, len(desired))
+	for _, dev := range desired {
+		if !api.ValidID(dev.DevID) {
+			return nil, fmt.Errorf("ttn-sdk: invalid device ID \"%s\"", dev.DevID)
+		}
+		if desiredIDs[dev.DevID] {
+			return nil, fmt.Errorf("ttn-sdk: duplicate device ID \"%s\"", dev.DevID)
+		}
+		desiredIDs[dev.DevID] = true
+	}
+
+	existing, err := ListAllDevices(ctx, manager, options.PageSize)
+	if err != nil {
+		return nil, err
+	}
+	existingIDs := make(map[string]bool, len(existing))
+	for _, dev := range existing {
+		existingIDs[dev.DevID] = true
+	}
+
+	manager = manager.WithContext(ctx)
+	limiter := newRateLimiter(options.Rate)
+	plan := new(ReconcilePlan)
+	for _, dev := range desired {
+		if !existingIDs[dev.DevID] {
+			created := &Device{SparseDevice: SparseDevice{DevID: dev.DevID}}
+			fields := reconcileDevice(created, dev)
+			plan.Changes = append(plan.Changes, ReconcileChange{Action: ReconcileCreate, DevID: dev.DevID, Fields: fields, device: created})
+			continue
+		}
+		if err := limiter.wait(ctx); err != nil {
+			return nil, err
+		}
+		current, err := manager.Get(dev.DevID)
+		if err != nil {
+			return nil, err
+		}
+		if fields := reconcileDevice(current, dev); len(fields) > 0 {
+			plan.Changes = append(plan.Changes, ReconcileChange{Action: ReconcileUpdate, DevID: dev.DevID, Fields: fields, device: current})
+		}
+	}
+	if !options.SkipDelete {
+		for _, dev := range existing {
+			if !desiredIDs[dev.DevID] {
+				plan.Changes = append(plan.Changes, ReconcileChange{Action: ReconcileDelete, DevID: dev.DevID})
+			}
+		}
+	}
+	return plan, nil
+}
+
+// ApplyReconcile applies the changes of a plan that was returned by PlanReconcile. The returned map contains the errors
+// of the devices that could not be changed.
+func ApplyReconcile(ctx context.Context, manager DeviceManager, plan *ReconcilePlan, options ReconcileOptions) map[string]error {
+	manager = manager.WithContext(ctx)
+	limiter := newRateLimiter(options.Rate)
+	errs := make(map[string]error)
+	for _, change := range plan.Changes {
+		if err := limiter.wait(ctx); err != nil {
+			errs[change.DevID] = err
+			continue
+		}
+		var err error
+		switch change.Action {
+		case ReconcileCreate, ReconcileUpdate:
+			err = manager.Set(change.device)
+		case ReconcileDelete:
+			err = manager.Delete(change.DevID)
+		}
+		if err != nil {
+			errs[change.DevID] = err
+		}
+	}
+	return errs
+}
+
+// Reconcile makes the application match the desired devices. It returns the plan that was applied and the errors of
+// the devices that could not be changed. Use PlanReconcile to inspect the changes without applying them.
+func Reconcile(ctx context.Context, manager DeviceManager, desired []*Device, options ReconcileOptions) (*ReconcilePlan, map[string]error, error) {
+	plan, err := PlanReconcile(ctx, manager, desired, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plan, ApplyReconcile(ctx, manager, plan, options), nil
+}
@@ -0,0 +1,78 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package ttnsdk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/TheThingsNetwork/ttn/core/types"
+	. "github.com/smartystreets/assertions"
+)
+
+func TestReconcile(t *testing.T) {
+	a := New(t)
+
+	devAddr, nwkSKey, appSKey, appKey := types.DevAddr{1, 2, 3, 4}, types.NwkSKey{1}, types.AppSKey{2}, types.AppKey{3}
+	manager := newMemoryDeviceManager("test")
+	manager.devices = []*Device{
+		{SparseDevice: SparseDevice{AppID: "test", DevID: "same", DevEUI: types.DevEUI{1}, AppKey: &appKey, DevAddr: &devAddr, NwkSKey: &nwkSKey, AppSKey: &appSKey}, FCntUp: 10},
+		{SparseDevice: SparseDevice{AppID: "test", DevID: "changed", DevEUI: types.DevEUI{2}, Description: "old", Attributes: map[string]string{"site": "a", "removed": "x"}}, FCntUp: 20},
+		{SparseDevice: SparseDevice{AppID: "test", DevID: "unknown"}},
+	}
+
+	desired := []*Device{
+		{SparseDevice: SparseDevice{DevID: "same", DevEUI: types.DevEUI{1}, AppKey: &appKey}},
+		{SparseDevice: SparseDevice{DevID: "changed", DevEUI: types.DevEUI{2}, Description: "new", AppKey: &appKey, Attributes: map[string]string{"site": "b", "added": "y"}}, Uses32BitFCnt: true},
+		{SparseDevice: SparseDevice{DevID: "new", DevEUI: types.DevEUI{3}, Latitude: 52.5}},
+	}
+
+	plan, err := PlanReconcile(context.Background(), manager, desired, ReconcileOptions{Rate: 1000})
+	a.So(err, ShouldBeNil)
+	a.So(plan.Changes, ShouldHaveLength, 3)
+	a.So(plan.Count(ReconcileCreate), ShouldEqual, 1)
+	a.So(plan.Count(ReconcileUpdate), ShouldEqual, 1)
+	a.So(plan.Count(ReconcileDelete), ShouldEqual, 1)
+
+	update := plan.Changes[0]
+	a.So(update.DevID, ShouldEqual, "changed")
+	var fields []string
+	for _, field := range update.Fields {
+		fields = append(fields, field.Field)
+	}
+	a.So(fields, ShouldResemble, []string{"description", "app_key", "uses32_bit_f_cnt", "attributes.added", "attributes.removed", "attributes.site"})
+
+	printed := plan.String()
+	a.So(printed, ShouldContainSubstring, "~ changed")
+	a.So(printed, ShouldContainSubstring, `description: "old" => "new"`)
+	a.So(printed, ShouldContainSubstring, `app_key: "" => (sensitive)`)
+	a.So(printed, ShouldContainSubstring, `latitude: "52.5"`)
+	a.So(printed, ShouldContainSubstring, "- unknown")
+	a.So(printed, ShouldContainSubstring, "Plan: 1 to create, 1 to update, 1 to delete")
+	a.So(printed, ShouldNotContainSubstring, appKey.String())
+
+	// Planning does not change anything
+	a.So(manager.devices, ShouldHaveLength, 3)
+
+	errs := ApplyReconcile(context.Background(), manager, plan, ReconcileOptions{Rate: 1000})
+	a.So(errs, ShouldBeEmpty)
+	a.So(devIDs(listDevices(manager)), ShouldResemble, []string{"same", "changed", "new"})
+
+	dev, err := manager.Get("changed")
+	a.So(err, ShouldBeNil)
+	a.So(dev.Description, ShouldEqual, "new")
+	a.So(dev.Attributes, ShouldResemble, map[string]string{"site": "b", "added": "y"})
+	a.So(dev.FCntUp, ShouldEqual, 20)
+
+	dev, err = manager.Get("same")
+	a.So(err, ShouldBeNil)
+	a.So(dev.DevAddr, ShouldResemble, &devAddr) // Sessions that are not in the desired devices are kept
+
+	plan, _, err = Reconcile(context.Background(), manager, desired, ReconcileOptions{Rate: 1000})
+	a.So(err, ShouldBeNil)
+	a.So(plan.Empty(), ShouldBeTrue)
+
+	_, err = PlanReconcile(context.Background(), manager, append(desired, desired[0]), ReconcileOptions{})
+	a.So(err, ShouldNotBeNil)
+}
@@ -5,5 +5,5 @@
 //
 // This package wraps The Things Network's application and device management APIs (github.com/TheThingsNetwork/api)
 // and the publish/subscribe API (github.com/TheThingsNetwork/ttn/mqtt). It works with the Discovery Server to retrieve
-// the addresses of the Handler and MQTT server.
+// the addresses of the Handler and MQTT server, unless these addresses are set in the ClientConfig.
 package ttnsdk
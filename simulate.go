@@ -14,9 +14,16 @@ import (
 // Simulator simulates messages for devices
 type Simulator interface {
 	Uplink(port uint8, payload []byte) error
+
+	// UplinkLPP simulates an uplink message with a Cayenne LPP payload that contains the values
+	UplinkLPP(port uint8, values ...LPPValue) error
+
+	// WithContext returns a view of the Simulator that uses the given context as parent context of its requests.
+	WithContext(ctx context.Context) Simulator
 }
 
 type simulator struct {
+	ctx            context.Context
 	logger         log.Interface
 	client         handler.ApplicationManagerClient
 	getContext     func(context.Context) context.Context
@@ -27,12 +34,17 @@ type simulator struct {
 }
 
 func (c *client) Simulate(devID string) (Simulator, error) {
-	if err := c.connectHandler(); err != nil {
+	return c.simulate(context.Background(), devID)
+}
+
+func (c *client) simulate(ctx context.Context, devID string) (Simulator, error) {
+	if err := c.connectHandler(ctx); err != nil {
 		return nil, err
 	}
 	return &simulator{
+		ctx:            ctx,
 		logger:         c.Logger,
-		client:         handler.NewApplicationManagerClient(c.handler.conn),
+		client:         &handlerClient{c},
 		getContext:     c.getContext,
 		requestTimeout: c.RequestTimeout,
 		appID:          c.appID,
@@ -40,8 +52,14 @@ func (c *client) Simulate(devID string) (Simulator, error) {
 	}, nil
 }
 
+func (s *simulator) WithContext(ctx context.Context) Simulator {
+	simulator := *s
+	simulator.ctx = ctx
+	return &simulator
+}
+
 func (s *simulator) Uplink(port uint8, payload []byte) error {
-	ctx, cancel := context.WithTimeout(s.getContext(context.Background()), s.requestTimeout)
+	ctx, cancel := requestContext(s.ctx, s.getContext, s.requestTimeout)
 	defer cancel()
 	_, err := s.client.SimulateUplink(ctx, &handler.SimulatedUplinkMessage{
 		AppID:   s.appID,
@@ -51,3 +69,11 @@ func (s *simulator) Uplink(port uint8, payload []byte) error {
 	})
 	return err
 }
+
+func (s *simulator) UplinkLPP(port uint8, values ...LPPValue) error {
+	payload, err := EncodeLPP(values...)
+	if err != nil {
+		return err
+	}
+	return s.Uplink(port, payload)
+}
@@ -31,13 +31,15 @@ func cleanMQTTAddress(in string) (address string, err error) {
 			scheme = "tcp"
 		}
 	}
-	if port == "" {
-		switch scheme {
-		case "ssl", "mqtts":
-			scheme = "ssl"
+	switch scheme {
+	case "ssl", "mqtts":
+		scheme = "ssl"
+		if port == "" {
 			port = "8883"
-		case "tcp", "mqtt":
-			scheme = "tcp"
+		}
+	case "tcp", "mqtt":
+		scheme = "tcp"
+		if port == "" {
 			port = "1883"
 		}
 	}